@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// startConfig holds the settings of the start command. Its YAML keys match
+// the names of the command's flags.
+type startConfig struct {
+	Domain           string `yaml:"domain"`
+	Storage          string `yaml:"storage"`
+	APIKey           string `yaml:"apiKey"`
+	LNBitsHost       string `yaml:"lnbitsHost"`
+	WebhookSecret    string `yaml:"webhookSecret"`
+	WebhookBaseURL   string `yaml:"webhookBaseURL"`
+	AdminKey         string `yaml:"adminKey"`
+	BasePath         string `yaml:"basePath"`
+	Port             int    `yaml:"port"`
+	Host             string `yaml:"host"`
+	TLSCert          string `yaml:"tlsCert"`
+	TLSKey           string `yaml:"tlsKey"`
+	LogLevel         string `yaml:"logLevel"`
+	FreeRegistration bool   `yaml:"freeRegistration"`
+
+	// path and lines locate the values read from a file, for errors.
+	path  string
+	lines map[string]int
+}
+
+// logLevels are the accepted values of logLevel.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// loadConfig reads the YAML config file at path. Unknown keys are an error.
+func loadConfig(path string) (*startConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %w", err)
+	}
+	config := &startConfig{path: path, lines: map[string]int{}}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	if len(root.Content) == 0 {
+		return config, nil
+	}
+	mapping := root.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: line %d: config must be a mapping of settings", path, mapping.Line)
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		config.lines[mapping.Content[i].Value] = mapping.Content[i].Line
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// flagEnvVars are the environment variables start falls back to for flags
+// that are not set.
+var flagEnvVars = map[string]string{
+	"domain":         "DID_DOMAIN",
+	"storage":        "DID_STORAGE",
+	"apiKey":         "DID_API_KEY",
+	"webhookBaseURL": "DID_WEBHOOK_URL",
+	"port":           "DID_PORT",
+	"host":           "DID_HOST",
+}
+
+// flagValue returns the value of the flag name when it is set, or else of
+// its environment variable.
+func flagValue(c *cli.Context, name string) (string, bool) {
+	if c.IsSet(name) {
+		return c.String(name), true
+	}
+	if env, ok := flagEnvVars[name]; ok {
+		return os.LookupEnv(env)
+	}
+	return "", false
+}
+
+// startConfigFromContext reads the file named by --config, if any, and
+// overrides its values with the flags set on c, or their environment
+// variables. Flags also fill in the values the file leaves out.
+func startConfigFromContext(c *cli.Context) (*startConfig, error) {
+	config := &startConfig{}
+	if path := c.String("config"); len(path) > 0 {
+		var err error
+		if config, err = loadConfig(path); err != nil {
+			return nil, err
+		}
+	}
+
+	stringFlags := map[string]*string{
+		"domain":         &config.Domain,
+		"storage":        &config.Storage,
+		"apiKey":         &config.APIKey,
+		"lnbitsHost":     &config.LNBitsHost,
+		"webhookSecret":  &config.WebhookSecret,
+		"webhookBaseURL": &config.WebhookBaseURL,
+		"adminKey":       &config.AdminKey,
+		"basePath":       &config.BasePath,
+		"host":           &config.Host,
+		"tlsCert":        &config.TLSCert,
+		"tlsKey":         &config.TLSKey,
+		"logLevel":       &config.LogLevel,
+	}
+	for name, value := range stringFlags {
+		if flag, ok := flagValue(c, name); ok {
+			*value = flag
+			delete(config.lines, name)
+		} else if len(*value) == 0 {
+			*value = c.String(name)
+		}
+	}
+	if port, ok := flagValue(c, "port"); ok {
+		var err error
+		if config.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("port %q is not a number", port)
+		}
+		delete(config.lines, "port")
+	} else if config.Port == 0 {
+		config.Port = c.Int("port")
+	}
+	if c.IsSet("freeRegistration") {
+		config.FreeRegistration = c.Bool("freeRegistration")
+		delete(config.lines, "freeRegistration")
+	}
+
+	if len(config.Storage) == 0 {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		config.Storage = filepath.Join(homeDir, ".did-web", "storage")
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// validate checks required settings are present and values are well formed.
+func (c *startConfig) validate() error {
+	if len(c.Domain) == 0 {
+		return c.fieldError("domain", "domain is required")
+	}
+	if len(c.APIKey) == 0 {
+		return c.fieldError("apiKey", "api key is required")
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		return c.fieldError("port", "port %d is not between 1 and 65535", c.Port)
+	}
+	if len(c.WebhookBaseURL) > 0 {
+		u, err := url.Parse(c.WebhookBaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return c.fieldError("webhookBaseURL", "webhookBaseURL %q is not an http or https url", c.WebhookBaseURL)
+		}
+	}
+	if len(c.TLSCert) == 0 && len(c.TLSKey) > 0 {
+		return c.fieldError("tlsKey", "tlsKey requires tlsCert")
+	}
+	if len(c.TLSKey) == 0 && len(c.TLSCert) > 0 {
+		return c.fieldError("tlsCert", "tlsCert requires tlsKey")
+	}
+	if !validLogLevel(c.LogLevel) {
+		return c.fieldError("logLevel", "logLevel %q is not one of %s", c.LogLevel, strings.Join(logLevels, ", "))
+	}
+	if c.FreeRegistration {
+		return c.fieldError("freeRegistration", "freeRegistration is not supported yet, registrations require an invoice")
+	}
+	return nil
+}
+
+func validLogLevel(level string) bool {
+	for _, known := range logLevels {
+		if strings.EqualFold(level, known) {
+			return true
+		}
+	}
+	return false
+}
+
+// startFlags are the flags of the start command. Each overrides the setting
+// of the same name in the --config file, as do the environment variables in
+// flagEnvVars.
+func startFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "YAML file with the settings below, which flags override",
+		},
+		&cli.StringFlag{
+			Name:    "domain",
+			Aliases: []string{"d"},
+			Usage:   "domain name to use for did web, or $DID_DOMAIN",
+		},
+		&cli.StringFlag{
+			Name:    "storage",
+			Aliases: []string{"s"},
+			Usage:   "path to directory for storage, or $DID_STORAGE",
+		},
+		&cli.StringFlag{
+			Name:    "apiKey",
+			Aliases: []string{"a"},
+			Usage:   "lnbits api key, or $DID_API_KEY to keep it out of the process list",
+		},
+		&cli.StringFlag{
+			Name:  "lnbitsHost",
+			Usage: "LNBits host name, or https url of a self-hosted instance",
+			Value: didstorage.DefaultAPIHost,
+		},
+		&cli.StringFlag{
+			Name:  "webhookSecret",
+			Usage: "secret a signing proxy signs payment webhooks with, instead of the per-invoice token in the webhook url",
+		},
+		&cli.StringFlag{
+			Name:  "webhookBaseURL",
+			Usage: "public url of this server that lnbits sends payment webhooks to, or $DID_WEBHOOK_URL",
+		},
+		&cli.StringFlag{
+			Name:  "adminKey",
+			Usage: "key required by the admin endpoints",
+		},
+		&cli.StringFlag{
+			Name:  "basePath",
+			Usage: "path prefix documents are served under, e.g. /identity",
+		},
+		&cli.IntFlag{
+			Name:  "port",
+			Usage: "port to listen on, or $DID_PORT",
+			Value: 8080,
+		},
+		&cli.StringFlag{
+			Name:  "host",
+			Usage: "address to listen on, or $DID_HOST",
+			Value: "0.0.0.0",
+		},
+		&cli.StringFlag{
+			Name:  "tlsCert",
+			Usage: "PEM certificate to serve HTTPS with, requires --tlsKey",
+		},
+		&cli.StringFlag{
+			Name:  "tlsKey",
+			Usage: "PEM private key of --tlsCert",
+		},
+		&cli.StringFlag{
+			Name:  "logLevel",
+			Usage: "debug, info, warn or error, debug logs every request",
+			Value: "info",
+		},
+		&cli.BoolFlag{
+			Name:  "freeRegistration",
+			Usage: "register dids without an invoice (not supported yet)",
+		},
+	}
+}
+
+// fieldError reports a problem with the setting key, giving the line of the
+// config file it was read from.
+func (c *startConfig) fieldError(key, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if line, ok := c.lines[key]; ok {
+		return fmt.Errorf("%s: line %d: %w", c.path, line, err)
+	}
+	return err
+}
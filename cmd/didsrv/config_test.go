@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+// runStartConfig parses args as the flags of the start command.
+func runStartConfig(t *testing.T, args ...string) (*startConfig, error) {
+	var config *startConfig
+	var err error
+	app := &cli.App{
+		Flags: startFlags(),
+		Action: func(c *cli.Context) error {
+			config, err = startConfigFromContext(c)
+			return nil
+		},
+	}
+	assert.NoError(t, app.Run(append([]string{"didsrv"}, args...)))
+	return config, err
+}
+
+func TestStartConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "config.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	path := write(`domain: example.com
+storage: /var/lib/did-web
+apiKey: key
+webhookBaseURL: https://did.example.com
+port: 8443
+tlsCert: cert.pem
+tlsKey: key.pem
+logLevel: debug
+`)
+	config, err := runStartConfig(t, "--config", path)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", config.Domain)
+	assert.Equal(t, "/var/lib/did-web", config.Storage)
+	assert.Equal(t, "key", config.APIKey)
+	assert.Equal(t, "https://did.example.com", config.WebhookBaseURL)
+	assert.Equal(t, 8443, config.Port)
+	assert.Equal(t, "0.0.0.0", config.Host)
+	assert.Equal(t, "cert.pem", config.TLSCert)
+	assert.Equal(t, "debug", config.LogLevel)
+
+	config, err = runStartConfig(t, "--config", path, "--port", "9000", "--domain", "example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, 9000, config.Port)
+	assert.Equal(t, "example.org", config.Domain)
+	assert.Equal(t, "key", config.APIKey)
+
+	config, err = runStartConfig(t, "--domain", "example.com", "--apiKey", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, 8080, config.Port)
+	assert.Equal(t, "info", config.LogLevel)
+	assert.NotEmpty(t, config.Storage)
+
+	tt := []struct {
+		name   string
+		config string
+		args   []string
+		err    string
+	}{
+		{"missing domain", "apiKey: key\n", nil, "domain is required"},
+		{"missing api key", "domain: example.com\n", nil, "api key is required"},
+		{"port out of range", "domain: example.com\napiKey: key\nport: 70000\n", nil, "config.yaml: line 3: port 70000 is not between 1 and 65535"},
+		{"port not a number", "domain: example.com\nport: http\n", nil, "line 2"},
+		{"invalid url", "domain: example.com\napiKey: key\nwebhookBaseURL: did.example.com\n", nil, "config.yaml: line 3: webhookBaseURL"},
+		{"tls key without cert", "domain: example.com\napiKey: key\ntlsKey: key.pem\n", nil, "line 3: tlsKey requires tlsCert"},
+		{"unknown log level", "domain: example.com\napiKey: key\nlogLevel: loud\n", nil, "line 3: logLevel"},
+		{"unknown key", "domain: example.com\napikey: key\n", nil, "line 2: field apikey not found"},
+		{"not a mapping", "- domain\n", nil, "line 1: config must be a mapping"},
+		{"flag override has no line", "domain: example.com\napiKey: key\nport: 70000\n", []string{"--port", "0"}, "port 0 is not between 1 and 65535"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append([]string{"--config", write(tc.config)}, tc.args...)
+			_, err := runStartConfig(t, args...)
+			assert.ErrorContains(t, err, tc.err)
+			if len(tc.args) > 0 {
+				assert.NotContains(t, err.Error(), "line")
+			}
+		})
+	}
+
+	_, err = runStartConfig(t, "--config", filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestStartConfigEnv(t *testing.T) {
+	_, err := runStartConfig(t, "--domain", "example.com")
+	assert.ErrorContains(t, err, "api key is required")
+
+	t.Setenv("DID_API_KEY", "env-key")
+	t.Setenv("DID_PORT", "9000")
+	t.Setenv("DID_WEBHOOK_URL", "https://did.example.com")
+	config, err := runStartConfig(t, "--domain", "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "env-key", config.APIKey)
+	assert.Equal(t, 9000, config.Port)
+	assert.Equal(t, "https://did.example.com", config.WebhookBaseURL)
+
+	config, err = runStartConfig(t, "--domain", "example.com", "--apiKey", "flag-key", "--port", "9001")
+	assert.NoError(t, err)
+	assert.Equal(t, "flag-key", config.APIKey)
+	assert.Equal(t, 9001, config.Port)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("domain: example.com\napiKey: file-key\nhost: 127.0.0.1\n"), 0600))
+	t.Setenv("DID_DOMAIN", "example.org")
+	config, err = runStartConfig(t, "--config", path)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.org", config.Domain)
+	assert.Equal(t, "env-key", config.APIKey)
+	assert.Equal(t, "127.0.0.1", config.Host)
+
+	t.Setenv("DID_PORT", "http")
+	_, err = runStartConfig(t, "--domain", "example.com")
+	assert.ErrorContains(t, err, `port "http" is not a number`)
+}
+
+func TestNewServer(t *testing.T) {
+	var apiKey string
+	lnbits := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/payments", r.URL.Path)
+		apiKey = r.Header.Get("X-Api-Key")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(didstorage.PaymentResponse{PaymentHash: "hash1", PaymentRequest: "lnbc1"})
+	}))
+	defer lnbits.Close()
+
+	config := &startConfig{
+		Domain:     "example.com",
+		Storage:    t.TempDir(),
+		APIKey:     "key",
+		LNBitsHost: lnbits.URL,
+		Port:       8080,
+		LogLevel:   "info",
+	}
+	srv, err := newServer(config, didstorage.WithHTTPClient(lnbits.Client()))
+	assert.NoError(t, err)
+
+	body := `{"id": "example.com:alice", "keys": [{"purposes": ["assertionMethod"], "publicKeyMultibase": "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"}]}`
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `"lnbc1"`, w.Body.String())
+	assert.Equal(t, "key", apiKey)
+
+	config.Storage = t.TempDir()
+	config.LNBitsHost = "http://lnbits.example.com"
+	_, err = newServer(config)
+	assert.ErrorContains(t, err, "invalid api host")
+}
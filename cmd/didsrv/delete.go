@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/13x-tech/go-did-web/pkg/server"
+	"github.com/TBD54566975/ssi-sdk/crypto/jwx"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// readPrivateKey reads the private key in path, either PEM encoded or a JWK
+// such as the privateKeyJwk printed by create. It also returns the key id of
+// a JWK, empty for PEM keys.
+func readPrivateKey(path string) (gocrypto.PrivateKey, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		var key gocrypto.PrivateKey
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("could not parse private key: %w", err)
+		}
+		return key, "", nil
+	}
+
+	var created CreateOutput
+	if err := json.Unmarshal(data, &created); err != nil {
+		return nil, "", fmt.Errorf("key file is neither PEM nor JSON: %w", err)
+	}
+	privateKeyJWK := created.PrivateKeyJWK
+	if privateKeyJWK == nil {
+		privateKeyJWK = &jwx.PrivateKeyJWK{}
+		if err := json.Unmarshal(data, privateKeyJWK); err != nil {
+			return nil, "", fmt.Errorf("could not parse JWK: %w", err)
+		}
+	}
+	key, err := jwkPrivateKey(privateKeyJWK)
+	if err != nil {
+		return nil, "", err
+	}
+	kid := privateKeyJWK.KID
+	if len(kid) > 0 && !strings.HasPrefix(kid, "#") && !strings.Contains(kid, ":") {
+		kid = "#" + kid
+	}
+	return key, kid, nil
+}
+
+// jwkPrivateKey decodes an Ed25519, P-256 or secp256k1 private JWK.
+func jwkPrivateKey(privateKeyJWK *jwx.PrivateKeyJWK) (gocrypto.PrivateKey, error) {
+	d, err := base64.RawURLEncoding.DecodeString(privateKeyJWK.D)
+	if err != nil || len(d) == 0 {
+		return nil, fmt.Errorf("JWK has no private key")
+	}
+	switch {
+	case privateKeyJWK.KTY == "OKP" && privateKeyJWK.CRV == "Ed25519" && len(d) == ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(d), nil
+	case privateKeyJWK.KTY == "EC" && privateKeyJWK.CRV == "secp256k1":
+		return secp256k1.PrivKeyFromBytes(d), nil
+	case privateKeyJWK.KTY == "EC" && privateKeyJWK.CRV == "P-256":
+		key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+		key.Curve = elliptic.P256()
+		key.X, key.Y = key.Curve.ScalarBaseMult(d)
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported %s %s key", privateKeyJWK.KTY, privateKeyJWK.CRV)
+}
+
+// requestChallenge asks serverURL for a challenge to sign for a change to
+// the DID id.
+func requestChallenge(ctx context.Context, client *http.Client, serverURL, id string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(serverURL, "/")+"/challenge/"+url.PathEscape(id), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not request challenge: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not request challenge: %s: %s", resp.Status, apiError(resp.Body))
+	}
+	var challenge server.Challenge
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&challenge); err != nil {
+		return "", fmt.Errorf("could not parse challenge: %w", err)
+	}
+	return challenge.Challenge, nil
+}
+
+// deleteDID deactivates the DID id on serverURL, or removes it entirely when
+// purge is set, authorized by proof.
+func deleteDID(ctx context.Context, client *http.Client, serverURL, id, proof string, purge bool) error {
+	target := strings.TrimSuffix(serverURL, "/") + "/delete/" + url.PathEscape(id)
+	if purge {
+		target += "?purge=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(server.ProofHeader, proof)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not delete: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusUnauthorized:
+		return fmt.Errorf("could not delete %s: the key does not match any authentication method of the document (%s)", id, apiError(resp.Body))
+	}
+	return fmt.Errorf("could not delete: %s: %s", resp.Status, apiError(resp.Body))
+}
+
+// apiError reads the message of an error response.
+func apiError(body io.Reader) string {
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(body, 1<<20)).Decode(&apiErr)
+	return apiErr.Error
+}
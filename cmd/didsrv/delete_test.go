@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/server"
+	"github.com/13x-tech/go-did-web/pkg/storage"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/TBD54566975/ssi-sdk/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteDID(t *testing.T) {
+	tt := []struct {
+		name    string
+		keyType crypto.KeyType
+	}{
+		{"ed25519", crypto.Ed25519},
+		{"P-256", crypto.P256},
+		{"secp256k1", crypto.SECP256k1},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := server.NewStore("example.com", dir, "did")
+			assert.NoError(t, err)
+			regStorage, err := storage.New(dir, "reg")
+			assert.NoError(t, err)
+			regStore, err := didstorage.NewRegisterStore("lnbits.invalid", "key", regStorage)
+			assert.NoError(t, err)
+			s, err := server.New(server.WithDomain("example.com"), server.WithStore(store), server.WithRegisterStore(regStore))
+			assert.NoError(t, err)
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+
+			doc, privKey, err := server.GenerateDocument("example.com:alice", tc.keyType)
+			assert.NoError(t, err)
+			assert.NoError(t, store.Register(doc))
+			_, other, err := server.GenerateDocument("example.com:bob", crypto.Ed25519)
+			assert.NoError(t, err)
+
+			write := func(name string, v interface{}) string {
+				data, err := json.Marshal(v)
+				assert.NoError(t, err)
+				path := filepath.Join(dir, name)
+				assert.NoError(t, os.WriteFile(path, data, 0600))
+				return path
+			}
+			ctx := context.Background()
+
+			otherKey, kid, err := readPrivateKey(write("other.json", other))
+			assert.NoError(t, err)
+			challenge, err := requestChallenge(ctx, http.DefaultClient, ts.URL, doc.ID)
+			assert.NoError(t, err)
+			proof, err := server.SignChallenge(challenge, kid, otherKey)
+			assert.NoError(t, err)
+			err = deleteDID(ctx, http.DefaultClient, ts.URL, doc.ID, proof, false)
+			assert.ErrorContains(t, err, "does not match any authentication method")
+
+			key, kid, err := readPrivateKey(write("key.json", CreateOutput{Document: doc, PrivateKeyJWK: privKey}))
+			assert.NoError(t, err)
+			assert.Equal(t, "#key-1", kid)
+			challenge, err = requestChallenge(ctx, http.DefaultClient, ts.URL, doc.ID)
+			assert.NoError(t, err)
+			proof, err = server.SignChallenge(challenge, kid, key)
+			assert.NoError(t, err)
+			assert.NoError(t, deleteDID(ctx, http.DefaultClient, ts.URL, doc.ID, proof, false))
+
+			// The deactivated DID is still there to purge.
+			challenge, err = requestChallenge(ctx, http.DefaultClient, ts.URL, doc.ID)
+			assert.NoError(t, err)
+			proof, err = server.SignChallenge(challenge, kid, key)
+			assert.NoError(t, err)
+			assert.NoError(t, deleteDID(ctx, http.DefaultClient, ts.URL, doc.ID, proof, true))
+
+			_, err = requestChallenge(ctx, http.DefaultClient, ts.URL, doc.ID)
+			assert.ErrorContains(t, err, "404")
+		})
+	}
+}
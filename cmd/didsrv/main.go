@@ -1,14 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/13x-tech/go-did-web/pkg/didweb"
 	"github.com/13x-tech/go-did-web/pkg/server"
 	"github.com/13x-tech/go-did-web/pkg/storage"
 	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/13x-tech/go-did-web/pkg/storage/filestorage"
+	"github.com/13x-tech/go-did-web/pkg/storage/sqlitestorage"
+	"github.com/TBD54566975/ssi-sdk/crypto"
+	"github.com/TBD54566975/ssi-sdk/crypto/jwx"
+	"github.com/TBD54566975/ssi-sdk/did"
 	"github.com/urfave/cli/v2"
 )
 
@@ -19,6 +34,114 @@ func main() {
 		Commands: []*cli.Command{{
 			Name:  "start",
 			Usage: "start service",
+			Flags: startFlags(),
+			Action: func(c *cli.Context) error {
+				config, err := startConfigFromContext(c)
+				if err != nil {
+					return err
+				}
+				return startServer(config)
+			},
+		}, {
+			Name:  "create",
+			Usage: "generate a key and print its did document without a server",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "domain",
+					Aliases:  []string{"d"},
+					Usage:    "domain name to use for did web",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "path of the did under the domain, e.g. alice or users:alice",
+				},
+				&cli.StringFlag{
+					Name:  "key-type",
+					Usage: "key type to generate, e.g. ed25519, secp256k1 or P-256",
+					Value: string(crypto.Ed25519),
+				},
+				&cli.StringSliceFlag{
+					Name:  "service",
+					Usage: "service to add as type=endpoint, may be repeated",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return createDocument(c.App.Writer, c.String("domain"), c.String("name"), c.String("key-type"), c.StringSlice("service"))
+			},
+		}, {
+			Name:  "migrate",
+			Usage: "copy every key from one storage backend to another",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "from",
+					Usage:    "source storage, e.g. bolt:path/to/did.db, sqlite:dsn or file:dir",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "to",
+					Usage:    "destination storage in the same form as --from",
+					Required: true,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return migrate(c.String("from"), c.String("to"))
+			},
+		}, {
+			Name:  "export",
+			Usage: "write every did document in a storage as JSON Lines",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "storage",
+					Usage:    "storage to export, e.g. bolt:path/to/did.db, sqlite:dsn or file:dir",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "out",
+					Usage: "file to write, standard output by default",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				out := c.App.Writer
+				if path := c.String("out"); len(path) > 0 {
+					f, err := os.Create(path)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					out = f
+				}
+				return exportDocuments(c.String("storage"), out)
+			},
+		}, {
+			Name:  "import",
+			Usage: "register the did documents of an export, skipping ids that are taken",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "storage",
+					Usage:    "storage to import into, in the same form as export --storage",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "in",
+					Usage: "file to read, standard input by default",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				in := io.Reader(os.Stdin)
+				if path := c.String("in"); len(path) > 0 {
+					f, err := os.Open(path)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					in = f
+				}
+				return importDocuments(c.String("storage"), in)
+			},
+		}, {
+			Name:  "register",
+			Usage: "register a did for a public key and print the invoice to pay",
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:     "domain",
@@ -27,33 +150,186 @@ func main() {
 					Required: true,
 				},
 				&cli.StringFlag{
-					Name:    "storage",
-					Aliases: []string{"s"},
-					Usage:   "path to directory for storage",
+					Name:  "name",
+					Usage: "path of the did under the domain, e.g. alice or users:alice",
 				},
 				&cli.StringFlag{
-					Name:     "apiKey",
-					Aliases:  []string{"a"},
-					Usage:    "lnbits api key",
+					Name:     "key-file",
+					Usage:    "public key as PEM or multicodec multibase",
 					Required: true,
 				},
+				&cli.StringSliceFlag{
+					Name:  "purpose",
+					Usage: "verification relationship of the key, may be repeated",
+					Value: cli.NewStringSlice("authentication", "assertionMethod"),
+				},
+				&cli.StringFlag{
+					Name:  "server-url",
+					Usage: "url of the did web server api",
+					Value: "http://localhost:8080",
+				},
+				&cli.BoolFlag{
+					Name:  "wait",
+					Usage: "wait until the invoice is paid",
+				},
+				&cli.BoolFlag{
+					Name:  "local",
+					Usage: "write the document to --storage instead of registering with a server",
+				},
+				&cli.StringFlag{
+					Name:  "storage",
+					Usage: "storage --local writes to, e.g. bolt:path/to/did.db",
+				},
 			},
 			Action: func(c *cli.Context) error {
-				domainInput := c.String("domain")
-				storageInput := c.String("storage")
-				apiKey := c.String("apiKey")
-				if len(apiKey) == 0 {
-					log.Fatal(fmt.Errorf("api key is required"))
-				}
-				if len(storageInput) == 0 {
-					homeDir, err := os.UserHomeDir()
+				id, err := registerID(c.String("domain"), c.String("name"))
+				if err != nil {
+					return err
+				}
+				key, err := readKeyInput(c.String("key-file"), c.StringSlice("purpose"))
+				if err != nil {
+					return err
+				}
+				request := server.RegisterRequest{ID: id, Keys: []didstorage.KeyInput{key}}
+
+				if c.Bool("local") {
+					if len(c.String("storage")) == 0 {
+						return fmt.Errorf("--local requires --storage")
+					}
+					doc, err := registerLocal(c.String("storage"), request)
 					if err != nil {
 						return err
 					}
-					storageInput = filepath.Join(homeDir, ".did-web", "storage")
+					fmt.Fprintf(c.App.Writer, "registered: %s\n", doc.ID)
+					return nil
 				}
 
-				return startServer(domainInput, storageInput, "legend.lnbits.com", apiKey)
+				invoice, err := registerRemote(c.Context, http.DefaultClient, c.String("server-url"), request)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(c.App.Writer, invoice)
+				if !c.Bool("wait") {
+					return nil
+				}
+				if err := waitForPayment(c.Context, http.DefaultClient, c.String("server-url"), id.DID()); err != nil {
+					return err
+				}
+				fmt.Fprintf(c.App.Writer, "paid: %s\n", id.DID())
+				return nil
+			},
+		}, {
+			Name:  "delete",
+			Usage: "deactivate a did, proving control with a key of its authentication methods",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "id",
+					Usage:    "did to delete",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "key-file",
+					Usage:    "private key as PEM, or a JWK such as the output of create",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "key-id",
+					Usage: "verification method of the key, e.g. #key-1, by default the JWK kid or any",
+				},
+				&cli.StringFlag{
+					Name:  "server-url",
+					Usage: "url of the did web server api",
+					Value: "http://localhost:8080",
+				},
+				&cli.BoolFlag{
+					Name:  "purge",
+					Usage: "remove the did entirely instead of deactivating it",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the signed challenge without deleting",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				id, err := didweb.Parse(c.String("id"))
+				if err != nil {
+					return err
+				}
+				key, kid, err := readPrivateKey(c.String("key-file"))
+				if err != nil {
+					return err
+				}
+				if len(c.String("key-id")) > 0 {
+					kid = c.String("key-id")
+				}
+				challenge, err := requestChallenge(c.Context, http.DefaultClient, c.String("server-url"), id.DID())
+				if err != nil {
+					return err
+				}
+				proof, err := server.SignChallenge(challenge, kid, key)
+				if err != nil {
+					return err
+				}
+				if c.Bool("dry-run") {
+					fmt.Fprintln(c.App.Writer, proof)
+					return nil
+				}
+				if err := deleteDID(c.Context, http.DefaultClient, c.String("server-url"), id.DID(), proof, c.Bool("purge")); err != nil {
+					return err
+				}
+				if c.Bool("purge") {
+					fmt.Fprintf(c.App.Writer, "deleted: %s\n", id.DID())
+				} else {
+					fmt.Fprintf(c.App.Writer, "deactivated: %s\n", id.DID())
+				}
+				return nil
+			},
+		}, {
+			Name:  "repair",
+			Usage: "remove records left behind by interrupted registrations",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "storage",
+					Usage:    "registration storage, e.g. bolt:path/to/reg.db, sqlite:dsn or file:dir",
+					Required: true,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return repairRegistrations(c.String("storage"), c.App.Writer)
+			},
+		}, {
+			Name:      "resolve",
+			Usage:     "resolve a did:web and print its document",
+			ArgsUsage: "<did>",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "how long to wait for the document",
+					Value: 10 * time.Second,
+				},
+				&cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "skip TLS verification and fetch localhost over plain HTTP",
+				},
+				&cli.BoolFlag{
+					Name:  "raw",
+					Usage: "print compact JSON instead of indented",
+				},
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "file to write, standard output by default",
+				},
+			},
+			OnUsageError: func(c *cli.Context, err error, isSubcommand bool) error {
+				return cli.Exit(err.Error(), exitFailed)
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.Exit("resolve takes exactly one did", exitInvalidDID)
+				}
+				ctx, cancel := context.WithTimeout(c.Context, c.Duration("timeout"))
+				defer cancel()
+				return resolveTo(ctx, c.App.Writer, c.String("output"), c.Args().First(), c.Bool("insecure"), c.Bool("raw"))
 			},
 		}},
 	}
@@ -63,27 +339,258 @@ func main() {
 	}
 }
 
-func startServer(domain, storageDir, apiHost, apiKey string) error {
+// CreateOutput is printed by the create command.
+type CreateOutput struct {
+	Document      *didweb.Document   `json:"document"`
+	PrivateKeyJWK *jwx.PrivateKeyJWK `json:"privateKeyJwk"`
+}
 
-	serverStore, err := server.NewStore(domain, storageDir, "did")
+func createDocument(out io.Writer, domain, name, keyTypeInput string, services []string) error {
+	keyType, err := parseKeyType(keyTypeInput)
 	if err != nil {
-		return fmt.Errorf("could not load server storage: %w", err)
+		return err
 	}
-	regStore, err := storage.New(storageDir, "reg")
+	id := domain
+	if len(name) > 0 {
+		id = domain + ":" + name
+	}
+	doc, privKey, err := server.GenerateDocument(id, keyType)
 	if err != nil {
-		return fmt.Errorf("could not load reg storage: %w", err)
+		return fmt.Errorf("could not generate document: %w", err)
+	}
+	for i, service := range services {
+		serviceType, endpoint, ok := strings.Cut(service, "=")
+		if !ok || len(serviceType) == 0 || len(endpoint) == 0 {
+			return fmt.Errorf("invalid service %q, want type=endpoint", service)
+		}
+		doc.Services = append(doc.Services, did.Service{
+			ID:              fmt.Sprintf("#service-%d", i+1),
+			Type:            serviceType,
+			ServiceEndpoint: endpoint,
+		})
 	}
 
-	registerStore := didstorage.NewRegisterStore(apiHost, apiKey, regStore)
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(CreateOutput{Document: doc, PrivateKeyJWK: privKey})
+}
 
-	srv, err := server.New(
-		server.WithRegisterStore(registerStore),
-		server.WithStore(serverStore),
-		server.WithDomain(domain),
-	)
+// Exit codes of the resolve command. exitFailed covers failures other than
+// resolving, such as bad flags or writing the output.
+const (
+	exitNotFound     = 1
+	exitNetworkError = 2
+	exitInvalidDID   = 3
+	exitFailed       = 4
+)
+
+// resolveTo resolves id and writes its document to the file at path, or to
+// out when path is empty. The file is only written once id has resolved, so
+// a failed resolution leaves it untouched.
+func resolveTo(ctx context.Context, out io.Writer, path, id string, insecure, raw bool) error {
+	var doc bytes.Buffer
+	if err := resolveDocument(ctx, &doc, id, insecure, raw); err != nil {
+		return err
+	}
+	if len(path) > 0 {
+		if err := os.WriteFile(path, doc.Bytes(), 0o666); err != nil {
+			return cli.Exit(fmt.Sprintf("could not write output: %s", err.Error()), exitFailed)
+		}
+		return nil
+	}
+	if _, err := out.Write(doc.Bytes()); err != nil {
+		return cli.Exit(fmt.Sprintf("could not write output: %s", err.Error()), exitFailed)
+	}
+	return nil
+}
+
+// resolveDocument fetches the document of id and writes it to out. Failures
+// are returned as cli exit errors whose code tells why resolution failed.
+func resolveDocument(ctx context.Context, out io.Writer, id string, insecure, raw bool) error {
+	resolver, err := didweb.NewResolverConfig(didweb.WithInsecureLocalhost(insecure))
+	if err != nil {
+		return cli.Exit(err.Error(), exitFailed)
+	}
+	client := http.DefaultClient
+	if insecure {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		client = &http.Client{Transport: transport}
+	}
+
+	doc, err := resolver.ResolveContext(ctx, id, client)
+	switch {
+	case errors.Is(err, didweb.ErrInvalidDID):
+		return cli.Exit(err.Error(), exitInvalidDID)
+	case errors.Is(err, didweb.ErrorDIDNotFound):
+		return cli.Exit(fmt.Sprintf("%s not found", id), exitNotFound)
+	case err != nil:
+		return cli.Exit(err.Error(), exitNetworkError)
+	}
+
+	encoder := json.NewEncoder(out)
+	if !raw {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(doc); err != nil {
+		return cli.Exit(fmt.Sprintf("could not write output: %s", err.Error()), exitFailed)
+	}
+	return nil
+}
+
+// parseKeyType matches input against the supported key types ignoring case.
+func parseKeyType(input string) (crypto.KeyType, error) {
+	for _, keyType := range crypto.GetSupportedKeyTypes() {
+		if strings.EqualFold(string(keyType), input) {
+			return keyType, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type %q", input)
+}
+
+// migrate streams an export of the from storage into the to storage.
+func migrate(from, to string) error {
+	src, err := openStorage(from, true)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", from, err)
+	}
+	defer closeStorage(src)
+	dst, err := openStorage(to, false)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", to, err)
+	}
+	defer closeStorage(dst)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(storage.Export(src, pw))
+	}()
+	if err := storage.Import(dst, pr); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	return nil
+}
+
+// exportDocuments writes the did documents in the storage named by spec to
+// out.
+func exportDocuments(spec string, out io.Writer) error {
+	src, err := openStorage(spec, true)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", spec, err)
+	}
+	defer closeStorage(src)
+	return didstorage.NewDIDStore(src).Export(out)
+}
+
+// importDocuments registers the did documents exported to in with the
+// storage named by spec.
+func importDocuments(spec string, in io.Reader) error {
+	dst, err := openStorage(spec, false)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", spec, err)
+	}
+	defer closeStorage(dst)
+	return didstorage.NewDIDStore(dst).Import(in)
+}
+
+// repairRegistrations repairs the registration storage named by spec and
+// writes what was removed to out.
+func repairRegistrations(spec string, out io.Writer) error {
+	regStorage, err := openStorage(spec, false)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", spec, err)
+	}
+	defer closeStorage(regStorage)
+	regStore, err := didstorage.NewRegisterStore(didstorage.DefaultAPIHost, "", regStorage)
+	if err != nil {
+		return err
+	}
+	report, err := regStore.Repair()
 	if err != nil {
 		return err
 	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// openStorage opens a backend named as kind:location. Bolt locations are the
+// database file, whose name without ".db" is the bucket, as storage.New
+// lays them out.
+func openStorage(spec string, readOnly bool) (storage.Storage, error) {
+	kind, location, ok := strings.Cut(spec, ":")
+	if !ok || len(location) == 0 {
+		return nil, fmt.Errorf("invalid storage %q, want kind:location", spec)
+	}
+	switch kind {
+	case "bolt":
+		bucket := strings.TrimSuffix(filepath.Base(location), ".db")
+		if readOnly {
+			return storage.NewReadOnly(location, bucket)
+		}
+		return storage.New(filepath.Dir(location), bucket, storage.WithFileName(filepath.Base(location)))
+	case "sqlite":
+		return sqlitestorage.New(location)
+	case "file":
+		return filestorage.NewFileStorage(location)
+	default:
+		return nil, fmt.Errorf("unsupported storage %q", kind)
+	}
+}
 
+func closeStorage(s storage.Storage) {
+	if closer, ok := s.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func startServer(config *startConfig) error {
+	srv, err := newServer(config)
+	if err != nil {
+		return err
+	}
 	return srv.Start()
 }
+
+// newServer builds the server config describes. registerOpts are passed on
+// to its RegisterStore.
+func newServer(config *startConfig, registerOpts ...didstorage.RegisterOption) (*server.Server, error) {
+	serverStore, err := server.NewStore(config.Domain, config.Storage, "did")
+	if err != nil {
+		return nil, fmt.Errorf("could not load server storage: %w", err)
+	}
+	regStore, err := storage.New(config.Storage, "reg")
+	if err != nil {
+		return nil, fmt.Errorf("could not load reg storage: %w", err)
+	}
+
+	if config.WebhookSecret != "" {
+		registerOpts = append(registerOpts, didstorage.WithWebhookSecret(config.WebhookSecret))
+	}
+	if config.WebhookBaseURL != "" {
+		registerOpts = append(registerOpts, didstorage.WithWebhookBaseURL(config.WebhookBaseURL))
+	}
+	registerStore, err := didstorage.NewRegisterStore(config.LNBitsHost, config.APIKey, regStore, registerOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create register store: %w", err)
+	}
+	registerStore.Start(context.Background())
+
+	opts := []server.Option{
+		server.WithRegisterStore(registerStore),
+		server.WithStore(serverStore),
+		server.WithDomains(config.Domain),
+		server.WithAdminKey(config.AdminKey),
+		server.WithBasePath(config.BasePath),
+		server.WithHost(config.Host),
+		server.WithPort(config.Port),
+	}
+	if len(config.TLSCert) > 0 {
+		opts = append(opts, server.WithTLS(config.TLSCert, config.TLSKey))
+	}
+	if strings.EqualFold(config.LogLevel, "debug") {
+		opts = append(opts, server.WithAccessLog(log.Default()))
+	}
+	return server.New(opts...)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/server"
+	"github.com/13x-tech/go-did-web/pkg/storage"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/13x-tech/go-did-web/pkg/storage/filestorage"
+	"github.com/TBD54566975/ssi-sdk/crypto"
+	"github.com/TBD54566975/ssi-sdk/cryptosuite"
+	"github.com/TBD54566975/ssi-sdk/did"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestCreateDocument(t *testing.T) {
+	tt := []struct {
+		keyType string
+		vmType  cryptosuite.LDKeyType
+	}{
+		{"ed25519", cryptosuite.Ed25519VerificationKey2018},
+		{"P-256", cryptosuite.JSONWebKey2020Type},
+		{"secp256k1", "EcdsaSecp256k1VerificationKey2019"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.keyType, func(t *testing.T) {
+			var out bytes.Buffer
+			assert.NoError(t, createDocument(&out, "example.com", "alice", tc.keyType, []string{"LinkedDomains=https://example.com"}))
+
+			var created CreateOutput
+			assert.NoError(t, json.Unmarshal(out.Bytes(), &created))
+			assert.Equal(t, "did:web:example.com:alice", created.Document.ID)
+			assert.Len(t, created.Document.VerificationMethod, 1)
+			assert.Equal(t, tc.vmType, created.Document.VerificationMethod[0].Type)
+			assert.Equal(t, []did.Service{{ID: "#service-1", Type: "LinkedDomains", ServiceEndpoint: "https://example.com"}}, created.Document.Services)
+			assert.NotEmpty(t, created.PrivateKeyJWK.D)
+		})
+	}
+
+	assert.Error(t, createDocument(&bytes.Buffer{}, "example.com", "alice", "rsa-1", nil))
+	assert.Error(t, createDocument(&bytes.Buffer{}, "example.com", "alice", "ed25519", []string{"LinkedDomains"}))
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	src, err := storage.New(dir, "did")
+	assert.NoError(t, err)
+	assert.NoError(t, src.Set("example.com:alice", []byte("a")))
+	assert.NoError(t, src.Set("example.com:bob", []byte("b")))
+	assert.NoError(t, src.Close())
+
+	boltPath := filepath.Join(dir, "did.db")
+	sqlitePath := filepath.Join(dir, "dids.sqlite")
+	assert.NoError(t, migrate("bolt:"+boltPath, "sqlite:"+sqlitePath))
+	assert.NoError(t, migrate("sqlite:"+sqlitePath, "bolt:"+filepath.Join(dir, "copy", "did.db")))
+
+	dst, err := storage.New(filepath.Join(dir, "copy"), "did")
+	assert.NoError(t, err)
+	defer dst.Close()
+	keys, err := dst.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com:alice", "example.com:bob"}, keys)
+
+	assert.Error(t, migrate("bolt:"+boltPath, "postgres:postgres://localhost/dids"))
+	assert.Error(t, migrate("nope", "file:"+dir))
+}
+
+func TestExportImportDocuments(t *testing.T) {
+	dir := t.TempDir()
+	src, err := storage.New(dir, "did")
+	assert.NoError(t, err)
+	doc, _, err := server.GenerateDocument("example.com:alice", crypto.Ed25519)
+	assert.NoError(t, err)
+	assert.NoError(t, didstorage.NewDIDStore(src).Register(doc))
+	assert.NoError(t, src.Close())
+
+	var export bytes.Buffer
+	assert.NoError(t, exportDocuments("bolt:"+filepath.Join(dir, "did.db"), &export))
+	assert.Contains(t, export.String(), `"id":"example.com:alice"`)
+
+	filePath := filepath.Join(dir, "files")
+	assert.NoError(t, importDocuments("file:"+filePath, &export))
+	dst, err := filestorage.NewFileStorage(filePath)
+	assert.NoError(t, err)
+	imported, err := didstorage.NewDIDStore(dst).Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, doc.ID, imported.ID)
+
+	assert.Error(t, exportDocuments("nope", &export))
+}
+
+func TestRepairRegistrations(t *testing.T) {
+	dir := t.TempDir()
+	regStorage, err := filestorage.NewFileStorage(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, regStorage.Set("did:web:example.com:alice", []byte("lnbc1")))
+
+	var out bytes.Buffer
+	assert.NoError(t, repairRegistrations("file:"+dir, &out))
+	var report didstorage.RepairReport
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &report))
+	assert.Equal(t, []string{"did:web:example.com:alice"}, report.DanglingPaymentRequests)
+	value, err := regStorage.Get("did:web:example.com:alice")
+	assert.True(t, err != nil || len(value) == 0)
+}
+
+func TestResolveDocument(t *testing.T) {
+	var id string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/did.json" {
+			http.NotFound(w, r)
+			return
+		}
+		doc, err := didweb.New(strings.TrimPrefix(id, "did:web:"))
+		assert.NoError(t, err)
+		json.NewEncoder(w).Encode(doc)
+	}))
+	defer ts.Close()
+	id = "did:web:" + url.QueryEscape(strings.TrimPrefix(ts.URL, "https://"))
+
+	tt := []struct {
+		name     string
+		id       string
+		insecure bool
+		exitCode int
+	}{
+		{"resolved", id, true, 0},
+		{"not found", id + ":bob", true, exitNotFound},
+		{"untrusted certificate", id, false, exitNetworkError},
+		{"unreachable", "did:web:127.0.0.1%3A1", true, exitNetworkError},
+		{"invalid did", "did:key:z6Mk", true, exitInvalidDID},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := resolveDocument(context.Background(), &out, tc.id, tc.insecure, false)
+			if tc.exitCode != 0 {
+				var exitErr cli.ExitCoder
+				if assert.ErrorAs(t, err, &exitErr) {
+					assert.Equal(t, tc.exitCode, exitErr.ExitCode())
+				}
+				return
+			}
+			assert.NoError(t, err)
+			var doc didweb.Document
+			assert.NoError(t, json.Unmarshal(out.Bytes(), &doc))
+			assert.Equal(t, id, doc.ID)
+			assert.Contains(t, out.String(), "\n  ")
+		})
+	}
+}
+
+func TestResolveTo(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	id := "did:web:" + url.QueryEscape(strings.TrimPrefix(ts.URL, "https://"))
+
+	dir := t.TempDir()
+	output := filepath.Join(dir, "did.json")
+	assert.NoError(t, os.WriteFile(output, []byte("previous"), 0o600))
+
+	var exitErr cli.ExitCoder
+	err := resolveTo(context.Background(), &bytes.Buffer{}, output, id, true, false)
+	if assert.ErrorAs(t, err, &exitErr) {
+		assert.Equal(t, exitNotFound, exitErr.ExitCode())
+	}
+	data, err := os.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "previous", string(data))
+
+	missing := filepath.Join(dir, "missing.json")
+	assert.Error(t, resolveTo(context.Background(), &bytes.Buffer{}, missing, "did:key:z6Mk", true, false))
+	_, err = os.Stat(missing)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestResolveToWriteFailure(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"did:web:%s"}`, url.QueryEscape(r.Host))
+	}))
+	defer ts.Close()
+	id := "did:web:" + url.QueryEscape(strings.TrimPrefix(ts.URL, "https://"))
+
+	output := filepath.Join(t.TempDir(), "no-such-dir", "did.json")
+	var exitErr cli.ExitCoder
+	err := resolveTo(context.Background(), &bytes.Buffer{}, output, id, true, false)
+	if assert.ErrorAs(t, err, &exitErr) {
+		assert.Equal(t, exitFailed, exitErr.ExitCode())
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/server"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/TBD54566975/ssi-sdk/cryptosuite"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// readKeyInput reads the public key in path, either a PEM encoded PKIX key,
+// published as a JsonWebKey2020, or a multicodec prefixed multibase key. The
+// verification method id, and type of multibase keys, are left for the
+// server to derive from the key.
+func readKeyInput(path string, purposes []string) (didstorage.KeyInput, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return didstorage.KeyInput{}, err
+	}
+	key := didstorage.KeyInput{Purposes: purposes}
+	if block, _ := pem.Decode(data); block != nil {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return didstorage.KeyInput{}, fmt.Errorf("could not parse public key: %w", err)
+		}
+		if key.PublicKeyJWK, err = jwk.FromRaw(pub); err != nil {
+			return didstorage.KeyInput{}, fmt.Errorf("could not encode public key: %w", err)
+		}
+		key.VerificationMethod.Type = cryptosuite.JSONWebKey2020Type
+		return key, nil
+	}
+
+	key.PublicKeyMultibase = strings.TrimSpace(string(data))
+	if _, err := didstorage.MultibaseKeyType(key.PublicKeyMultibase); err != nil {
+		return didstorage.KeyInput{}, fmt.Errorf("key file is neither PEM nor a multibase key: %w", err)
+	}
+	return key, nil
+}
+
+// registerRemote posts request to the register endpoint of serverURL and
+// returns the Lightning invoice to pay.
+func registerRemote(ctx context.Context, client *http.Client, serverURL string, request server.RegisterRequest) (string, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(serverURL, "/")+"/register", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not register: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not register: %s: %s", resp.Status, apiError(resp.Body))
+	}
+	var invoice string
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&invoice); err != nil {
+		return "", fmt.Errorf("could not parse invoice: %w", err)
+	}
+	return invoice, nil
+}
+
+// waitForPayment follows the payment stream of the DID id on serverURL until
+// it reports the invoice paid or expired.
+func waitForPayment(ctx context.Context, client *http.Client, serverURL, id string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(serverURL, "/")+"/payment/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not wait for payment: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not wait for payment: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "event: ") {
+			continue
+		}
+		switch strings.TrimPrefix(line, "event: ") {
+		case "paid":
+			return nil
+		case "expired":
+			return fmt.Errorf("invoice for %s expired", id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not wait for payment: %w", err)
+	}
+	return fmt.Errorf("payment stream for %s closed before payment", id)
+}
+
+// registerLocal builds the document of request and registers it directly
+// with the storage named by spec, without an invoice.
+func registerLocal(spec string, request server.RegisterRequest) (*didweb.Document, error) {
+	doc, err := didstorage.BuildDocument(request.ID.ID(), request.Keys, request.Services,
+		didstorage.WithController(request.Controller),
+	)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := openStorage(spec, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", spec, err)
+	}
+	defer closeStorage(dst)
+	store := didstorage.NewDIDStore(dst)
+	if _, err := store.Resolve(request.ID.ID()); err == nil {
+		return nil, fmt.Errorf("%s already exists", request.ID.DID())
+	} else if !errors.Is(err, didstorage.ErrorNotFound) {
+		return nil, err
+	}
+	if err := store.Register(doc); err != nil {
+		return nil, fmt.Errorf("could not register: %w", err)
+	}
+	return doc, nil
+}
+
+// registerID parses the DID registered at name under domain.
+func registerID(domain, name string) (didweb.DIDWebURL, error) {
+	id := domain
+	if len(name) > 0 {
+		id = domain + ":" + name
+	}
+	var u didweb.DIDWebURL
+	if err := u.UnmarshalText([]byte(id)); err != nil {
+		return didweb.DIDWebURL{}, err
+	}
+	return u, nil
+}
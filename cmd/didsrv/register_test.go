@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/server"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/TBD54566975/ssi-sdk/cryptosuite"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeKeyFile writes a PEM encoded ed25519 public key to dir.
+func writeKeyFile(t *testing.T, dir string) string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+	return path
+}
+
+func TestReadKeyInput(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	key, err := readKeyInput(writeKeyFile(t, dir), []string{"authentication"})
+	assert.NoError(t, err)
+	assert.Equal(t, cryptosuite.JSONWebKey2020Type, key.VerificationMethod.Type)
+	rawJWK, err := json.Marshal(key.PublicKeyJWK)
+	assert.NoError(t, err)
+	assert.Contains(t, string(rawJWK), `"crv":"Ed25519"`)
+	assert.Equal(t, []string{"authentication"}, key.Purposes)
+	assert.NoError(t, key.Validate())
+
+	key, err = readKeyInput(write("multibase.txt", "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK\n"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK", key.PublicKeyMultibase)
+	assert.NoError(t, key.Validate())
+
+	_, err = readKeyInput(write("garbage.txt", "not a key"), nil)
+	assert.Error(t, err)
+	_, err = readKeyInput(filepath.Join(dir, "missing.pem"), nil)
+	assert.Error(t, err)
+}
+
+func TestRegisterRemote(t *testing.T) {
+	var request server.RegisterRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/register":
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+			json.NewEncoder(w).Encode("lnbc1")
+		case "/payment/did:web:example.com:alice":
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "id: 1\nevent: connected\ndata: did:web:example.com:alice\n\n")
+			fmt.Fprint(w, "id: 2\nevent: paid\ndata: did:web:example.com:alice\n\n")
+		case "/payment/did:web:example.com:bob":
+			fmt.Fprint(w, "id: 1\nevent: expired\ndata: did:web:example.com:bob\n\n")
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"did exists"}`)
+		}
+	}))
+	defer ts.Close()
+
+	id, err := registerID("example.com", "alice")
+	assert.NoError(t, err)
+	key, err := readKeyInput(writeKeyFile(t, t.TempDir()), []string{"assertionMethod"})
+	assert.NoError(t, err)
+	invoice, err := registerRemote(context.Background(), ts.Client(), ts.URL, server.RegisterRequest{ID: id, Keys: []didstorage.KeyInput{key}})
+	assert.NoError(t, err)
+	assert.Equal(t, "lnbc1", invoice)
+	assert.Equal(t, "did:web:example.com:alice", request.ID.DID())
+	assert.Len(t, request.Keys, 1)
+
+	_, err = registerRemote(context.Background(), ts.Client(), ts.URL+"/api", server.RegisterRequest{ID: id})
+	assert.ErrorContains(t, err, "did exists")
+
+	assert.NoError(t, waitForPayment(context.Background(), ts.Client(), ts.URL, "did:web:example.com:alice"))
+	assert.ErrorContains(t, waitForPayment(context.Background(), ts.Client(), ts.URL, "did:web:example.com:bob"), "expired")
+}
+
+func TestRegisterLocal(t *testing.T) {
+	dir := t.TempDir()
+	id, err := registerID("example.com", "alice")
+	assert.NoError(t, err)
+	key, err := readKeyInput(writeKeyFile(t, dir), []string{"assertionMethod"})
+	assert.NoError(t, err)
+	request := server.RegisterRequest{ID: id, Keys: []didstorage.KeyInput{key}}
+
+	spec := "bolt:" + filepath.Join(dir, "did.db")
+	doc, err := registerLocal(spec, request)
+	assert.NoError(t, err)
+	assert.Equal(t, "did:web:example.com:alice", doc.ID)
+	_, err = registerLocal(spec, request)
+	assert.ErrorContains(t, err, "already exists")
+
+	src, err := openStorage(spec, true)
+	assert.NoError(t, err)
+	defer closeStorage(src)
+	stored, err := didstorage.NewDIDStore(src).Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Len(t, stored.AssertionMethod, 1)
+}
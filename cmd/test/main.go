@@ -1,13 +1,14 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
-
-	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"os"
+	"os/exec"
 )
 
+// main resolves a list of sample DIDs with `didsrv resolve`, which must be on
+// the PATH or named by the DIDSRV environment variable.
 func main() {
 	dids := []string{
 		"did:web:example.com",
@@ -19,24 +20,38 @@ func main() {
 		"did:web:did.actor:bob",
 		"did:web:dwn.tbddev.org",
 	}
+	didsrv := os.Getenv("DIDSRV")
+	if len(didsrv) == 0 {
+		didsrv = "didsrv"
+	}
 	for _, id := range dids {
-		if parsed, err := didweb.Parse(id); err == nil {
-			fmt.Printf("%s -> (%s)\n", id, parsed.DID())
-			results, err := didweb.Resolve(parsed.DID(), http.DefaultClient)
-			if err != nil {
-				fmt.Printf("\t -> [unknown error] - %s\n\n", err.Error())
-				continue
-			}
-			jsonResults, err := json.Marshal(results)
-			if err != nil {
-				fmt.Printf("\t -> [could not format] - %s\n\n", err.Error())
-				continue
-			}
-
-			fmt.Printf("\t -> %s\n\n", jsonResults)
-		} else {
-			fmt.Printf("%s\n", id)
-			fmt.Printf("\t -> [unknown error] - %s\n\n", err.Error())
+		fmt.Printf("%s\n", id)
+		cmd := exec.Command(didsrv, "resolve", "--insecure", "--raw", id)
+		output, err := cmd.CombinedOutput()
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil:
+			fmt.Printf("\t -> %s\n", output)
+		case errors.As(err, &exitErr):
+			fmt.Printf("\t -> [%s] - %s\n", exitReason(exitErr.ExitCode()), output)
+		default:
+			fmt.Printf("\t -> [could not run %s] - %s\n\n", didsrv, err.Error())
 		}
 	}
 }
+
+// exitReason names the exit codes of didsrv resolve.
+func exitReason(code int) string {
+	switch code {
+	case 1:
+		return "not found"
+	case 2:
+		return "network error"
+	case 3:
+		return "invalid did"
+	case 4:
+		return "failed"
+	default:
+		return "unknown error"
+	}
+}
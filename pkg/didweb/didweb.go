@@ -1,25 +1,114 @@
 package didweb
 
 import (
+	"context"
+	gocrypto "crypto"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/TBD54566975/ssi-sdk/crypto"
+	"github.com/TBD54566975/ssi-sdk/cryptosuite"
 	"github.com/TBD54566975/ssi-sdk/did"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-varint"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/idna"
 )
 
-func New(id string) (*did.Document, error) {
+func New(id string) (*Document, error) {
 
 	doc := did.NewDIDDocumentBuilder()
 	if err := doc.SetID(fmt.Sprintf("did:web:%s", id)); err != nil {
 		return nil, fmt.Errorf("invalid id %s: %w", id, err)
 	}
 
-	return doc.Build()
+	built, err := doc.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &Document{Document: *built}, nil
+}
+
+// NewWithKeyPair generates a key pair of keyType and returns a document for id
+// using its public key for authentication and assertions, together with the
+// private key. The private key is not kept anywhere.
+func NewWithKeyPair(id string, keyType crypto.KeyType) (*Document, gocrypto.PrivateKey, error) {
+	pubKey, privKey, err := crypto.GenerateKeyByKeyType(keyType)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate key: %w", err)
+	}
+	pubKeyBytes, err := crypto.PubKeyToBytes(pubKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not encode public key: %w", err)
+	}
+	ldKeyType, err := did.KeyTypeToLDKeyType(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	doc, err := New(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	var vm *did.VerificationMethod
+	if keyType == crypto.SECP256k1 {
+		// secp256k1 JWKs are not supported by the JWK library, so the key is
+		// published as multicodec prefixed multibase instead.
+		prefixed := append(varint.ToUvarint(uint64(did.SECP256k1MultiCodec)), pubKeyBytes...)
+		vm = &did.VerificationMethod{
+			ID:                 "#key-1",
+			Type:               ldKeyType,
+			Controller:         doc.ID,
+			PublicKeyMultibase: multibase.MustNewEncoder(multibase.Base58BTC).Encode(prefixed),
+		}
+	} else if vm, err = did.ConstructJWKVerificationMethod(doc.ID, "#key-1", pubKeyBytes, ldKeyType, keyType); err != nil {
+		return nil, nil, fmt.Errorf("could not build verification method: %w", err)
+	}
+	doc.VerificationMethod = []did.VerificationMethod{*vm}
+	doc.Authentication = []did.VerificationMethodSet{vm.ID}
+	doc.AssertionMethod = []did.VerificationMethodSet{vm.ID}
+
+	return doc, privKey, nil
+}
+
+// SchnorrSecp256k1VerificationKey2019 is the verification method type of
+// Nostr keys.
+const SchnorrSecp256k1VerificationKey2019 cryptosuite.LDKeyType = "SchnorrSecp256k1VerificationKey2019"
+
+// NostrVerificationMethod returns a verification method for a Nostr public
+// key, either x-only (32 bytes) or compressed (33 bytes), encoded as the
+// base16 multibase of its x-only form.
+func NostrVerificationMethod(docID string, pubKey []byte) (*did.VerificationMethod, error) {
+	if len(pubKey) == 32 {
+		// x-only keys are the even-y point with that x coordinate.
+		pubKey = append([]byte{secp256k1.PubKeyFormatCompressedEven}, pubKey...)
+	}
+	if len(pubKey) != secp256k1.PubKeyBytesLenCompressed {
+		return nil, fmt.Errorf("invalid secp256k1 public key length %d", len(pubKey))
+	}
+	parsed, err := secp256k1.ParsePubKey(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secp256k1 public key: %w", err)
+	}
+	pubKey = parsed.SerializeCompressed()[1:]
+	return &did.VerificationMethod{
+		ID:                 "#nostr",
+		Type:               SchnorrSecp256k1VerificationKey2019,
+		Controller:         docID,
+		PublicKeyMultibase: multibase.MustNewEncoder(multibase.Base16).Encode(pubKey),
+	}, nil
 }
 
 type DIDWebURL struct {
@@ -27,29 +116,100 @@ type DIDWebURL struct {
 	parts       []string
 	QueryParams url.Values
 	Anchor      string
+	// BasePath is the path prefix the documents are served under, e.g.
+	// "/identity" when hosted behind a proxy mounting them on a subpath.
+	BasePath string
 }
 
+// ToURL returns the HTTPS URL of the document.
+func (u *DIDWebURL) ToURL() (*url.URL, error) {
+	return u.url("https")
+}
+
+// URLString returns the HTTPS URL of the document, or "" when it cannot be
+// built.
+func (u *DIDWebURL) URLString() string {
+	docURL, err := u.ToURL()
+	if err != nil {
+		return ""
+	}
+	return docURL.String()
+}
+
+// Deprecated: use URLString, or ToURL to handle errors.
 func (u *DIDWebURL) URL() string {
+	return u.URLString()
+}
+
+// url builds the document URL using scheme.
+func (u *DIDWebURL) url(scheme string) (*url.URL, error) {
 	parts := u.parts
 	if len(parts) == 0 {
 		parts = []string{".well-known"}
 	}
+	if base := basePathParts(u.BasePath); len(base) > 0 {
+		parts = append(base, parts...)
+	}
 
-	rawURL, err := url.Parse(fmt.Sprintf("https://%s/%s/did.json", u.Host(), strings.Join(parts, "/")))
+	docURL, err := url.Parse(fmt.Sprintf("%s://%s/%s/did.json", scheme, u.Host(), strings.Join(parts, "/")))
 	if err != nil {
-		return ""
+		return nil, fmt.Errorf("could not build document url: %w", err)
 	}
-	return rawURL.String()
+	return docURL, nil
 }
 func (u DIDWebURL) RawHost() string {
 	return u.host
 }
+
+// Host returns the host and port the document is fetched from. Unicode
+// hosts are converted to their ASCII (punycode) form, while the DID keeps
+// the host as written.
 func (u DIDWebURL) Host() string {
+	host, port, ok := u.hostPort()
+	if !ok {
+		return host
+	}
+	if port > 0 {
+		return fmt.Sprintf("%s:%d", host, port)
+	}
+	return host
+}
+
+// Port returns the port of the host, and false when the DID has none.
+func (u DIDWebURL) Port() (int, bool) {
+	_, port, ok := u.hostPort()
+	return port, ok && port > 0
+}
+
+// Scheme returns the scheme of the document URL: http for loopback hosts,
+// which the did:web spec allows during development, and https otherwise.
+func (u DIDWebURL) Scheme() string {
+	host, _, _ := u.hostPort()
+	if isLocalhost(host) {
+		return "http"
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return "http"
+	}
+	return "https"
+}
+
+// isLocalhost reports whether host, without its port, is localhost or a
+// .localhost name.
+func isLocalhost(host string) bool {
+	host = strings.ToLower(host)
+	return host == "localhost" || strings.HasSuffix(host, ".localhost")
+}
+
+// hostPort splits the host of u into its ASCII name and port, 0 when there
+// is none. It returns the host as written and false when it cannot be
+// decoded.
+func (u DIDWebURL) hostPort() (string, int, bool) {
 	host := u.host
 	port := 0
 	decodedHost, err := url.QueryUnescape(host)
 	if err != nil {
-		return host
+		return host, 0, false
 	}
 
 	if strings.Contains(decodedHost, ":") {
@@ -58,49 +218,136 @@ func (u DIDWebURL) Host() string {
 			var err error
 			port, err = strconv.Atoi(split[1])
 			if err != nil {
-				return host
+				return host, 0, false
 			}
 			host = split[0]
 		}
+	} else if !isASCII(decodedHost) {
+		host = decodedHost
 	}
 
-	if port > 0 {
-		return fmt.Sprintf("%s:%d", host, port)
+	if !isASCII(host) {
+		ascii, err := idna.Lookup.ToASCII(host)
+		if err != nil {
+			return u.host, 0, false
+		}
+		host = ascii
 	}
+	return host, port, true
+}
 
-	return host
+// isASCII reports whether s has only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
 }
 
 func (u *DIDWebURL) DID() string {
-	parts := u.parts
-	if len(parts) == 0 {
-		return fmt.Sprintf("did:web:%s", u.host)
-	}
-	for i, part := range parts {
-		parts[i] = url.QueryEscape(part)
-	}
-	return fmt.Sprintf("did:web:%s:%s", u.host, strings.Join(parts, ":"))
+	return fmt.Sprintf("did:web:%s", u.ID())
 }
 
 func (u *DIDWebURL) ID() string {
-	parts := u.parts
-	if len(parts) == 0 {
+	if len(u.parts) == 0 {
 		return u.host
 	}
-	for i, part := range parts {
+	parts := make([]string, len(u.parts))
+	for i, part := range u.parts {
 		parts[i] = url.QueryEscape(part)
 	}
 	return fmt.Sprintf("%s:%s", u.host, strings.Join(parts, ":"))
 }
 
+// String returns the DID, e.g. "did:web:example.com:alice".
+func (u DIDWebURL) String() string {
+	return u.DID()
+}
+
+// MarshalText encodes u as its DID.
+func (u DIDWebURL) MarshalText() ([]byte, error) {
+	return []byte(u.DID()), nil
+}
+
+// UnmarshalText parses a DID into u. The "did:web:" prefix may be omitted,
+// e.g. "example.com:alice".
+func (u *DIDWebURL) UnmarshalText(text []byte) error {
+	id := string(text)
+	if !strings.HasPrefix(id, "did:") {
+		id = "did:web:" + id
+	}
+	parsed, err := Parse(id)
+	if err != nil {
+		return err
+	}
+	*u = parsed
+	return nil
+}
+
+// Equivalent reports whether u and other refer to the same document, ignoring
+// the case of the host and a trailing ".well-known" segment.
+func (u DIDWebURL) Equivalent(other DIDWebURL) bool {
+	if !strings.EqualFold(u.Host(), other.Host()) {
+		return false
+	}
+	parts, otherParts := canonicalParts(u.parts), canonicalParts(other.parts)
+	if len(parts) != len(otherParts) {
+		return false
+	}
+	for i := range parts {
+		if parts[i] != otherParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalParts drops a trailing ".well-known" segment, which maps to the
+// same document as its parent.
+func canonicalParts(parts []string) []string {
+	if len(parts) > 0 && strings.EqualFold(parts[len(parts)-1], ".well-known") {
+		return parts[:len(parts)-1]
+	}
+	return parts
+}
+
+// WithPathSegment returns the DID one level below u, named segment. The
+// segment is percent-encoded in the DID as needed.
+func (u DIDWebURL) WithPathSegment(segment string) (DIDWebURL, error) {
+	if len(segment) == 0 || strings.Contains(segment, "/") {
+		return DIDWebURL{}, fmt.Errorf("%w: invalid path segment %q", ErrInvalidDID, segment)
+	}
+	parts := make([]string, 0, len(u.parts)+1)
+	parts = append(append(parts, u.parts...), segment)
+	return DIDWebURL{host: u.host, parts: parts, QueryParams: url.Values{}, BasePath: u.BasePath}, nil
+}
+
+// Parent returns the DID one level above u, or false when u is a domain's
+// root DID.
+func (u DIDWebURL) Parent() (DIDWebURL, bool) {
+	if len(u.parts) == 0 {
+		return DIDWebURL{}, false
+	}
+	parts := append([]string{}, u.parts[:len(u.parts)-1]...)
+	if len(parts) == 0 {
+		parts = nil
+	}
+	return DIDWebURL{host: u.host, parts: parts, QueryParams: url.Values{}, BasePath: u.BasePath}, true
+}
+
 func Parse(id string) (DIDWebURL, error) {
 	didParts := strings.Split(id, ":")
 	if len(didParts) < 3 {
-		return DIDWebURL{}, fmt.Errorf("invalid did, must be in format did:web:example.org:john")
+		return DIDWebURL{}, fmt.Errorf("%w: must be in format did:web:example.org:john", ErrInvalidDID)
 	}
 
-	if didParts[0] != "did" || didParts[1] != "web" {
-		return DIDWebURL{}, fmt.Errorf("invalid did, must be in format did:web:example.org:john")
+	if didParts[0] != "did" || didParts[1] != "web" || len(didParts[2]) == 0 {
+		return DIDWebURL{}, fmt.Errorf("%w: must be in format did:web:example.org:john", ErrInvalidDID)
+	}
+	if strings.ContainsAny(didParts[2], "/?#") {
+		return DIDWebURL{}, fmt.Errorf("%w: invalid host", ErrInvalidDID)
 	}
 	d := DIDWebURL{
 		host: didParts[2],
@@ -112,7 +359,7 @@ func Parse(id string) (DIDWebURL, error) {
 			if i > 2 && len(part) > 0 {
 				unescape, err := url.QueryUnescape(part)
 				if err != nil {
-					return DIDWebURL{}, fmt.Errorf("invalid unescape of path part")
+					return DIDWebURL{}, fmt.Errorf("%w: invalid unescape of path part", ErrInvalidDID)
 				}
 				path = append(path, unescape)
 			}
@@ -121,7 +368,7 @@ func Parse(id string) (DIDWebURL, error) {
 
 	didURL, err := url.Parse(fmt.Sprintf("https://%s/%s", d.Host(), strings.Join(path, "/")))
 	if err != nil {
-		return DIDWebURL{}, fmt.Errorf("invalid did, must be in format did:web:example.org:john: %w", err)
+		return DIDWebURL{}, fmt.Errorf("%w: must be in format did:web:example.org:john: %s", ErrInvalidDID, err)
 	}
 	if len(path) > 0 {
 		d.parts = strings.Split(strings.Trim(didURL.Path, "/"), "/")
@@ -132,52 +379,330 @@ func Parse(id string) (DIDWebURL, error) {
 }
 
 func ParsePath(path string) (DIDWebURL, error) {
+	return ParsePathWithBase(path, "")
+}
+
+// ParsePathWithBase parses a host prefixed document path served under
+// basePath, e.g. "example.com/identity/john/did.json" with base "/identity".
+func ParsePathWithBase(path, basePath string) (DIDWebURL, error) {
 	parts := strings.Split(path, "/")
 	if len(parts) < 2 {
-		return DIDWebURL{}, fmt.Errorf("invalid")
+		return DIDWebURL{}, fmt.Errorf("%w: not a did.json path", ErrInvalidDID)
 	}
 	lastPart := parts[len(parts)-1]
 	if !strings.EqualFold(lastPart, "did.json") {
-		return DIDWebURL{}, fmt.Errorf("invalid")
+		return DIDWebURL{}, fmt.Errorf("%w: not a did.json path", ErrInvalidDID)
 	}
 	parts = parts[:len(parts)-1]
-	if strings.EqualFold(parts[len(parts)-1], ".well-known") {
+
+	base := basePathParts(basePath)
+	if len(parts) < len(base)+1 {
+		return DIDWebURL{}, fmt.Errorf("%w: not a did.json path", ErrInvalidDID)
+	}
+	for i, part := range base {
+		if parts[i+1] != part {
+			return DIDWebURL{}, fmt.Errorf("%w: path is outside base path", ErrInvalidDID)
+		}
+	}
+	parts = append(parts[:1], parts[len(base)+1:]...)
+
+	if len(parts) > 1 && strings.EqualFold(parts[len(parts)-1], ".well-known") {
 		parts = parts[:len(parts)-1]
 	}
 
-	return Parse(fmt.Sprintf("did:web:%s", strings.Join(parts, ":")))
+	u, err := Parse(fmt.Sprintf("did:web:%s", strings.Join(parts, ":")))
+	if err != nil {
+		return DIDWebURL{}, err
+	}
+	if len(base) > 0 {
+		u.BasePath = "/" + strings.Join(base, "/")
+	}
+	return u, nil
+}
+
+// basePathParts splits basePath into its non-empty segments.
+func basePathParts(basePath string) []string {
+	var parts []string
+	for _, part := range strings.Split(basePath, "/") {
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// ResolverConfig controls how documents are fetched by its Resolve method.
+type ResolverConfig struct {
+	insecureLocalhost bool
+	redirects         RedirectPolicy
+}
+
+// RedirectPolicy decides which redirects are followed while fetching a
+// document.
+type RedirectPolicy int
+
+const (
+	// RedirectSameHost follows redirects that stay on the DID's host, e.g.
+	// to a canonical path, but not to another host. It is the default,
+	// since the host is what a did:web DID vouches for.
+	RedirectSameHost RedirectPolicy = iota
+	// RedirectNone follows no redirects.
+	RedirectNone
+	// RedirectAny follows redirects to any HTTPS host.
+	RedirectAny
+)
+
+// maxRedirects matches the limit of http.Client's default policy.
+const maxRedirects = 10
+
+type ResolverOption func(c *ResolverConfig) error
+
+// WithInsecureLocalhost fetches the documents of localhost and .localhost
+// hosts over plain HTTP, as the did:web spec allows for development.
+// Loopback addresses such as 127.0.0.1 are still fetched over HTTPS, unlike
+// their Scheme, so a local TLS server can be reached by address.
+func WithInsecureLocalhost(enabled bool) ResolverOption {
+	return func(c *ResolverConfig) error {
+		c.insecureLocalhost = enabled
+		return nil
+	}
+}
+
+// WithRedirectPolicy sets which redirects are followed, RedirectSameHost by
+// default.
+func WithRedirectPolicy(policy RedirectPolicy) ResolverOption {
+	return func(c *ResolverConfig) error {
+		if policy < RedirectSameHost || policy > RedirectAny {
+			return fmt.Errorf("invalid redirect policy %d", policy)
+		}
+		c.redirects = policy
+		return nil
+	}
+}
+
+func NewResolverConfig(opts ...ResolverOption) (*ResolverConfig, error) {
+	c := &ResolverConfig{}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// URL returns the document URL of u, using HTTP for localhost when enabled.
+func (c *ResolverConfig) URL(u DIDWebURL) string {
+	docURL, err := c.ToURL(u)
+	if err != nil {
+		return ""
+	}
+	return docURL.String()
+}
+
+// ToURL is like URL but reports why the URL could not be built.
+func (c *ResolverConfig) ToURL(u DIDWebURL) (*url.URL, error) {
+	if host, _, _ := u.hostPort(); c.insecureLocalhost && isLocalhost(host) {
+		return u.url("http")
+	}
+	return u.ToURL()
+}
+
+// Resolve fetches the document of id over HTTPS.
+func Resolve(id string, client *http.Client) (*Document, error) {
+	return ResolveContext(context.Background(), id, client)
 }
 
-func Resolve(id string, client *http.Client) (*did.Document, error) {
+// ResolveContext is like Resolve but carries ctx on the request.
+func ResolveContext(ctx context.Context, id string, client *http.Client) (*Document, error) {
+	return (&ResolverConfig{}).ResolveContext(ctx, id, client)
+}
+
+// Resolve fetches the document of id.
+func (c *ResolverConfig) Resolve(id string, client *http.Client) (*Document, error) {
+	return c.ResolveContext(context.Background(), id, client)
+}
+
+// tracerName names the tracer resolution spans are recorded with. Spans are
+// dropped unless a global tracer provider has been set.
+const tracerName = "github.com/13x-tech/go-did-web/pkg/didweb"
+
+// ResolveContext fetches the document of id, recording a span with the
+// global tracer provider.
+func (c *ResolverConfig) ResolveContext(ctx context.Context, id string, client *http.Client) (*Document, error) {
+	result, err := c.ResolveWithMetadata(ctx, id, client)
+	if err != nil {
+		return nil, err
+	}
+	return result.Document, nil
+}
+
+// Document is a DID document. The ssi-sdk did.Document holds alsoKnownAs as
+// a single string, so Document keeps the identifiers in its own AlsoKnownAs
+// and leaves the embedded one empty.
+type Document struct {
+	did.Document
+	AlsoKnownAs []string `json:"alsoKnownAs,omitempty"`
+}
+
+// plainDocument unmarshals the fields of a Document without its methods.
+type plainDocument Document
+
+// UnmarshalJSON reads alsoKnownAs as either a single identifier or an array
+// of them.
+func (d *Document) UnmarshalJSON(data []byte) error {
+	doc := struct {
+		*plainDocument
+		AlsoKnownAs json.RawMessage `json:"alsoKnownAs"`
+	}{plainDocument: (*plainDocument)(d)}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	var alsoKnownAs []string
+	if len(doc.AlsoKnownAs) > 0 && string(doc.AlsoKnownAs) != "null" {
+		if err := json.Unmarshal(doc.AlsoKnownAs, &alsoKnownAs); err != nil {
+			var single string
+			if err := json.Unmarshal(doc.AlsoKnownAs, &single); err != nil {
+				return fmt.Errorf("alsoKnownAs must be a string or an array of strings")
+			}
+			alsoKnownAs = []string{single}
+		}
+	}
+	d.AlsoKnownAs = alsoKnownAs
+	d.Document.AlsoKnownAs = ""
+	return nil
+}
+
+// ResolveResult is a resolved document and the document metadata resolution
+// produced.
+type ResolveResult struct {
+	Document *Document
+	// CanonicalID is the document's own id when it differs from the requested
+	// one only by normalization, such as the case of the host.
+	CanonicalID string
+	// EquivalentID holds the requested id when CanonicalID is set.
+	EquivalentID []string
+	// Deactivated reports that the DID has been deactivated. Document is its
+	// last document before that.
+	Deactivated bool
+}
+
+// ResolveWithMetadata is like ResolveContext but also reports the canonical
+// id of a document whose id is a normalized form of the requested one.
+func ResolveWithMetadata(ctx context.Context, id string, client *http.Client) (*ResolveResult, error) {
+	return (&ResolverConfig{}).ResolveWithMetadata(ctx, id, client)
+}
+
+// ResolveWithMetadata is like ResolveContext but also reports the canonical
+// id of a document whose id is a normalized form of the requested one.
+func (c *ResolverConfig) ResolveWithMetadata(ctx context.Context, id string, client *http.Client) (*ResolveResult, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "didweb.Resolve",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("did.id", id)),
+	)
+	defer span.End()
+
+	doc, err := c.resolve(ctx, span, id, client)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	result := &ResolveResult{Document: doc}
+	if doc.ID != id {
+		result.CanonicalID = doc.ID
+		result.EquivalentID = []string{id}
+	}
+	return result, nil
+}
+
+func (c *ResolverConfig) resolve(ctx context.Context, span trace.Span, id string, client *http.Client) (*Document, error) {
 	url, err := Parse(id)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse did url: %w", err)
 	}
-	resp, err := client.Get(url.URL())
+	docURL, err := c.ToURL(url)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("server.address", docURL.Host))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, docURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not build request: %w", err)
+	}
+	resp, err := c.client(client).Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("could not get did json: %w", err)
 	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 	if resp.StatusCode == http.StatusNotFound {
 		return nil, ErrorDIDNotFound
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid status cod: %d - %s", resp.StatusCode, resp.Status)
+		return nil, fmt.Errorf("%w: %d", ErrUnexpectedStatus, resp.StatusCode)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxDocumentSize+1))
 	if err != nil {
 		return nil, fmt.Errorf("could not read body: %w", err)
 	}
-	var doc did.Document
+	if len(body) > MaxDocumentSize {
+		return nil, ErrDocumentTooLarge
+	}
+	var doc Document
 	if err := json.Unmarshal(body, &doc); err != nil {
 		return nil, fmt.Errorf("could not decode document body: %w", err)
 	}
-	if !strings.EqualFold(id, doc.ID) {
-		return nil, fmt.Errorf("masmatched document id: %w", err)
+	if docURL, err := Parse(doc.ID); err != nil || !url.Equivalent(docURL) {
+		return nil, fmt.Errorf("%w: mismatched document id: got %q, want %q", ErrHostMismatch, doc.ID, id)
 	}
 	return &doc, nil
 }
 
+// client returns a copy of client enforcing the redirect policy before its
+// own.
+func (c *ResolverConfig) client(client *http.Client) *http.Client {
+	limited := *client
+	limited.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("%w: stopped after %d redirects", ErrRedirectNotAllowed, maxRedirects)
+		}
+		from := via[len(via)-1].URL
+		switch {
+		case c.redirects == RedirectNone:
+			return fmt.Errorf("%w: to %s", ErrRedirectNotAllowed, req.URL)
+		case from.Scheme == "https" && req.URL.Scheme != "https":
+			return fmt.Errorf("%w: downgrade to %s", ErrRedirectNotAllowed, req.URL)
+		case c.redirects == RedirectSameHost && !strings.EqualFold(req.URL.Host, via[0].URL.Host):
+			return fmt.Errorf("%w: from %s to %s", ErrRedirectNotAllowed, via[0].URL.Host, req.URL.Host)
+		}
+		if client.CheckRedirect != nil {
+			return client.CheckRedirect(req, via)
+		}
+		return nil
+	}
+	return &limited
+}
+
+// ResolveVersionTime resolves id as it was at versionTime. did:web hosts only
+// serve their current document, so remote history is not available and this
+// always fails with ErrUnsupported.
+func ResolveVersionTime(id string, versionTime time.Time, client *http.Client) (*Document, error) {
+	if _, err := Parse(id); err != nil {
+		return nil, fmt.Errorf("could not parse did url: %w", err)
+	}
+	return nil, fmt.Errorf("%w: versionTime for %s", ErrUnsupported, id)
+}
+
+// MaxDocumentSize is the largest document body Resolve will read.
+const MaxDocumentSize = 1 << 20
+
 var (
-	ErrorDIDNotFound = fmt.Errorf("not found")
+	ErrorDIDNotFound      = fmt.Errorf("not found")
+	ErrInvalidDID         = fmt.Errorf("invalid did")
+	ErrHostMismatch       = fmt.Errorf("document id does not match requested did")
+	ErrDocumentTooLarge   = fmt.Errorf("document too large")
+	ErrUnexpectedStatus   = fmt.Errorf("unexpected status code")
+	ErrUnsupported        = fmt.Errorf("not supported by remote did:web hosts")
+	ErrRedirectNotAllowed = fmt.Errorf("redirect not allowed")
 )
@@ -1,10 +1,29 @@
 package didweb
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/TBD54566975/ssi-sdk/crypto"
+	"github.com/TBD54566975/ssi-sdk/cryptosuite"
+	"github.com/TBD54566975/ssi-sdk/did"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // Testing New()
@@ -52,6 +71,8 @@ func TestParse(t *testing.T) {
 		{"did:web:example.com", "example.com", false},
 		{"did:web:example.com:john", "example.com:john", false},
 		{"example.com", "", true},
+		{"did:web:example.com/alice", "", true},
+		{"did:web:example.com?x=1:alice", "", true},
 		// add more cases as needed
 	}
 
@@ -68,3 +89,553 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func TestNewWithKeyPair(t *testing.T) {
+	doc, privKey, err := NewWithKeyPair("example.com:alice", crypto.P256)
+	assert.NoError(t, err)
+	assert.Equal(t, "did:web:example.com:alice", doc.ID)
+	assert.Len(t, doc.VerificationMethod, 1)
+	assert.Equal(t, "did:web:example.com:alice", doc.VerificationMethod[0].Controller)
+	assert.Equal(t, []did.VerificationMethodSet{"#key-1"}, doc.Authentication)
+	assert.Equal(t, []did.VerificationMethodSet{"#key-1"}, doc.AssertionMethod)
+
+	ecKey, ok := privKey.(ecdsa.PrivateKey)
+	assert.True(t, ok)
+	pubKey, err := did.GetKeyFromVerificationMethod(doc.Document, "key-1")
+	assert.NoError(t, err)
+	docKey, ok := pubKey.(*ecdsa.PublicKey)
+	assert.True(t, ok)
+	assert.True(t, ecKey.PublicKey.Equal(docKey))
+
+	_, _, err = NewWithKeyPair("example.com:alice", crypto.KeyType("nope"))
+	assert.Error(t, err)
+}
+
+func TestBasePath(t *testing.T) {
+	tt := []struct {
+		input     string
+		basePath  string
+		expected  string
+		expectErr bool
+	}{
+		{"example.com/identity/.well-known/did.json", "/identity", "did:web:example.com", false},
+		{"example.com/identity/john/did.json", "/identity", "did:web:example.com:john", false},
+		{"example.com/identity/accounting/john/did.json", "identity/", "did:web:example.com:accounting:john", false},
+		{"example.com/people/identity/john/did.json", "/people/identity", "did:web:example.com:john", false},
+		{"example.com/john/did.json", "/identity", "", true},
+	}
+
+	for i, tc := range tt {
+		t.Run(fmt.Sprintf("base path case: %d", i+1), func(t *testing.T) {
+			res, err := ParsePathWithBase(tc.input, tc.basePath)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, res.DID())
+			assert.Equal(t, "https://"+tc.input, res.URLString())
+		})
+	}
+}
+
+func TestToURL(t *testing.T) {
+	u, err := Parse("did:web:example.com%3A8443:users:alice")
+	assert.NoError(t, err)
+
+	docURL, err := u.ToURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "https", docURL.Scheme)
+	assert.Equal(t, "example.com:8443", docURL.Host)
+	assert.Equal(t, "/users/alice/did.json", docURL.Path)
+	assert.Equal(t, docURL.String(), u.URLString())
+	assert.Equal(t, u.URLString(), u.URL())
+}
+
+func TestPortScheme(t *testing.T) {
+	insecure, err := NewResolverConfig(WithInsecureLocalhost(true))
+	assert.NoError(t, err)
+
+	tt := []struct {
+		id     string
+		port   int
+		ported bool
+		scheme string
+	}{
+		{"did:web:example.com", 0, false, "https"},
+		{"did:web:example.com:users:alice", 0, false, "https"},
+		{"did:web:example.com%3A8443:users:alice", 8443, true, "https"},
+		{"did:web:bücher.example%3A8443", 8443, true, "https"},
+		{"did:web:localhost", 0, false, "http"},
+		{"did:web:localhost%3A8080", 8080, true, "http"},
+		{"did:web:LocalHost%3A8080", 8080, true, "http"},
+		{"did:web:api.localhost", 0, false, "http"},
+		{"did:web:127.0.0.1%3A8443", 8443, true, "http"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.id, func(t *testing.T) {
+			u, err := Parse(tc.id)
+			assert.NoError(t, err)
+			port, ok := u.Port()
+			assert.Equal(t, tc.port, port)
+			assert.Equal(t, tc.ported, ok)
+			assert.Equal(t, tc.scheme, u.Scheme())
+
+			// Loopback addresses are still fetched over HTTPS.
+			if host, _, _ := u.hostPort(); net.ParseIP(host) == nil {
+				docURL, err := insecure.ToURL(u)
+				assert.NoError(t, err)
+				assert.Equal(t, u.Scheme(), docURL.Scheme)
+			}
+		})
+	}
+}
+
+func TestIDNHost(t *testing.T) {
+	tt := []struct {
+		id   string
+		host string
+		url  string
+	}{
+		{"did:web:bücher.example", "xn--bcher-kva.example", "https://xn--bcher-kva.example/.well-known/did.json"},
+		{"did:web:bücher.example:alice", "xn--bcher-kva.example", "https://xn--bcher-kva.example/alice/did.json"},
+		{"did:web:b%C3%BCcher.example", "xn--bcher-kva.example", "https://xn--bcher-kva.example/.well-known/did.json"},
+		{"did:web:bücher.example%3A8443:alice", "xn--bcher-kva.example:8443", "https://xn--bcher-kva.example:8443/alice/did.json"},
+		{"did:web:例え.テスト", "xn--r8jz45g.xn--zckzah", "https://xn--r8jz45g.xn--zckzah/.well-known/did.json"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.id, func(t *testing.T) {
+			u, err := Parse(tc.id)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.host, u.Host())
+			assert.Equal(t, tc.url, u.URLString())
+			assert.Equal(t, tc.id, u.DID())
+		})
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/alice/did.json":
+			fmt.Fprint(w, `{"id":"did:web:other.org:alice"}`)
+		case "/large/did.json":
+			w.Write([]byte(`{"id":"` + strings.Repeat("a", MaxDocumentSize) + `"}`))
+		case "/broken/did.json":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	host := url.QueryEscape(strings.TrimPrefix(srv.URL, "https://"))
+
+	tt := []struct {
+		id       string
+		expected error
+	}{
+		{"web:" + host + ":alice", ErrInvalidDID},
+		{"did:web:" + host + ":alice", ErrHostMismatch},
+		{"did:web:" + host + ":large", ErrDocumentTooLarge},
+		{"did:web:" + host + ":broken", ErrUnexpectedStatus},
+		{"did:web:" + host + ":nobody", ErrorDIDNotFound},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.expected.Error(), func(t *testing.T) {
+			_, err := Resolve(tc.id, srv.Client())
+			assert.ErrorIs(t, err, tc.expected)
+		})
+	}
+}
+
+func TestResolveVersionTime(t *testing.T) {
+	_, err := ResolveVersionTime("did:web:example.com:alice", time.Now(), http.DefaultClient)
+	assert.ErrorIs(t, err, ErrUnsupported)
+
+	_, err = ResolveVersionTime("example.com:alice", time.Now(), http.DefaultClient)
+	assert.ErrorIs(t, err, ErrInvalidDID)
+}
+
+func TestWithPathSegment(t *testing.T) {
+	root, err := Parse("did:web:example.com")
+	assert.NoError(t, err)
+
+	users, err := root.WithPathSegment("users")
+	assert.NoError(t, err)
+	alice, err := users.WithPathSegment("alice smith")
+	assert.NoError(t, err)
+	assert.Equal(t, "did:web:example.com:users:alice+smith", alice.DID())
+	assert.Equal(t, "did:web:example.com:users:alice+smith", alice.DID())
+	assert.Equal(t, "did:web:example.com:users", users.DID())
+	assert.Equal(t, "did:web:example.com", root.DID())
+
+	parsed, err := Parse(alice.DID())
+	assert.NoError(t, err)
+	assert.Equal(t, alice.URLString(), parsed.URLString())
+
+	_, err = users.WithPathSegment("")
+	assert.ErrorIs(t, err, ErrInvalidDID)
+	_, err = users.WithPathSegment("a/b")
+	assert.ErrorIs(t, err, ErrInvalidDID)
+}
+
+func TestParent(t *testing.T) {
+	alice, err := Parse("did:web:example.com:users:alice")
+	assert.NoError(t, err)
+
+	users, ok := alice.Parent()
+	assert.True(t, ok)
+	assert.Equal(t, "did:web:example.com:users", users.DID())
+
+	root, ok := users.Parent()
+	assert.True(t, ok)
+	assert.Equal(t, "did:web:example.com", root.DID())
+	assert.Equal(t, "https://example.com/.well-known/did.json", root.URLString())
+
+	_, ok = root.Parent()
+	assert.False(t, ok)
+	assert.Equal(t, "did:web:example.com:users:alice", alice.DID())
+}
+
+func TestDIDWebURLText(t *testing.T) {
+	u, err := Parse("did:web:example.com:users:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "did:web:example.com:users:alice", fmt.Sprintf("%s", u))
+	assert.Equal(t, "did:web:example.com:users:alice", fmt.Sprint(&u))
+
+	type holder struct {
+		ID DIDWebURL `json:"id"`
+	}
+	encoded, err := json.Marshal(holder{ID: u})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"did:web:example.com:users:alice"}`, string(encoded))
+
+	tt := []struct {
+		input     string
+		expected  string
+		expectErr bool
+	}{
+		{`{"id":"did:web:example.com:alice"}`, "did:web:example.com:alice", false},
+		{`{"id":"example.com:alice"}`, "did:web:example.com:alice", false},
+		{`{"id":"did:key:z6Mk"}`, "", true},
+		{`{"id":""}`, "", true},
+		{`{"id":42}`, "", true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.input, func(t *testing.T) {
+			var decoded holder
+			err := json.Unmarshal([]byte(tc.input), &decoded)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, decoded.ID.String())
+		})
+	}
+}
+
+func TestEquivalent(t *testing.T) {
+	tt := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"did:web:example.com", "did:web:EXAMPLE.COM", true},
+		{"did:web:Example.COM:alice", "did:web:example.com:alice", true},
+		{"did:web:example.com:.well-known", "did:web:example.com", true},
+		{"did:web:example.com%3A8080:alice", "did:web:EXAMPLE.com%3a8080:alice", true},
+		{"did:web:example.com:alice", "did:web:example.com:Alice", false},
+		{"did:web:example.com:alice", "did:web:example.org:alice", false},
+		{"did:web:example.com:alice", "did:web:example.com", false},
+		{"did:web:example.com%3A8080", "did:web:example.com", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.a+" "+tc.b, func(t *testing.T) {
+			a, err := Parse(tc.a)
+			assert.NoError(t, err)
+			b, err := Parse(tc.b)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, a.Equivalent(b))
+			assert.Equal(t, tc.expected, b.Equivalent(a))
+		})
+	}
+}
+
+func TestResolveCaseInsensitiveHost(t *testing.T) {
+	tt := []struct {
+		requested string
+		served    string
+	}{
+		{"did:web:Example.COM:alice", "did:web:example.com:alice"},
+		{"did:web:example.com", "did:web:EXAMPLE.COM"},
+		{"did:web:example.com", "did:web:example.com:.well-known"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.requested+" "+tc.served, func(t *testing.T) {
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"id":%q}`, tc.served)
+			}))
+			defer srv.Close()
+			client := srv.Client()
+			transport := client.Transport.(*http.Transport).Clone()
+			transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+			}
+			client.Transport = transport
+
+			doc, err := Resolve(tc.requested, client)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.served, doc.ID)
+		})
+	}
+}
+
+func TestResolverConfigLocalhost(t *testing.T) {
+	secure, err := NewResolverConfig()
+	assert.NoError(t, err)
+	insecure, err := NewResolverConfig(WithInsecureLocalhost(true))
+	assert.NoError(t, err)
+
+	tt := []struct {
+		id       string
+		secure   string
+		insecure string
+	}{
+		{"did:web:localhost", "https://localhost/.well-known/did.json", "http://localhost/.well-known/did.json"},
+		{"did:web:localhost%3A8443:alice", "https://localhost:8443/alice/did.json", "http://localhost:8443/alice/did.json"},
+		{"did:web:LocalHost", "https://LocalHost/.well-known/did.json", "http://LocalHost/.well-known/did.json"},
+		{"did:web:api.localhost", "https://api.localhost/.well-known/did.json", "http://api.localhost/.well-known/did.json"},
+		{"did:web:127.0.0.1%3A8443", "https://127.0.0.1:8443/.well-known/did.json", "https://127.0.0.1:8443/.well-known/did.json"},
+		{"did:web:localhost.example.com", "https://localhost.example.com/.well-known/did.json", "https://localhost.example.com/.well-known/did.json"},
+		{"did:web:example.com:localhost", "https://example.com/localhost/did.json", "https://example.com/localhost/did.json"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.id, func(t *testing.T) {
+			u, err := Parse(tc.id)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.secure, u.URLString())
+			assert.Equal(t, tc.secure, secure.URL(u))
+			assert.Equal(t, tc.insecure, insecure.URL(u))
+		})
+	}
+}
+
+func TestResolverConfigResolveLocalhost(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"did:web:%s"}`, url.QueryEscape(r.Host))
+	}))
+	defer srv.Close()
+	id := "did:web:" + url.QueryEscape(strings.Replace(strings.TrimPrefix(srv.URL, "http://"), "127.0.0.1", "localhost", 1))
+
+	insecure, err := NewResolverConfig(WithInsecureLocalhost(true))
+	assert.NoError(t, err)
+	doc, err := insecure.Resolve(id, srv.Client())
+	assert.NoError(t, err)
+	assert.Equal(t, id, doc.ID)
+
+	_, err = Resolve(id, srv.Client())
+	assert.Error(t, err)
+}
+
+func TestNewWithKeyPairSecp256k1(t *testing.T) {
+	doc, privKey, err := NewWithKeyPair("example.com:alice", crypto.SECP256k1)
+	assert.NoError(t, err)
+	assert.Len(t, doc.VerificationMethod, 1)
+	assert.Equal(t, cryptosuite.ECDSASECP256k1VerificationKey2019, doc.VerificationMethod[0].Type)
+	assert.Nil(t, doc.VerificationMethod[0].PublicKeyJWK)
+
+	secpKey, ok := privKey.(secp256k1.PrivateKey)
+	assert.True(t, ok)
+	pubKey, err := did.GetKeyFromVerificationMethod(doc.Document, "key-1")
+	assert.NoError(t, err)
+	docKey, err := crypto.PubKeyToBytes(pubKey)
+	assert.NoError(t, err)
+	assert.Equal(t, secpKey.PubKey().SerializeCompressed(), docKey)
+}
+
+func TestNostrVerificationMethod(t *testing.T) {
+	privKey, err := secp256k1.GeneratePrivateKey()
+	assert.NoError(t, err)
+	compressed := privKey.PubKey().SerializeCompressed()
+	xOnly := hex.EncodeToString(compressed[1:])
+
+	for _, pubKey := range [][]byte{compressed, compressed[1:]} {
+		vm, err := NostrVerificationMethod("did:web:example.com:alice", pubKey)
+		assert.NoError(t, err)
+		assert.Equal(t, "#nostr", vm.ID)
+		assert.Equal(t, SchnorrSecp256k1VerificationKey2019, vm.Type)
+		assert.Equal(t, "f"+xOnly, vm.PublicKeyMultibase)
+	}
+
+	_, err = NostrVerificationMethod("did:web:example.com:alice", []byte{1, 2, 3})
+	assert.Error(t, err)
+}
+
+func TestResolveContextSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":"did:web:example.com:alice"}`)
+	}))
+	defer srv.Close()
+	client := srv.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	client.Transport = transport
+
+	_, err := ResolveContext(context.Background(), "did:web:example.com:alice", client)
+	assert.NoError(t, err)
+	_, err = ResolveContext(context.Background(), "did:web:example.com:bob", client)
+	assert.ErrorIs(t, err, ErrHostMismatch)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "didweb.Resolve", spans[0].Name())
+	assert.Contains(t, spans[0].Attributes(), attribute.String("did.id", "did:web:example.com:alice"))
+	assert.Contains(t, spans[0].Attributes(), attribute.String("server.address", "example.com"))
+	assert.Contains(t, spans[0].Attributes(), attribute.Int("http.status_code", http.StatusOK))
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.Len(t, spans[1].Events(), 1)
+}
+
+func TestResolveRedirects(t *testing.T) {
+	var host string
+	other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"did:web:%s:moved"}`, host)
+	}))
+	defer other.Close()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/alice/did.json":
+			http.Redirect(w, r, "/canonical/alice/did.json", http.StatusMovedPermanently)
+		case "/canonical/alice/did.json":
+			fmt.Fprintf(w, `{"id":"did:web:%s:alice"}`, host)
+		case "/moved/did.json":
+			http.Redirect(w, r, other.URL+"/alice/did.json", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+	host = url.QueryEscape(strings.TrimPrefix(srv.URL, "https://"))
+
+	tt := []struct {
+		name     string
+		policy   []ResolverOption
+		path     string
+		expected error
+	}{
+		{"same host by default", nil, "alice", nil},
+		{"cross host by default", nil, "moved", ErrRedirectNotAllowed},
+		{"same host", []ResolverOption{WithRedirectPolicy(RedirectSameHost)}, "alice", nil},
+		{"none", []ResolverOption{WithRedirectPolicy(RedirectNone)}, "alice", ErrRedirectNotAllowed},
+		{"any cross host", []ResolverOption{WithRedirectPolicy(RedirectAny)}, "moved", nil},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := NewResolverConfig(tc.policy...)
+			assert.NoError(t, err)
+			client := srv.Client()
+			doc, err := config.Resolve("did:web:"+host+":"+tc.path, client)
+			assert.Nil(t, client.CheckRedirect)
+			if tc.expected != nil {
+				assert.ErrorIs(t, err, tc.expected)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "did:web:"+host+":"+tc.path, doc.ID)
+		})
+	}
+
+	_, err := NewResolverConfig(WithRedirectPolicy(RedirectPolicy(42)))
+	assert.Error(t, err)
+}
+
+func TestResolveWithMetadata(t *testing.T) {
+	tt := []struct {
+		requested string
+		served    string
+		canonical string
+		expected  error
+	}{
+		{"did:web:example.com:alice", "did:web:example.com:alice", "", nil},
+		{"did:web:Example.COM:alice", "did:web:example.com:alice", "did:web:example.com:alice", nil},
+		{"did:web:example.com", "did:web:example.com:.well-known", "did:web:example.com:.well-known", nil},
+		{"did:web:example.com:alice", "did:web:example.com:bob", "", ErrHostMismatch},
+		{"did:web:example.com:alice", "did:web:other.org:alice", "", ErrHostMismatch},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.requested+" "+tc.served, func(t *testing.T) {
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"id":%q}`, tc.served)
+			}))
+			defer srv.Close()
+			client := srv.Client()
+			transport := client.Transport.(*http.Transport).Clone()
+			transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+			}
+			client.Transport = transport
+
+			result, err := ResolveWithMetadata(context.Background(), tc.requested, client)
+			if tc.expected != nil {
+				assert.ErrorIs(t, err, tc.expected)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.served, result.Document.ID)
+			assert.Equal(t, tc.canonical, result.CanonicalID)
+			if len(tc.canonical) > 0 {
+				assert.Equal(t, []string{tc.requested}, result.EquivalentID)
+			} else {
+				assert.Empty(t, result.EquivalentID)
+			}
+		})
+	}
+}
+
+func TestDocumentAlsoKnownAs(t *testing.T) {
+	tt := []struct {
+		name      string
+		input     string
+		expected  []string
+		output    string
+		expectErr bool
+	}{
+		{"absent", `{"id":"did:web:example.com"}`, nil, `{"id":"did:web:example.com"}`, false},
+		{"single string", `{"id":"did:web:example.com","alsoKnownAs":"https://example.org"}`, []string{"https://example.org"}, `{"id":"did:web:example.com","alsoKnownAs":["https://example.org"]}`, false},
+		{"array", `{"id":"did:web:example.com","alsoKnownAs":["https://example.org","did:key:z6Mk"]}`, []string{"https://example.org", "did:key:z6Mk"}, `{"id":"did:web:example.com","alsoKnownAs":["https://example.org","did:key:z6Mk"]}`, false},
+		{"invalid", `{"id":"did:web:example.com","alsoKnownAs":1}`, nil, "", true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var doc Document
+			err := json.Unmarshal([]byte(tc.input), &doc)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "did:web:example.com", doc.ID)
+			assert.Equal(t, tc.expected, doc.AlsoKnownAs)
+			assert.Empty(t, doc.Document.AlsoKnownAs)
+
+			output, err := json.Marshal(&doc)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tc.output, string(output))
+		})
+	}
+}
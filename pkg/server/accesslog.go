@@ -0,0 +1,27 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// WithAccessLog writes one line per request to logger, with its method,
+// path, status, bytes written, remote IP and latency.
+func WithAccessLog(logger *log.Logger) Option {
+	return func(s *Server) error {
+		s.accessLog = logger
+		return nil
+	}
+}
+
+// accessLogMiddleware logs each request once it has been served.
+func (s *Server) accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		s.accessLog.Printf("method=%s path=%q status=%d bytes=%d remote=%s latency=%s",
+			r.Method, r.URL.Path, recorder.status, recorder.bytes, s.realIP(r), time.Since(start))
+	})
+}
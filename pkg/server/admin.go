@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/TBD54566975/ssi-sdk/crypto"
+	"github.com/TBD54566975/ssi-sdk/crypto/jwx"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+type ListDIDsResponse struct {
+	DIDs   []string `json:"dids"`
+	Total  int      `json:"total"`
+	Cursor string   `json:"cursor,omitempty"`
+}
+
+func (s *Server) handleListDIDs(w http.ResponseWriter, r *http.Request) {
+	limit := defaultListLimit
+	if rawLimit := r.URL.Query().Get("limit"); len(rawLimit) > 0 {
+		parsed, err := strconv.Atoi(rawLimit)
+		if err != nil || parsed < 1 || parsed > maxListLimit {
+			s.errorResponse(w, 400, "invalid limit")
+			return
+		}
+		limit = parsed
+	}
+
+	seek := []byte{}
+	if cursor := r.URL.Query().Get("cursor"); len(cursor) > 0 {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			s.errorResponse(w, 400, "invalid cursor")
+			return
+		}
+		seek = decoded
+	}
+
+	domain := s.requestDomain(r)
+	prefix := ""
+	if subpath := strings.Trim(strings.ReplaceAll(r.URL.Query().Get("prefix"), "/", ":"), ":"); len(subpath) > 0 {
+		prefix = domain + ":" + subpath + ":"
+	}
+
+	store := s.stores[domain]
+	ids, next, err := store.ListPage(string(seek), limit, prefix)
+	if err != nil {
+		s.errorResponse(w, 500, "could not list dids")
+		return
+	}
+	response := ListDIDsResponse{DIDs: []string{}}
+	for _, id := range ids {
+		response.DIDs = append(response.DIDs, "did:web:"+id)
+	}
+	if len(next) > 0 {
+		response.Cursor = base64.RawURLEncoding.EncodeToString([]byte(next))
+	}
+
+	if response.Total, err = countDIDs(store, prefix); err != nil {
+		s.errorResponse(w, 500, "could not count dids")
+		return
+	}
+
+	s.jsonSuccess(w, response)
+}
+
+// counter is implemented by stores that can count their documents without
+// reading them.
+type counter interface {
+	Count(prefix string) (int, error)
+}
+
+// countDIDs counts the ids of store starting with prefix, listing them a
+// page at a time when the store cannot count them itself.
+func countDIDs(store Store, prefix string) (int, error) {
+	if c, ok := store.(counter); ok {
+		return c.Count(prefix)
+	}
+	total := 0
+	cursor := ""
+	for {
+		ids, next, err := store.ListPage(cursor, maxListLimit, prefix)
+		if err != nil {
+			return 0, err
+		}
+		total += len(ids)
+		if len(next) == 0 {
+			return total, nil
+		}
+		cursor = next
+	}
+}
+
+func (s *Server) handleListPending(w http.ResponseWriter, r *http.Request) {
+	pending, err := s.regStore.Pending()
+	if err != nil {
+		s.errorResponse(w, 500, "could not list pending registrations")
+		return
+	}
+	s.jsonSuccess(w, pending)
+}
+
+func (s *Server) handleDeletePending(w http.ResponseWriter, r *http.Request) {
+	nonce := mux.Vars(r)["nonce"]
+	if err := s.regStore.DeletePending(nonce); errors.Is(err, didstorage.ErrorPendingNotFound) {
+		s.errorResponse(w, 404, "not found")
+		return
+	} else if err != nil {
+		s.errorResponse(w, 500, "could not delete pending registration")
+		return
+	}
+	s.jsonSuccess(w, "ok")
+}
+
+// backuper is implemented by stores that can write an online backup.
+type backuper interface {
+	Backup(dst io.Writer) error
+}
+
+// backupWriter streams a backup to w, setting the download headers on the
+// first write so a store that cannot back up still gets an error response.
+// Writes fail once ctx is done, aborting a backup when the client
+// disconnects.
+type backupWriter struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	started bool
+}
+
+func (b *backupWriter) Write(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if !b.started {
+		b.w.Header().Set("Content-Type", "application/octet-stream")
+		b.w.Header().Set("Content-Disposition", "attachment; filename=dids.db.bak")
+		b.started = true
+	}
+	return b.w.Write(p)
+}
+
+// handleBackup streams a backup of the request domain's store.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.stores[s.requestDomain(r)].(backuper)
+	if !ok {
+		s.errorResponse(w, 501, "store does not support backups")
+		return
+	}
+	dst := &backupWriter{ctx: r.Context(), w: w}
+	err := store.Backup(dst)
+	switch {
+	case err == nil:
+	case dst.started:
+		log.Printf("could not write backup for %s: %s\n", s.realIP(r), err.Error())
+	case errors.Is(err, didstorage.ErrorBackupUnsupported):
+		s.errorResponse(w, 501, err.Error())
+	default:
+		log.Printf("could not write backup for %s: %s\n", s.realIP(r), err.Error())
+		s.errorResponse(w, 500, "could not write backup")
+	}
+}
+
+type CreateRequest struct {
+	ID      string         `json:"id"`
+	KeyType crypto.KeyType `json:"keyType,omitempty"`
+}
+
+type CreateResponse struct {
+	DID           string             `json:"did"`
+	PrivateKeyJWK *jwx.PrivateKeyJWK `json:"privateKeyJwk"`
+}
+
+// handleCreate generates a key pair, registers a document for it without
+// payment and returns the private key. The private key is not kept.
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.errorResponse(w, 500, "could not get body")
+		return
+	}
+	var input CreateRequest
+	if err := json.Unmarshal(body, &input); err != nil {
+		s.errorResponse(w, 400, "invalid request")
+		return
+	}
+	if len(input.KeyType) == 0 {
+		input.KeyType = crypto.Ed25519
+	}
+
+	var u didweb.DIDWebURL
+	if err := u.UnmarshalText([]byte(input.ID)); err != nil {
+		s.errorResponse(w, 400, fmt.Sprintf("id must be in the format of %s:sally", s.requestDomain(r)))
+		return
+	}
+	// Documents are stored and looked up under the canonical host.
+	id := localID(u)
+	parts := strings.Split(id, ":")
+	store, ok := s.storeFor(parts[0])
+	if len(parts) < 2 || !ok {
+		s.errorResponse(w, 400, fmt.Sprintf("id must be in the format of %s:sally", s.requestDomain(r)))
+		return
+	}
+
+	if _, err := store.Resolve(id); err == nil {
+		s.errorResponse(w, 400, "did exists")
+		return
+	} else if !errors.Is(err, didstorage.ErrorNotFound) {
+		s.errorResponse(w, 500, fmt.Sprintf("could not check did: %s", err.Error()))
+		return
+	}
+
+	doc, privKey, err := GenerateDocument(id, input.KeyType)
+	if err != nil {
+		s.errorResponse(w, 400, fmt.Sprintf("could not create: %s", err.Error()))
+		return
+	}
+
+	if err := store.Register(doc); err != nil {
+		s.errorResponse(w, 500, fmt.Sprintf("could not register: %s", err.Error()))
+		return
+	}
+
+	s.jsonSuccess(w, CreateResponse{DID: doc.ID, PrivateKeyJWK: privKey})
+}
+
+// GenerateDocument builds a document for id around a freshly generated key
+// used for authentication and assertions.
+func GenerateDocument(id string, keyType crypto.KeyType) (*didweb.Document, *jwx.PrivateKeyJWK, error) {
+	doc, privKey, err := didweb.NewWithKeyPair(id, keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	kid := strings.TrimPrefix(doc.VerificationMethod[0].ID, "#")
+	if secpKey, ok := privKey.(secp256k1.PrivateKey); ok {
+		return doc, secp256k1PrivateKeyJWK(kid, secpKey), nil
+	}
+	_, privJWK, err := jwx.PrivateKeyToPrivateKeyJWK(kid, privKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not encode key: %w", err)
+	}
+	return doc, privJWK, nil
+}
+
+// secp256k1PrivateKeyJWK encodes key by hand, since the JWK library is built
+// without secp256k1 support.
+func secp256k1PrivateKeyJWK(kid string, key secp256k1.PrivateKey) *jwx.PrivateKeyJWK {
+	pub := key.PubKey().SerializeUncompressed()
+	return &jwx.PrivateKeyJWK{
+		KTY: "EC",
+		CRV: "secp256k1",
+		X:   base64.RawURLEncoding.EncodeToString(pub[1:33]),
+		Y:   base64.RawURLEncoding.EncodeToString(pub[33:]),
+		D:   base64.RawURLEncoding.EncodeToString(key.Serialize()),
+		KID: kid,
+	}
+}
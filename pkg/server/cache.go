@@ -0,0 +1,215 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+)
+
+// errDeactivateUnsupported is returned by a CachedDIDStore whose inner store
+// cannot deactivate DIDs.
+var errDeactivateUnsupported = fmt.Errorf("store does not support deactivation")
+
+// CachedDIDStore is a Store that keeps the most recently resolved documents
+// in memory. Writes through it invalidate the entries they change, so it
+// must be the only writer of the inner store. Cached documents are shared
+// between callers and must not be modified.
+type CachedDIDStore struct {
+	inner      Store
+	maxEntries int
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// gen counts invalidations, so a read that raced one does not cache
+	// what it read.
+	gen uint64
+}
+
+type cacheEntry struct {
+	id      string
+	result  *didweb.ResolveResult
+	expires time.Time
+}
+
+// NewCachedStore caches up to maxEntries documents of inner, each for at
+// most ttl, or until evicted when ttl is not positive.
+func NewCachedStore(inner Store, maxEntries int, ttl time.Duration) *CachedDIDStore {
+	return &CachedDIDStore{
+		inner:      inner,
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		now:        time.Now,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Resolve returns the cached document of id, reading it from the inner store
+// on a miss.
+func (c *CachedDIDStore) Resolve(id string) (*didweb.Document, error) {
+	result, err := c.resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	return result.Document, nil
+}
+
+// ResolveWithMetadata is like Resolve but also reports whether id has been
+// deactivated, which only an inner store that can deactivate DIDs knows.
+func (c *CachedDIDStore) ResolveWithMetadata(id string) (*didweb.ResolveResult, error) {
+	return c.resolve(id)
+}
+
+func (c *CachedDIDStore) resolve(id string) (*didweb.ResolveResult, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[id]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if c.ttl <= 0 || c.now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			return entry.result, nil
+		}
+		c.remove(elem)
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	var result *didweb.ResolveResult
+	if d, ok := c.inner.(deactivator); ok {
+		var err error
+		if result, err = d.ResolveWithMetadata(id); err != nil {
+			return nil, err
+		}
+	} else {
+		doc, err := c.inner.Resolve(id)
+		if err != nil {
+			return nil, err
+		}
+		result = &didweb.ResolveResult{Document: doc}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen == c.gen && c.maxEntries > 0 {
+		c.add(id, result)
+	}
+	return result, nil
+}
+
+// add caches result under id, evicting the least recently used entries to
+// make room. The caller holds c.mu.
+func (c *CachedDIDStore) add(id string, result *didweb.ResolveResult) {
+	if elem, ok := c.entries[id]; ok {
+		c.remove(elem)
+	}
+	c.entries[id] = c.lru.PushFront(&cacheEntry{id: id, result: result, expires: c.now().Add(c.ttl)})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *CachedDIDStore) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).id)
+}
+
+// invalidate drops ids from the cache.
+func (c *CachedDIDStore) invalidate(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, id := range ids {
+		if elem, ok := c.entries[id]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+// Len returns how many documents are cached.
+func (c *CachedDIDStore) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *CachedDIDStore) Register(doc *didweb.Document) error {
+	if u, err := didweb.Parse(doc.ID); err == nil {
+		// The store keys documents by ID, the server reads them by localID.
+		defer c.invalidate(u.ID(), localID(u))
+	}
+	return c.inner.Register(doc)
+}
+
+func (c *CachedDIDStore) Delete(id string) error {
+	defer c.invalidate(id)
+	return c.inner.Delete(id)
+}
+
+// Deactivate deactivates id in the inner store, failing when it cannot.
+func (c *CachedDIDStore) Deactivate(id string) error {
+	d, ok := c.inner.(deactivator)
+	if !ok {
+		return errDeactivateUnsupported
+	}
+	defer c.invalidate(id)
+	return d.Deactivate(id)
+}
+
+func (c *CachedDIDStore) ResolveVersion(id string, versionID string) (*didweb.Document, error) {
+	return c.inner.ResolveVersion(id, versionID)
+}
+
+func (c *CachedDIDStore) ResolveVersionTime(id string, versionTime time.Time) (*didweb.Document, error) {
+	return c.inner.ResolveVersionTime(id, versionTime)
+}
+
+func (c *CachedDIDStore) ForEach(seek string, fn func(id string, doc *didweb.Document) bool) error {
+	return c.inner.ForEach(seek, fn)
+}
+
+func (c *CachedDIDStore) ListPage(cursor string, limit int, prefix string) (ids []string, nextCursor string, err error) {
+	return c.inner.ListPage(cursor, limit, prefix)
+}
+
+// Count counts the documents of the inner store.
+func (c *CachedDIDStore) Count(prefix string) (int, error) {
+	return countDIDs(c.inner, prefix)
+}
+
+// History returns the versions of id kept by the inner store, if it keeps
+// any.
+func (c *CachedDIDStore) History(id string) ([]didstorage.VersionedDocument, error) {
+	if h, ok := c.inner.(historian); ok {
+		return h.History(id)
+	}
+	return nil, nil
+}
+
+func (c *CachedDIDStore) Ping() error {
+	if p, ok := c.inner.(didstorage.Pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+func (c *CachedDIDStore) Probe() error {
+	if p, ok := c.inner.(prober); ok {
+		return p.Probe()
+	}
+	return c.Ping()
+}
+
+func (c *CachedDIDStore) Backup(dst io.Writer) error {
+	if b, ok := c.inner.(backuper); ok {
+		return b.Backup(dst)
+	}
+	return didstorage.ErrorBackupUnsupported
+}
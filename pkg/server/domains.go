@@ -0,0 +1,200 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+)
+
+// WithDomains sets the domains the server hosts DIDs for. Every domain needs
+// a store, either its own from WithDomainStore or the shared one from
+// WithStore.
+func WithDomains(domains ...string) Option {
+	return func(s *Server) error {
+		for _, raw := range domains {
+			domain, err := normalizeDomain(raw)
+			if err != nil {
+				return err
+			}
+			if !s.hasDomain(domain) {
+				s.domains = append(s.domains, domain)
+			}
+		}
+		return nil
+	}
+}
+
+func (s *Server) hasDomain(domain string) bool {
+	for _, existing := range s.domains {
+		if existing == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// WithDomainStore sets the store holding the DIDs of domain.
+func WithDomainStore(domain string, store Store) Option {
+	return func(s *Server) error {
+		normalized, err := normalizeDomain(domain)
+		if err != nil {
+			return err
+		}
+		if s.stores == nil {
+			s.stores = map[string]Store{}
+		}
+		s.stores[normalized] = store
+		return nil
+	}
+}
+
+// WithAllowedPaths restricts registration to DIDs whose path under the
+// domain matches one of patterns. Segments are separated by colons and *
+// matches within a segment, so "users:*" allows "users:alice" but not
+// "admin". All paths are allowed by default.
+func WithAllowedPaths(patterns []string) Option {
+	return func(s *Server) error {
+		if err := validatePathPatterns(patterns); err != nil {
+			return err
+		}
+		s.allowedPaths = append(s.allowedPaths, patterns...)
+		return nil
+	}
+}
+
+// WithBlockedPaths rejects registration of DIDs whose path under the domain
+// matches one of patterns, e.g. "admin" or "well-known", even when
+// WithAllowedPaths allows them.
+func WithBlockedPaths(patterns []string) Option {
+	return func(s *Server) error {
+		if err := validatePathPatterns(patterns); err != nil {
+			return err
+		}
+		s.blockedPaths = append(s.blockedPaths, patterns...)
+		return nil
+	}
+}
+
+func validatePathPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchesPath reports whether subpath matches any of patterns, ignoring case.
+// Colons are matched as slashes so * stays within a segment.
+func matchesPath(patterns []string, subpath string) bool {
+	segments := strings.NewReplacer(":", "/")
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(segments.Replace(strings.ToLower(pattern)), segments.Replace(strings.ToLower(subpath))); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pathAllowed reports whether DIDs may be registered at subpath, the part of
+// the id after the domain such as "users:alice".
+func (s *Server) pathAllowed(subpath string) bool {
+	if matchesPath(s.blockedPaths, subpath) {
+		return false
+	}
+	return s.allowedPaths == nil || matchesPath(s.allowedPaths, subpath)
+}
+
+// hostnamePattern matches a lowercase hostname, optionally with a port.
+var hostnamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*(:[0-9]{1,5})?$`)
+
+// normalizeDomain turns values such as "https://Example.com/" or
+// "localhost:8080" into the host form used in did:web ids, e.g.
+// "example.com" or "localhost%3A8080".
+func normalizeDomain(domain string) (string, error) {
+	host, err := url.PathUnescape(strings.TrimSpace(domain))
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %q: %w", domain, err)
+	}
+	host = strings.ToLower(host)
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host = strings.TrimSuffix(host, "/")
+	if !hostnamePattern.MatchString(host) {
+		return "", fmt.Errorf("invalid domain %q", domain)
+	}
+	return canonicalHost(host), nil
+}
+
+// storeFor returns the store for domain, or false when the server does not
+// host it.
+func (s *Server) storeFor(domain string) (Store, bool) {
+	store, ok := s.stores[canonicalHost(domain)]
+	return store, ok
+}
+
+// storeForDID returns the store for the domain of a did:web id.
+func (s *Server) storeForDID(id string) (Store, bool) {
+	u, err := didweb.Parse(id)
+	if err != nil {
+		return nil, false
+	}
+	return s.storeFor(u.RawHost())
+}
+
+// hostDomain returns the request's Host in the form used by did:web ids,
+// with any port percent-encoded.
+func hostDomain(r *http.Request) string {
+	return canonicalHost(r.Host)
+}
+
+// canonicalHost lowercases host and percent-encodes its port separator, so
+// "Example.com:8080" and "example.com%3a8080" compare equal.
+func canonicalHost(host string) string {
+	if unescaped, err := url.PathUnescape(host); err == nil {
+		host = unescaped
+	}
+	return url.QueryEscape(strings.ToLower(host))
+}
+
+// requestDomain returns the hosted domain named by the request's Host, or
+// the first configured domain when the Host is not one of them.
+func (s *Server) requestDomain(r *http.Request) string {
+	if domain := hostDomain(r); s.hosts(domain) {
+		return domain
+	}
+	return s.domains[0]
+}
+
+// hosts reports whether the server hosts DIDs for domain.
+func (s *Server) hosts(domain string) bool {
+	_, ok := s.storeFor(domain)
+	return ok
+}
+
+// distinctStores returns each configured store once, even when it is shared
+// by several domains.
+func (s *Server) distinctStores() []Store {
+	seen := map[Store]struct{}{}
+	stores := []Store{}
+	for _, domain := range s.domains {
+		store := s.stores[domain]
+		if _, ok := seen[store]; ok {
+			continue
+		}
+		seen[store] = struct{}{}
+		stores = append(stores, store)
+	}
+	return stores
+}
+
+// localID returns the storage id of u with its host in canonical form.
+func localID(u didweb.DIDWebURL) string {
+	return canonicalHost(u.RawHost()) + strings.TrimPrefix(u.ID(), u.RawHost())
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+)
+
+// Health statuses, from best to worst.
+const (
+	healthOK        = "ok"
+	healthDegraded  = "degraded"
+	healthUnhealthy = "unhealthy"
+)
+
+// healthCheckTimeout bounds each component check of /health.
+const healthCheckTimeout = 2 * time.Second
+
+// healthCheckInterval is how long the result of a component check is reused
+// before /health checks the component again.
+const healthCheckInterval = 5 * time.Second
+
+// healthSlowLatency is how long a storage check may take before the storage
+// is reported degraded.
+const healthSlowLatency = 500 * time.Millisecond
+
+// ComponentHealth is the health of one dependency of the server.
+type ComponentHealth struct {
+	Status    string `json:"status"`
+	LatencyMS *int64 `json:"latency_ms,omitempty"`
+}
+
+// HealthResponse is the body of /health.
+type HealthResponse struct {
+	Status          string           `json:"status"`
+	Storage         *ComponentHealth `json:"storage,omitempty"`
+	PaymentProvider *ComponentHealth `json:"payment_provider,omitempty"`
+	UptimeSeconds   int64            `json:"uptime_seconds"`
+}
+
+// prober is implemented by stores that can check themselves with a write
+// round trip rather than a read.
+type prober interface {
+	Probe() error
+}
+
+// healthCheck runs one component check of /health. Concurrent requests share
+// a running check, and its result is reused for healthCheckInterval, so a
+// burst of requests cannot start more than one check at a time, nor a check
+// that hangs pile up goroutines.
+type healthCheck struct {
+	check func(ctx context.Context) error
+
+	mu sync.Mutex
+	// done is closed when the running check finishes, and nil when no check
+	// is running.
+	done    chan struct{}
+	checked time.Time
+	latency time.Duration
+	err     error
+}
+
+func newHealthCheck(check func(ctx context.Context) error) *healthCheck {
+	return &healthCheck{check: check}
+}
+
+// run returns the result of the last check when it is recent. Otherwise it
+// waits up to the health check deadline for a check to finish, starting one
+// unless one is already running.
+func (c *healthCheck) run(ctx context.Context) (time.Duration, error) {
+	c.mu.Lock()
+	if c.done == nil {
+		if !c.checked.IsZero() && time.Since(c.checked) < healthCheckInterval {
+			latency, err := c.latency, c.err
+			c.mu.Unlock()
+			return latency, err
+		}
+		c.done = make(chan struct{})
+		go c.start(c.done)
+	}
+	done := c.done
+	c.mu.Unlock()
+
+	timer := time.NewTimer(healthCheckTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.latency, c.err
+	case <-timer.C:
+		return healthCheckTimeout, context.DeadlineExceeded
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// start runs the check with the health check deadline. It does not use the
+// context of the request that started it, whose result other requests share.
+func (c *healthCheck) start(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := c.check(ctx)
+	c.mu.Lock()
+	c.latency, c.err, c.checked = time.Since(start), err, time.Now()
+	c.done = nil
+	c.mu.Unlock()
+	close(done)
+}
+
+// storeCheck checks store with a write round trip when it supports one, and
+// a ping otherwise.
+func storeCheck(store Store) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if p, ok := store.(prober); ok {
+			return p.Probe()
+		}
+		if p, ok := store.(didstorage.Pinger); ok {
+			return p.Ping()
+		}
+		return nil
+	}
+}
+
+// checkStorage checks every store, reporting the slowest and the worst.
+func (s *Server) checkStorage(ctx context.Context) *ComponentHealth {
+	health := &ComponentHealth{Status: healthOK}
+	var slowest time.Duration
+	for _, check := range s.storageChecks {
+		latency, err := check.run(ctx)
+		if latency > slowest {
+			slowest = latency
+		}
+		if err != nil {
+			log.Printf("storage health check failed: %s\n", err.Error())
+			health.Status = healthUnhealthy
+		} else if latency > healthSlowLatency && health.Status == healthOK {
+			health.Status = healthDegraded
+		}
+	}
+	ms := slowest.Milliseconds()
+	health.LatencyMS = &ms
+	return health
+}
+
+// checkPaymentProvider reports the provider degraded when it answers with an
+// error and unhealthy when it cannot be reached.
+func (s *Server) checkPaymentProvider(ctx context.Context) *ComponentHealth {
+	_, err := s.providerCheck.run(ctx)
+	switch {
+	case err == nil:
+		return &ComponentHealth{Status: healthOK}
+	case errors.Is(err, didstorage.ErrorProviderStatus):
+		log.Printf("payment provider degraded: %s\n", err.Error())
+		return &ComponentHealth{Status: healthDegraded}
+	default:
+		log.Printf("payment provider unreachable: %s\n", err.Error())
+		return &ComponentHealth{Status: healthUnhealthy}
+	}
+}
+
+// worseHealth returns the worse of two statuses.
+func worseHealth(a, b string) string {
+	rank := map[string]int{healthOK: 0, healthDegraded: 1, healthUnhealthy: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// handleHealth reports the health of the storage and the payment provider,
+// checked concurrently. It answers 503 when either is unhealthy.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	var storage, provider *ComponentHealth
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		provider = s.checkPaymentProvider(r.Context())
+	}()
+	storage = s.checkStorage(r.Context())
+	<-done
+
+	resp := HealthResponse{
+		Status:          worseHealth(storage.Status, provider.Status),
+		Storage:         storage,
+		PaymentProvider: provider,
+		UptimeSeconds:   int64(time.Since(s.startedAt).Seconds()),
+	}
+	code := http.StatusOK
+	if resp.Status == healthUnhealthy {
+		code = http.StatusServiceUnavailable
+	}
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		s.errorResponse(w, 500, fmt.Sprintf("could not encode health: %s", err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(bytes)
+}
@@ -0,0 +1,189 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/server"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/13x-tech/go-did-web/pkg/storage/memstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+// MockPaymentProvider is an LNBits stand-in that issues invoices and reports
+// them paid once Pay is called.
+type MockPaymentProvider struct {
+	*httptest.Server
+	mu       sync.Mutex
+	invoices int
+	paid     map[string]bool
+	webhooks map[string]string
+}
+
+func NewMockPaymentProvider(t *testing.T) *MockPaymentProvider {
+	p := &MockPaymentProvider{paid: map[string]bool{}, webhooks: map[string]string{}}
+	p.Server = httptest.NewTLSServer(http.HandlerFunc(p.serveHTTP))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *MockPaymentProvider) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/payments":
+		var invoice struct {
+			Out     bool   `json:"out"`
+			Data    string `json:"data"`
+			Webhook string `json:"webhook"`
+		}
+		json.NewDecoder(r.Body).Decode(&invoice)
+		if len(invoice.Data) > 0 {
+			// Decoding an invoice to check it is still valid.
+			json.NewEncoder(w).Encode(map[string]any{"payment_hash": invoice.Data})
+			return
+		}
+		p.invoices++
+		hash := fmt.Sprintf("hash%d", p.invoices)
+		p.webhooks[hash] = invoice.Webhook
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(didstorage.PaymentResponse{
+			PaymentHash:    hash,
+			PaymentRequest: fmt.Sprintf("lnbc%d", p.invoices),
+		})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/v1/payments/"):
+		hash := strings.TrimPrefix(r.URL.Path, "/api/v1/payments/")
+		json.NewEncoder(w).Encode(map[string]bool{"paid": p.paid[hash]})
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Pay marks the invoice with hash as paid and returns the webhook URL it was
+// created with, which LNBits would now call.
+func (p *MockPaymentProvider) Pay(hash string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paid[hash] = true
+	return p.webhooks[hash]
+}
+
+// readEvent reads the next event of a server-sent event stream, skipping
+// comments.
+func readEvent(t *testing.T, stream *bufio.Reader) (event, data string) {
+	t.Helper()
+	for {
+		line, err := stream.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return "", ""
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case len(line) == 0 && len(event) > 0:
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestRegistrationEndToEnd(t *testing.T) {
+	provider := NewMockPaymentProvider(t)
+	regStore, err := didstorage.NewRegisterStore(
+		strings.TrimPrefix(provider.URL, "https://"), "key", memstorage.NewMemStorage(),
+		didstorage.WithHTTPClient(provider.Client()),
+	)
+	assert.NoError(t, err)
+	s, err := server.New(
+		server.WithDomain("example.com"),
+		server.WithStore(didstorage.NewDIDStore(memstorage.NewMemStorage())),
+		server.WithRegisterStore(regStore),
+	)
+	assert.NoError(t, err)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	do := func(method, path, body string, header http.Header) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Host = "example.com"
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	id := "did:web:example.com:alice"
+	events := do(http.MethodGet, "/payment/"+id, "", nil)
+	defer events.Body.Close()
+	stream := bufio.NewReader(events.Body)
+	event, data := readEvent(t, stream)
+	assert.Equal(t, "connected", event)
+	assert.Equal(t, id, data)
+
+	resp := do(http.MethodPost, "/register", `{
+		"id": "example.com:alice",
+		"keys": [{
+			"purposes": ["assertionMethod"],
+			"publicKeyMultibase": "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"
+		}]
+	}`, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var paymentRequest string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&paymentRequest))
+	assert.Equal(t, "lnbc1", paymentRequest)
+
+	resp = do(http.MethodGet, "/alice/did.json", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	pending, err := regStore.Pending()
+	assert.NoError(t, err)
+	if !assert.Len(t, pending, 1) {
+		return
+	}
+	// The webhook is called exactly as the provider was told to call it.
+	webhook, err := url.Parse(provider.Pay(pending[0].PaymentHash))
+	assert.NoError(t, err)
+	body := fmt.Sprintf(`{"payment_hash":%q,"amount":69}`, pending[0].PaymentHash)
+	resp = do(http.MethodPost, webhook.RequestURI(), body, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	paid := make(chan [2]string, 1)
+	go func() {
+		event, data := readEvent(t, stream)
+		paid <- [2]string{event, data}
+	}()
+	select {
+	case e := <-paid:
+		assert.Equal(t, [2]string{"paid", id}, e)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no paid event")
+	}
+
+	resp = do(http.MethodGet, "/alice/did.json", "", nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var doc didweb.Document
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&doc))
+	assert.Equal(t, id, doc.ID)
+	if assert.Len(t, doc.VerificationMethod, 1) {
+		assert.Equal(t, "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK", doc.VerificationMethod[0].PublicKeyMultibase)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// Media types a did.json document can be served as, preferred first.
+const (
+	didJSONType   = "application/did+json"
+	didLDJSONType = didContentType
+	jsonType      = "application/json"
+)
+
+var documentTypes = []string{didJSONType, didLDJSONType, jsonType}
+
+// negotiate picks the offer the Accept header accept rates highest, the
+// first offer breaking ties. A missing header accepts the first offer. It
+// returns false when the header accepts none of them.
+func negotiate(accept string, offers []string) (string, bool) {
+	if len(strings.TrimSpace(accept)) == 0 {
+		return offers[0], true
+	}
+	ranges := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(ranges, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// mediaRange is one entry of an Accept header.
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(accept string) []mediaRange {
+	ranges := []mediaRange{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(raw, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// acceptQuality is the quality of offer under the most specific range that
+// matches it, or 0 when none does.
+func acceptQuality(ranges []mediaRange, offer string) float64 {
+	offerType := strings.SplitN(offer, "/", 2)[0]
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.mediaType == offer:
+			s = 2
+		case r.mediaType == offerType+"/*":
+			s = 1
+		case r.mediaType == "*/*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+	"net/url"
+)
+
+// openAPISpec describes the server's routes. Paths are relative to the API
+// prefix, or to the base path for documents and well-known files.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// swaggerUIURL is the hosted Swagger UI /swagger-ui redirects to.
+const swaggerUIURL = "https://petstore.swagger.io/"
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
+
+// handleSwaggerUI redirects to the hosted Swagger UI loading this server's
+// specification.
+func (s *Server) handleSwaggerUI(w http.ResponseWriter, r *http.Request) {
+	spec := url.URL{Scheme: "https", Host: r.Host, Path: s.apiPrefix + "/openapi.json"}
+	http.Redirect(w, r, swaggerUIURL+"?url="+url.QueryEscape(spec.String()), http.StatusFound)
+}
@@ -0,0 +1,430 @@
+package server
+
+import (
+	"container/list"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/TBD54566975/ssi-sdk/did"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secpecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-varint"
+)
+
+const (
+	// ProofHeader carries the signed challenge authorizing a change to a
+	// document.
+	ProofHeader = "Proof"
+	// ChallengeTTL is how long a challenge stays usable.
+	ChallengeTTL = 5 * time.Minute
+)
+
+// Challenge is returned by /challenge/{id}. The challenge must be signed by
+// one of the document's authentication methods with SignChallenge.
+type Challenge struct {
+	Challenge string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+const (
+	// DefaultMaxChallengesPerDID is how many unused challenges a DID may have
+	// outstanding unless WithMaxChallenges says otherwise.
+	DefaultMaxChallengesPerDID = 8
+	// DefaultMaxChallenges is how many unused challenges may be outstanding
+	// in total unless WithMaxChallenges says otherwise.
+	DefaultMaxChallenges = 10000
+)
+
+// errTooManyChallenges is returned by issueChallenge when a limit of
+// outstanding challenges is reached.
+var errTooManyChallenges = fmt.Errorf("too many outstanding challenges")
+
+type issuedChallenge struct {
+	challenge string
+	id        string
+	expiresAt time.Time
+}
+
+// challengeStore keeps the outstanding challenges in the order they were
+// issued, which is also the order they expire in as they share a TTL, so
+// expired challenges are dropped from the front without a sweep.
+type challengeStore struct {
+	maxPerDID int
+	max       int
+
+	mu     sync.Mutex
+	issued map[string]*list.Element
+	order  *list.List
+	perDID map[string]int
+}
+
+func newChallengeStore(maxPerDID, max int) *challengeStore {
+	return &challengeStore{
+		maxPerDID: maxPerDID,
+		max:       max,
+		issued:    make(map[string]*list.Element),
+		order:     list.New(),
+		perDID:    make(map[string]int),
+	}
+}
+
+// expire drops the challenges that expired before now. The caller holds
+// c.mu.
+func (c *challengeStore) expire(now time.Time) {
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		if now.Before(front.Value.(*issuedChallenge).expiresAt) {
+			return
+		}
+		c.remove(front)
+	}
+}
+
+func (c *challengeStore) remove(elem *list.Element) {
+	issued := c.order.Remove(elem).(*issuedChallenge)
+	delete(c.issued, issued.challenge)
+	if c.perDID[issued.id]--; c.perDID[issued.id] <= 0 {
+		delete(c.perDID, issued.id)
+	}
+}
+
+func (c *challengeStore) add(issued *issuedChallenge, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+	if c.order.Len() >= c.max || c.perDID[issued.id] >= c.maxPerDID {
+		return errTooManyChallenges
+	}
+	c.issued[issued.challenge] = c.order.PushBack(issued)
+	c.perDID[issued.id]++
+	return nil
+}
+
+// take consumes challenge, reporting whether it was issued for the DID id
+// and has not expired.
+func (c *challengeStore) take(challenge, id string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+	elem, ok := c.issued[challenge]
+	if !ok {
+		return false
+	}
+	c.remove(elem)
+	return elem.Value.(*issuedChallenge).id == id
+}
+
+// issueChallenge returns a new single use challenge for the DID id, or
+// errTooManyChallenges when id, or the server, has too many outstanding.
+func (s *Server) issueChallenge(id string) (Challenge, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return Challenge{}, fmt.Errorf("could not generate challenge: %w", err)
+	}
+	now := time.Now()
+	challenge := Challenge{Challenge: hex.EncodeToString(nonce), ExpiresAt: now.Add(ChallengeTTL).UTC()}
+	issued := &issuedChallenge{challenge: challenge.Challenge, id: id, expiresAt: challenge.ExpiresAt}
+	if err := s.challenges.add(issued, now); err != nil {
+		return Challenge{}, err
+	}
+	return challenge, nil
+}
+
+// takeChallenge consumes challenge, reporting whether it was issued for the
+// DID id and has not expired.
+func (s *Server) takeChallenge(challenge, id string) bool {
+	return s.challenges.take(challenge, id, time.Now())
+}
+
+// hostedDocument resolves the DID in the request path from the local store,
+// answering the request itself when it cannot.
+func (s *Server) hostedDocument(w http.ResponseWriter, r *http.Request) (Store, string, *didweb.Document, bool) {
+	pathParts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), s.apiPrefix), "/")
+	var u didweb.DIDWebURL
+	if len(pathParts) < 3 || u.UnmarshalText([]byte(pathParts[2])) != nil {
+		s.errorResponse(w, 400, "invalid id")
+		return nil, "", nil, false
+	}
+	store, ok := s.storeFor(u.RawHost())
+	if !ok {
+		s.errorResponse(w, 404, "not found")
+		return nil, "", nil, false
+	}
+	doc, err := store.Resolve(localID(u))
+	if errors.Is(err, didstorage.ErrorNotFound) {
+		s.errorResponse(w, 404, "not found")
+		return nil, "", nil, false
+	} else if err != nil {
+		s.errorResponse(w, 500, fmt.Sprintf("could not resolve: %s", err.Error()))
+		return nil, "", nil, false
+	}
+	return store, localID(u), doc, true
+}
+
+func (s *Server) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	_, _, doc, ok := s.hostedDocument(w, r)
+	if !ok {
+		return
+	}
+	challenge, err := s.issueChallenge(doc.ID)
+	if errors.Is(err, errTooManyChallenges) {
+		s.errorResponse(w, http.StatusTooManyRequests, err.Error())
+		return
+	} else if err != nil {
+		s.errorResponse(w, 500, err.Error())
+		return
+	}
+	s.jsonSuccess(w, challenge)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	proof := r.Header.Get(ProofHeader)
+	if len(proof) == 0 {
+		s.errorResponse(w, 401, "proof required")
+		return
+	}
+	store, id, doc, ok := s.hostedDocument(w, r)
+	if !ok {
+		return
+	}
+	if err := s.verifyProof(r, doc, proof); err != nil {
+		s.errorResponse(w, 401, err.Error())
+		return
+	}
+	if r.URL.Query().Get("purge") == "true" {
+		if err := store.Delete(id); err != nil {
+			s.errorResponse(w, 500, fmt.Sprintf("could not delete: %s", err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	d, ok := store.(deactivator)
+	if !ok {
+		s.errorResponse(w, 501, "store does not support deactivation, delete with purge=true")
+		return
+	}
+	if err := d.Deactivate(id); errors.Is(err, errDeactivateUnsupported) {
+		s.errorResponse(w, 501, "store does not support deactivation, delete with purge=true")
+		return
+	} else if err != nil {
+		s.errorResponse(w, 500, fmt.Sprintf("could not deactivate: %s", err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// proofHeader is the protected header of a proof JWS.
+type proofHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// verifyProof checks proof is a compact JWS of a challenge issued for doc,
+// signed by one of the methods allowed to authenticate as its controller.
+// A kid in the header limits the methods tried to the one it names.
+func (s *Server) verifyProof(r *http.Request, doc *didweb.Document, proof string) error {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("proof must be a compact JWS")
+	}
+	var header proofHeader
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &header) != nil {
+		return fmt.Errorf("invalid proof header")
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid proof payload")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid proof signature")
+	}
+	if !s.takeChallenge(string(challenge), doc.ID) {
+		return fmt.Errorf("unknown or expired challenge")
+	}
+
+	methods, err := didstorage.AuthenticationMethods(doc, func(id string) (*didweb.Document, error) {
+		u, err := didweb.Parse(id)
+		if err != nil {
+			return nil, err
+		}
+		controller, _, err := s.resolveWithMetadata(r.Context(), u)
+		return controller, err
+	})
+	if err != nil {
+		return fmt.Errorf("could not load authentication methods: %w", err)
+	}
+	kid := header.Kid
+	if strings.HasPrefix(kid, "#") {
+		kid = doc.ID + kid
+	}
+	signingInput := []byte(parts[0] + "." + parts[1])
+	for _, method := range methods {
+		if len(kid) > 0 && method.ID != kid {
+			continue
+		}
+		key, err := verificationMethodKey(method)
+		if err != nil {
+			continue
+		}
+		if verifySignature(header.Alg, key, signingInput, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("proof is not signed by an authentication method of %s", doc.ID)
+}
+
+// SignChallenge returns the Proof header value for challenge, a compact JWS
+// signed with key. Ed25519, P-256 and secp256k1 keys are supported. kid names
+// the verification method and may be left empty to try each of them.
+func SignChallenge(challenge, kid string, key gocrypto.PrivateKey) (string, error) {
+	if k, ok := key.(secp256k1.PrivateKey); ok {
+		key = &k
+	}
+	var alg string
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		alg = "EdDSA"
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return "", fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+		alg = "ES256"
+	case *secp256k1.PrivateKey:
+		alg = "ES256K"
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+	rawHeader, err := json.Marshal(proofHeader{Alg: alg, Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(rawHeader) + "." + base64.RawURLEncoding.EncodeToString([]byte(challenge))
+
+	var signature []byte
+	hash := sha256.Sum256([]byte(signingInput))
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signingInput))
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			return "", fmt.Errorf("could not sign: %w", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case *secp256k1.PrivateKey:
+		// Compact signatures are a recovery code followed by R and S.
+		signature = secpecdsa.SignCompact(key, hash[:], true)[1:]
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifySignature checks signature over input was made with alg by the
+// private half of key.
+func verifySignature(alg string, key gocrypto.PublicKey, input, signature []byte) bool {
+	hash := sha256.Sum256(input)
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, input, signature)
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || key.Curve != elliptic.P256() || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, hash[:], r, s)
+	case *secp256k1.PublicKey:
+		if alg != "ES256K" || len(signature) != 64 {
+			return false
+		}
+		var r, s secp256k1.ModNScalar
+		if r.SetByteSlice(signature[:32]) || s.SetByteSlice(signature[32:]) {
+			return false
+		}
+		return secpecdsa.NewSignature(&r, &s).Verify(hash[:], key)
+	}
+	return false
+}
+
+// verificationMethodKey decodes the public key of vm, given as a JWK, a
+// multicodec prefixed multibase key or a base58 key.
+func verificationMethodKey(vm did.VerificationMethod) (gocrypto.PublicKey, error) {
+	if jwk := vm.PublicKeyJWK; jwk != nil {
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		switch {
+		case jwk.KTY == "OKP" && jwk.CRV == "Ed25519" && len(x) == ed25519.PublicKeySize:
+			return ed25519.PublicKey(x), nil
+		case jwk.KTY == "EC" && (jwk.CRV == "P-256" || jwk.CRV == "secp256k1"):
+			y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if err != nil || len(x) != 32 || len(y) != 32 {
+				return nil, fmt.Errorf("invalid %s key", jwk.CRV)
+			}
+			if jwk.CRV == "secp256k1" {
+				return secp256k1.ParsePubKey(append(append([]byte{0x04}, x...), y...))
+			}
+			return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+		}
+		return nil, fmt.Errorf("unsupported %s %s key", jwk.KTY, jwk.CRV)
+	}
+
+	if len(vm.PublicKeyMultibase) > 0 {
+		_, decoded, err := multibase.Decode(vm.PublicKeyMultibase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid publicKeyMultibase: %w", err)
+		}
+		codec, n, err := varint.FromUvarint(decoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid publicKeyMultibase: %w", err)
+		}
+		data := decoded[n:]
+		switch {
+		case codec == uint64(did.Ed25519MultiCodec) && len(data) == ed25519.PublicKeySize:
+			return ed25519.PublicKey(data), nil
+		case codec == uint64(did.SECP256k1MultiCodec):
+			return secp256k1.ParsePubKey(data)
+		case codec == uint64(did.P256MultiCodec):
+			x, y := elliptic.UnmarshalCompressed(elliptic.P256(), data)
+			if x == nil {
+				return nil, fmt.Errorf("invalid P-256 key")
+			}
+			return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+		}
+		return nil, fmt.Errorf("unsupported multicodec %#x", codec)
+	}
+
+	// Base58 keys carry no type, so they are told apart by length.
+	if len(vm.PublicKeyBase58) > 0 {
+		_, data, err := multibase.Decode("z" + vm.PublicKeyBase58)
+		if err != nil {
+			return nil, fmt.Errorf("invalid publicKeyBase58: %w", err)
+		}
+		if len(data) == ed25519.PublicKeySize {
+			return ed25519.PublicKey(data), nil
+		}
+		return secp256k1.ParsePubKey(data)
+	}
+	return nil, fmt.Errorf("verification method %s has no public key", vm.ID)
+}
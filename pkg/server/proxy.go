@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// WithTrustedProxies trusts the X-Forwarded-For header of requests arriving
+// from the given CIDR ranges or single addresses, e.g. a load balancer in
+// front of the server.
+func WithTrustedProxies(cidrs []string) Option {
+	return func(s *Server) error {
+		for _, cidr := range cidrs {
+			if !strings.Contains(cidr, "/") {
+				ip := net.ParseIP(cidr)
+				if ip == nil {
+					return fmt.Errorf("invalid trusted proxy %q", cidr)
+				}
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					bits = 8 * net.IPv4len
+				}
+				cidr = fmt.Sprintf("%s/%d", cidr, bits)
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+			}
+			s.trustedProxies = append(s.trustedProxies, network)
+		}
+		return nil
+	}
+}
+
+func (s *Server) trustedProxy(ip net.IP) bool {
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIP returns the client address of r. X-Forwarded-For is only read when
+// the peer is a trusted proxy, and then from the right, returning the first
+// address that is not itself a trusted proxy, so clients cannot forge it.
+func (s *Server) realIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || !s.trustedProxy(ip) {
+		return addr
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		addr = hop.String()
+		if !s.trustedProxy(hop) {
+			break
+		}
+	}
+	return addr
+}
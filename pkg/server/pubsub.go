@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// paidChannel prefixes the Redis channel a payment of a DID is published on.
+const paidChannel = "did-paid:"
+
+// subscriber carries payment notifications to the brokers with clients
+// waiting on them, within this process or across instances.
+type subscriber interface {
+	// Publish announces that id has been paid.
+	Publish(ctx context.Context, id string) error
+	// Subscribe calls paid with the id of every payment published until ctx
+	// is done. It returns once the subscription is in place.
+	Subscribe(ctx context.Context, paid func(id string)) error
+}
+
+// localSubscriber delivers payments to the subscribers of this process.
+type localSubscriber struct {
+	mu     sync.RWMutex
+	nextID int
+	paid   map[int]func(id string)
+}
+
+func newLocalSubscriber() *localSubscriber {
+	return &localSubscriber{paid: make(map[int]func(id string))}
+}
+
+func (l *localSubscriber) Publish(ctx context.Context, id string) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, paid := range l.paid {
+		paid(id)
+	}
+	return nil
+}
+
+func (l *localSubscriber) Subscribe(ctx context.Context, paid func(id string)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := l.nextID
+	l.nextID++
+	l.paid[key] = paid
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			delete(l.paid, key)
+		}()
+	}
+	return nil
+}
+
+// redisSubscriber publishes payments on the Redis channel did-paid:{id}, so
+// the instance holding the client's stream learns of a payment whose
+// webhook reached another one.
+type redisSubscriber struct {
+	client *redis.Client
+}
+
+// newRedisSubscriber connects to the Redis server at addr, either host:port
+// or a redis:// URL.
+func newRedisSubscriber(addr string) (*redisSubscriber, error) {
+	opts := &redis.Options{Addr: addr}
+	if strings.Contains(addr, "://") {
+		var err error
+		if opts, err = redis.ParseURL(addr); err != nil {
+			return nil, fmt.Errorf("invalid redis url: %w", err)
+		}
+	}
+	return &redisSubscriber{client: redis.NewClient(opts)}, nil
+}
+
+func (r *redisSubscriber) Publish(ctx context.Context, id string) error {
+	return r.client.Publish(ctx, paidChannel+id, string(paidMessage)).Err()
+}
+
+func (r *redisSubscriber) Subscribe(ctx context.Context, paid func(id string)) error {
+	pubsub := r.client.PSubscribe(ctx, paidChannel+"*")
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("could not subscribe to payments: %w", err)
+	}
+	go func() {
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				paid(strings.TrimPrefix(msg.Channel, paidChannel))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// WithRedisPaymentBroker shares payments between instances through the Redis
+// server at redisAddr, host:port or a redis:// URL, so clients are notified
+// whichever instance receives the payment webhook.
+func WithRedisPaymentBroker(redisAddr string) Option {
+	return func(s *Server) error {
+		if len(redisAddr) == 0 {
+			return fmt.Errorf("redis address required")
+		}
+		pubsub, err := newRedisSubscriber(redisAddr)
+		if err != nil {
+			return err
+		}
+		s.paymentPubSub = pubsub
+		return nil
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+)
+
+const (
+	resolutionContext     = "https://w3id.org/did-resolution/v1"
+	resolutionContentType = `application/ld+json;profile="https://w3id.org/did-resolution"`
+	didContentType        = "application/did+ld+json"
+)
+
+// ResolutionResult is a DID resolution result in the shape returned by the
+// DIF Universal Resolver.
+type ResolutionResult struct {
+	Context            string             `json:"@context"`
+	DIDDocument        *didweb.Document   `json:"didDocument"`
+	ResolutionMetadata ResolutionMetadata `json:"didResolutionMetadata"`
+	DocumentMetadata   DocumentMetadata   `json:"didDocumentMetadata"`
+}
+
+type ResolutionMetadata struct {
+	ContentType string `json:"contentType,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type DocumentMetadata struct {
+	Created      string   `json:"created,omitempty"`
+	Updated      string   `json:"updated,omitempty"`
+	VersionID    string   `json:"versionId,omitempty"`
+	CanonicalID  string   `json:"canonicalId,omitempty"`
+	EquivalentID []string `json:"equivalentId,omitempty"`
+	Deactivated  bool     `json:"deactivated,omitempty"`
+}
+
+// historian is implemented by stores that keep a document's version history.
+type historian interface {
+	History(id string) ([]didstorage.VersionedDocument, error)
+}
+
+// deactivator is implemented by stores that can deactivate a DID while
+// keeping its last document resolvable.
+type deactivator interface {
+	Deactivate(id string) error
+	ResolveWithMetadata(id string) (*didweb.ResolveResult, error)
+}
+
+// resolveCurrent returns the current document of id and whether it has been
+// deactivated. Stores that cannot deactivate DIDs report none as
+// deactivated.
+func resolveCurrent(store Store, id string) (*didweb.Document, bool, error) {
+	d, ok := store.(deactivator)
+	if !ok {
+		doc, err := store.Resolve(id)
+		return doc, false, err
+	}
+	result, err := d.ResolveWithMetadata(id)
+	if err != nil {
+		return nil, false, err
+	}
+	return result.Document, result.Deactivated, nil
+}
+
+// handleIdentifiers implements the Universal Resolver driver interface,
+// GET /1.0/identifiers/{did}.
+func (s *Server) handleIdentifiers(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.EscapedPath(), s.apiPrefix), "/1.0/identifiers/")
+	if !strings.HasPrefix(id, "did:") {
+		if unescaped, err := url.PathUnescape(id); err == nil {
+			id = unescaped
+		}
+	}
+
+	u, err := didweb.Parse(id)
+	if err != nil {
+		s.resolutionResponse(w, http.StatusBadRequest, ResolutionResult{ResolutionMetadata: ResolutionMetadata{Error: "invalidDid"}})
+		return
+	}
+
+	doc, metadata, err := s.resolveWithMetadata(r.Context(), u)
+	if errors.Is(err, errResolveForbidden) {
+		s.resolutionResponse(w, http.StatusForbidden, ResolutionResult{ResolutionMetadata: ResolutionMetadata{Error: "forbidden"}})
+		return
+	}
+	if errors.Is(err, didweb.ErrInvalidDID) {
+		s.resolutionResponse(w, http.StatusBadRequest, ResolutionResult{ResolutionMetadata: ResolutionMetadata{Error: "invalidDid"}})
+		return
+	} else if err != nil {
+		s.resolutionResponse(w, http.StatusNotFound, ResolutionResult{ResolutionMetadata: ResolutionMetadata{Error: "notFound"}})
+		return
+	}
+
+	s.resolutionResponse(w, http.StatusOK, ResolutionResult{
+		DIDDocument:        doc,
+		ResolutionMetadata: ResolutionMetadata{ContentType: didContentType},
+		DocumentMetadata:   metadata,
+	})
+}
+
+// resolveWithMetadata resolves u from the local store when its domain is
+// hosted here, and over HTTPS otherwise. Remote documents only carry their
+// canonical id.
+func (s *Server) resolveWithMetadata(ctx context.Context, u didweb.DIDWebURL) (*didweb.Document, DocumentMetadata, error) {
+	store, ok := s.storeFor(u.RawHost())
+	if !ok {
+		if err := s.checkResolveHost(ctx, u); err != nil {
+			return nil, DocumentMetadata{}, err
+		}
+		result, err := didweb.ResolveWithMetadata(ctx, u.DID(), s.client)
+		if err != nil {
+			return nil, DocumentMetadata{}, err
+		}
+		return result.Document, DocumentMetadata{CanonicalID: result.CanonicalID, EquivalentID: result.EquivalentID}, nil
+	}
+
+	metadata := DocumentMetadata{}
+	doc, deactivated, err := resolveCurrent(store, localID(u))
+	if err != nil {
+		return nil, DocumentMetadata{}, err
+	}
+	metadata.Deactivated = deactivated
+	if h, ok := store.(historian); ok {
+		if history, err := h.History(localID(u)); err == nil && len(history) > 0 {
+			latest := history[len(history)-1]
+			metadata.Created = history[0].Created.Format(time.RFC3339)
+			metadata.VersionID = latest.VersionID
+			if len(history) > 1 {
+				metadata.Updated = latest.Created.Format(time.RFC3339)
+			}
+		}
+	}
+	return doc, metadata, nil
+}
+
+func (s *Server) resolutionResponse(w http.ResponseWriter, code int, result ResolutionResult) {
+	result.Context = resolutionContext
+	w.Header().Set("Content-Type", resolutionContentType)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("could not write resolution result: %s\n", err.Error())
+	}
+}
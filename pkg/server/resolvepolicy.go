@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+)
+
+// errResolveForbidden is returned for DIDs the server will not resolve
+// remotely.
+var errResolveForbidden = fmt.Errorf("resolution of this host is not allowed")
+
+// hostPattern matches hosts by name, by "*." wildcard of a domain's
+// subdomains, or by the IP range they resolve to.
+type hostPattern struct {
+	name    string
+	network *net.IPNet
+}
+
+func parseHostPatterns(patterns []string) ([]hostPattern, error) {
+	parsed := []hostPattern{}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if len(pattern) == 0 {
+			return nil, fmt.Errorf("empty host pattern")
+		}
+		if strings.Contains(pattern, "/") {
+			_, network, err := net.ParseCIDR(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+			}
+			parsed = append(parsed, hostPattern{network: network})
+			continue
+		}
+		if ip := net.ParseIP(pattern); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			parsed = append(parsed, hostPattern{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}})
+			continue
+		}
+		parsed = append(parsed, hostPattern{name: strings.TrimSuffix(pattern, ".")})
+	}
+	return parsed, nil
+}
+
+func (p hostPattern) matches(host string, ips []net.IP) bool {
+	if p.network != nil {
+		for _, ip := range ips {
+			if p.network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if strings.HasPrefix(p.name, "*.") {
+		return strings.HasSuffix(host, p.name[1:])
+	}
+	return host == p.name
+}
+
+func matchesAny(patterns []hostPattern, host string, ips []net.IP) bool {
+	for _, pattern := range patterns {
+		if pattern.matches(host, ips) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithResolveAllowlist only resolves DIDs hosted elsewhere when their host
+// matches one of hosts: a name, a "*.example.com" wildcard, an IP or a CIDR
+// range. Allowed hosts may be private or loopback addresses.
+func WithResolveAllowlist(hosts []string) Option {
+	return func(s *Server) error {
+		patterns, err := parseHostPatterns(hosts)
+		if err != nil {
+			return err
+		}
+		s.resolveAllowlist = append(s.resolveAllowlist, patterns...)
+		return nil
+	}
+}
+
+// WithResolveDenylist never resolves DIDs whose host matches one of hosts,
+// given as for WithResolveAllowlist.
+func WithResolveDenylist(hosts []string) Option {
+	return func(s *Server) error {
+		patterns, err := parseHostPatterns(hosts)
+		if err != nil {
+			return err
+		}
+		s.resolveDenylist = append(s.resolveDenylist, patterns...)
+		return nil
+	}
+}
+
+// WithPrivateResolution lets the server resolve DIDs hosted on private,
+// loopback and link-local addresses, which it refuses by default so callers
+// cannot use it to reach the internal network.
+func WithPrivateResolution() Option {
+	return func(s *Server) error {
+		s.privateResolution = true
+		return nil
+	}
+}
+
+// isPrivateIP reports whether ip is loopback, link-local, unspecified or in
+// a private range.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// checkResolveHost returns errResolveForbidden unless the host of u may be
+// fetched: it is not denied, it is allowed when there is an allowlist, and
+// it is neither private nor loopback unless explicitly allowed.
+func (s *Server) checkResolveHost(ctx context.Context, u didweb.DIDWebURL) error {
+	host := u.Host()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if addrs, err := s.lookupIP(ctx, host); err == nil {
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	if matchesAny(s.resolveDenylist, host, ips) {
+		return fmt.Errorf("%w: %s is denied", errResolveForbidden, host)
+	}
+	if matchesAny(s.resolveAllowlist, host, ips) {
+		return nil
+	}
+	if len(s.resolveAllowlist) > 0 {
+		return fmt.Errorf("%w: %s is not allowed", errResolveForbidden, host)
+	}
+	if s.privateResolution {
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("%w: %s is a local address", errResolveForbidden, host)
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return fmt.Errorf("%w: %s is a private address", errResolveForbidden, host)
+		}
+	}
+	return nil
+}
+
+// lookupIP resolves host with the resolver set for tests, or the default
+// one.
+func (s *Server) lookupIP(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if s.resolver != nil {
+		return s.resolver(ctx, host)
+	}
+	return net.DefaultResolver.LookupIPAddr(ctx, host)
+}
+
+// resolutionClient returns the client used to resolve DIDs hosted elsewhere
+// when none is set. It checks the addresses it connects to, so names that
+// resolve to a private address by the time of the request, or redirects to
+// one, are refused as well. It never goes through a proxy from the
+// environment, as the guard would then only see the address of the proxy.
+func (s *Server) resolutionClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = s.guardedDialContext(&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	})
+	return &http.Client{Transport: transport, Timeout: s.resolveTimeout}
+}
+
+// guardedDialContext dials the first address of the host in addr that is
+// not denied, and not private unless allowed.
+func (s *Server) guardedDialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			addrs, err := s.lookupIP(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+		}
+
+		for _, ip := range ips {
+			ipList := []net.IP{ip}
+			if matchesAny(s.resolveDenylist, host, ipList) {
+				continue
+			}
+			if isPrivateIP(ip) && !s.privateResolution && !matchesAny(s.resolveAllowlist, host, ipList) {
+				continue
+			}
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		}
+		return nil, fmt.Errorf("%w: %s has no public address", errResolveForbidden, host)
+	}
+}
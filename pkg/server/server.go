@@ -1,31 +1,52 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/13x-tech/go-did-web/pkg/didweb"
 	"github.com/13x-tech/go-did-web/pkg/storage"
 	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
 	"github.com/TBD54566975/ssi-sdk/did"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 	"github.com/gorilla/mux"
 	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-varint"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Store interface {
-	Register(doc *did.Document) error
-	Resolve(id string) (*did.Document, error)
+	Register(doc *didweb.Document) error
+	Resolve(id string) (*didweb.Document, error)
+	ResolveVersion(id string, versionID string) (*didweb.Document, error)
+	ResolveVersionTime(id string, versionTime time.Time) (*didweb.Document, error)
 	Delete(id string) error
+	ForEach(seek string, fn func(id string, doc *didweb.Document) bool) error
+	ListPage(cursor string, limit int, prefix string) (ids []string, nextCursor string, err error)
 }
 
-func NewStore(domain, storageDir, bucket string) (Store, error) {
-	store, err := storage.New(storageDir, bucket)
+func NewStore(domain, storageDir, bucket string, opts ...storage.Option) (Store, error) {
+	store, err := storage.New(storageDir, bucket, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -35,52 +56,167 @@ func NewStore(domain, storageDir, bucket string) (Store, error) {
 
 type Message struct {
 	id      string
-	message string
+	message []byte
 }
 
-func NewBroker() *PaymentBroker {
+// DefaultKeepAlive is how often an idle payment stream receives a comment so
+// proxies keep the connection open.
+const DefaultKeepAlive = 15 * time.Second
+
+// clientBuffer is how many undelivered events a slow client may queue before
+// further events to it are dropped.
+const clientBuffer = 8
+
+// DefaultMaxPaymentClients is how many payment streams may wait on the same
+// DID at once unless WithMaxPaymentClients says otherwise.
+const DefaultMaxPaymentClients = 16
+
+// errTooManyClients is returned when a DID already has the most payment
+// streams allowed.
+var errTooManyClients = fmt.Errorf("too many clients waiting for this payment")
+
+// NewBroker returns a broker allowing at most maxClientsPerDID streams per
+// DID, or any number when it is not positive.
+func NewBroker(maxClientsPerDID int) *PaymentBroker {
 	return &PaymentBroker{
-		mu:       sync.RWMutex{},
-		clients:  make(map[string]map[chan string]struct{}),
-		messages: make(chan Message),
+		mu:         sync.RWMutex{},
+		clients:    make(map[string]map[chan []byte]struct{}),
+		messages:   make(chan Message),
+		keepAlive:  DefaultKeepAlive,
+		maxClients: maxClientsPerDID,
+		pubsub:     newLocalSubscriber(),
 	}
 }
 
 type PaymentBroker struct {
-	mu       sync.RWMutex
-	clients  map[string]map[chan string]struct{}
-	messages chan Message
+	mu         sync.RWMutex
+	clients    map[string]map[chan []byte]struct{}
+	messages   chan Message
+	keepAlive  time.Duration
+	maxClients int
+	pubsub     subscriber
+	eventID    uint64
+	// deadline returns when the invoice for id expires, if known.
+	deadline func(id string) (time.Time, bool)
+}
+
+// writeEvent writes a single named server-sent event.
+func (b *PaymentBroker) writeEvent(w io.Writer, event, data string) {
+	id := atomic.AddUint64(&b.eventID, 1)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, data)
 }
 
-func (b *PaymentBroker) Start() {
+// Start subscribes the broker to payments and starts delivering events to
+// its clients.
+func (b *PaymentBroker) Start() error {
+	if err := b.pubsub.Subscribe(context.Background(), b.notifyPaid); err != nil {
+		return err
+	}
 	go func() {
-		for {
-			select {
-			case msg := <-b.messages:
-				b.mu.RLock()
-				clients, ok := b.clients[msg.id]
-				b.mu.RUnlock()
-				if ok {
-					for c := range clients {
-						c <- msg.message
-					}
-				}
+		for msg := range b.messages {
+			b.mu.RLock()
+			for c := range b.clients[msg.id] {
+				deliver(c, msg.message)
 			}
+			b.mu.RUnlock()
 		}
 	}()
+	return nil
 }
 
+// deliver hands message to a client without blocking, dropping it when the
+// client has stopped reading and its buffer is full. Callers must hold the
+// broker lock so c cannot be closed concurrently.
+func deliver(c chan []byte, message []byte) bool {
+	select {
+	case c <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// paidMessage is the event sent to every client once its DID has been paid.
+var paidMessage = []byte("paid")
+
+// publishTimeout bounds how long publishing a payment may take.
+const publishTimeout = 5 * time.Second
+
+// BroadcastPayment publishes that id has been paid to the brokers of every
+// instance sharing the broker's subscriber, itself included.
 func (b *PaymentBroker) BroadcastPayment(id string) {
 	fmt.Printf("attempt broadcast: %s", id)
-	b.mu.RLock()
-	client, ok := b.clients[id]
-	b.mu.RUnlock()
-	if ok {
-		for c := range client {
-			c <- "paid"
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	if err := b.pubsub.Publish(ctx, id); err != nil {
+		log.Printf("could not publish payment of %s: %s\n", id, err.Error())
+	}
+}
+
+// notifyPaid notifies every client waiting on id that it has been paid and
+// then closes their streams, since no further events can follow.
+func (b *PaymentBroker) notifyPaid(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients[id] {
+		// The payment must not be dropped, so make room by discarding the
+		// oldest queued event if the client has fallen behind.
+		if !deliver(c, paidMessage) {
+			select {
+			case <-c:
+			default:
+			}
+			deliver(c, paidMessage)
 		}
-		//TODO close out connections?
+		close(c)
+	}
+	delete(b.clients, id)
+}
+
+// subscribe registers a new client waiting on id, unless id already has the
+// most clients allowed.
+func (b *PaymentBroker) subscribe(id string) (chan []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clients, ok := b.clients[id]
+	if !ok {
+		clients = make(map[chan []byte]struct{})
+		b.clients[id] = clients
+	}
+	if b.maxClients > 0 && len(clients) >= b.maxClients {
+		return nil, errTooManyClients
+	}
+	c := make(chan []byte, clientBuffer)
+	clients[c] = struct{}{}
+	return c, nil
+}
+
+// unsubscribe removes c from the clients waiting on id, if it is still there.
+func (b *PaymentBroker) unsubscribe(id string, c chan []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clients, ok := b.clients[id]
+	if !ok {
+		return
+	}
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(b.clients, id)
+	}
+}
+
+// expiry returns a channel that fires when the invoice for id expires, nil
+// if that is not known, and a func that stops the timer.
+func (b *PaymentBroker) expiry(id string) (<-chan time.Time, func()) {
+	if b.deadline == nil {
+		return nil, func() {}
+	}
+	deadline, ok := b.deadline(id)
+	if !ok {
+		return nil, func() {}
 	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, func() { timer.Stop() }
 }
 
 func (b *PaymentBroker) WaitForPayment(w http.ResponseWriter, r *http.Request) {
@@ -93,37 +229,41 @@ func (b *PaymentBroker) WaitForPayment(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 	fmt.Printf("Connected and waiting: %s", id)
-	b.mu.Lock()
-	clients, ok := b.clients[id]
-	if !ok {
-		clients = make(map[chan string]struct{})
+	messageChan, err := b.subscribe(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
 	}
-	messageChan := make(chan string)
-	clients[messageChan] = struct{}{}
-	b.clients[id] = clients
-	b.mu.Unlock()
+	defer b.unsubscribe(id, messageChan)
 
 	ctx := r.Context()
-	go func() {
-		<-ctx.Done()
-		b.mu.Lock()
-		clients, ok := b.clients[id]
-		if ok {
-			delete(clients, messageChan)
-			b.clients[id] = clients
-		}
-		b.mu.Unlock()
-	}()
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
+	b.writeEvent(w, "connected", id)
+	flusher.Flush()
+
+	ticker := time.NewTicker(b.keepAlive)
+	defer ticker.Stop()
+	expired, stop := b.expiry(id)
+	defer stop()
 	for {
 		select {
-		case msg := <-messageChan:
-			fmt.Fprintf(w, "data: Message: %s\n\n", msg)
+		case msg, ok := <-messageChan:
+			if !ok {
+				return
+			}
+			b.writeEvent(w, string(msg), id)
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-expired:
+			b.writeEvent(w, "expired", id)
 			flusher.Flush()
+			return
 		case <-ctx.Done():
 			return
 		}
@@ -146,13 +286,14 @@ func WithPort(port int) Option {
 	}
 }
 
+// WithDomain hosts DIDs for a single domain.
+//
+// Deprecated: use WithDomains.
 func WithDomain(domain string) Option {
-	return func(s *Server) error {
-		s.domain = domain
-		return nil
-	}
+	return WithDomains(domain)
 }
 
+// WithStore sets the store used by domains without one of their own.
 func WithStore(store Store) Option {
 	return func(s *Server) error {
 		s.store = store
@@ -167,6 +308,160 @@ func WithHandler(handler http.Handler) Option {
 	}
 }
 
+// WithAdminKey sets the key required by the admin endpoints. Admin endpoints
+// reject every request when no key is configured.
+func WithAdminKey(key string) Option {
+	return func(s *Server) error {
+		s.adminKey = key
+		return nil
+	}
+}
+
+// WithAllowedOrigins sets the origins whose cross-origin requests are allowed
+// on every route, including the limited ones.
+func WithAllowedOrigins(origins []string) Option {
+	return func(s *Server) error {
+		for _, origin := range origins {
+			if _, err := path.Match(origin, ""); err != nil {
+				return fmt.Errorf("invalid origin pattern %s: %w", origin, err)
+			}
+		}
+		s.allowedOrigins = origins
+		return nil
+	}
+}
+
+// WithBasePath serves the documents and well-known files under basePath, for
+// deployments mounted on a subpath such as "/identity".
+func WithBasePath(basePath string) Option {
+	return func(s *Server) error {
+		s.basePath = cleanPrefix(basePath)
+		return nil
+	}
+}
+
+// WithBasePrefix serves the API routes such as /register and /resolve under
+// prefix. Documents and well-known files are still served from the base path.
+func WithBasePrefix(prefix string) Option {
+	return func(s *Server) error {
+		s.apiPrefix = cleanPrefix(prefix)
+		return nil
+	}
+}
+
+// cleanPrefix returns prefix with a single leading slash and no trailing
+// one, or an empty string for the root.
+func cleanPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if len(prefix) == 0 {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// WithMiddleware wraps the server's handler in mw, the first being the
+// outermost. Middleware may respond itself to stop the request.
+func WithMiddleware(mw ...func(http.Handler) http.Handler) Option {
+	return func(s *Server) error {
+		s.middleware = append(s.middleware, mw...)
+		return nil
+	}
+}
+
+// WithMaxPaymentClients sets how many payment streams may wait on the same
+// DID at once, DefaultMaxPaymentClients by default. Further streams are
+// refused with 429 Too Many Requests.
+func WithMaxPaymentClients(n int) Option {
+	return func(s *Server) error {
+		if n < 1 {
+			return fmt.Errorf("max payment clients must be at least 1")
+		}
+		s.maxPaymentClients = n
+		return nil
+	}
+}
+
+// WithMaxChallenges sets how many unused challenges may be outstanding for
+// one DID and in total, DefaultMaxChallengesPerDID and DefaultMaxChallenges
+// by default. Further challenges are refused with 429 Too Many Requests
+// until some are used or expire.
+func WithMaxChallenges(perDID, total int) Option {
+	return func(s *Server) error {
+		if perDID < 1 || total < 1 {
+			return fmt.Errorf("max challenges must be at least 1")
+		}
+		s.maxChallengesPerDID = perDID
+		s.maxChallenges = total
+		return nil
+	}
+}
+
+// DefaultResolveTimeout bounds the resolution of a DID hosted elsewhere
+// unless WithResolveTimeout says otherwise.
+const DefaultResolveTimeout = 10 * time.Second
+
+// WithResolveClient sets the client used to resolve DIDs hosted elsewhere.
+// It is used without the check of the addresses the default client connects
+// to, and keeps its own timeout unless WithResolveTimeout is also given.
+func WithResolveClient(client *http.Client) Option {
+	return func(s *Server) error {
+		if client == nil {
+			return fmt.Errorf("resolve client required")
+		}
+		s.client = client
+		return nil
+	}
+}
+
+// WithHTTPClient sets the client used to resolve DIDs hosted elsewhere.
+//
+// Deprecated: use WithResolveClient.
+func WithHTTPClient(client *http.Client) Option {
+	return WithResolveClient(client)
+}
+
+// WithResolveTimeout bounds the resolution of a DID hosted elsewhere,
+// DefaultResolveTimeout by default.
+func WithResolveTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout <= 0 {
+			return fmt.Errorf("resolve timeout must be positive")
+		}
+		s.resolveTimeout = timeout
+		return nil
+	}
+}
+
+// WithRouter lets fn add routes to the built-in router, e.g. to serve a web
+// UI next to the API. It has no effect together with WithHandler.
+func WithRouter(fn func(r *mux.Router)) Option {
+	return func(s *Server) error {
+		s.routerFuncs = append(s.routerFuncs, fn)
+		return nil
+	}
+}
+
+// WithCustomRouter mounts the server's routes on r, an existing router of
+// the embedding application, instead of a router of its own. Routes r
+// already has take precedence. It cannot be combined with WithHandler.
+func WithCustomRouter(r *mux.Router) Option {
+	return func(s *Server) error {
+		if r == nil {
+			return fmt.Errorf("router required")
+		}
+		s.router = r
+		return nil
+	}
+}
+
+// chain wraps h in mw so that mw[0] runs first.
+func chain(h http.Handler, mw ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
 func WithRegisterStore(store *didstorage.RegisterStore) Option {
 	return func(s *Server) error {
 		s.regStore = store
@@ -177,15 +472,47 @@ func WithRegisterStore(store *didstorage.RegisterStore) Option {
 type Server struct {
 	host      string
 	port      int
-	domain    string
-	store     Store
-	regStore  *didstorage.RegisterStore
-	payBroker *PaymentBroker
-	handler   http.Handler
+	domains   []string
+	basePath  string
+	apiPrefix string
+	adminKey  string
+
+	allowedOrigins    []string
+	allowedPaths      []string
+	blockedPaths      []string
+	trustedProxies    []*net.IPNet
+	middleware        []func(http.Handler) http.Handler
+	routerFuncs       []func(r *mux.Router)
+	router            *mux.Router
+	store             Store
+	stores            map[string]Store
+	regStore          *didstorage.RegisterStore
+	payBroker         *PaymentBroker
+	maxPaymentClients int
+	paymentTransport  string
+	paymentPubSub     subscriber
+	handler           http.Handler
+	client            *http.Client
+	resolveTimeout    time.Duration
+	tlsConfig         *tls.Config
+	accessLog         *log.Logger
+
+	maxChallengesPerDID int
+	maxChallenges       int
+	challenges          *challengeStore
+
+	resolveAllowlist  []hostPattern
+	resolveDenylist   []hostPattern
+	privateResolution bool
+	resolver          func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	startedAt     time.Time
+	storageChecks []*healthCheck
+	providerCheck *healthCheck
 }
 
 func New(opts ...Option) (*Server, error) {
-	s := &Server{}
+	s := &Server{startedAt: time.Now()}
 	for _, opt := range opts {
 		if err := opt(s); err != nil {
 			return s, err
@@ -195,11 +522,31 @@ func New(opts ...Option) (*Server, error) {
 	if s.regStore == nil {
 		return nil, fmt.Errorf("reg store required")
 	}
+	if s.router != nil && s.handler != nil {
+		return nil, fmt.Errorf("WithCustomRouter cannot be combined with WithHandler")
+	}
 
 	// Do some sort of cert check
-	if len(s.domain) == 0 {
+	if len(s.domains) == 0 {
 		return nil, fmt.Errorf("invalid domain")
 	}
+	if s.stores == nil {
+		s.stores = map[string]Store{}
+	}
+	for _, domain := range s.domains {
+		if _, ok := s.stores[domain]; ok {
+			continue
+		}
+		if s.store == nil {
+			return nil, fmt.Errorf("no store for domain %s", domain)
+		}
+		s.stores[domain] = s.store
+	}
+
+	for _, store := range s.distinctStores() {
+		s.storageChecks = append(s.storageChecks, newHealthCheck(storeCheck(store)))
+	}
+	s.providerCheck = newHealthCheck(s.regStore.CheckProvider)
 
 	if s.host == "" {
 		s.host = "0.0.0.0"
@@ -208,41 +555,150 @@ func New(opts ...Option) (*Server, error) {
 	if s.port == 0 {
 		s.port = 8080
 	}
-	s.payBroker = NewBroker()
-	go s.payBroker.Start()
+
+	if s.client == nil {
+		if s.resolveTimeout == 0 {
+			s.resolveTimeout = DefaultResolveTimeout
+		}
+		s.client = s.resolutionClient()
+	} else if s.resolveTimeout > 0 {
+		client := *s.client
+		client.Timeout = s.resolveTimeout
+		s.client = &client
+	}
+	if s.maxChallengesPerDID == 0 {
+		s.maxChallengesPerDID = DefaultMaxChallengesPerDID
+	}
+	if s.maxChallenges == 0 {
+		s.maxChallenges = DefaultMaxChallenges
+	}
+	s.challenges = newChallengeStore(s.maxChallengesPerDID, s.maxChallenges)
+	if s.maxPaymentClients == 0 {
+		s.maxPaymentClients = DefaultMaxPaymentClients
+	}
+	s.payBroker = NewBroker(s.maxPaymentClients)
+	s.payBroker.deadline = s.paymentDeadline
+	if s.paymentPubSub != nil {
+		s.payBroker.pubsub = s.paymentPubSub
+	}
+	if err := s.payBroker.Start(); err != nil {
+		return nil, err
+	}
 	if s.handler == nil {
 		r := mux.NewRouter()
-		r.HandleFunc("/register", s.addCORS(false, s.handleRegister))
-		r.HandleFunc("/paid/{id}", s.addCORS(false, s.handlePaid))
-		r.HandleFunc("/payment/{id}", s.addCORS(false, s.payBroker.WaitForPayment))
-		r.HandleFunc("/resolve/{id}", s.addCORS(false, s.handleResolve)).Methods("GET")
-		r.HandleFunc("/update/{id}", s.addCORS(true, s.handleUpdate)).Methods("POST")
-		r.HandleFunc("/delete/{id}", s.addCORS(true, s.handleDelete)).Methods("DELETE")
-		r.HandleFunc("/health", s.addCORS(true, s.handleHealth)).Methods("GET")
-		r.PathPrefix("/.well-known").HandlerFunc(s.addCORS(false, s.handleWellKnownDir)).Methods("GET")
+		if s.router != nil {
+			r = s.router.NewRoute().Subrouter()
+		}
+		api := r
+		if len(s.apiPrefix) > 0 {
+			api = r.PathPrefix(s.apiPrefix).Subrouter()
+		}
+		r.MethodNotAllowedHandler = methodNotAllowed(r)
+		api.HandleFunc("/register", s.addCORS(false, s.handleRegister)).Methods("POST", "OPTIONS")
+		api.HandleFunc("/paid/{id}", s.addCORS(false, s.handlePaid)).Methods("POST", "OPTIONS")
+		if s.paymentTransport != PaymentTransportWS {
+			api.HandleFunc("/payment/{id}", s.addCORS(false, s.payBroker.WaitForPayment)).Methods("GET", "OPTIONS")
+		}
+		if s.paymentTransport != PaymentTransportSSE {
+			api.HandleFunc("/ws/payment/{id}", s.payBroker.WaitForPaymentWS).Methods("GET")
+		}
+		api.HandleFunc("/resolve/{id}", s.addCORS(false, s.handleResolve)).Methods("GET", "OPTIONS")
+		api.HandleFunc("/1.0/identifiers/{did}", s.addCORS(false, s.handleIdentifiers)).Methods("GET", "OPTIONS")
+		api.HandleFunc("/update/{id}", s.addCORS(true, s.handleUpdate)).Methods("POST", "OPTIONS")
+		api.HandleFunc("/challenge/{id}", s.addCORS(true, s.handleChallenge)).Methods("POST", "OPTIONS")
+		api.HandleFunc("/delete/{id}", s.addCORS(true, s.handleDelete)).Methods("DELETE", "OPTIONS")
+		api.HandleFunc("/admin/dids", s.addCORS(true, s.keyAuthMiddleware(s.handleListDIDs))).Methods("GET", "OPTIONS")
+		api.HandleFunc("/list", s.addCORS(true, s.keyAuthMiddleware(s.handleListDIDs))).Methods("GET", "OPTIONS")
+		api.HandleFunc("/admin/create", s.addCORS(true, s.keyAuthMiddleware(s.handleCreate))).Methods("POST", "OPTIONS")
+		api.HandleFunc("/admin/pending", s.addCORS(true, s.keyAuthMiddleware(s.handleListPending))).Methods("GET", "OPTIONS")
+		api.HandleFunc("/admin/pending/{nonce}", s.addCORS(true, s.keyAuthMiddleware(s.handleDeletePending))).Methods("DELETE", "OPTIONS")
+		api.HandleFunc("/admin/backup", s.addCORS(true, s.keyAuthMiddleware(s.handleBackup))).Methods("POST", "OPTIONS")
+		api.HandleFunc("/health", s.addCORS(true, s.handleHealth)).Methods("GET", "OPTIONS")
+		api.HandleFunc("/ready", s.addCORS(true, s.handleReady)).Methods("GET", "OPTIONS")
+		api.HandleFunc("/openapi.json", s.addCORS(false, s.handleOpenAPI)).Methods("GET", "OPTIONS")
+		api.HandleFunc("/swagger-ui", s.handleSwaggerUI).Methods("GET")
+		r.PathPrefix(s.basePath+"/.well-known").HandlerFunc(s.addCORS(false, s.handleWellKnownDir)).Methods("GET", "OPTIONS")
+		r.PathPrefix(s.basePath+"/").MatcherFunc(isDocumentPath).HandlerFunc(s.addCORS(false, s.handleDefault)).Methods("GET", "OPTIONS")
+		for _, fn := range s.routerFuncs {
+			fn(r)
+		}
 		s.handler = r
 	}
+	if s.accessLog != nil {
+		s.middleware = append([]func(http.Handler) http.Handler{s.accessLogMiddleware}, s.middleware...)
+	}
+	if s.router != nil {
+		// Middleware only wraps the server's own routes, not the application's.
+		for _, mw := range s.middleware {
+			s.handler.(*mux.Router).Use(mw)
+		}
+		s.handler = s.router
+	} else {
+		s.handler = chain(s.handler, s.middleware...)
+	}
 
 	return s, nil
 }
 
+// Start listens on the configured host and port and serves requests.
 func (s *Server) Start() error {
-	return http.ListenAndServe(fmt.Sprintf("%s:%d", s.host, s.port), s.handler)
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.host, s.port))
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ServeHTTP lets the server be mounted in another mux or http.Server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// allowMethods are the methods methodNotAllowed offers in its Allow header.
+var allowMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// methodNotAllowed answers requests whose path matches a route of r but not
+// its method, listing the methods the path does accept.
+func methodNotAllowed(r *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		allowed := []string{}
+		for _, method := range allowMethods {
+			probe := req.Clone(req.Context())
+			probe.Method = method
+			var match mux.RouteMatch
+			if r.Match(probe, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+}
+
+// isDocumentPath matches requests for a did.json document.
+func isDocumentPath(r *http.Request, _ *mux.RouteMatch) bool {
+	return strings.HasSuffix(r.URL.Path, "/did.json")
 }
 
 func (s *Server) handleWellKnownDir(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Well Known: %s\n", r.URL.Path)
-	if strings.EqualFold(r.URL.Path, ".well-known/nostr.json") {
+	log.Printf("Well Known: %s from %s\n", r.URL.Path, s.realIP(r))
+	switch strings.ToLower(strings.TrimPrefix(r.URL.Path, s.basePath)) {
+	case "/.well-known/nostr.json":
 		s.handleWellKnownNostr(w, r)
 		return
+	case "/.well-known/did.json":
+		s.handleDefault(w, r)
+		return
 	}
-	//TODO DID well-knowns
 
 	w.WriteHeader(http.StatusNotImplemented)
 }
 
 type NostrWellKnown struct {
-	Names map[string]string
+	Names map[string]string `json:"names"`
 }
 
 func (s *Server) handleWellKnownNostr(w http.ResponseWriter, r *http.Request) {
@@ -252,25 +708,23 @@ func (s *Server) handleWellKnownNostr(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	doc, err := s.store.Resolve(fmt.Sprintf("%s:%s", s.domain, name))
-	if err != nil {
+	domain := s.requestDomain(r)
+	// Deactivated DIDs no longer vouch for a nostr key.
+	doc, deactivated, err := resolveCurrent(s.stores[domain], fmt.Sprintf("%s:%s", domain, name))
+	if err != nil || deactivated {
 		s.jsonSuccess(w, NostrWellKnown{Names: map[string]string{}})
 		return
 	}
 
 	for _, vm := range doc.VerificationMethod {
-		if strings.EqualFold(vm.Type.String(), "SchnorrSecp256k1VerificationKey2019") && strings.Contains(strings.ToLower(vm.ID), "nostr") {
-			enc, data, err := multibase.Decode(vm.PublicKeyMultibase)
+		if strings.EqualFold(vm.Type.String(), didweb.SchnorrSecp256k1VerificationKey2019.String()) && strings.Contains(strings.ToLower(vm.ID), "nostr") {
+			pubKey, err := nostrPubKey(vm.PublicKeyMultibase)
 			if err != nil {
 				s.jsonSuccess(w, NostrWellKnown{Names: map[string]string{}})
 				return
 			}
-			if enc != multibase.Base16 {
-				s.jsonSuccess(w, NostrWellKnown{Names: map[string]string{}})
-				return
-			}
 			s.jsonSuccess(w, NostrWellKnown{Names: map[string]string{
-				name: fmt.Sprintf("%x", data),
+				name: hex.EncodeToString(pubKey),
 			}})
 			return
 		}
@@ -279,22 +733,93 @@ func (s *Server) handleWellKnownNostr(w http.ResponseWriter, r *http.Request) {
 	s.jsonSuccess(w, NostrWellKnown{Names: map[string]string{}})
 }
 
+// nostrPubKey decodes a multibase secp256k1 key in any encoding into the
+// 32-byte x-only form nostr uses. Compressed and uncompressed keys are
+// accepted, with or without a multicodec prefix.
+func nostrPubKey(publicKeyMultibase string) ([]byte, error) {
+	_, data, err := multibase.Decode(publicKeyMultibase)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode key: %w", err)
+	}
+	if codec, n, err := varint.FromUvarint(data); err == nil && codec == uint64(did.SECP256k1MultiCodec) && len(data)-n == secp256k1.PubKeyBytesLenCompressed {
+		data = data[n:]
+	}
+	switch len(data) {
+	case 32:
+		return data, nil
+	case secp256k1.PubKeyBytesLenCompressed, secp256k1.PubKeyBytesLenUncompressed:
+		pubKey, err := secp256k1.ParsePubKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse key: %w", err)
+		}
+		return pubKey.SerializeCompressed()[1:], nil
+	default:
+		return nil, fmt.Errorf("invalid key length %d", len(data))
+	}
+}
+
 func (s *Server) handleDefault(w http.ResponseWriter, r *http.Request) {
-	path := fmt.Sprintf("%s/%s", url.QueryEscape(r.Host), r.URL.Path)
-	url, err := didweb.ParsePath(path)
+	path := fmt.Sprintf("%s%s", url.QueryEscape(r.Host), r.URL.Path)
+	url, err := didweb.ParsePathWithBase(path, s.basePath)
 	if err != nil {
 		s.errorResponse(w, 404, "not found")
 		return
 	}
-	doc, err := s.store.Resolve(url.ID())
+	store, ok := s.storeFor(url.RawHost())
+	if !ok {
+		s.errorResponse(w, 404, "not found")
+		return
+	}
+	doc, deactivated, err := resolveCurrent(store, localID(url))
 	if err != nil {
-		fmt.Printf("could not resolve %s: %s\n", url.ID(), err.Error())
+		fmt.Printf("could not resolve %s: %s\n", localID(url), err.Error())
 		s.errorResponse(w, 404, "not found")
 		return
+	} else if deactivated {
+		s.errorResponse(w, 410, "deactivated")
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	contentType, ok := negotiate(r.Header.Get("Accept"), documentTypes)
+	if !ok {
+		s.errorResponse(w, 406, fmt.Sprintf("document is available as %s", strings.Join(documentTypes, ", ")))
+		return
 	}
-	s.jsonSuccess(w, doc)
+	if contentType == didLDJSONType && doc.Context == nil {
+		// JSON-LD needs the context the plain JSON form may leave out.
+		withContext := *doc
+		withContext.Context = []string{did.KnownDIDContext}
+		doc = &withContext
+	}
+	bytes, err := json.Marshal(doc)
+	if err != nil {
+		s.errorResponse(w, 500, fmt.Sprintf("could not parse reponse: %s", err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
 }
 
+// paymentDeadline returns when the invoice of the pending registration for
+// the DID id expires.
+func (s *Server) paymentDeadline(id string) (time.Time, bool) {
+	registration, err := s.regStore.PendingFor(id)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return registration.ExpiresAt, true
+}
+
+// IdempotencyKeyHeader lets clients retry a registration without creating
+// another invoice.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// WebhookSignatureHeader carries the hex encoded HMAC-SHA256 of the payment
+// webhook body, checked when the register store has a shared webhook secret.
+const WebhookSignatureHeader = "X-Webhook-Signature"
+
 type PayInfo struct {
 	PaymentHash string `json:"payment_hash"`
 	Amount      int    `json:"amount"`
@@ -308,25 +833,47 @@ func (s *Server) handlePaid(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	doc, err := s.regStore.Paid(id)
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		s.errorResponse(w, 401, "unauthorized")
+		fmt.Printf("invalid body: %s\n", err.Error())
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		fmt.Printf("invalid body: %s\n", err.Error())
+	token := r.URL.Query().Get(didstorage.WebhookTokenParam)
+	if err := s.regStore.VerifyWebhook(id, token, body, r.Header.Get(WebhookSignatureHeader)); err != nil {
+		s.errorResponse(w, 401, "unauthorized")
 		return
 	}
 
 	var info PayInfo
 	if err := json.Unmarshal(body, &info); err != nil {
 		fmt.Printf("could not get payment info: %s\n", err.Error())
+		s.errorResponse(w, 400, "invalid request")
+		return
+	}
+
+	// The webhook only says the invoice was paid, so check with the provider.
+	if paid, err := s.regStore.IsPaid(id); err != nil {
+		log.Printf("could not confirm payment: %s\n", err.Error())
+		s.errorResponse(w, 502, "could not confirm payment")
+		return
+	} else if !paid {
+		s.errorResponse(w, 402, "invoice not paid")
 		return
 	}
 
-	if err := s.store.Register(doc); err != nil {
+	doc, err := s.regStore.Paid(id)
+	if err != nil {
+		s.errorResponse(w, 401, "unauthorized")
+		return
+	}
+
+	store, ok := s.storeForDID(doc.ID)
+	if !ok {
+		s.errorResponse(w, 400, "domain is not hosted here")
+		return
+	}
+	if err := store.Register(doc); err != nil {
 		s.errorResponse(w, 500, fmt.Sprintf("could not register: %s", err.Error()))
 		return
 	}
@@ -334,7 +881,19 @@ func (s *Server) handlePaid(w http.ResponseWriter, r *http.Request) {
 	go s.payBroker.BroadcastPayment(doc.ID)
 	s.jsonSuccess(w, "ok")
 }
-func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+
+// handleReady reports whether the store is usable, without the write round
+// trip and payment provider check of handleHealth.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	for _, store := range s.distinctStores() {
+		if pinger, ok := store.(didstorage.Pinger); ok {
+			if err := pinger.Ping(); err != nil {
+				log.Printf("store not ready: %s\n", err.Error())
+				s.errorResponse(w, http.StatusServiceUnavailable, "store unavailable")
+				return
+			}
+		}
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
@@ -363,9 +922,61 @@ func (s *Server) jsonSuccess(w http.ResponseWriter, response any) {
 	w.Write(bytes)
 }
 
+// tracerName names the tracer request spans are recorded with. Spans are
+// dropped unless a global tracer provider has been set.
+const tracerName = "github.com/13x-tech/go-did-web/pkg/server"
+
+// statusRecorder remembers the status code and size of a response. It
+// flushes through to the underlying writer so event streams keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands over the connection, e.g. for a WebSocket upgrade.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer(tracerName).Start(r.Context(), "server.Register", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.register(recorder, r.WithContext(ctx))
+	span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+	if recorder.status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(recorder.status))
+	}
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		w.WriteHeader(http.StatusNotFound)
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -374,37 +985,70 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		s.errorResponse(w, 500, "could not get boxy")
 		return
 	}
-	var input RegisterRequest
-	if err := json.Unmarshal(body, &input); err != nil {
-		s.errorResponse(w, 400, "invalid request")
+	input, fields := decodeRegisterRequest(body)
+	if len(fields) > 0 {
+		s.validationError(w, fields)
 		return
 	}
 
-	parts := strings.Split(input.ID, ":")
+	domain := s.requestDomain(r)
+	id := localID(input.ID)
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("did.id", input.ID.DID()))
+	parts := strings.Split(id, ":")
 	if len(parts) < 2 {
-		s.errorResponse(w, 400, fmt.Sprintf("id must be in the format of %s:sally, where sally is the name you're registering", s.domain))
+		s.errorResponse(w, 400, fmt.Sprintf("id must be in the format of %s:sally, where sally is the name you're registering", domain))
 		return
 	}
-	if parts[0] != s.domain {
-		s.errorResponse(w, 400, fmt.Sprintf("invalid domain must be in the form if %s:sally, where sally is the name you're reistering", s.domain))
+	store, ok := s.storeFor(parts[0])
+	if !ok || (s.hosts(hostDomain(r)) && !strings.EqualFold(parts[0], domain)) {
+		s.errorResponse(w, 400, fmt.Sprintf("invalid domain must be in the form if %s:sally, where sally is the name you're reistering", domain))
+		return
+	}
+	if !s.pathAllowed(strings.Join(parts[1:], ":")) {
+		s.errorResponse(w, 403, "registration is not allowed at this path")
 		return
 	}
 
-	if doc, err := s.store.Resolve(input.ID); err == nil && doc != nil {
+	if _, err := store.Resolve(id); err == nil {
 		s.errorResponse(w, 400, "did exists")
 		return
+	} else if !errors.Is(err, didstorage.ErrorNotFound) {
+		s.errorResponse(w, 500, fmt.Sprintf("could not check did: %s", err.Error()))
+		return
 	}
 
-	doc, err := didstorage.DIDFromProps(input.ID, input.Keys, input.Services)
-	if err != nil {
+	doc, err := didstorage.BuildDocument(id, input.Keys, input.Services,
+		didstorage.WithAlsoKnownAs(input.AlsoKnownAs),
+		didstorage.WithController(input.Controller),
+	)
+	if errors.Is(err, didstorage.ErrorInvalidService) || errors.Is(err, didstorage.ErrorInvalidAlsoKnownAs) || errors.Is(err, didstorage.ErrorInvalidController) || errors.Is(err, didstorage.ErrorInvalidKey) {
+		s.errorResponse(w, 400, err.Error())
+		return
+	} else if err != nil {
 		s.errorResponse(w, 500, fmt.Sprintf("could not register: %s", err.Error()))
 		return
 	}
 
-	if payReq, ok := s.regStore.Get(doc); ok {
-		s.jsonSuccess(w, payReq)
+	// Preview returns the assembled document without creating an invoice.
+	if preview, _ := strconv.ParseBool(r.URL.Query().Get("preview")); preview {
+		s.jsonSuccess(w, doc)
+		return
+	}
+
+	if key := r.Header.Get(IdempotencyKeyHeader); len(key) > 0 {
+		paymentRequest, err := s.regStore.RegisterIdempotentContext(r.Context(), key, doc)
+		if errors.Is(err, didstorage.ErrorIdempotencyKeyReused) {
+			s.errorResponse(w, 422, err.Error())
+			return
+		} else if err != nil {
+			s.errorResponse(w, 500, fmt.Sprintf("could not get payment request: %s", err.Error()))
+			return
+		}
+		s.jsonSuccess(w, paymentRequest.PaymentRequest)
+	} else if pending, ok := s.regStore.Get(doc); ok {
+		s.jsonSuccess(w, pending.PaymentRequest)
 	} else {
-		paymentRequest, err := s.regStore.Register(doc)
+		paymentRequest, err := s.regStore.RegisterContext(r.Context(), doc)
 		if err != nil {
 			s.errorResponse(w, 500, fmt.Sprintf("could not get payment request: %s", err.Error()))
 			return
@@ -414,7 +1058,7 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleResolve(w http.ResponseWriter, r *http.Request) {
-	pathParts := strings.Split(r.RequestURI, "/")
+	pathParts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), s.apiPrefix), "/")
 	if len(pathParts) < 3 {
 		s.errorResponse(w, 400, "invalid")
 		return
@@ -430,13 +1074,58 @@ func (s *Server) handleResolve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if strings.EqualFold(url.RawHost(), s.domain) {
-		if doc, err := s.store.Resolve(url.ID()); err == nil {
+	versionID := r.URL.Query().Get("versionId")
+	var versionTime time.Time
+	if raw := r.URL.Query().Get("versionTime"); len(raw) > 0 {
+		if len(versionID) > 0 {
+			s.errorResponse(w, 400, "versionId and versionTime cannot be combined")
+			return
+		}
+		if versionTime, err = time.Parse(time.RFC3339, raw); err != nil {
+			s.errorResponse(w, 400, "invalid versionTime")
+			return
+		}
+	}
+
+	if _, ok := s.storeFor(url.RawHost()); !ok {
+		if err := s.checkResolveHost(r.Context(), url); err != nil {
+			s.errorResponse(w, 403, err.Error())
+			return
+		}
+	}
+
+	if store, ok := s.storeFor(url.RawHost()); ok {
+		if len(versionID) > 0 {
+			if doc, err := store.ResolveVersion(localID(url), versionID); err == nil {
+				s.jsonSuccess(w, doc)
+				return
+			}
+		} else if !versionTime.IsZero() {
+			if doc, err := store.ResolveVersionTime(localID(url), versionTime); err == nil {
+				s.jsonSuccess(w, doc)
+				return
+			}
+		} else if doc, deactivated, err := resolveCurrent(store, localID(url)); err == nil {
+			if deactivated {
+				s.errorResponse(w, 410, "deactivated")
+				return
+			}
 			s.jsonSuccess(w, doc)
 			return
+		} else if !errors.Is(err, didstorage.ErrorNotFound) {
+			s.errorResponse(w, 500, fmt.Sprintf("could not resolve: %s", err.Error()))
+			return
+		}
+	} else if len(versionID) > 0 {
+		s.errorResponse(w, 400, "versionId is only supported for local dids")
+		return
+	} else if !versionTime.IsZero() {
+		if _, err := didweb.ResolveVersionTime(url.DID(), versionTime, s.client); errors.Is(err, didweb.ErrUnsupported) {
+			s.errorResponse(w, 400, "versionTime is only supported for local dids")
+			return
 		}
 	} else {
-		if doc, err := didweb.Resolve(url.DID(), http.DefaultClient); err == nil {
+		if doc, err := didweb.ResolveContext(r.Context(), url.DID(), s.client); err == nil {
 			s.jsonSuccess(w, doc)
 			return
 		}
@@ -447,12 +1136,10 @@ func (s *Server) handleResolve(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {}
 
-func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {}
-
 func (s *Server) keyAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		keys, ok := r.Header["X-Api-Key"]
-		if !ok || len(keys) == 0 {
+		key := requestAPIKey(r)
+		if len(key) == 0 || len(s.adminKey) == 0 || subtle.ConstantTimeCompare([]byte(key), []byte(s.adminKey)) != 1 {
 			s.errorResponse(w, 401, "unauthorized")
 			return
 		}
@@ -461,25 +1148,79 @@ func (s *Server) keyAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
+// requestAPIKey returns the key from the X-Api-Key header, falling back to an
+// Authorization bearer token.
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); len(key) > 0 {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return ""
+}
+
 func (s *Server) addCORS(limited bool, next http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if limited {
-			w.Header().Set("Access-Control-Allow-Origin", s.domain)
-		} else {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-		}
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
+	return chain(next, s.corsMiddleware(limited)).ServeHTTP
+}
+
+// corsMiddleware sets the CORS headers and answers preflight requests. Limited
+// routes only allow the server's own domain unless the origin is allowlisted.
+func (s *Server) corsMiddleware(limited bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); len(origin) > 0 && s.originAllowed(origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			} else if limited {
+				w.Header().Set("Access-Control-Allow-Origin", s.requestDomain(r))
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Api-Key, Proof")
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// originAllowed reports whether origin matches an entry of the allowlist.
+// "*" allows every origin. Other entries may use * as a wildcard in the host,
+// e.g. "https://*.example.com", and match any scheme when they have none.
+func (s *Server) originAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	scheme, host, ok := strings.Cut(origin, "://")
+	for _, allowed := range s.allowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
 		}
-		next.ServeHTTP(w, r)
-	})
+		if !ok {
+			continue
+		}
+		allowedScheme, allowedHost, hasScheme := strings.Cut(allowed, "://")
+		if !hasScheme {
+			allowedScheme, allowedHost = scheme, allowed
+		}
+		if allowedScheme != scheme {
+			continue
+		}
+		if match, _ := path.Match(allowedHost, host); match {
+			return true
+		}
+	}
+	return false
 }
 
 type RegisterRequest struct {
-	ID       string                `json:"id"`
-	Keys     []didstorage.KeyInput `json:"keys"`
-	Services []did.Service         `json:"services"`
+	ID          didweb.DIDWebURL      `json:"id"`
+	Keys        []didstorage.KeyInput `json:"keys"`
+	Services    []did.Service         `json:"services"`
+	AlsoKnownAs []string              `json:"alsoKnownAs,omitempty"`
+	Controller  string                `json:"controller,omitempty"`
 }
@@ -0,0 +1,2632 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/storage"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/13x-tech/go-did-web/pkg/storage/memstorage"
+	"github.com/TBD54566975/ssi-sdk/crypto"
+	"github.com/TBD54566975/ssi-sdk/crypto/jwx"
+	"github.com/TBD54566975/ssi-sdk/cryptosuite"
+	"github.com/TBD54566975/ssi-sdk/did"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-varint"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeLNBits serves the LNBits payment creation endpoint, issuing a new
+// invoice for every request, and the payment status endpoint, reporting every
+// invoice but the unpaid ones as paid.
+func newFakeLNBits(t *testing.T, unpaid ...string) *httptest.Server {
+	var mu sync.Mutex
+	invoices := 0
+	lnbits := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			hash := strings.TrimPrefix(r.URL.Path, "/api/v1/payments/")
+			paid := true
+			for _, u := range unpaid {
+				paid = paid && u != hash
+			}
+			json.NewEncoder(w).Encode(map[string]bool{"paid": paid})
+			return
+		}
+		mu.Lock()
+		invoices++
+		n := invoices
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(didstorage.PaymentResponse{
+			PaymentHash:    fmt.Sprintf("hash%d", n),
+			PaymentRequest: fmt.Sprintf("lnbc%d", n),
+		})
+	}))
+	t.Cleanup(lnbits.Close)
+	return lnbits
+}
+
+func newTestServer(t *testing.T, opts ...Option) *Server {
+	dir := t.TempDir()
+	store, err := NewStore("example.com", dir, "did")
+	assert.NoError(t, err)
+	regStorage, err := storage.New(dir, "reg")
+	assert.NoError(t, err)
+	lnbits := newFakeLNBits(t)
+	regStore, err := didstorage.NewRegisterStore(
+		strings.TrimPrefix(lnbits.URL, "https://"), "key", regStorage,
+		didstorage.WithHTTPClient(lnbits.Client()),
+	)
+	assert.NoError(t, err)
+
+	opts = append([]Option{
+		WithDomain("example.com"),
+		WithStore(store),
+		WithRegisterStore(regStore),
+	}, opts...)
+	s, err := New(opts...)
+	assert.NoError(t, err)
+	return s
+}
+
+func testDocument(t *testing.T, id string, keyIDs ...string) *didweb.Document {
+	keys := []didstorage.KeyInput{}
+	for _, keyID := range keyIDs {
+		keys = append(keys, didstorage.KeyInput{
+			Purposes: []string{"assertionMethod"},
+			VerificationMethod: did.VerificationMethod{
+				ID:                 keyID,
+				Type:               cryptosuite.Ed25519VerificationKey2018,
+				PublicKeyMultibase: "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK",
+			},
+		})
+	}
+	doc, err := didstorage.DIDFromProps(id, keys, nil)
+	assert.NoError(t, err)
+	return doc
+}
+
+func doRequest(s *Server, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func TestResolveVersion(t *testing.T) {
+	s := newTestServer(t)
+	assert.NoError(t, s.store.Register(testDocument(t, "example.com:alice", "key-1")))
+	assert.NoError(t, s.store.Register(testDocument(t, "example.com:alice", "key-1", "key-2")))
+
+	tt := []struct {
+		target  string
+		code    int
+		numKeys int
+	}{
+		{"/resolve/did:web:example.com:alice", http.StatusOK, 2},
+		{"/resolve/did:web:example.com:alice?versionId=1", http.StatusOK, 1},
+		{"/resolve/did:web:example.com:alice?versionId=2", http.StatusOK, 2},
+		{"/resolve/did:web:example.com:alice?versionId=3", http.StatusNotFound, 0},
+		{"/resolve/did:web:other.org:alice?versionId=1", http.StatusBadRequest, 0},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.target, func(t *testing.T) {
+			w := doRequest(s, http.MethodGet, tc.target)
+			assert.Equal(t, tc.code, w.Code)
+			if tc.code != http.StatusOK {
+				return
+			}
+			var doc didweb.Document
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+			assert.Equal(t, "did:web:example.com:alice", doc.ID)
+			assert.Len(t, doc.VerificationMethod, tc.numKeys)
+		})
+	}
+}
+
+func TestListDIDs(t *testing.T) {
+	s := newTestServer(t, WithAdminKey("secret"))
+	for _, name := range []string{"alice", "bob", "carol"} {
+		assert.NoError(t, s.store.Register(testDocument(t, "example.com:"+name, "key-1")))
+	}
+
+	list := func(target string) ListDIDsResponse {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Api-Key", "secret")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response ListDIDsResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	all := list("/admin/dids")
+	assert.Equal(t, 3, all.Total)
+	assert.ElementsMatch(t, []string{
+		"did:web:example.com:alice",
+		"did:web:example.com:bob",
+		"did:web:example.com:carol",
+	}, all.DIDs)
+	assert.Empty(t, all.Cursor)
+
+	first := list("/admin/dids?limit=2")
+	assert.Len(t, first.DIDs, 2)
+	assert.Equal(t, 3, first.Total)
+	assert.NotEmpty(t, first.Cursor)
+
+	second := list("/admin/dids?limit=2&cursor=" + first.Cursor)
+	assert.Len(t, second.DIDs, 1)
+	assert.Empty(t, second.Cursor)
+	assert.ElementsMatch(t, all.DIDs, append(first.DIDs, second.DIDs...))
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(s, http.MethodGet, "/admin/dids").Code)
+}
+
+func TestListPrefix(t *testing.T) {
+	s := newTestServer(t, WithAdminKey("secret"))
+	for _, name := range []string{"alice", "users:bob", "users:carol", "users:dave"} {
+		assert.NoError(t, s.store.Register(testDocument(t, "example.com:"+name, "key-1")))
+	}
+
+	list := func(target string) ListDIDsResponse {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Api-Key", "secret")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response ListDIDsResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	first := list("https://example.com/list?prefix=users&limit=2")
+	assert.Equal(t, []string{"did:web:example.com:users:bob", "did:web:example.com:users:carol"}, first.DIDs)
+	assert.Equal(t, 3, first.Total)
+	assert.NotEmpty(t, first.Cursor)
+
+	second := list("https://example.com/list?prefix=users&limit=2&cursor=" + first.Cursor)
+	assert.Equal(t, []string{"did:web:example.com:users:dave"}, second.DIDs)
+	assert.Empty(t, second.Cursor)
+
+	all := list("https://example.com/list")
+	assert.Equal(t, 4, all.Total)
+	assert.Len(t, all.DIDs, 4)
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(s, http.MethodGet, "/list").Code)
+}
+
+func TestCountDIDs(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"alice", "users:bob", "users:carol", "users:bob"} {
+		assert.NoError(t, s.store.Register(testDocument(t, "example.com:"+name, "key-1")))
+	}
+	assert.NoError(t, s.store.(deactivator).Deactivate("example.com:users:carol"))
+
+	// countingStore hides Count, so it is counted a page at a time.
+	for _, store := range []Store{s.store, &countingStore{Store: s.store}} {
+		total, err := countDIDs(store, "")
+		assert.NoError(t, err)
+		assert.Equal(t, 3, total)
+		total, err = countDIDs(store, "example.com:users:")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, total)
+	}
+}
+
+func TestPendingEndpoints(t *testing.T) {
+	s := newTestServer(t, WithAdminKey("secret"))
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-Api-Key", "secret")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodGet, "/admin/pending")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, "[]", w.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/admin/pending/abc").Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(s, http.MethodGet, "/admin/pending").Code)
+}
+
+func TestKeyAuthMiddleware(t *testing.T) {
+	s := newTestServer(t, WithAdminKey("secret"))
+	handler := s.keyAuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tt := []struct {
+		name   string
+		header string
+		value  string
+		code   int
+	}{
+		{"canonical api key", "X-Api-Key", "secret", http.StatusOK},
+		{"lowercase api key", "x-api-key", "secret", http.StatusOK},
+		{"bearer token", "Authorization", "Bearer secret", http.StatusOK},
+		{"lowercase bearer", "Authorization", "bearer secret", http.StatusOK},
+		{"missing", "", "", http.StatusUnauthorized},
+		{"wrong api key", "X-Api-Key", "secreT", http.StatusUnauthorized},
+		{"prefix of key", "X-Api-Key", "secre", http.StatusUnauthorized},
+		{"wrong bearer", "Authorization", "Bearer nope", http.StatusUnauthorized},
+		{"basic auth", "Authorization", "Basic secret", http.StatusUnauthorized},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if len(tc.header) > 0 {
+				req.Header.Set(tc.header, tc.value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, tc.code, w.Code)
+		})
+	}
+}
+
+func TestKeyAuthMiddlewareNoAdminKey(t *testing.T) {
+	s := newTestServer(t)
+	handler := s.keyAuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Api-Key", "")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRegisterPreview(t *testing.T) {
+	s := newTestServer(t)
+
+	body := `{
+		"id": "example.com:alice",
+		"keys": [{
+			"purposes": ["assertionMethod", "authentication"],
+			"verificationMethod": {
+				"id": "key-1",
+				"type": "Ed25519VerificationKey2018",
+				"publicKeyMultibase": "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"
+			}
+		}]
+	}`
+	req := httptest.NewRequest(http.MethodPost, "/register?preview=true", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var doc didweb.Document
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, "did:web:example.com:alice", doc.ID)
+	assert.Len(t, doc.VerificationMethod, 1)
+	assert.Equal(t, "did:web:example.com:alice", doc.VerificationMethod[0].Controller)
+	assert.Len(t, doc.AssertionMethod, 1)
+	assert.Len(t, doc.Authentication, 1)
+
+	pending, err := s.regStore.Pending()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+	_, err = s.store.Resolve("example.com:alice")
+	assert.Error(t, err)
+
+	req = httptest.NewRequest(http.MethodPost, "/register?preview=true", strings.NewReader(`{"id": "example.com:alice", "keys": []}`))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.NotEqual(t, http.StatusOK, w.Code)
+}
+
+func TestRegisterValidation(t *testing.T) {
+	s := newTestServer(t)
+	tt := []struct {
+		name   string
+		body   string
+		fields []FieldError
+	}{
+		{"not an object", `[]`, []FieldError{{"", "body must be a JSON object"}}},
+		{"empty", `{}`, []FieldError{{"id", "required"}, {"keys", "at least one key is required"}}},
+		{"wrong types", `{"id": 1, "keys": {}, "controller": []}`, []FieldError{
+			{"id", "must be a string"},
+			{"keys", "must be an array"},
+			{"controller", "must be a string"},
+		}},
+		{"invalid id", `{"id": "did:key:z6Mk", "keys": []}`, []FieldError{
+			{"id", "must be a did:web or its method specific id, e.g. example.com:alice"},
+			{"keys", "at least one key is required"},
+		}},
+		{"unknown purposes", `{"id": "example.com:alice", "keys": [
+			{"purposes": ["assertionMethod", "signing"], "publicKeyMultibase": "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"},
+			{"purposes": ["encrypting"], "publicKeyMultibase": "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"}
+		]}`, []FieldError{
+			{"keys[0].purposes[1]", `unknown purpose "signing"`},
+			{"keys[1].purposes[0]", `unknown purpose "encrypting"`},
+		}},
+		{"key without material", `{"id": "example.com:alice", "keys": [
+			{"purposes": ["assertionMethod"], "verificationMethod": {"id": "key-1", "type": "Ed25519VerificationKey2018"}},
+			{"purposes": "assertionMethod"}
+		]}`, []FieldError{
+			{"keys[0]", "publicKeyMultibase or publicKeyJwk required"},
+			{"keys[1]", "invalid key: purposes has the wrong type"},
+		}},
+		{"invalid service", `{"id": "example.com:alice", "keys": [
+			{"purposes": ["assertionMethod"], "publicKeyMultibase": "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"}
+		], "services": [{"id": "#hub", "type": "Hub"}]}`, []FieldError{
+			{"services[0]", "service '#hub' has invalid endpoint URL: missing serviceEndpoint"},
+		}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp ValidationErrorResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "invalid request", resp.Error)
+			assert.Equal(t, tc.fields, resp.Fields)
+		})
+	}
+}
+
+func TestRegisterMultibaseShorthand(t *testing.T) {
+	s := newTestServer(t)
+	body := `{
+		"id": "example.com:alice",
+		"keys": [{
+			"purposes": ["assertionMethod"],
+			"publicKeyMultibase": "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"
+		}]
+	}`
+	req := httptest.NewRequest(http.MethodPost, "/register?preview=true", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var doc didweb.Document
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Len(t, doc.VerificationMethod, 1)
+	assert.Equal(t, cryptosuite.Ed25519VerificationKey2020, doc.VerificationMethod[0].Type)
+	assert.Equal(t, "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK", doc.VerificationMethod[0].PublicKeyMultibase)
+
+	req = httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	body = `{"id": "example.com:bob", "keys": [{"purposes": ["assertionMethod"], "publicKeyMultibase": "z0not-a-key"}]}`
+	req = httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+const testRegisterBody = `{
+	"id": "example.com:alice",
+	"keys": [{
+		"purposes": ["assertionMethod"],
+		"verificationMethod": {
+			"id": "key-1",
+			"type": "Ed25519VerificationKey2018",
+			"publicKeyMultibase": "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"
+		}
+	}]
+}`
+
+// registerPending registers alice through the API and returns the nonce of
+// the resulting pending registration.
+func registerPending(t *testing.T, s *Server) string {
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(testRegisterBody))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	pending, err := s.regStore.Pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	return pending[0].Nonce
+}
+
+// paidTarget returns the webhook URL the payment provider was given for the
+// pending registration nonce.
+func paidTarget(t *testing.T, s *Server, nonce string) string {
+	secret, err := s.regStore.WebhookSecret(nonce)
+	assert.NoError(t, err)
+	return fmt.Sprintf("/paid/%s?%s=%x", nonce, didstorage.WebhookTokenParam, secret)
+}
+
+func TestPaidWebhookToken(t *testing.T) {
+	s := newTestServer(t)
+	nonce := registerPending(t, s)
+	target := paidTarget(t, s, nonce)
+
+	body := []byte(`{"payment_hash":"hash1","amount":69}`)
+	paid := func(target string) int {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(string(body)))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, paid("/paid/"+nonce))
+	assert.Equal(t, http.StatusUnauthorized, paid(fmt.Sprintf("/paid/%s?%s=%s", nonce, didstorage.WebhookTokenParam, strings.Repeat("00", 32))))
+	_, err := s.store.Resolve("example.com:alice")
+	assert.Error(t, err)
+
+	assert.Equal(t, http.StatusOK, paid(target))
+	doc, err := s.store.Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "did:web:example.com:alice", doc.ID)
+
+	assert.Equal(t, http.StatusUnauthorized, paid(target))
+}
+
+func TestPaidSharedWebhookSecret(t *testing.T) {
+	regStorage, err := storage.New(t.TempDir(), "reg")
+	assert.NoError(t, err)
+	lnbits := newFakeLNBits(t, "hash2")
+	regStore, err := didstorage.NewRegisterStore(
+		strings.TrimPrefix(lnbits.URL, "https://"), "key", regStorage,
+		didstorage.WithHTTPClient(lnbits.Client()),
+		didstorage.WithWebhookSecret("shared"),
+	)
+	assert.NoError(t, err)
+	s := newTestServer(t, WithRegisterStore(regStore))
+
+	sign := func(secret string, body []byte) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	paid := func(nonce string, body []byte, signature string) int {
+		req := httptest.NewRequest(http.MethodPost, "/paid/"+nonce, strings.NewReader(string(body)))
+		req.Header.Set(WebhookSignatureHeader, signature)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// alice's invoice, hash1, is paid.
+	alice := registerPending(t, s)
+	body := []byte(`{"payment_hash":"hash1","amount":69}`)
+	assert.Equal(t, http.StatusUnauthorized, paid(alice, body, sign("wrong", body)))
+	assert.Equal(t, http.StatusOK, paid(alice, body, sign("shared", body)))
+	_, err = s.store.Resolve("example.com:alice")
+	assert.NoError(t, err)
+
+	// bob's invoice, hash2, is not paid even though the webhook says so.
+	bobBody := strings.Replace(testRegisterBody, `"example.com:alice"`, `"example.com:bob"`, 1)
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(bobBody))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	registration, err := s.regStore.PendingFor("did:web:example.com:bob")
+	assert.NoError(t, err)
+	assert.Equal(t, "hash2", registration.PaymentHash)
+
+	body = []byte(`{"payment_hash":"hash2","amount":69}`)
+	assert.Equal(t, http.StatusPaymentRequired, paid(registration.Nonce, body, sign("shared", body)))
+	_, err = s.store.Resolve("example.com:bob")
+	assert.Error(t, err)
+}
+
+type sseEvent struct {
+	id      string
+	event   string
+	data    string
+	comment string
+}
+
+// readEvent reads the next server-sent event or comment from the stream.
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return e
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) == 0 {
+			return e
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "":
+			e.comment = value
+		case "id":
+			e.id = value
+		case "event":
+			e.event = value
+		case "data":
+			e.data = value
+		}
+	}
+}
+
+func TestPaymentStreamEvents(t *testing.T) {
+	s := newTestServer(t)
+	s.payBroker.keepAlive = 20 * time.Millisecond
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	id := "did:web:example.com:alice"
+	resp, err := http.Get(srv.URL + "/payment/" + id)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	stream := bufio.NewReader(resp.Body)
+	connected := readEvent(t, stream)
+	assert.Equal(t, "connected", connected.event)
+	assert.Equal(t, id, connected.data)
+	assert.NotEmpty(t, connected.id)
+
+	assert.Equal(t, "keep-alive", readEvent(t, stream).comment)
+
+	go s.payBroker.BroadcastPayment(id)
+	for {
+		e := readEvent(t, stream)
+		if len(e.comment) > 0 {
+			continue
+		}
+		assert.Equal(t, "paid", e.event)
+		assert.Equal(t, id, e.data)
+		assert.NotEqual(t, connected.id, e.id)
+		break
+	}
+}
+
+func TestBroadcastPaymentClosesStreams(t *testing.T) {
+	s := newTestServer(t)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	id := "did:web:example.com:alice"
+	resp, err := http.Get(srv.URL + "/payment/" + id)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	stream := bufio.NewReader(resp.Body)
+	assert.Equal(t, "connected", readEvent(t, stream).event)
+
+	s.payBroker.BroadcastPayment(id)
+	assert.Equal(t, "paid", readEvent(t, stream).event)
+
+	_, err = stream.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF)
+
+	s.payBroker.mu.RLock()
+	_, ok := s.payBroker.clients[id]
+	s.payBroker.mu.RUnlock()
+	assert.False(t, ok)
+}
+
+func TestPaymentStreamMaxClients(t *testing.T) {
+	s := newTestServer(t, WithMaxPaymentClients(2))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	id := "did:web:example.com:alice"
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(srv.URL + "/payment/" + id)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "connected", readEvent(t, bufio.NewReader(resp.Body)).event)
+	}
+
+	resp, err := http.Get(srv.URL + "/payment/" + id)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	other, err := http.Get(srv.URL + "/payment/did:web:example.com:bob")
+	assert.NoError(t, err)
+	defer other.Body.Close()
+	assert.Equal(t, http.StatusOK, other.StatusCode)
+
+	_, err = New(WithMaxPaymentClients(0))
+	assert.Error(t, err)
+}
+
+func TestBroadcastPaymentClosesChannels(t *testing.T) {
+	b := NewBroker(2)
+	assert.NoError(t, b.Start())
+	id := "did:web:example.com:alice"
+	first, err := b.subscribe(id)
+	assert.NoError(t, err)
+	second, err := b.subscribe(id)
+	assert.NoError(t, err)
+	_, err = b.subscribe(id)
+	assert.ErrorIs(t, err, errTooManyClients)
+
+	b.BroadcastPayment(id)
+	for _, c := range []chan []byte{first, second} {
+		assert.Equal(t, paidMessage, <-c)
+		_, ok := <-c
+		assert.False(t, ok)
+	}
+	assert.Empty(t, b.clients)
+
+	// The DID's slots are free again once its clients are closed.
+	c, err := b.subscribe(id)
+	assert.NoError(t, err)
+	b.unsubscribe(id, c)
+}
+
+func TestPaymentWebSocket(t *testing.T) {
+	logs := make(lineWriter, 4)
+	s := newTestServer(t, WithAccessLog(log.New(logs, "", 0)))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	id := "did:web:example.com:alice"
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/payment/"+id, nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	_, msg, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "connected", string(msg))
+
+	s.payBroker.BroadcastPayment(id)
+	_, msg, err = conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "paid", string(msg))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+
+	select {
+	case line := <-logs:
+		assert.Contains(t, line, "status=101")
+	case <-time.After(time.Second):
+		t.Fatal("upgrade not logged")
+	}
+}
+
+// lineWriter passes each write on to a reader in another goroutine.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestWithPaymentTransport(t *testing.T) {
+	tt := []struct {
+		transport string
+		sse       bool
+		ws        bool
+	}{
+		{"", true, true},
+		{PaymentTransportBoth, true, true},
+		{PaymentTransportSSE, true, false},
+		{PaymentTransportWS, false, true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.transport, func(t *testing.T) {
+			opts := []Option{}
+			if len(tc.transport) > 0 {
+				opts = append(opts, WithPaymentTransport(tc.transport))
+			}
+			s := newTestServer(t, opts...)
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + "/payment/did:web:example.com:alice")
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tc.sse, resp.StatusCode == http.StatusOK)
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/payment/did:web:example.com:alice", nil)
+			if tc.ws {
+				assert.NoError(t, err)
+				conn.Close()
+			} else {
+				assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+			}
+		})
+	}
+
+	_, err := New(WithPaymentTransport("poll"))
+	assert.Error(t, err)
+}
+
+func TestSubscribers(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	remote, err := newRedisSubscriber(redisServer.Addr())
+	assert.NoError(t, err)
+
+	for name, pubsub := range map[string]subscriber{"local": newLocalSubscriber(), "redis": remote} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			paid := make(chan string, 1)
+			assert.NoError(t, pubsub.Subscribe(ctx, func(id string) { paid <- id }))
+
+			assert.NoError(t, pubsub.Publish(context.Background(), "did:web:example.com:alice"))
+			select {
+			case id := <-paid:
+				assert.Equal(t, "did:web:example.com:alice", id)
+			case <-time.After(time.Second):
+				t.Fatal("payment not received")
+			}
+
+			// Nothing is delivered once the subscription ends.
+			cancel()
+			assert.Eventually(t, func() bool {
+				assert.NoError(t, pubsub.Publish(context.Background(), "did:web:example.com:bob"))
+				select {
+				case <-paid:
+					return false
+				case <-time.After(20 * time.Millisecond):
+					return true
+				}
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestRedisPaymentBroker(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	waiting := newTestServer(t, WithRedisPaymentBroker(redisServer.Addr()))
+	webhook := newTestServer(t, WithRedisPaymentBroker("redis://"+redisServer.Addr()+"/0"))
+	srv := httptest.NewServer(waiting)
+	defer srv.Close()
+
+	id := "did:web:example.com:alice"
+	resp, err := http.Get(srv.URL + "/payment/" + id)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	stream := bufio.NewReader(resp.Body)
+	assert.Equal(t, "connected", readEvent(t, stream).event)
+
+	webhook.payBroker.BroadcastPayment(id)
+	assert.Equal(t, "paid", readEvent(t, stream).event)
+	_, err = stream.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF)
+
+	_, err = New(WithRedisPaymentBroker(""))
+	assert.Error(t, err)
+	addr := redisServer.Addr()
+	redisServer.Close()
+	_, err = New(WithRedisPaymentBroker(addr))
+	assert.Error(t, err)
+}
+
+func TestPaymentStreamDisconnectCleansUp(t *testing.T) {
+	s := newTestServer(t)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	id := "did:web:example.com:alice"
+	resp, err := http.Get(srv.URL + "/payment/" + id)
+	assert.NoError(t, err)
+	assert.Equal(t, "connected", readEvent(t, bufio.NewReader(resp.Body)).event)
+	resp.Body.Close()
+
+	assert.Eventually(t, func() bool {
+		s.payBroker.mu.RLock()
+		defer s.payBroker.mu.RUnlock()
+		_, ok := s.payBroker.clients[id]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBrokerStalledClient(t *testing.T) {
+	s := newTestServer(t)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	id := "did:web:example.com:alice"
+	stalled, err := s.payBroker.subscribe(id)
+	assert.NoError(t, err)
+	defer s.payBroker.unsubscribe(id, stalled)
+
+	resp, err := http.Get(srv.URL + "/payment/" + id)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	stream := bufio.NewReader(resp.Body)
+	assert.Equal(t, "connected", readEvent(t, stream).event)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < clientBuffer*2; i++ {
+			s.payBroker.messages <- Message{id: id, message: []byte("pending")}
+		}
+		s.payBroker.BroadcastPayment(id)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broker blocked on a stalled client")
+	}
+
+	received := 0
+	for {
+		e := readEvent(t, stream)
+		if e.event == "paid" {
+			break
+		}
+		assert.Equal(t, "pending", e.event)
+		received++
+	}
+	assert.Greater(t, received, 0)
+	assert.Len(t, stalled, clientBuffer)
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	s := newTestServer(t, WithAllowedOrigins([]string{"https://app.example.org", "https://*.example.net"}))
+
+	tt := []struct {
+		name     string
+		method   string
+		target   string
+		origin   string
+		expected string
+		code     int
+	}{
+		{"allowed limited", http.MethodGet, "/health", "https://app.example.org", "https://app.example.org", http.StatusOK},
+		{"wildcard limited", http.MethodGet, "/health", "https://spa.example.net", "https://spa.example.net", http.StatusOK},
+		{"disallowed limited", http.MethodGet, "/health", "https://evil.com", "example.com", http.StatusOK},
+		{"disallowed public", http.MethodGet, "/resolve/did:web:example.com:nobody", "https://evil.com", "*", http.StatusNotFound},
+		{"allowed public", http.MethodGet, "/resolve/did:web:example.com:nobody", "https://app.example.org", "https://app.example.org", http.StatusNotFound},
+		{"no origin public", http.MethodGet, "/resolve/did:web:example.com:nobody", "", "*", http.StatusNotFound},
+		{"allowed preflight", http.MethodOptions, "/admin/dids", "https://app.example.org", "https://app.example.org", http.StatusNoContent},
+		{"disallowed preflight", http.MethodOptions, "/admin/dids", "https://evil.com", "example.com", http.StatusNoContent},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, nil)
+			if len(tc.origin) > 0 {
+				req.Header.Set("Origin", tc.origin)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			assert.Equal(t, tc.code, w.Code)
+			assert.Equal(t, tc.expected, w.Header().Get("Access-Control-Allow-Origin"))
+			assert.Equal(t, "Origin", w.Header().Get("Vary"))
+		})
+	}
+
+	// "*" allows every origin, even on the limited routes.
+	s = newTestServer(t, WithAllowedOrigins([]string{"*"}))
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("Origin", "https://anywhere.example")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, "https://anywhere.example", w.Header().Get("Access-Control-Allow-Origin"))
+
+	_, err := New(WithAllowedOrigins([]string{"https://[.example.com"}))
+	assert.Error(t, err)
+}
+
+func TestOriginAllowed(t *testing.T) {
+	tt := []struct {
+		allowed []string
+		origin  string
+		ok      bool
+	}{
+		{[]string{"*"}, "https://app.example.org", true},
+		{[]string{"*"}, "http://localhost:3000", true},
+		{[]string{"https://*.example.net"}, "https://spa.example.net", true},
+		{[]string{"https://*.example.net"}, "http://spa.example.net", false},
+		{[]string{"https://*.example.net"}, "https://example.net", false},
+		{[]string{"https://*"}, "https://evil.com", true},
+		{[]string{"https://*"}, "http://evil.com", false},
+		{[]string{"*.example.net"}, "http://spa.example.net", true},
+		{[]string{"https://app.example.org"}, "HTTPS://APP.EXAMPLE.ORG", true},
+		{[]string{"https://app.example.org"}, "https://app.example.org.evil.com", false},
+		{[]string{"http://localhost:*"}, "http://localhost:3000", true},
+		{nil, "https://app.example.org", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(fmt.Sprintf("%v %s", tc.allowed, tc.origin), func(t *testing.T) {
+			s := &Server{allowedOrigins: tc.allowed}
+			assert.Equal(t, tc.ok, s.originAllowed(tc.origin))
+		})
+	}
+}
+
+func TestAdminCreate(t *testing.T) {
+	s := newTestServer(t, WithAdminKey("secret"))
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/create", strings.NewReader(body))
+		req.Header.Set("X-Api-Key", "secret")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, keyType := range []string{"", "P-256", "P-384", "secp256k1"} {
+		t.Run("key type "+keyType, func(t *testing.T) {
+			name := "user" + strings.ReplaceAll(keyType, "-", "")
+			w := create(fmt.Sprintf(`{"id": "example.com:%s", "keyType": %q}`, name, keyType))
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var response CreateResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, "did:web:example.com:"+name, response.DID)
+			assert.NotEmpty(t, response.PrivateKeyJWK.D)
+
+			resolved := doRequest(s, http.MethodGet, "/resolve/"+response.DID)
+			assert.Equal(t, http.StatusOK, resolved.Code)
+			var doc didweb.Document
+			assert.NoError(t, json.Unmarshal(resolved.Body.Bytes(), &doc))
+			assert.Len(t, doc.VerificationMethod, 1)
+			docKey, err := did.GetKeyFromVerificationMethod(doc.Document, doc.VerificationMethod[0].ID)
+			assert.NoError(t, err)
+			if keyType == "secp256k1" {
+				assert.Equal(t, "EcdsaSecp256k1VerificationKey2019", doc.VerificationMethod[0].Type.String())
+				docKeyBytes, err := crypto.PubKeyToBytes(docKey)
+				assert.NoError(t, err)
+				assert.Equal(t, response.PrivateKeyJWK.X, base64.RawURLEncoding.EncodeToString(docKeyBytes[1:]))
+				return
+			}
+			docJWK, err := jwx.PublicKeyToPublicKeyJWK("", docKey)
+			assert.NoError(t, err)
+			assert.Equal(t, response.PrivateKeyJWK.X, docJWK.X)
+		})
+	}
+
+	assert.Equal(t, http.StatusBadRequest, create(`{"id": "example.com:user"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, create(`{"id": "other.org:bob"}`).Code)
+
+	w := create(`{"id": "Example.COM:alice"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response CreateResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "did:web:example.com:alice", response.DID)
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "https://example.com/alice/did.json").Code)
+	assert.Equal(t, http.StatusBadRequest, create(`{"id": "example.com:alice"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, create(`{"id": "example.com:bob", "keyType": "nope"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(s, http.MethodPost, "/admin/create").Code)
+}
+
+func TestBasePathDocuments(t *testing.T) {
+	s := newTestServer(t, WithBasePath("/identity/"))
+	assert.NoError(t, s.store.Register(testDocument(t, "example.com", "key-1")))
+	assert.NoError(t, s.store.Register(testDocument(t, "example.com:alice", "key-1")))
+
+	tt := []struct {
+		target string
+		code   int
+		id     string
+	}{
+		{"https://example.com/identity/alice/did.json", http.StatusOK, "did:web:example.com:alice"},
+		{"https://example.com/identity/.well-known/did.json", http.StatusOK, "did:web:example.com"},
+		{"https://example.com/identity/bob/did.json", http.StatusNotFound, ""},
+		{"https://example.com/alice/did.json", http.StatusNotFound, ""},
+		{"https://example.com/.well-known/did.json", http.StatusNotFound, ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.target, func(t *testing.T) {
+			w := doRequest(s, http.MethodGet, tc.target)
+			assert.Equal(t, tc.code, w.Code)
+			if tc.code != http.StatusOK {
+				return
+			}
+			var doc didweb.Document
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+			assert.Equal(t, tc.id, doc.ID)
+
+			u, err := didweb.Parse(doc.ID)
+			assert.NoError(t, err)
+			u.BasePath = "/identity"
+			assert.Equal(t, tc.target, u.URLString())
+		})
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	s := newTestServer(t)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/health")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// failingStore is a Store whose storage can no longer be used.
+type failingStore struct {
+	Store
+}
+
+func (failingStore) Ping() error {
+	return fmt.Errorf("disk full")
+}
+
+func TestReady(t *testing.T) {
+	s := newTestServer(t)
+	w := doRequest(s, http.MethodGet, "/ready")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	s = newTestServer(t, WithStore(failingStore{s.store}))
+	w = doRequest(s, http.MethodGet, "/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"error":"store unavailable"}`, w.Body.String())
+
+	w = doRequest(s, http.MethodGet, "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+// providerStore returns a RegisterStore whose payment provider answers the
+// wallet check with code, or cannot be reached when code is 0.
+func providerStore(t *testing.T, code int) *didstorage.RegisterStore {
+	lnbits := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(lnbits.Close)
+	if code == 0 {
+		lnbits.Close()
+	}
+	regStorage, err := storage.New(t.TempDir(), "reg")
+	assert.NoError(t, err)
+	regStore, err := didstorage.NewRegisterStore(
+		strings.TrimPrefix(lnbits.URL, "https://"), "key", regStorage,
+		didstorage.WithHTTPClient(lnbits.Client()),
+	)
+	assert.NoError(t, err)
+	return regStore
+}
+
+func TestHealth(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     func(s *Server) []Option
+		code     int
+		status   string
+		storage  string
+		provider string
+	}{
+		{
+			name:     "ok",
+			opts:     func(s *Server) []Option { return nil },
+			code:     http.StatusOK,
+			status:   "ok",
+			storage:  "ok",
+			provider: "ok",
+		},
+		{
+			name: "provider error",
+			opts: func(s *Server) []Option {
+				return []Option{WithRegisterStore(providerStore(t, http.StatusInternalServerError))}
+			},
+			code:     http.StatusOK,
+			status:   "degraded",
+			storage:  "ok",
+			provider: "degraded",
+		},
+		{
+			name: "provider unreachable",
+			opts: func(s *Server) []Option {
+				return []Option{WithRegisterStore(providerStore(t, 0))}
+			},
+			code:     http.StatusServiceUnavailable,
+			status:   "unhealthy",
+			storage:  "ok",
+			provider: "unhealthy",
+		},
+		{
+			name: "storage unavailable",
+			opts: func(s *Server) []Option {
+				return []Option{WithStore(failingStore{s.store})}
+			},
+			code:     http.StatusServiceUnavailable,
+			status:   "unhealthy",
+			storage:  "unhealthy",
+			provider: "ok",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s = newTestServer(t, test.opts(s)...)
+			w := doRequest(s, http.MethodGet, "/health")
+			assert.Equal(t, test.code, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+			var resp HealthResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, test.status, resp.Status)
+			if assert.NotNil(t, resp.Storage) && assert.NotNil(t, resp.PaymentProvider) {
+				assert.Equal(t, test.storage, resp.Storage.Status)
+				assert.NotNil(t, resp.Storage.LatencyMS)
+				assert.Equal(t, test.provider, resp.PaymentProvider.Status)
+			}
+		})
+	}
+}
+
+func TestHealthCheckShared(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	check := newHealthCheck(func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	})
+
+	// Requests that give up on a hanging check do not start another.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := check.run(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, time.Millisecond)
+	for i := 0; i < 5; i++ {
+		_, err := check.run(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	close(release)
+	_, err = check.run(context.Background())
+	assert.NoError(t, err)
+	// A recent result is reused.
+	_, err = check.run(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+// brokenStore is a Store whose reads fail.
+type brokenStore struct {
+	Store
+}
+
+func (brokenStore) Resolve(id string) (*didweb.Document, error) {
+	return nil, fmt.Errorf("disk error")
+}
+
+func TestStoreErrors(t *testing.T) {
+	s := newTestServer(t)
+	w := doRequest(s, http.MethodGet, "/resolve/did:web:example.com:nobody")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	s = newTestServer(t, WithStore(brokenStore{s.store}))
+	w = doRequest(s, http.MethodGet, "/resolve/did:web:example.com:nobody")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(testRegisterBody))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestBasePrefix(t *testing.T) {
+	s := newTestServer(t, WithBasePrefix("/did-web/"))
+	assert.NoError(t, s.store.Register(testDocument(t, "example.com", "key-1")))
+
+	tt := []struct {
+		target string
+		code   int
+	}{
+		{"https://example.com/.well-known/did.json", http.StatusOK},
+		{"/did-web/resolve/did:web:example.com", http.StatusOK},
+		{"/did-web/health", http.StatusOK},
+		{"/resolve/did:web:example.com", http.StatusNotFound},
+		{"/did-web/.well-known/did.json", http.StatusNotFound},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.target, func(t *testing.T) {
+			w := doRequest(s, http.MethodGet, tc.target)
+			assert.Equal(t, tc.code, w.Code)
+		})
+	}
+}
+
+func TestWithMiddleware(t *testing.T) {
+	order := []string{}
+	record := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	deny := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Deny") != "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	s := newTestServer(t, WithMiddleware(record("first"), record("second"), deny))
+
+	w := doRequest(s, http.MethodGet, "/health")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"ok"`)
+	assert.Equal(t, []string{"first", "second"}, order)
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("X-Deny", "1")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestWithAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestServer(t, WithAccessLog(log.New(&buf, "", 0)))
+
+	w := doRequest(s, http.MethodGet, "/resolve/did:web:example.com:nobody")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	line := buf.String()
+	assert.Equal(t, 1, strings.Count(line, "\n"))
+	assert.Contains(t, line, `method=GET path="/resolve/did:web:example.com:nobody" status=404 `)
+	assert.Contains(t, line, fmt.Sprintf(" bytes=%d ", w.Body.Len()))
+	assert.Contains(t, line, " remote=192.0.2.1 ")
+	assert.Contains(t, line, " latency=")
+
+	// Event streams are flushed through the access log.
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/payment/did:web:example.com:alice")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "connected", readEvent(t, bufio.NewReader(resp.Body)).event)
+}
+
+func TestResolveVersionTime(t *testing.T) {
+	s := newTestServer(t)
+	assert.NoError(t, s.store.Register(testDocument(t, "example.com:alice", "key-1")))
+	assert.NoError(t, s.store.Register(testDocument(t, "example.com:alice", "key-1", "key-2")))
+
+	past := url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339))
+	future := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	tt := []struct {
+		target  string
+		code    int
+		numKeys int
+	}{
+		{"/resolve/did:web:example.com:alice?versionTime=" + future, http.StatusOK, 2},
+		{"/resolve/did:web:example.com:alice?versionTime=" + past, http.StatusNotFound, 0},
+		{"/resolve/did:web:example.com:alice?versionTime=yesterday", http.StatusBadRequest, 0},
+		{"/resolve/did:web:example.com:alice?versionId=1&versionTime=" + future, http.StatusBadRequest, 0},
+		{"/resolve/did:web:other.org:alice?versionTime=" + future, http.StatusBadRequest, 0},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.target, func(t *testing.T) {
+			w := doRequest(s, http.MethodGet, tc.target)
+			assert.Equal(t, tc.code, w.Code)
+			if tc.code != http.StatusOK {
+				return
+			}
+			var doc didweb.Document
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+			assert.Len(t, doc.VerificationMethod, tc.numKeys)
+		})
+	}
+}
+
+func TestMultipleDomains(t *testing.T) {
+	orgStore, err := NewStore("example.org", t.TempDir(), "did")
+	assert.NoError(t, err)
+	s := newTestServer(t, WithDomains("example.com", "Example.org"), WithDomainStore("example.org", orgStore))
+	assert.NoError(t, s.store.Register(testDocument(t, "example.com:alice", "key-1")))
+	assert.NoError(t, orgStore.Register(testDocument(t, "example.org:bob", "key-1")))
+
+	tt := []struct {
+		target string
+		code   int
+	}{
+		{"https://example.com/alice/did.json", http.StatusOK},
+		{"https://example.org/bob/did.json", http.StatusOK},
+		{"https://example.com/bob/did.json", http.StatusNotFound},
+		{"https://example.org/alice/did.json", http.StatusNotFound},
+		{"https://example.net/alice/did.json", http.StatusNotFound},
+		{"/resolve/did:web:example.org:bob", http.StatusOK},
+	}
+	for _, tc := range tt {
+		t.Run(tc.target, func(t *testing.T) {
+			assert.Equal(t, tc.code, doRequest(s, http.MethodGet, tc.target).Code)
+		})
+	}
+
+	register := []struct {
+		host string
+		id   string
+		code int
+	}{
+		{"example.org", "example.org:carol", http.StatusOK},
+		{"example.com", "example.com:carol", http.StatusOK},
+		{"api.example.net", "example.org:carol", http.StatusOK},
+		{"example.org", "example.com:carol", http.StatusBadRequest},
+		{"example.org", "example.net:carol", http.StatusBadRequest},
+	}
+	for _, tc := range register {
+		t.Run(tc.host+" "+tc.id, func(t *testing.T) {
+			body := strings.Replace(testRegisterBody, "example.com:alice", tc.id, 1)
+			req := httptest.NewRequest(http.MethodPost, "https://"+tc.host+"/register?preview=true", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			assert.Equal(t, tc.code, w.Code)
+		})
+	}
+}
+
+func TestMultipleDomainsPaidRegistration(t *testing.T) {
+	orgStore, err := NewStore("example.org", t.TempDir(), "did")
+	assert.NoError(t, err)
+	s := newTestServer(t, WithDomains("example.com", "example.org"), WithDomainStore("example.org", orgStore))
+
+	// The same name registers separately under each domain.
+	for i, host := range []string{"example.org", "example.com"} {
+		id := host + ":carol"
+		body := strings.Replace(testRegisterBody, "example.com:alice", id, 1)
+		req := httptest.NewRequest(http.MethodPost, "https://"+host+"/register", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		pending, err := s.regStore.PendingFor("did:web:" + id)
+		assert.NoError(t, err)
+		paid := []byte(fmt.Sprintf(`{"payment_hash":%q,"amount":69}`, pending.PaymentHash))
+		req = httptest.NewRequest(http.MethodPost, paidTarget(t, s, pending.Nonce), bytes.NewReader(paid))
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "registration %d", i)
+	}
+
+	_, err = orgStore.Resolve("example.org:carol")
+	assert.NoError(t, err)
+	_, err = orgStore.Resolve("example.com:carol")
+	assert.ErrorIs(t, err, didstorage.ErrorNotFound)
+	_, err = s.store.Resolve("example.com:carol")
+	assert.NoError(t, err)
+	_, err = s.store.Resolve("example.org:carol")
+	assert.ErrorIs(t, err, didstorage.ErrorNotFound)
+
+	for _, host := range []string{"example.org", "example.com"} {
+		w := doRequest(s, http.MethodGet, "https://"+host+"/carol/did.json")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var doc didweb.Document
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+		assert.Equal(t, "did:web:"+host+":carol", doc.ID)
+
+		// Either domain resolves the other's DIDs locally.
+		other := "example.com"
+		if host == other {
+			other = "example.org"
+		}
+		w = doRequest(s, http.MethodGet, "https://"+other+"/1.0/identifiers/did:web:"+host+":carol")
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = doRequest(s, http.MethodGet, "https://"+other+"/resolve/did:web:"+host+":carol")
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+}
+
+func TestNewDomainValidation(t *testing.T) {
+	s := newTestServer(t)
+
+	_, err := New(WithRegisterStore(s.regStore), WithStore(s.store))
+	assert.Error(t, err)
+
+	_, err = New(WithRegisterStore(s.regStore), WithDomains("example.com", "example.org"), WithDomainStore("example.com", s.store))
+	assert.Error(t, err)
+
+	_, err = New(WithRegisterStore(s.regStore), WithDomains("example.com", "example.org"), WithStore(s.store))
+	assert.NoError(t, err)
+}
+
+func TestWithRouter(t *testing.T) {
+	s := newTestServer(t, WithRouter(func(r *mux.Router) {
+		r.HandleFunc("/ui", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ui"))
+		}).Methods("GET")
+	}))
+
+	w := doRequest(s, http.MethodGet, "/ui")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ui", w.Body.String())
+
+	w = doRequest(s, http.MethodGet, "/health")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"ok"`)
+}
+
+func TestWithCustomRouter(t *testing.T) {
+	text := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}
+	}
+	app := mux.NewRouter()
+	app.HandleFunc("/before", text("before")).Methods("GET")
+	app.HandleFunc("/health", text("app health")).Methods("GET")
+	s := newTestServer(t, WithCustomRouter(app))
+	app.HandleFunc("/after", text("after")).Methods("GET")
+	app.HandleFunc("/ready", text("app ready")).Methods("GET")
+
+	for _, handler := range []http.Handler{app, s} {
+		for path, body := range map[string]string{
+			"/before": "before",
+			"/after":  "after",
+			// The application's routes are not shadowed by the server's.
+			"/health": "app health",
+			// Routes added afterwards only match what the server does not.
+			"/ready": "ok",
+		} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code, path)
+			assert.Equal(t, body, w.Body.String(), path)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(testRegisterBody))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Body.String(), `"lnbc`))
+}
+
+func TestWithCustomRouterAndHandler(t *testing.T) {
+	_, err := New(
+		WithRegisterStore(&didstorage.RegisterStore{}),
+		WithCustomRouter(mux.NewRouter()),
+		WithHandler(http.NotFoundHandler()),
+	)
+	assert.Error(t, err)
+}
+
+func TestPaymentStreamExpired(t *testing.T) {
+	regStorage, err := storage.New(t.TempDir(), "reg")
+	assert.NoError(t, err)
+	lnbits := newFakeLNBits(t)
+	regStore, err := didstorage.NewRegisterStore(
+		strings.TrimPrefix(lnbits.URL, "https://"), "key", regStorage,
+		didstorage.WithHTTPClient(lnbits.Client()),
+		didstorage.WithExpiry(1),
+	)
+	assert.NoError(t, err)
+	s := newTestServer(t, WithRegisterStore(regStore))
+	registerPending(t, s)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	id := "did:web:example.com:alice"
+	resp, err := http.Get(srv.URL + "/payment/" + id)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	stream := bufio.NewReader(resp.Body)
+	assert.Equal(t, "connected", readEvent(t, stream).event)
+	for {
+		e := readEvent(t, stream)
+		if len(e.comment) > 0 {
+			continue
+		}
+		assert.Equal(t, "expired", e.event)
+		assert.Equal(t, id, e.data)
+		break
+	}
+
+	_, err = stream.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestRegisterInvalidID(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, id := range []string{`"did:key:z6Mk"`, `""`, `"example.com"`, `null`} {
+		t.Run(id, func(t *testing.T) {
+			body := strings.Replace(testRegisterBody, `"example.com:alice"`, id, 1)
+			req := httptest.NewRequest(http.MethodPost, "/register?preview=true", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+
+	body := strings.Replace(testRegisterBody, `"example.com:alice"`, `"did:web:example.com:alice"`, 1)
+	req := httptest.NewRequest(http.MethodPost, "/register?preview=true", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDomainNormalization(t *testing.T) {
+	tt := []struct {
+		domain    string
+		expected  string
+		expectErr bool
+	}{
+		{"example.com", "example.com", false},
+		{"Example.COM", "example.com", false},
+		{"https://example.com/", "example.com", false},
+		{"http://Example.com", "example.com", false},
+		{" example.com/ ", "example.com", false},
+		{"localhost:8080", "localhost%3A8080", false},
+		{"localhost%3A8080", "localhost%3A8080", false},
+		{"", "", true},
+		{"https://", "", true},
+		{"example.com/alice", "", true},
+		{"exa mple.com", "", true},
+		{"user@example.com", "", true},
+		{"example.com:port", "", true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.domain, func(t *testing.T) {
+			domain, err := normalizeDomain(tc.domain)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, domain)
+		})
+	}
+}
+
+func TestMessyDomainResolution(t *testing.T) {
+	for _, domain := range []string{"https://Example.COM/", "EXAMPLE.com"} {
+		t.Run(domain, func(t *testing.T) {
+			s := newTestServer(t, WithDomains(domain))
+			assert.NoError(t, s.store.Register(testDocument(t, "example.com:alice", "key-1")))
+
+			assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/resolve/did:web:example.com:alice").Code)
+			assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/resolve/did:web:Example.com:alice").Code)
+			assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "https://EXAMPLE.com/alice/did.json").Code)
+		})
+	}
+
+	s := newTestServer(t, WithDomains("localhost:8080"))
+	assert.NoError(t, s.store.Register(testDocument(t, "localhost%3A8080:alice", "key-1")))
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/resolve/did:web:localhost%3A8080:alice").Code)
+	assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "https://localhost:8080/alice/did.json").Code)
+
+	_, err := New(WithRegisterStore(s.regStore), WithStore(s.store), WithDomains("https://example.com/alice"))
+	assert.Error(t, err)
+}
+
+func TestDocumentContentNegotiation(t *testing.T) {
+	s := newTestServer(t)
+	alice := testDocument(t, "example.com:alice", "key-1")
+	alice.Context = nil
+	assert.NoError(t, s.store.Register(alice))
+
+	tt := []struct {
+		accept      string
+		code        int
+		contentType string
+	}{
+		{"", http.StatusOK, "application/did+json"},
+		{"*/*", http.StatusOK, "application/did+json"},
+		{"application/*", http.StatusOK, "application/did+json"},
+		{"application/did+json", http.StatusOK, "application/did+json"},
+		{"application/did+ld+json", http.StatusOK, "application/did+ld+json"},
+		{"application/json", http.StatusOK, "application/json"},
+		{"application/did+json;q=0.5, application/did+ld+json;q=0.9", http.StatusOK, "application/did+ld+json"},
+		{"text/html, */*;q=0.1", http.StatusOK, "application/did+json"},
+		{"text/html", http.StatusNotAcceptable, ""},
+		{"application/did+json;q=0", http.StatusNotAcceptable, ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "https://example.com/alice/did.json", nil)
+			if len(tc.accept) > 0 {
+				req.Header.Set("Accept", tc.accept)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			assert.Equal(t, tc.code, w.Code)
+			assert.Contains(t, w.Header().Values("Vary"), "Accept")
+			if tc.code != http.StatusOK {
+				return
+			}
+			assert.Equal(t, tc.contentType, w.Header().Get("Content-Type"))
+
+			var doc map[string]any
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+			assert.Equal(t, "did:web:example.com:alice", doc["id"])
+			if tc.contentType == "application/did+ld+json" {
+				assert.Equal(t, []any{did.KnownDIDContext}, doc["@context"])
+			} else {
+				assert.NotContains(t, doc, "@context")
+			}
+		})
+	}
+}
+
+func TestResolveTimeout(t *testing.T) {
+	release := make(chan struct{})
+	remote := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer remote.Close()
+	defer close(release)
+	remoteHost := url.QueryEscape(strings.TrimPrefix(remote.URL, "https://"))
+
+	s := newTestServer(t)
+	assert.Equal(t, DefaultResolveTimeout, s.client.Timeout)
+
+	s = newTestServer(t,
+		WithResolveClient(remote.Client()),
+		WithResolveTimeout(100*time.Millisecond),
+		WithResolveAllowlist([]string{"127.0.0.1"}),
+	)
+	assert.Equal(t, 100*time.Millisecond, s.client.Timeout)
+	assert.Zero(t, remote.Client().Timeout)
+
+	start := time.Now()
+	w := doRequest(s, http.MethodGet, "/resolve/did:web:"+remoteHost+":slow")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	_, err := New(WithResolveTimeout(0))
+	assert.Error(t, err)
+	_, err = New(WithResolveClient(nil))
+	assert.Error(t, err)
+}
+
+func TestUniversalResolverIdentifiers(t *testing.T) {
+	remote := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bob/did.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"id":"did:web:%s:bob"}`, url.QueryEscape(r.Host))
+	}))
+	defer remote.Close()
+	remoteHost := url.QueryEscape(strings.TrimPrefix(remote.URL, "https://"))
+
+	s := newTestServer(t, WithResolveClient(remote.Client()), WithResolveAllowlist([]string{"127.0.0.1"}))
+	assert.NoError(t, s.store.Register(testDocument(t, "example.com:alice", "key-1")))
+	assert.NoError(t, s.store.Register(testDocument(t, "example.com:alice", "key-1", "key-2")))
+
+	tt := []struct {
+		name    string
+		did     string
+		code    int
+		id      string
+		version string
+		err     string
+	}{
+		{"local", "did:web:example.com:alice", http.StatusOK, "did:web:example.com:alice", "2", ""},
+		{"escaped", "did%3Aweb%3Aexample.com%3Aalice", http.StatusOK, "did:web:example.com:alice", "2", ""},
+		{"remote", "did:web:" + remoteHost + ":bob", http.StatusOK, "did:web:" + remoteHost + ":bob", "", ""},
+		{"local missing", "did:web:example.com:nobody", http.StatusNotFound, "", "", "notFound"},
+		{"remote missing", "did:web:" + remoteHost + ":nobody", http.StatusNotFound, "", "", "notFound"},
+		{"invalid", "did:key:z6Mk", http.StatusBadRequest, "", "", "invalidDid"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := doRequest(s, http.MethodGet, "/1.0/identifiers/"+tc.did)
+			assert.Equal(t, tc.code, w.Code)
+			assert.Equal(t, `application/ld+json;profile="https://w3id.org/did-resolution"`, w.Header().Get("Content-Type"))
+
+			var result struct {
+				Context            string                     `json:"@context"`
+				DIDDocument        *didweb.Document           `json:"didDocument"`
+				ResolutionMetadata map[string]string          `json:"didResolutionMetadata"`
+				DocumentMetadata   map[string]json.RawMessage `json:"didDocumentMetadata"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+			assert.Equal(t, "https://w3id.org/did-resolution/v1", result.Context)
+			assert.NotNil(t, result.DocumentMetadata)
+			if len(tc.err) > 0 {
+				assert.Nil(t, result.DIDDocument)
+				assert.Equal(t, tc.err, result.ResolutionMetadata["error"])
+				return
+			}
+			assert.Equal(t, tc.id, result.DIDDocument.ID)
+			assert.Equal(t, "application/did+ld+json", result.ResolutionMetadata["contentType"])
+			if len(tc.version) > 0 {
+				assert.JSONEq(t, `"`+tc.version+`"`, string(result.DocumentMetadata["versionId"]))
+				assert.Contains(t, result.DocumentMetadata, "created")
+				assert.Contains(t, result.DocumentMetadata, "updated")
+			}
+		})
+	}
+}
+
+func TestResolvePolicy(t *testing.T) {
+	remote := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"did:web:%s:bob"}`, url.QueryEscape(r.Host))
+	}))
+	defer remote.Close()
+	remoteHost := url.QueryEscape(strings.TrimPrefix(remote.URL, "https://"))
+	lookup := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "internal.test":
+			return []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}}, nil
+		case "public.test":
+			return []net.IPAddr{{IP: net.ParseIP("203.0.113.7")}}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	tt := []struct {
+		name string
+		opts []Option
+		did  string
+		code int
+	}{
+		{"loopback", nil, "did:web:" + remoteHost + ":bob", http.StatusForbidden},
+		{"allowed ip", []Option{WithResolveAllowlist([]string{"127.0.0.1"})}, "did:web:" + remoteHost + ":bob", http.StatusOK},
+		{"allowed cidr", []Option{WithResolveAllowlist([]string{"127.0.0.0/8"})}, "did:web:" + remoteHost + ":bob", http.StatusOK},
+		{"denied over allowed", []Option{WithResolveAllowlist([]string{"127.0.0.0/8"}), WithResolveDenylist([]string{"127.0.0.1"})}, "did:web:" + remoteHost + ":bob", http.StatusForbidden},
+		{"not in allowlist", []Option{WithResolveAllowlist([]string{"*.example.org"})}, "did:web:public.test:bob", http.StatusForbidden},
+		{"denied name", []Option{WithResolveDenylist([]string{"*.test"})}, "did:web:public.test:bob", http.StatusForbidden},
+		{"private ip", nil, "did:web:10.0.0.1:bob", http.StatusForbidden},
+		{"link local ip", nil, "did:web:169.254.169.254:bob", http.StatusForbidden},
+		{"private name", nil, "did:web:internal.test:bob", http.StatusForbidden},
+		{"localhost", nil, "did:web:localhost%3A8443:bob", http.StatusForbidden},
+		{"local domain", nil, "did:web:example.com:alice", http.StatusNotFound},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, append([]Option{WithResolveClient(remote.Client())}, tc.opts...)...)
+			s.resolver = lookup
+			assert.Equal(t, tc.code, doRequest(s, http.MethodGet, "/resolve/"+tc.did).Code)
+
+			w := doRequest(s, http.MethodGet, "/1.0/identifiers/"+tc.did)
+			assert.Equal(t, tc.code, w.Code)
+			if tc.code == http.StatusForbidden {
+				assert.Contains(t, w.Body.String(), `"error":"forbidden"`)
+			}
+		})
+	}
+
+	_, err := New(WithResolveAllowlist([]string{"10.0.0.0/33"}))
+	assert.Error(t, err)
+}
+
+func TestResolutionClientPrivateAddresses(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer internal.Close()
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(internal.URL, "http://"))
+	assert.NoError(t, err)
+
+	tt := []struct {
+		name string
+		opts []Option
+		host string
+		ok   bool
+	}{
+		{"loopback", nil, "127.0.0.1", false},
+		{"name of loopback", nil, "rebound.test", false},
+		{"private override", []Option{WithPrivateResolution()}, "127.0.0.1", true},
+		{"allowed", []Option{WithResolveAllowlist([]string{"127.0.0.1"})}, "127.0.0.1", true},
+		{"allowed name", []Option{WithResolveAllowlist([]string{"rebound.test"})}, "rebound.test", true},
+		{"denied", []Option{WithPrivateResolution(), WithResolveDenylist([]string{"127.0.0.0/8"})}, "127.0.0.1", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, tc.opts...)
+			s.resolver = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+				return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+			}
+			resp, err := s.client.Get("http://" + net.JoinHostPort(tc.host, port) + "/")
+			if !tc.ok {
+				assert.ErrorIs(t, err, errResolveForbidden)
+				return
+			}
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestResolutionClientNoProxy(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://proxy.test:3128")
+	t.Setenv("HTTPS_PROXY", "http://proxy.test:3128")
+	s := newTestServer(t)
+	transport, ok := s.client.Transport.(*http.Transport)
+	if assert.True(t, ok) {
+		assert.Nil(t, transport.Proxy)
+	}
+}
+
+func TestResolveRebinding(t *testing.T) {
+	s := newTestServer(t)
+	lookups := 0
+	s.resolver = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		if lookups == 1 {
+			return []net.IPAddr{{IP: net.ParseIP("203.0.113.7")}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("169.254.169.254")}}, nil
+	}
+
+	w := doRequest(s, http.MethodGet, "/resolve/did:web:rebound.test:bob")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, 2, lookups)
+}
+
+func TestNostrWellKnownSecp256k1(t *testing.T) {
+	s := newTestServer(t)
+
+	privKey, err := secp256k1.GeneratePrivateKey()
+	assert.NoError(t, err)
+	vm, err := didweb.NostrVerificationMethod("did:web:example.com:alice", privKey.PubKey().SerializeCompressed())
+	assert.NoError(t, err)
+	doc, err := didstorage.DIDFromProps("example.com:alice", []didstorage.KeyInput{{
+		Purposes:           []string{"assertionMethod"},
+		VerificationMethod: *vm,
+	}}, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, s.store.Register(doc))
+
+	w := doRequest(s, http.MethodGet, "https://example.com/.well-known/nostr.json?name=alice")
+	assert.Equal(t, http.StatusOK, w.Code)
+	expected := hex.EncodeToString(privKey.PubKey().SerializeCompressed()[1:])
+	assert.JSONEq(t, `{"names":{"alice":"`+expected+`"}}`, w.Body.String())
+
+	w = doRequest(s, http.MethodGet, "https://example.com/.well-known/nostr.json?name=bob")
+	assert.JSONEq(t, `{"names":{}}`, w.Body.String())
+
+	assert.NoError(t, s.store.(deactivator).Deactivate("example.com:alice"))
+	w = doRequest(s, http.MethodGet, "https://example.com/.well-known/nostr.json?name=alice")
+	assert.JSONEq(t, `{"names":{}}`, w.Body.String())
+}
+
+func TestRegisterIdempotencyKey(t *testing.T) {
+	s := newTestServer(t)
+
+	register := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+		req.Header.Set(IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	first := register("retry-1", testRegisterBody)
+	assert.Equal(t, http.StatusOK, first.Code)
+	second := register("retry-1", testRegisterBody)
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+
+	changed := strings.Replace(testRegisterBody, `"keys"`, `"alsoKnownAs": ["https://mastodon.social/@alice"], "keys"`, 1)
+	assert.Equal(t, http.StatusUnprocessableEntity, register("retry-1", changed).Code)
+
+	pending, err := s.regStore.Pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+}
+
+func TestAdminBackup(t *testing.T) {
+	s := newTestServer(t, WithAdminKey("secret"))
+	assert.NoError(t, s.store.Register(testDocument(t, "example.com:alice", "key-1")))
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(s, http.MethodPost, "/admin/backup").Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/backup", nil)
+	req.Header.Set("X-Api-Key", "secret")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "attachment; filename=dids.db.bak", w.Header().Get("Content-Disposition"))
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "did.db"), w.Body.Bytes(), 0600))
+	restored, err := NewStore("example.com", dir, "did")
+	assert.NoError(t, err)
+	doc, err := restored.Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "did:web:example.com:alice", doc.ID)
+}
+
+func TestAdminBackupUnsupported(t *testing.T) {
+	s := newTestServer(t, WithAdminKey("secret"), WithStore(didstorage.NewDIDStore(memstorage.NewMemStorage())))
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/backup", nil)
+	req.Header.Set("X-Api-Key", "secret")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Disposition"))
+	assert.NotEqual(t, "application/octet-stream", w.Header().Get("Content-Type"))
+}
+
+func TestNostrWellKnownEncodings(t *testing.T) {
+	privKey, err := secp256k1.GeneratePrivateKey()
+	assert.NoError(t, err)
+	compressed := privKey.PubKey().SerializeCompressed()
+	expected := hex.EncodeToString(compressed[1:])
+
+	tt := []struct {
+		name     string
+		encoding multibase.Encoding
+		key      []byte
+	}{
+		{"base16 x-only", multibase.Base16, compressed[1:]},
+		{"base58btc x-only", multibase.Base58BTC, compressed[1:]},
+		{"base58btc compressed", multibase.Base58BTC, compressed},
+		{"base58btc multicodec", multibase.Base58BTC, append(varint.ToUvarint(uint64(did.SECP256k1MultiCodec)), compressed...)},
+		{"base64url uncompressed", multibase.Base64url, privKey.PubKey().SerializeUncompressed()},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			encoded, err := multibase.Encode(tc.encoding, tc.key)
+			assert.NoError(t, err)
+			doc, err := didstorage.DIDFromProps("example.com:alice", []didstorage.KeyInput{{
+				Purposes: []string{"assertionMethod"},
+				VerificationMethod: did.VerificationMethod{
+					ID:                 "#nostr",
+					Type:               didweb.SchnorrSecp256k1VerificationKey2019,
+					PublicKeyMultibase: encoded,
+				},
+			}}, nil)
+			assert.NoError(t, err)
+			assert.NoError(t, s.store.Register(doc))
+
+			w := doRequest(s, http.MethodGet, "https://example.com/.well-known/nostr.json?name=alice")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, `{"names":{"alice":"`+expected+`"}}`, w.Body.String())
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	s := newTestServer(t, WithTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"}))
+
+	tt := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"forged from untrusted peer", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:443", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"client prepends a forged hop", "10.1.2.3:443", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.1.2.3:443", []string{"198.51.100.1, 192.0.2.1", "10.9.9.9"}, "198.51.100.1"},
+		{"only trusted hops", "10.1.2.3:443", []string{"10.4.4.4"}, "10.4.4.4"},
+		{"malformed hop", "10.1.2.3:443", []string{"198.51.100.1, garbage"}, "10.1.2.3"},
+		{"trusted proxy without header", "192.0.2.1:443", nil, "192.0.2.1"},
+		{"ipv6 peer", "[2001:db8::1]:443", []string{"198.51.100.1"}, "2001:db8::1"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, value := range tc.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			assert.Equal(t, tc.expected, s.realIP(r))
+		})
+	}
+
+	_, err := New(WithTrustedProxies([]string{"not-a-cidr"}))
+	assert.Error(t, err)
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	loader := openapi3.NewLoader()
+	spec, err := loader.LoadFromData(openAPISpec)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, spec.Validate(loader.Context))
+	assert.True(t, strings.HasPrefix(spec.OpenAPI, "3.0."))
+
+	for _, name := range []string{"RegisterRequest", "PayInfo", "NostrWellKnown", "Error"} {
+		assert.Contains(t, spec.Components.Schemas, name)
+	}
+	assert.Contains(t, spec.Components.SecuritySchemes, "apiKey")
+
+	// Every API route must be documented. The prefix routes serving
+	// documents and well-known files are documented per file instead.
+	s := newTestServer(t)
+	err = s.handler.(*mux.Router).Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || template == "/" || template == "/.well-known" {
+			return nil
+		}
+		assert.NotNil(t, spec.Paths.Find(template), template)
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	s := newTestServer(t, WithBasePrefix("/api"))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, openAPISpec, w.Body.Bytes())
+
+	req = httptest.NewRequest(http.MethodGet, "https://example.com/api/swagger-ui", nil)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "petstore.swagger.io", location.Host)
+	assert.Equal(t, "https://example.com/api/openapi.json", location.Query().Get("url"))
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	tt := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{http.MethodGet, "/register", "POST, OPTIONS"},
+		{http.MethodPost, "/resolve/did:web:example.com:alice", "GET, OPTIONS"},
+		{http.MethodGet, "/delete/did:web:example.com:alice", "DELETE, OPTIONS"},
+		{http.MethodPut, "/health", "GET, OPTIONS"},
+	}
+
+	s := newTestServer(t)
+	for _, tc := range tt {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			w := doRequest(s, tc.method, tc.path)
+			assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+			assert.Equal(t, tc.allow, w.Header().Get("Allow"))
+		})
+	}
+
+	w := httptest.NewRecorder()
+	s.handleRegister(w, httptest.NewRequest(http.MethodGet, "/register", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "POST, OPTIONS", w.Header().Get("Allow"))
+}
+
+func TestRegisterPaths(t *testing.T) {
+	tt := []struct {
+		name     string
+		opts     []Option
+		id       string
+		expected int
+	}{
+		{"default allows all", nil, "example.com:admin", http.StatusOK},
+		{"allowed", []Option{WithAllowedPaths([]string{"users:*"})}, "example.com:users:alice", http.StatusOK},
+		{"not allowed", []Option{WithAllowedPaths([]string{"users:*"})}, "example.com:admin", http.StatusForbidden},
+		{"too deep", []Option{WithAllowedPaths([]string{"users:*"})}, "example.com:users:a:b", http.StatusForbidden},
+		{"blocked", []Option{WithBlockedPaths([]string{"admin", "well-known"})}, "example.com:Admin", http.StatusForbidden},
+		{"not blocked", []Option{WithBlockedPaths([]string{"admin", "well-known"})}, "example.com:alice", http.StatusOK},
+		{"blocked wins", []Option{WithAllowedPaths([]string{"*"}), WithBlockedPaths([]string{"admin"})}, "example.com:admin", http.StatusForbidden},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, tc.opts...)
+			body := strings.Replace(testRegisterBody, `"example.com:alice"`, fmt.Sprintf("%q", tc.id), 1)
+			req := httptest.NewRequest(http.MethodPost, "/register?preview=true", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			assert.Equal(t, tc.expected, w.Code, w.Body.String())
+		})
+	}
+
+	_, err := New(WithRegisterStore(&didstorage.RegisterStore{}), WithAllowedPaths([]string{"users:["}))
+	assert.Error(t, err)
+}
+
+func TestRegisterAlsoKnownAs(t *testing.T) {
+	s := newTestServer(t)
+	register := func(alsoKnownAs string) *httptest.ResponseRecorder {
+		body := strings.Replace(testRegisterBody, `"keys"`, `"alsoKnownAs": [`+alsoKnownAs+`], "keys"`, 1)
+		req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, register(`"alice"`).Code)
+
+	didKey := "did:key:z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"
+	profile := "https://mastodon.social/@alice"
+	assert.Equal(t, http.StatusOK, register(fmt.Sprintf("%q, %q", didKey, profile)).Code)
+	pending, err := s.regStore.Pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	nonce := pending[0].Nonce
+
+	body := []byte(`{"payment_hash":"hash1","amount":69}`)
+	req := httptest.NewRequest(http.MethodPost, paidTarget(t, s, nonce), strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(s, http.MethodGet, "/resolve/did:web:example.com:alice")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var served struct {
+		AlsoKnownAs []string `json:"alsoKnownAs"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &served))
+	assert.Equal(t, []string{didKey, profile}, served.AlsoKnownAs)
+	var doc didweb.Document
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, []string{didKey, profile}, doc.AlsoKnownAs)
+}
+
+// writeSelfSignedCert writes a certificate and key for 127.0.0.1 to dir.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestWithTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, pool := writeSelfSignedCert(t, dir)
+
+	s := newTestServer(t, WithTLS(certFile, keyFile))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go s.Serve(l)
+	defer l.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + l.Addr().String() + "/health")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotNil(t, resp.TLS)
+	}
+
+	// Plain HTTP is answered with a 400 by the TLS listener.
+	resp, err = http.Get("http://" + l.Addr().String() + "/health")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestWithTLSErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeSelfSignedCert(t, dir)
+
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"missing cert", []Option{WithTLS(filepath.Join(dir, "missing.pem"), keyFile)}},
+		{"key as cert", []Option{WithTLS(keyFile, keyFile)}},
+		{"tls twice", []Option{WithTLS(certFile, keyFile), WithTLS(certFile, keyFile)}},
+		{"tls and autocert", []Option{WithTLS(certFile, keyFile), WithAutocert("example.com")}},
+		{"autocert without domains", []Option{WithAutocert()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := New(test.opts...)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// testAuthDocument returns a document for id authenticating with a new
+// ed25519 key, and that key.
+func testAuthDocument(t *testing.T, id string) (*didweb.Document, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	publicKeyMultibase, err := multibase.Encode(multibase.Base58BTC, append(varint.ToUvarint(uint64(did.Ed25519MultiCodec)), pub...))
+	assert.NoError(t, err)
+	doc, err := didstorage.DIDFromProps(id, []didstorage.KeyInput{{
+		Purposes: []string{"authentication", "assertionMethod"},
+		VerificationMethod: did.VerificationMethod{
+			ID:                 "key-1",
+			Type:               cryptosuite.Ed25519VerificationKey2020,
+			PublicKeyMultibase: publicKeyMultibase,
+		},
+	}}, nil)
+	assert.NoError(t, err)
+	return doc, priv
+}
+
+// requestChallenge issues a challenge for the DID id.
+func requestChallenge(t *testing.T, s *Server, id string) string {
+	w := doRequest(s, http.MethodPost, "/challenge/"+id)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var challenge Challenge
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&challenge))
+	return challenge.Challenge
+}
+
+func TestChallengeLimits(t *testing.T) {
+	s := newTestServer(t, WithMaxChallenges(2, 3))
+	for _, id := range []string{"example.com:alice", "example.com:bob"} {
+		doc, _ := testAuthDocument(t, id)
+		assert.NoError(t, s.store.Register(doc))
+	}
+
+	alice := requestChallenge(t, s, "did:web:example.com:alice")
+	requestChallenge(t, s, "did:web:example.com:alice")
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(s, http.MethodPost, "/challenge/did:web:example.com:alice").Code)
+	requestChallenge(t, s, "did:web:example.com:bob")
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(s, http.MethodPost, "/challenge/did:web:example.com:bob").Code)
+
+	// Using a challenge makes room for another.
+	assert.True(t, s.takeChallenge(alice, "did:web:example.com:alice"))
+	assert.False(t, s.takeChallenge(alice, "did:web:example.com:alice"))
+	requestChallenge(t, s, "did:web:example.com:bob")
+
+	_, err := New(WithMaxChallenges(0, 10))
+	assert.Error(t, err)
+}
+
+func TestChallengeStoreExpiry(t *testing.T) {
+	store := newChallengeStore(2, 10)
+	now := time.Now()
+	issue := func(challenge string, at time.Time) error {
+		return store.add(&issuedChallenge{challenge: challenge, id: "did:web:example.com:alice", expiresAt: at.Add(ChallengeTTL)}, at)
+	}
+
+	assert.NoError(t, issue("a", now))
+	assert.NoError(t, issue("b", now.Add(time.Minute)))
+	assert.ErrorIs(t, issue("c", now.Add(time.Minute)), errTooManyChallenges)
+
+	// Expired challenges are dropped, and no longer count or work.
+	later := now.Add(ChallengeTTL)
+	assert.NoError(t, issue("c", later))
+	assert.False(t, store.take("a", "did:web:example.com:alice", later))
+	assert.True(t, store.take("b", "did:web:example.com:alice", later))
+	assert.Equal(t, 1, store.order.Len())
+	assert.Len(t, store.issued, 1)
+	assert.Equal(t, map[string]int{"did:web:example.com:alice": 1}, store.perDID)
+}
+
+func TestDeleteWithProof(t *testing.T) {
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	tt := []struct {
+		name  string
+		proof func(t *testing.T, s *Server, key ed25519.PrivateKey) string
+		purge bool
+		code  int
+	}{
+		{
+			name: "signed",
+			proof: func(t *testing.T, s *Server, key ed25519.PrivateKey) string {
+				proof, err := SignChallenge(requestChallenge(t, s, "did:web:example.com:alice"), "#key-1", key)
+				assert.NoError(t, err)
+				return proof
+			},
+			code: http.StatusNoContent,
+		},
+		{
+			name: "no kid",
+			proof: func(t *testing.T, s *Server, key ed25519.PrivateKey) string {
+				proof, err := SignChallenge(requestChallenge(t, s, "did:web:example.com:alice"), "", key)
+				assert.NoError(t, err)
+				return proof
+			},
+			code: http.StatusNoContent,
+		},
+		{
+			name: "purge",
+			proof: func(t *testing.T, s *Server, key ed25519.PrivateKey) string {
+				proof, err := SignChallenge(requestChallenge(t, s, "did:web:example.com:alice"), "#key-1", key)
+				assert.NoError(t, err)
+				return proof
+			},
+			purge: true,
+			code:  http.StatusNoContent,
+		},
+		{
+			name: "missing proof",
+			proof: func(t *testing.T, s *Server, key ed25519.PrivateKey) string {
+				return ""
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong key",
+			proof: func(t *testing.T, s *Server, key ed25519.PrivateKey) string {
+				proof, err := SignChallenge(requestChallenge(t, s, "did:web:example.com:alice"), "#key-1", otherKey)
+				assert.NoError(t, err)
+				return proof
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "unknown challenge",
+			proof: func(t *testing.T, s *Server, key ed25519.PrivateKey) string {
+				proof, err := SignChallenge("00", "#key-1", key)
+				assert.NoError(t, err)
+				return proof
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "challenge for another DID",
+			proof: func(t *testing.T, s *Server, key ed25519.PrivateKey) string {
+				proof, err := SignChallenge(requestChallenge(t, s, "did:web:example.com:bob"), "#key-1", key)
+				assert.NoError(t, err)
+				return proof
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "reused challenge",
+			proof: func(t *testing.T, s *Server, key ed25519.PrivateKey) string {
+				proof, err := SignChallenge(requestChallenge(t, s, "did:web:example.com:alice"), "#key-1", key)
+				assert.NoError(t, err)
+				doc, err := s.store.Resolve("example.com:alice")
+				assert.NoError(t, err)
+				assert.NoError(t, s.verifyProof(httptest.NewRequest(http.MethodDelete, "/", nil), doc, proof))
+				return proof
+			},
+			code: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			doc, key := testAuthDocument(t, "example.com:alice")
+			assert.NoError(t, s.store.Register(doc))
+			bob, _ := testAuthDocument(t, "example.com:bob")
+			assert.NoError(t, s.store.Register(bob))
+
+			target := "/delete/did:web:example.com:alice"
+			if tc.purge {
+				target += "?purge=true"
+			}
+			req := httptest.NewRequest(http.MethodDelete, target, nil)
+			if proof := tc.proof(t, s, key); len(proof) > 0 {
+				req.Header.Set(ProofHeader, proof)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+			assert.Equal(t, tc.code, w.Code)
+
+			resolved := doRequest(s, http.MethodGet, "/1.0/identifiers/did:web:example.com:alice")
+			if tc.purge {
+				assert.Equal(t, http.StatusNotFound, resolved.Code)
+				return
+			}
+			// Deleting deactivates the DID, whose last document still resolves.
+			assert.Equal(t, http.StatusOK, resolved.Code)
+			var result struct {
+				DocumentMetadata DocumentMetadata `json:"didDocumentMetadata"`
+			}
+			assert.NoError(t, json.Unmarshal(resolved.Body.Bytes(), &result))
+			assert.Equal(t, tc.code == http.StatusNoContent, result.DocumentMetadata.Deactivated)
+
+			// The plain document endpoints report a deactivated DID as gone,
+			// while its versions stay resolvable.
+			code := http.StatusOK
+			if tc.code == http.StatusNoContent {
+				code = http.StatusGone
+			}
+			assert.Equal(t, code, doRequest(s, http.MethodGet, "/resolve/did:web:example.com:alice").Code)
+			assert.Equal(t, code, doRequest(s, http.MethodGet, "https://example.com/alice/did.json").Code)
+			assert.Equal(t, http.StatusOK, doRequest(s, http.MethodGet, "/resolve/did:web:example.com:alice?versionId=1").Code)
+		})
+	}
+
+	s := newTestServer(t)
+	w := doRequest(s, http.MethodPost, "/challenge/did:web:example.com:nobody")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSignChallenge(t *testing.T) {
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	secpKey, err := secp256k1.GeneratePrivateKey()
+	assert.NoError(t, err)
+
+	tt := []struct {
+		name string
+		key  interface{}
+		pub  interface{}
+		alg  string
+	}{
+		{"ed25519", edKey, edPub, "EdDSA"},
+		{"P-256", p256Key, &p256Key.PublicKey, "ES256"},
+		{"secp256k1", secpKey, secpKey.PubKey(), "ES256K"},
+		{"secp256k1 value", *secpKey, secpKey.PubKey(), "ES256K"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			proof, err := SignChallenge("challenge", "#key-1", tc.key)
+			assert.NoError(t, err)
+			parts := strings.Split(proof, ".")
+			assert.Len(t, parts, 3)
+			signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+			assert.NoError(t, err)
+			assert.True(t, verifySignature(tc.alg, tc.pub, []byte(parts[0]+"."+parts[1]), signature))
+			assert.False(t, verifySignature(tc.alg, tc.pub, []byte(parts[0]+"."), signature))
+		})
+	}
+}
+
+// countingStore counts the reads of the store it wraps.
+type countingStore struct {
+	Store
+	mu    sync.Mutex
+	reads int
+}
+
+func (c *countingStore) Resolve(id string) (*didweb.Document, error) {
+	c.mu.Lock()
+	c.reads++
+	c.mu.Unlock()
+	return c.Store.Resolve(id)
+}
+
+func (c *countingStore) Deactivate(id string) error {
+	return c.Store.(deactivator).Deactivate(id)
+}
+
+func (c *countingStore) ResolveWithMetadata(id string) (*didweb.ResolveResult, error) {
+	c.mu.Lock()
+	c.reads++
+	c.mu.Unlock()
+	return c.Store.(deactivator).ResolveWithMetadata(id)
+}
+
+func TestCachedDIDStore(t *testing.T) {
+	inner := &countingStore{Store: newTestServer(t).store}
+	cache := NewCachedStore(inner, 2, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	for _, id := range []string{"example.com:alice", "example.com:bob", "example.com:carol"} {
+		assert.NoError(t, cache.Register(testDocument(t, id, "key-1")))
+	}
+
+	resolve := func(id string, reads int) *didweb.Document {
+		t.Helper()
+		doc, err := cache.Resolve(id)
+		assert.NoError(t, err)
+		assert.Equal(t, reads, inner.reads)
+		return doc
+	}
+
+	doc := resolve("example.com:alice", 1)
+	assert.Len(t, doc.VerificationMethod, 1)
+	resolve("example.com:alice", 1)
+
+	// Writes through the cache invalidate what they change.
+	assert.NoError(t, cache.Register(testDocument(t, "example.com:alice", "key-1", "key-2")))
+	doc = resolve("example.com:alice", 2)
+	assert.Len(t, doc.VerificationMethod, 2)
+	assert.NoError(t, cache.Deactivate("example.com:alice"))
+	resolve("example.com:alice", 3)
+	result, err := cache.ResolveWithMetadata("example.com:alice")
+	assert.NoError(t, err)
+	assert.True(t, result.Deactivated)
+	assert.Equal(t, 3, inner.reads)
+	assert.NoError(t, cache.Delete("example.com:alice"))
+	_, err = cache.Resolve("example.com:alice")
+	assert.ErrorIs(t, err, didstorage.ErrorNotFound)
+	assert.Equal(t, 0, cache.Len())
+
+	// The least recently used entry is evicted.
+	resolve("example.com:bob", 5)
+	resolve("example.com:carol", 6)
+	resolve("example.com:bob", 6)
+	assert.NoError(t, cache.Register(testDocument(t, "example.com:dave", "key-1")))
+	resolve("example.com:dave", 7)
+	assert.Equal(t, 2, cache.Len())
+	resolve("example.com:bob", 7)
+	resolve("example.com:carol", 8)
+
+	// Entries expire after the ttl.
+	now = now.Add(time.Minute)
+	resolve("example.com:carol", 9)
+}
+
+func TestCachedDIDStoreConcurrent(t *testing.T) {
+	s := newTestServer(t)
+	cache := NewCachedStore(s.store, 10, time.Minute)
+	assert.NoError(t, cache.Register(testDocument(t, "example.com:alice", "key-1")))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if i == 0 && j%10 == 0 {
+					cache.Register(testDocument(t, "example.com:alice", "key-1", fmt.Sprintf("key-%d", j+2)))
+					continue
+				}
+				_, err := cache.Resolve("example.com:alice")
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	cached, err := cache.Resolve("example.com:alice")
+	assert.NoError(t, err)
+	stored, err := s.store.Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, stored, cached)
+}
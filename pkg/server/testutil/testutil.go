@@ -0,0 +1,267 @@
+// Package testutil provides an in-memory server.Store for handler tests,
+// with hooks to replace its behavior or make it fail.
+package testutil
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+)
+
+// ErrInjected is returned by the operations an ErrorMode fails.
+var ErrInjected = fmt.Errorf("injected failure")
+
+// ErrorMode selects the operations of a TestStore that fail with
+// ErrInjected. The zero value fails none.
+type ErrorMode struct {
+	fail  bool
+	after int
+}
+
+// AlwaysFail fails every operation.
+var AlwaysFail = ErrorMode{fail: true}
+
+// FailAfter lets n operations succeed and fails every one after them.
+func FailAfter(n int) ErrorMode {
+	return ErrorMode{fail: true, after: n}
+}
+
+// TestStore is a server.Store keeping documents in memory. Each of
+// RegisterFn, ResolveFn and DeleteFn replaces the in-memory behavior of its
+// operation when set. ErrorMode is applied to every operation first.
+type TestStore struct {
+	RegisterFn func(doc *didweb.Document) error
+	ResolveFn  func(id string) (*didweb.Document, error)
+	DeleteFn   func(id string) error
+	ErrorMode  ErrorMode
+
+	mu       sync.Mutex
+	calls    int
+	versions map[string][]version
+}
+
+type version struct {
+	doc     *didweb.Document
+	created time.Time
+}
+
+// check counts an operation and returns ErrInjected when ErrorMode fails it.
+func (s *TestStore) check() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.ErrorMode.fail && s.calls > s.ErrorMode.after {
+		return ErrInjected
+	}
+	return nil
+}
+
+// Calls returns how many operations the store has been asked to do.
+func (s *TestStore) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// key is the id a DID is stored under, e.g. "example.com:alice" for
+// "did:web:example.com:alice". Lookups accept either form.
+func key(id string) string {
+	if u, err := didweb.Parse(id); err == nil {
+		return u.ID()
+	}
+	return id
+}
+
+func (s *TestStore) put(doc *didweb.Document) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.versions == nil {
+		s.versions = map[string][]version{}
+	}
+	id := key(doc.ID)
+	s.versions[id] = append(s.versions[id], version{doc: doc, created: time.Now()})
+}
+
+func (s *TestStore) history(id string) []version {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.versions[key(id)]
+}
+
+func (s *TestStore) Register(doc *didweb.Document) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if s.RegisterFn != nil {
+		return s.RegisterFn(doc)
+	}
+	if _, err := didweb.Parse(doc.ID); err != nil {
+		return fmt.Errorf("could not parse did doc id: %w", err)
+	}
+	s.put(doc)
+	return nil
+}
+
+func (s *TestStore) Resolve(id string) (*didweb.Document, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if s.ResolveFn != nil {
+		return s.ResolveFn(id)
+	}
+	history := s.history(id)
+	if len(history) == 0 {
+		return nil, fmt.Errorf("%w: %s", didstorage.ErrorNotFound, id)
+	}
+	return history[len(history)-1].doc, nil
+}
+
+// ResolveVersion returns the document of id registered as versionID, the
+// first registration being version 1.
+func (s *TestStore) ResolveVersion(id string, versionID string) (*didweb.Document, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	history := s.history(id)
+	if len(history) == 0 {
+		return nil, fmt.Errorf("%w: %s", didstorage.ErrorNotFound, id)
+	}
+	n, err := strconv.Atoi(versionID)
+	if err != nil || n < 1 || n > len(history) {
+		return nil, fmt.Errorf("%w: %s version %s", didstorage.ErrorVersionNotFound, id, versionID)
+	}
+	return history[n-1].doc, nil
+}
+
+// ResolveVersionTime returns the document of id current at versionTime.
+func (s *TestStore) ResolveVersionTime(id string, versionTime time.Time) (*didweb.Document, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	history := s.history(id)
+	if len(history) == 0 {
+		return nil, fmt.Errorf("%w: %s", didstorage.ErrorNotFound, id)
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if !history[i].created.After(versionTime) {
+			return history[i].doc, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s at %s", didstorage.ErrorVersionNotFound, id, versionTime.Format(time.RFC3339))
+}
+
+func (s *TestStore) Delete(id string) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	if s.DeleteFn != nil {
+		return s.DeleteFn(id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.versions, key(id))
+	return nil
+}
+
+// ids returns the stored ids at or after seek in order.
+func (s *TestStore) ids(seek string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []string{}
+	for id := range s.versions {
+		if id >= seek {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *TestStore) ForEach(seek string, fn func(id string, doc *didweb.Document) bool) error {
+	if err := s.check(); err != nil {
+		return err
+	}
+	for _, id := range s.ids(seek) {
+		history := s.history(id)
+		if len(history) == 0 {
+			continue
+		}
+		if !fn(id, history[len(history)-1].doc) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *TestStore) ListPage(cursor string, limit int, prefix string) (ids []string, nextCursor string, err error) {
+	if err := s.check(); err != nil {
+		return nil, "", err
+	}
+	if limit < 1 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	seek := cursor
+	if seek < prefix {
+		seek = prefix
+	}
+	ids = []string{}
+	for _, id := range s.ids(seek) {
+		if !strings.HasPrefix(id, prefix) {
+			break
+		}
+		if len(ids) == limit {
+			return ids, id, nil
+		}
+		ids = append(ids, id)
+	}
+	return ids, "", nil
+}
+
+// TestStoreBuilder builds a TestStore holding some documents from the start.
+type TestStoreBuilder struct {
+	docs map[string]*didweb.Document
+	ids  []string
+	mode ErrorMode
+}
+
+// NewStore starts building an empty TestStore.
+func NewStore() *TestStoreBuilder {
+	return &TestStoreBuilder{docs: map[string]*didweb.Document{}}
+}
+
+// WithDocument stores doc as the current document of the DID id, e.g.
+// "did:web:example.com:alice". The document ID is set to id when empty.
+func (b *TestStoreBuilder) WithDocument(id string, doc *didweb.Document) *TestStoreBuilder {
+	if len(doc.ID) == 0 {
+		withID := *doc
+		withID.ID = id
+		doc = &withID
+	}
+	if _, ok := b.docs[id]; !ok {
+		b.ids = append(b.ids, id)
+	}
+	b.docs[id] = doc
+	return b
+}
+
+// WithErrorMode sets the ErrorMode of the store, which applies once it is
+// built.
+func (b *TestStoreBuilder) WithErrorMode(mode ErrorMode) *TestStoreBuilder {
+	b.mode = mode
+	return b
+}
+
+// Build returns the store.
+func (b *TestStoreBuilder) Build() *TestStore {
+	s := &TestStore{ErrorMode: b.mode, versions: map[string][]version{}}
+	for _, id := range b.ids {
+		s.versions[key(id)] = []version{{doc: b.docs[id], created: time.Now()}}
+	}
+	return s
+}
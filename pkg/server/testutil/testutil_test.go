@@ -0,0 +1,113 @@
+package testutil_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/server"
+	"github.com/13x-tech/go-did-web/pkg/server/testutil"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/13x-tech/go-did-web/pkg/storage/memstorage"
+	"github.com/TBD54566975/ssi-sdk/did"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTestStore(t *testing.T) {
+	store := testutil.NewStore().
+		WithDocument("did:web:example.com:alice", &didweb.Document{}).
+		Build()
+
+	doc, err := store.Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "did:web:example.com:alice", doc.ID)
+	_, err = store.Resolve("did:web:example.com:alice")
+	assert.NoError(t, err)
+	_, err = store.Resolve("example.com:bob")
+	assert.ErrorIs(t, err, didstorage.ErrorNotFound)
+
+	updated := &didweb.Document{Document: did.Document{ID: "did:web:example.com:alice"}, AlsoKnownAs: []string{"did:web:example.org:alice"}}
+	assert.NoError(t, store.Register(updated))
+	assert.NoError(t, store.Register(&didweb.Document{Document: did.Document{ID: "did:web:example.com:users:bob"}}))
+	doc, err = store.Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, updated, doc)
+	doc, err = store.ResolveVersion("example.com:alice", "1")
+	assert.NoError(t, err)
+	assert.Empty(t, doc.AlsoKnownAs)
+	_, err = store.ResolveVersion("example.com:alice", "3")
+	assert.ErrorIs(t, err, didstorage.ErrorVersionNotFound)
+
+	ids, next, err := store.ListPage("", 1, "example.com:")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com:alice"}, ids)
+	assert.Equal(t, "example.com:users:bob", next)
+
+	assert.NoError(t, store.Delete("example.com:alice"))
+	_, err = store.Resolve("example.com:alice")
+	assert.ErrorIs(t, err, didstorage.ErrorNotFound)
+	assert.Equal(t, 11, store.Calls())
+}
+
+func TestTestStoreErrorMode(t *testing.T) {
+	store := testutil.NewStore().
+		WithDocument("did:web:example.com:alice", &didweb.Document{}).
+		WithErrorMode(testutil.FailAfter(2)).
+		Build()
+	for i := 0; i < 2; i++ {
+		_, err := store.Resolve("example.com:alice")
+		assert.NoError(t, err)
+	}
+	_, err := store.Resolve("example.com:alice")
+	assert.ErrorIs(t, err, testutil.ErrInjected)
+	assert.ErrorIs(t, store.Delete("example.com:alice"), testutil.ErrInjected)
+
+	store.ErrorMode = testutil.ErrorMode{}
+	_, err = store.Resolve("example.com:alice")
+	assert.NoError(t, err)
+
+	store.ErrorMode = testutil.AlwaysFail
+	assert.ErrorIs(t, store.Register(&didweb.Document{Document: did.Document{ID: "did:web:example.com:bob"}}), testutil.ErrInjected)
+}
+
+func TestTestStoreFns(t *testing.T) {
+	registered := []string{}
+	store := &testutil.TestStore{
+		RegisterFn: func(doc *didweb.Document) error {
+			registered = append(registered, doc.ID)
+			return nil
+		},
+		ResolveFn: func(id string) (*didweb.Document, error) {
+			return nil, fmt.Errorf("disk error")
+		},
+	}
+	assert.NoError(t, store.Register(&didweb.Document{Document: did.Document{ID: "did:web:example.com:alice"}}))
+	assert.Equal(t, []string{"did:web:example.com:alice"}, registered)
+	_, err := store.Resolve("example.com:alice")
+	assert.EqualError(t, err, "disk error")
+}
+
+func TestTestStoreHandlers(t *testing.T) {
+	regStore, err := didstorage.NewRegisterStore("lnbits.example.com", "key", memstorage.NewMemStorage())
+	assert.NoError(t, err)
+	newServer := func(store server.Store) *server.Server {
+		s, err := server.New(server.WithDomain("example.com"), server.WithStore(store), server.WithRegisterStore(regStore))
+		assert.NoError(t, err)
+		return s
+	}
+	get := func(s *server.Server, target string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w.Code
+	}
+
+	s := newServer(testutil.NewStore().WithDocument("did:web:example.com:alice", &didweb.Document{}).Build())
+	assert.Equal(t, http.StatusOK, get(s, "https://example.com/alice/did.json"))
+	assert.Equal(t, http.StatusOK, get(s, "/resolve/did:web:example.com:alice"))
+	assert.Equal(t, http.StatusNotFound, get(s, "/resolve/did:web:example.com:bob"))
+
+	s = newServer(testutil.NewStore().WithErrorMode(testutil.AlwaysFail).Build())
+	assert.Equal(t, http.StatusInternalServerError, get(s, "/resolve/did:web:example.com:alice"))
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// WithTLS serves HTTPS with the certificate and key in the given PEM files.
+func WithTLS(certFile, keyFile string) Option {
+	return func(s *Server) error {
+		if s.tlsConfig != nil {
+			return fmt.Errorf("TLS is already configured")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("could not load TLS certificate: %w", err)
+		}
+		s.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		return nil
+	}
+}
+
+// WithAutocert serves HTTPS with certificates for domains obtained from Let's
+// Encrypt, which must be able to reach the server on port 443. Certificates
+// are cached in the user's cache directory.
+func WithAutocert(domains ...string) Option {
+	return func(s *Server) error {
+		if s.tlsConfig != nil {
+			return fmt.Errorf("TLS is already configured")
+		}
+		if len(domains) == 0 {
+			return fmt.Errorf("autocert requires at least one domain")
+		}
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return fmt.Errorf("could not find a certificate cache directory: %w", err)
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(filepath.Join(cacheDir, "did-web", "autocert")),
+		}
+		s.tlsConfig = manager.TLSConfig()
+		return nil
+	}
+}
+
+// Serve accepts connections on l, over TLS when WithTLS or WithAutocert is
+// set.
+func (s *Server) Serve(l net.Listener) error {
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	return http.Serve(l, s)
+}
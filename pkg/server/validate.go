@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/TBD54566975/ssi-sdk/did"
+)
+
+// FieldError tells which field of a request is invalid and why.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrorResponse is the body of a 400 for a request with invalid
+// fields.
+type ValidationErrorResponse struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields"`
+}
+
+// decodeRegisterRequest parses a registration body, reporting every invalid
+// field rather than only the first.
+func decodeRegisterRequest(body []byte) (RegisterRequest, []FieldError) {
+	var raw struct {
+		ID          json.RawMessage `json:"id"`
+		Keys        json.RawMessage `json:"keys"`
+		Services    json.RawMessage `json:"services"`
+		AlsoKnownAs json.RawMessage `json:"alsoKnownAs"`
+		Controller  json.RawMessage `json:"controller"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return RegisterRequest{}, []FieldError{{Field: "", Message: "body must be a JSON object"}}
+	}
+
+	var input RegisterRequest
+	fields := []FieldError{}
+	fail := func(field, format string, args ...any) {
+		fields = append(fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	var id string
+	if isAbsent(raw.ID) {
+		fail("id", "required")
+	} else if err := json.Unmarshal(raw.ID, &id); err != nil {
+		fail("id", "must be a string")
+	} else if err := input.ID.UnmarshalText([]byte(id)); err != nil {
+		fail("id", "must be a did:web or its method specific id, e.g. example.com:alice")
+	}
+
+	var keys []json.RawMessage
+	if isAbsent(raw.Keys) {
+		fail("keys", "at least one key is required")
+	} else if err := json.Unmarshal(raw.Keys, &keys); err != nil {
+		fail("keys", "must be an array")
+	} else if len(keys) == 0 {
+		fail("keys", "at least one key is required")
+	}
+	for i, rawKey := range keys {
+		field := fmt.Sprintf("keys[%d]", i)
+		var key didstorage.KeyInput
+		if err := json.Unmarshal(rawKey, &key); err != nil {
+			fail(field, "invalid key: %s", jsonProblem(err))
+			continue
+		}
+		for j, purpose := range key.Purposes {
+			if !didstorage.ValidPurpose(purpose) {
+				fail(fmt.Sprintf("%s.purposes[%d]", field, j), "unknown purpose %q", purpose)
+			}
+		}
+		withoutPurposes := key
+		withoutPurposes.Purposes = nil
+		if err := withoutPurposes.Validate(); err != nil {
+			fail(field, "%s", trimSentinel(err, didstorage.ErrorInvalidKey))
+		}
+		input.Keys = append(input.Keys, key)
+	}
+
+	var services []json.RawMessage
+	if !isAbsent(raw.Services) {
+		if err := json.Unmarshal(raw.Services, &services); err != nil {
+			fail("services", "must be an array")
+		}
+	}
+	for i, rawService := range services {
+		field := fmt.Sprintf("services[%d]", i)
+		var service did.Service
+		if err := json.Unmarshal(rawService, &service); err != nil {
+			fail(field, "invalid service: %s", jsonProblem(err))
+			continue
+		}
+		if err := didstorage.ValidateService(service); err != nil {
+			fail(field, "%s", trimSentinel(err, didstorage.ErrorInvalidService))
+		}
+		input.Services = append(input.Services, service)
+	}
+
+	if !isAbsent(raw.AlsoKnownAs) {
+		if err := json.Unmarshal(raw.AlsoKnownAs, &input.AlsoKnownAs); err != nil {
+			fail("alsoKnownAs", "must be an array of strings")
+		}
+	}
+	if !isAbsent(raw.Controller) {
+		if err := json.Unmarshal(raw.Controller, &input.Controller); err != nil {
+			fail("controller", "must be a string")
+		}
+	}
+
+	if len(fields) > 0 {
+		return RegisterRequest{}, fields
+	}
+	return input, nil
+}
+
+// isAbsent reports whether a field was left out or null.
+func isAbsent(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+// jsonProblem describes a decoding error without the Go type names
+// encoding/json puts in it.
+func jsonProblem(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if len(typeErr.Field) > 0 {
+			return fmt.Sprintf("%s has the wrong type", typeErr.Field)
+		}
+		return "wrong type"
+	}
+	return err.Error()
+}
+
+// trimSentinel drops the "sentinel: " prefix an error wrapping sentinel
+// starts with, which the field already conveys.
+func trimSentinel(err, sentinel error) string {
+	return strings.TrimPrefix(err.Error(), sentinel.Error()+": ")
+}
+
+// validationError writes a 400 listing the invalid fields.
+func (s *Server) validationError(w http.ResponseWriter, fields []FieldError) {
+	bytes, err := json.Marshal(ValidationErrorResponse{Error: "invalid request", Fields: fields})
+	if err != nil {
+		s.errorResponse(w, 400, "invalid request")
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(bytes)
+}
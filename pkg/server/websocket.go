@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Payment transports accepted by WithPaymentTransport.
+const (
+	PaymentTransportSSE  = "sse"
+	PaymentTransportWS   = "ws"
+	PaymentTransportBoth = "both"
+)
+
+// wsWriteWait is how long a write to a WebSocket may take before the client
+// is considered gone.
+const wsWriteWait = 10 * time.Second
+
+// WithPaymentTransport selects the payment event endpoints: the event stream
+// at /payment/{id} ("sse"), the WebSocket at /ws/payment/{id} ("ws"), or
+// both, which is the default.
+func WithPaymentTransport(transport string) Option {
+	return func(s *Server) error {
+		switch transport {
+		case PaymentTransportSSE, PaymentTransportWS, PaymentTransportBoth:
+			s.paymentTransport = transport
+			return nil
+		}
+		return fmt.Errorf("invalid payment transport %q: must be %s, %s or %s",
+			transport, PaymentTransportSSE, PaymentTransportWS, PaymentTransportBoth)
+	}
+}
+
+// wsUpgrader accepts connections from any origin, as the event stream does.
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WaitForPaymentWS sends the payment events of a DID over a WebSocket, one
+// text message per event, and closes it once the DID is paid or its invoice
+// expires.
+func (b *PaymentBroker) WaitForPaymentWS(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	messageChan, err := b.subscribe(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer b.unsubscribe(id, messageChan)
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error.
+		return
+	}
+	defer conn.Close()
+
+	// Clients send nothing, but reading notices when they go away.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(message []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteMessage(websocket.TextMessage, message)
+	}
+	closeWith := func(message []byte) {
+		if write(message) != nil {
+			return
+		}
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteWait))
+	}
+
+	if write([]byte("connected")) != nil {
+		return
+	}
+
+	ticker := time.NewTicker(b.keepAlive)
+	defer ticker.Stop()
+	expired, stop := b.expiry(id)
+	defer stop()
+	for {
+		select {
+		case msg, ok := <-messageChan:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteWait))
+				return
+			}
+			if write(msg) != nil {
+				return
+			}
+		case <-ticker.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)) != nil {
+				return
+			}
+		case <-expired:
+			closeWith([]byte("expired"))
+			return
+		case <-gone:
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package storage_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/storage"
+	"github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+	"github.com/13x-tech/go-did-web/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+// ObservableStorage keeps the optional interfaces of the storage it wraps.
+var (
+	_ didstorage.Expirable = (*storage.ObservableStorage)(nil)
+	_ didstorage.Pager     = (*storage.ObservableStorage)(nil)
+	_ didstorage.Backuper  = (*storage.ObservableStorage)(nil)
+	_ io.Closer            = (*storage.ObservableStorage)(nil)
+)
+
+// The shared suite imports storage, so it runs from the external test package.
+func TestBoltStorageBehavior(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		store, err := storage.New(t.TempDir(), "test")
+		assert.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestObservableStorageBehavior(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		store, err := storage.New(t.TempDir(), "test")
+		assert.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		return storage.NewObservableStorage(store, storage.NewLoggingObserver(slog.New(slog.NewTextHandler(io.Discard))))
+	})
+}
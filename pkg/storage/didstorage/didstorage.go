@@ -1,88 +1,561 @@
 package didstorage
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"log"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/storage"
+	"github.com/TBD54566975/ssi-sdk/cryptosuite"
 	"github.com/TBD54566975/ssi-sdk/did"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/multiformats/go-multibase"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	ErrorDuplicateVerificationMethod = fmt.Errorf("duplicate verification method id")
+	ErrorDuplicateService            = fmt.Errorf("duplicate service id")
+	ErrorInvalidService              = fmt.Errorf("invalid service")
+	ErrorNotFound                    = fmt.Errorf("not found")
+	ErrorVersionNotFound             = fmt.Errorf("version not found")
+	ErrorMissingRelationship         = fmt.Errorf("missing verification relationship")
+	ErrorInvalidAlsoKnownAs          = fmt.Errorf("invalid alsoKnownAs")
+	ErrorInvalidController           = fmt.Errorf("invalid controller")
+	ErrorInvalidKey                  = fmt.Errorf("invalid key")
 )
 
 type Storage interface {
 	Set(id string, value []byte) error
 	Get(id string) ([]byte, error)
 	Delete(id string) error
+	List(prefix string) ([]string, error)
+	ForEach(seek string, fn func(id string, value []byte) bool) error
+}
+
+// Updater is implemented by storage that can read and rewrite a record in a
+// single transaction.
+type Updater interface {
+	Update(id string, fn func(value []byte) ([]byte, error)) error
+}
+
+// Expirable is implemented by storage that can expire records on its own.
+type Expirable interface {
+	SetWithTTL(id string, value []byte, ttl time.Duration) error
+	TTL(id string) (time.Duration, error)
+}
+
+// get reads id from store, treating storage.ErrNotFound as an absent value.
+func get(store storage.Tx, id string) ([]byte, error) {
+	value, err := store.Get(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// ReadOnlyStorage is implemented by storage that may refuse writes.
+type ReadOnlyStorage interface {
+	ReadOnly() bool
+}
+
+// Pinger is implemented by storage that can check it is usable.
+type Pinger interface {
+	Ping() error
+}
+
+// Backuper is implemented by storage that can write an online backup of
+// itself.
+type Backuper interface {
+	Backup(dst io.Writer) error
+}
+
+// ValidateService checks service has an id that is a fragment or an
+// absolute URI, a type, and an endpoint that is an absolute URI, an object,
+// or a non-empty set of those. Errors wrap ErrorInvalidService.
+func ValidateService(service did.Service) error {
+	if len(strings.TrimSpace(service.ID)) == 0 {
+		return fmt.Errorf("%w: missing id", ErrorInvalidService)
+	}
+	if !validServiceID(service.ID) {
+		return fmt.Errorf("%w: service '%s' id must be a fragment or an absolute URI", ErrorInvalidService, service.ID)
+	}
+	if len(strings.TrimSpace(service.Type)) == 0 {
+		return fmt.Errorf("%w: service '%s' is missing a type", ErrorInvalidService, service.ID)
+	}
+	if err := validateServiceEndpoint(service.ServiceEndpoint, true); err != nil {
+		return fmt.Errorf("%w: service '%s' has invalid endpoint URL: %s", ErrorInvalidService, service.ID, err.Error())
+	}
+	return nil
+}
+
+// validServiceID reports whether id is a fragment such as "#hub" or an
+// absolute URI such as "did:web:example.com#hub".
+func validServiceID(id string) bool {
+	if strings.HasPrefix(id, "#") {
+		return fragmentPattern.MatchString(id[1:])
+	}
+	u, err := url.Parse(id)
+	return err == nil && len(u.Scheme) > 0 && !strings.ContainsAny(id, " \t\n")
+}
+
+func validateServiceEndpoint(endpoint any, allowSet bool) error {
+	switch e := endpoint.(type) {
+	case string:
+		u, err := url.Parse(e)
+		if err != nil || len(u.Scheme) == 0 {
+			return fmt.Errorf("serviceEndpoint %q is not an absolute URI", e)
+		}
+		return nil
+	case map[string]any:
+		if len(e) == 0 {
+			return fmt.Errorf("serviceEndpoint object is empty")
+		}
+		return nil
+	case []any:
+		if !allowSet {
+			break
+		}
+		if len(e) == 0 {
+			return fmt.Errorf("serviceEndpoint set is empty")
+		}
+		for _, item := range e {
+			if err := validateServiceEndpoint(item, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []string:
+		if !allowSet || len(e) == 0 {
+			break
+		}
+		for _, item := range e {
+			if err := validateServiceEndpoint(item, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	case nil:
+		return fmt.Errorf("missing serviceEndpoint")
+	}
+	return fmt.Errorf("serviceEndpoint must be a URI, an object or a set of them")
+}
+
+// verificationRelationships are the purposes a key may be submitted for.
+var verificationRelationships = []string{"authentication", "assertionMethod", "keyAgreement", "capabilityInvocation", "capabilityDelegation"}
+
+type documentOptions struct {
+	required    []string
+	alsoKnownAs []string
+	controller  string
+}
+
+// DIDFromPropsOption configures BuildDocument.
+type DIDFromPropsOption func(o *documentOptions) error
+
+func requirePurposes(purposes ...string) DIDFromPropsOption {
+	return func(o *documentOptions) error {
+		o.required = append(o.required, purposes...)
+		return nil
+	}
+}
+
+// RequireAuthentication rejects documents without an authentication key.
+func RequireAuthentication() DIDFromPropsOption {
+	return requirePurposes("authentication")
+}
+
+// RequireAssertionMethod rejects documents without an assertionMethod key.
+// It is the requirement when no other is given.
+func RequireAssertionMethod() DIDFromPropsOption {
+	return requirePurposes("assertionMethod")
+}
+
+// RequireKeyAgreement rejects documents without a keyAgreement key.
+func RequireKeyAgreement() DIDFromPropsOption {
+	return requirePurposes("keyAgreement")
+}
+
+// AllPurposesRequired rejects documents missing a key for any verification
+// relationship.
+func AllPurposesRequired() DIDFromPropsOption {
+	return requirePurposes(verificationRelationships...)
 }
 
-func DIDFromProps(id string, keys []KeyInput, services []did.Service) (*did.Document, error) {
+// WithAlsoKnownAs sets the document's alsoKnownAs identifiers.
+func WithAlsoKnownAs(alsoKnownAs []string) DIDFromPropsOption {
+	return func(o *documentOptions) error {
+		o.alsoKnownAs = alsoKnownAs
+		return nil
+	}
+}
+
+// didPattern matches a DID without a path, query or fragment.
+var didPattern = regexp.MustCompile(`^did:[a-z0-9]+:([A-Za-z0-9._-]|%[0-9A-Fa-f]{2})*(:([A-Za-z0-9._-]|%[0-9A-Fa-f]{2})+)*$`)
+
+// WithController names another DID allowed to control the document, e.g. an
+// organization's DID controlling its members'. Documents control themselves
+// by default.
+func WithController(controller string) DIDFromPropsOption {
+	return func(o *documentOptions) error {
+		if len(controller) > 0 && (!didPattern.MatchString(controller) || strings.HasSuffix(controller, ":")) {
+			return fmt.Errorf("%w: must be a did: %s", ErrorInvalidController, controller)
+		}
+		o.controller = controller
+		return nil
+	}
+}
+
+// DIDFromProps builds a did:web document for id from the submitted keys and
+// services.
+//
+// Deprecated: use BuildDocument.
+func DIDFromProps(id string, keys []KeyInput, services []did.Service) (*didweb.Document, error) {
+	return BuildDocument(id, keys, services)
+}
+
+// BuildDocument builds a did:web document for id from the submitted keys and
+// services. Unless opts require other relationships, the document must have
+// an assertionMethod key.
+func BuildDocument(id string, keys []KeyInput, services []did.Service, opts ...DIDFromPropsOption) (*didweb.Document, error) {
+	options := documentOptions{}
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return nil, err
+		}
+	}
+	if len(options.required) == 0 {
+		options.required = []string{"assertionMethod"}
+	}
+
 	newDID, err := didweb.New(id)
 	if err != nil {
 		return nil, err
 	}
 
 	doc := did.NewDIDDocumentBuilder()
-	doc.Document = newDID
+	doc.Document = &newDID.Document
+	seenKeys := map[string]struct{}{}
 	for _, key := range keys {
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		if err := key.expand(); err != nil {
+			return nil, err
+		}
+		if key.PublicKeyJWK != nil && len(key.VerificationMethod.PublicKeyMultibase) == 0 {
+			publicKeyJWK, err := parsePublicKeyJWK(key.PublicKeyJWK)
+			if err != nil {
+				return nil, err
+			}
+			key.VerificationMethod.PublicKeyJWK = publicKeyJWK
+		}
+		if len(key.VerificationMethod.ID) == 0 {
+			derived, err := deriveVerificationMethodID(key.VerificationMethod)
+			if err != nil {
+				return nil, err
+			}
+			key.VerificationMethod.ID = derived
+		}
+		vmID, err := normalizeVerificationMethodID(doc.ID, key.VerificationMethod.ID)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seenKeys[strings.ToLower(vmID)]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrorDuplicateVerificationMethod, vmID)
+		}
+		seenKeys[strings.ToLower(vmID)] = struct{}{}
+		key.VerificationMethod.ID = vmID
 		key.VerificationMethod.Controller = doc.ID
-		if err := doc.AddVerificationMethod(key.VerificationMethod); err != nil {
+		if key.VerificationMethod.PublicKeyJWK != nil {
+			if err := validateJWKType(key.VerificationMethod.Type, key.VerificationMethod.PublicKeyJWK); err != nil {
+				return nil, err
+			}
+		}
+		// Embedded methods only appear in their relationships, referenced ones
+		// are listed once and referred to by id.
+		var method did.VerificationMethodSet = key.VerificationMethod.ID
+		if key.Embed {
+			method = key.VerificationMethod
+		} else if err := doc.AddVerificationMethod(key.VerificationMethod); err != nil {
 			return nil, fmt.Errorf("verification method error: %w", err)
 		}
 		for _, purpose := range key.Purposes {
 			if strings.EqualFold(purpose, "authentication") {
-				if err := doc.AddAuthenticationMethod("#" + key.VerificationMethod.ID); err != nil {
+				if err := doc.AddAuthenticationMethod(method); err != nil {
 					return nil, fmt.Errorf("could not add authentication method: %w", err)
 				}
 			} else if strings.EqualFold(purpose, "assertionMethod") {
-				if err := doc.AddAssertionMethod("#" + key.VerificationMethod.ID); err != nil {
+				if err := doc.AddAssertionMethod(method); err != nil {
 					return nil, fmt.Errorf("could not add assertion method: %w", err)
 				}
 			} else if strings.EqualFold(purpose, "capabilityDelegation") {
-				if err := doc.AddCapabilityDelegation("#" + key.VerificationMethod.ID); err != nil {
+				if err := doc.AddCapabilityDelegation(method); err != nil {
 					return nil, fmt.Errorf("could not add capability delegation: %w", err)
 				}
 			} else if strings.EqualFold(purpose, "capabilityInvocation") {
-				if err := doc.AddCapabilityInvocation("#" + key.VerificationMethod.ID); err != nil {
+				if err := doc.AddCapabilityInvocation(method); err != nil {
 					return nil, fmt.Errorf("could not add capbility invocation: %w", err)
 				}
 			} else if strings.EqualFold(purpose, "keyAgreement") {
-				if err := doc.AddKeyAgreement("#" + key.VerificationMethod.ID); err != nil {
+				if err := doc.AddKeyAgreement(method); err != nil {
 					return nil, fmt.Errorf("could not add key agreement: %w", err)
 				}
 			}
 		}
 	}
 
-	if len(doc.AssertionMethod) == 0 {
-		return nil, fmt.Errorf("did document must have at least one assertion verifiction method")
+	relationships := map[string][]did.VerificationMethodSet{
+		"authentication":       doc.Authentication,
+		"assertionMethod":      doc.AssertionMethod,
+		"keyAgreement":         doc.KeyAgreement,
+		"capabilityInvocation": doc.CapabilityInvocation,
+		"capabilityDelegation": doc.CapabilityDelegation,
+	}
+	for _, purpose := range options.required {
+		if len(relationships[purpose]) == 0 {
+			return nil, fmt.Errorf("%w: did document must have at least one %s verification method", ErrorMissingRelationship, purpose)
+		}
 	}
 
+	seenServices := map[string]struct{}{}
 	for _, service := range services {
+		if err := ValidateService(service); err != nil {
+			return nil, err
+		}
+		if _, ok := seenServices[strings.ToLower(service.ID)]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrorDuplicateService, service.ID)
+		}
+		seenServices[strings.ToLower(service.ID)] = struct{}{}
 		if err := doc.AddService(service); err != nil {
 			return nil, fmt.Errorf("service error: %w", err)
 		}
 	}
 
+	if err := setAlsoKnownAs(newDID, options.alsoKnownAs); err != nil {
+		return nil, err
+	}
+	if len(options.controller) > 0 {
+		if err := doc.SetController(options.controller); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrorInvalidController, err.Error())
+		}
+	}
+
 	return newDID, nil
 }
 
+// normalizeVerificationMethodID returns id as a fragment relative to docID.
+// "key-1", "#key-1" and "<docID>#key-1" all normalize to "#key-1", while an
+// absolute DID URL for any other DID is rejected.
+func normalizeVerificationMethodID(docID, id string) (string, error) {
+	fragment := id
+	if strings.HasPrefix(id, "did:") {
+		base, idFragment, ok := strings.Cut(id, "#")
+		if !ok || len(idFragment) == 0 {
+			return "", fmt.Errorf("verification method id must include a fragment: %s", id)
+		}
+		if base != docID {
+			return "", fmt.Errorf("verification method id %s does not belong to %s", id, docID)
+		}
+		fragment = idFragment
+	}
+	fragment = strings.TrimPrefix(fragment, "#")
+	if len(fragment) == 0 {
+		return "", fmt.Errorf("verification method id required")
+	}
+	if !fragmentPattern.MatchString(fragment) {
+		return "", fmt.Errorf("verification method id must be url safe: %s", id)
+	}
+	return "#" + fragment, nil
+}
+
+// fragmentPattern matches the characters RFC 3986 allows in a URI fragment.
+var fragmentPattern = regexp.MustCompile(`^([A-Za-z0-9\-._~!$&'()*+,;=:@/?]|%[0-9A-Fa-f]{2})+$`)
+
+// setAlsoKnownAs validates each identifier is an absolute URI before setting
+// them on the document.
+func setAlsoKnownAs(doc *didweb.Document, alsoKnownAs []string) error {
+	for _, aka := range alsoKnownAs {
+		uri, err := url.Parse(aka)
+		if err != nil || len(uri.Scheme) == 0 {
+			return fmt.Errorf("%w: must be a uri: %s", ErrorInvalidAlsoKnownAs, aka)
+		}
+	}
+	doc.AlsoKnownAs = alsoKnownAs
+	return nil
+}
+
 func NewDIDStore(storage Storage) *DIDStore {
-	return &DIDStore{storage}
+	return &DIDStore{store: storage, now: time.Now}
 }
 
 type DIDStore struct {
 	store Storage
+	now   func() time.Time
 }
 
 type KeyInput struct {
 	Purposes           []string               `json:"purposes"`
 	VerificationMethod did.VerificationMethod `json:"verificationMethod"`
+	// PublicKeyJWK is used as the verification method's publicKeyJwk when it
+	// has no publicKeyMultibase.
+	PublicKeyJWK jwk.Key `json:"publicKeyJwk,omitempty"`
+	// Embed places the whole verification method in each relationship
+	// instead of listing it under verificationMethod and referencing it.
+	Embed bool `json:"embed,omitempty"`
+	// PublicKeyMultibase is a shorthand for a verification method holding
+	// only this key. Its type is KeyType, or else taken from the key's
+	// multicodec prefix.
+	PublicKeyMultibase string `json:"publicKeyMultibase,omitempty"`
+	KeyType            string `json:"keyType,omitempty"`
+}
+
+// plainKeyInput unmarshals the fields of a KeyInput without its methods.
+type plainKeyInput KeyInput
+
+// UnmarshalJSON parses publicKeyJwk as a JWK.
+func (k *KeyInput) UnmarshalJSON(data []byte) error {
+	input := struct {
+		*plainKeyInput
+		PublicKeyJWK json.RawMessage `json:"publicKeyJwk"`
+	}{plainKeyInput: (*plainKeyInput)(k)}
+	if err := json.Unmarshal(data, &input); err != nil {
+		return err
+	}
+	k.PublicKeyJWK = nil
+	if len(input.PublicKeyJWK) > 0 && string(input.PublicKeyJWK) != "null" {
+		key, err := jwk.ParseKey(input.PublicKeyJWK)
+		if err != nil {
+			return fmt.Errorf("invalid publicKeyJwk: %w", err)
+		}
+		k.PublicKeyJWK = key
+	}
+	return nil
+}
+
+// expand builds the verification method from the PublicKeyMultibase
+// shorthand.
+func (k *KeyInput) expand() error {
+	if len(k.PublicKeyMultibase) == 0 {
+		return nil
+	}
+	vm := k.VerificationMethod
+	if len(vm.PublicKeyMultibase) > 0 || len(vm.PublicKeyBase58) > 0 || vm.PublicKeyJWK != nil || k.PublicKeyJWK != nil {
+		return fmt.Errorf("%w: publicKeyMultibase given with another public key", ErrorInvalidKey)
+	}
+	keyType := cryptosuite.LDKeyType(k.KeyType)
+	if len(keyType) > 0 {
+		if _, _, err := multibase.Decode(k.PublicKeyMultibase); err != nil {
+			return fmt.Errorf("%w: invalid publicKeyMultibase: %s", ErrorInvalidKey, err)
+		}
+	} else {
+		var err error
+		if keyType, err = MultibaseKeyType(k.PublicKeyMultibase); err != nil {
+			return err
+		}
+	}
+	k.VerificationMethod.PublicKeyMultibase = k.PublicKeyMultibase
+	if len(k.VerificationMethod.Type) == 0 {
+		k.VerificationMethod.Type = keyType
+	}
+	return nil
+}
+
+// Validate checks the key has a type, public key material and only known
+// purposes.
+func (k KeyInput) Validate() error {
+	if err := k.expand(); err != nil {
+		return err
+	}
+	if len(k.VerificationMethod.Type) == 0 {
+		return fmt.Errorf("%w: verification method type required", ErrorInvalidKey)
+	}
+	vm := k.VerificationMethod
+	if len(vm.PublicKeyMultibase) == 0 && len(vm.PublicKeyBase58) == 0 && vm.PublicKeyJWK == nil && k.PublicKeyJWK == nil {
+		return fmt.Errorf("%w: publicKeyMultibase or publicKeyJwk required", ErrorInvalidKey)
+	}
+	for _, purpose := range k.Purposes {
+		if !ValidPurpose(purpose) {
+			return fmt.Errorf("%w: unknown purpose %q", ErrorInvalidKey, purpose)
+		}
+	}
+	return nil
+}
+
+// ValidPurpose reports whether a key may be submitted for purpose, a
+// verification relationship compared case-insensitively.
+func ValidPurpose(purpose string) bool {
+	for _, relationship := range verificationRelationships {
+		if strings.EqualFold(purpose, relationship) {
+			return true
+		}
+	}
+	return false
+}
+
+// VersionedDocument is a snapshot of a DID document as it was registered at
+// a point in time.
+type VersionedDocument struct {
+	VersionID string           `json:"versionId"`
+	Created   time.Time        `json:"created"`
+	Document  *didweb.Document `json:"document"`
 }
 
-func (d *DIDStore) Register(doc *did.Document) error {
+// Version records and tombstones are stored next to the documents, under
+// keys starting with metadataPrefix. A document is stored under its did:web
+// id, which cannot contain a "/": path parts are escaped and hosts are
+// rejected by didweb.Parse when they contain one.
+const (
+	metadataPrefix  = "/"
+	historyPrefix   = metadataPrefix + "history/"
+	tombstonePrefix = metadataPrefix + "deactivated/"
+)
+
+// historyKeyPrefix is the prefix of every version record of id.
+func historyKeyPrefix(id string) string {
+	return historyPrefix + id + "/"
+}
+
+func versionKey(id string, version int) string {
+	return historyKeyPrefix(id) + strconv.Itoa(version)
+}
+
+// deactivatedKey is where the tombstone of a deactivated id is stored.
+func deactivatedKey(id string) string {
+	return tombstonePrefix + id
+}
+
+// isMetadataKey reports whether key holds a version, tombstone or probe
+// record rather than a document.
+func isMetadataKey(key string) bool {
+	return strings.HasPrefix(key, metadataPrefix)
+}
+
+// Register stores doc as the current document for its id and appends it to
+// the id's version history rather than overwriting prior versions.
+func (d *DIDStore) Register(doc *didweb.Document) error {
+	if d.readOnly() {
+		return storage.ErrReadOnly
+	}
 	bytes, err := json.Marshal(doc)
 	if err != nil {
 		return fmt.Errorf("invalid doc: %w", err)
@@ -91,43 +564,542 @@ func (d *DIDStore) Register(doc *did.Document) error {
 	if err != nil {
 		return fmt.Errorf("could not parse did doc id: %w", err)
 	}
-	if err := d.store.Set(didwebUrl.ID(), bytes); err != nil {
-		return fmt.Errorf("could not store: %w", err)
+	id := didwebUrl.ID()
+
+	return d.batch(func(tx storage.Tx) error {
+		if err := d.appendVersion(tx, id, doc); err != nil {
+			return err
+		}
+		if err := tx.Set(id, bytes); err != nil {
+			return fmt.Errorf("could not store: %w", err)
+		}
+		return nil
+	})
+}
+
+// batch runs fn in a single transaction when the storage supports it, and
+// directly against the storage otherwise.
+func (d *DIDStore) batch(fn func(tx storage.Tx) error) error {
+	if batcher, ok := d.store.(storage.Batcher); ok {
+		return batcher.Batch(fn)
 	}
+	return fn(d.store)
+}
 
+// appendVersion records doc as the next version in id's history. It should
+// run in the transaction that stores doc, so concurrent writes cannot claim
+// the same version.
+func (d *DIDStore) appendVersion(tx storage.Tx, id string, doc *didweb.Document) error {
+	version := 1
+	for ; ; version++ {
+		existing, err := get(tx, versionKey(id, version))
+		if err != nil {
+			return fmt.Errorf("could not load history: %w", err)
+		} else if len(existing) == 0 {
+			break
+		}
+	}
+	versionBytes, err := json.Marshal(VersionedDocument{
+		VersionID: strconv.Itoa(version),
+		Created:   d.now().UTC(),
+		Document:  doc,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid version: %w", err)
+	}
+	if err := tx.Set(versionKey(id, version), versionBytes); err != nil {
+		return fmt.Errorf("could not store version: %w", err)
+	}
 	return nil
 }
 
-func (d *DIDStore) Resolve(id string) (*did.Document, error) {
-	bytes, err := d.store.Get(id)
+// Resolve returns the current document for id, or an error wrapping
+// ErrorNotFound when there is none. Other errors mean the store failed.
+func (d *DIDStore) Resolve(id string) (*didweb.Document, error) {
+	bytes, err := get(d.store, id)
 	if err != nil {
 		return nil, fmt.Errorf("could not get from store: %w", err)
 	} else if len(bytes) == 0 {
-		return nil, fmt.Errorf("not found")
+		return nil, fmt.Errorf("%w: %s", ErrorNotFound, id)
 	}
-	var doc did.Document
+	var doc didweb.Document
 	if err := json.Unmarshal(bytes, &doc); err != nil {
 		return nil, fmt.Errorf("could not parse: %w", err)
 	}
 	return &doc, nil
 }
 
+// tombstone records when a DID was deactivated.
+type tombstone struct {
+	Deactivated time.Time `json:"deactivated"`
+}
+
+// Deactivate marks id as deactivated. Its last document stays resolvable,
+// with the deactivated flag set by ResolveWithMetadata. Deactivating an id
+// again keeps the original time.
+func (d *DIDStore) Deactivate(id string) error {
+	if d.readOnly() {
+		return storage.ErrReadOnly
+	}
+	if _, err := d.Resolve(id); err != nil {
+		return err
+	}
+	if deactivated, err := d.deactivated(id); err != nil || deactivated {
+		return err
+	}
+	bytes, err := json.Marshal(tombstone{Deactivated: d.now().UTC()})
+	if err != nil {
+		return fmt.Errorf("invalid tombstone: %w", err)
+	}
+	if err := d.store.Set(deactivatedKey(id), bytes); err != nil {
+		return fmt.Errorf("could not store tombstone: %w", err)
+	}
+	return nil
+}
+
+func (d *DIDStore) deactivated(id string) (bool, error) {
+	bytes, err := get(d.store, deactivatedKey(id))
+	if err != nil {
+		return false, fmt.Errorf("could not get from store: %w", err)
+	}
+	return len(bytes) > 0, nil
+}
+
+// ResolveWithMetadata is like Resolve but also reports whether id has been
+// deactivated.
+func (d *DIDStore) ResolveWithMetadata(id string) (*didweb.ResolveResult, error) {
+	doc, err := d.Resolve(id)
+	if err != nil {
+		return nil, err
+	}
+	deactivated, err := d.deactivated(id)
+	if err != nil {
+		return nil, err
+	}
+	return &didweb.ResolveResult{Document: doc, Deactivated: deactivated}, nil
+}
+
+// History returns every stored version of id, oldest first.
+func (d *DIDStore) History(id string) ([]VersionedDocument, error) {
+	history := []VersionedDocument{}
+	for version := 1; ; version++ {
+		bytes, err := get(d.store, versionKey(id, version))
+		if err != nil {
+			return nil, fmt.Errorf("could not get from store: %w", err)
+		} else if len(bytes) == 0 {
+			return history, nil
+		}
+		var versioned VersionedDocument
+		if err := json.Unmarshal(bytes, &versioned); err != nil {
+			return nil, fmt.Errorf("could not parse version %d: %w", version, err)
+		}
+		history = append(history, versioned)
+	}
+}
+
+// ResolveVersion returns the document stored for id at versionID, as reported
+// by History.
+func (d *DIDStore) ResolveVersion(id string, versionID string) (*didweb.Document, error) {
+	version, err := strconv.Atoi(versionID)
+	if err != nil || version < 1 {
+		return nil, fmt.Errorf("invalid version id: %s", versionID)
+	}
+	bytes, err := get(d.store, versionKey(id, version))
+	if err != nil {
+		return nil, fmt.Errorf("could not get from store: %w", err)
+	} else if len(bytes) == 0 {
+		return nil, fmt.Errorf("%w: %s version %s", ErrorNotFound, id, versionID)
+	}
+	var versioned VersionedDocument
+	if err := json.Unmarshal(bytes, &versioned); err != nil {
+		return nil, fmt.Errorf("could not parse: %w", err)
+	}
+	return versioned.Document, nil
+}
+
+// ResolveVersionTime returns the newest version of id created at or before
+// versionTime.
+func (d *DIDStore) ResolveVersionTime(id string, versionTime time.Time) (*didweb.Document, error) {
+	history, err := d.History(id)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if !history[i].Created.After(versionTime) {
+			return history[i].Document, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s at %s", ErrorVersionNotFound, id, versionTime.Format(time.RFC3339))
+}
+
+// ForEach calls fn for each current document whose id is at or after seek in
+// key order, skipping version history entries. Iteration stops early when fn
+// returns false.
+func (d *DIDStore) ForEach(seek string, fn func(id string, doc *didweb.Document) bool) error {
+	var parseErr error
+	err := d.store.ForEach(seek, func(id string, value []byte) bool {
+		if isMetadataKey(id) {
+			return true
+		}
+		var doc didweb.Document
+		if err := json.Unmarshal(value, &doc); err != nil {
+			parseErr = fmt.Errorf("could not parse %s: %w", id, err)
+			return false
+		}
+		return fn(id, &doc)
+	})
+	if err != nil {
+		return fmt.Errorf("could not iterate store: %w", err)
+	}
+	return parseErr
+}
+
+// Pager is implemented by storage that can list keys a page at a time.
+type Pager interface {
+	ListPage(cursor string, limit int, opts ...storage.ListOption) ([]string, string, error)
+}
+
+// ListPage returns up to limit stored ids starting with prefix in key order,
+// starting at cursor. nextCursor is the id the following page starts at, or
+// empty after the last page.
+func (d *DIDStore) ListPage(cursor string, limit int, prefix string) (ids []string, nextCursor string, err error) {
+	isDocument := func(key string) bool { return !isMetadataKey(key) }
+	if pager, ok := d.store.(Pager); ok {
+		return pager.ListPage(cursor, limit, storage.WithPrefix(prefix), storage.WithKeyFilter(isDocument))
+	}
+
+	if limit < 1 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	seek := cursor
+	if seek < prefix {
+		seek = prefix
+	}
+	ids = []string{}
+	err = d.store.ForEach(seek, func(id string, _ []byte) bool {
+		if !strings.HasPrefix(id, prefix) {
+			return false
+		}
+		if !isDocument(id) {
+			return true
+		}
+		if len(ids) == limit {
+			nextCursor = id
+			return false
+		}
+		ids = append(ids, id)
+		return true
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("could not iterate store: %w", err)
+	}
+	return ids, nextCursor, nil
+}
+
+// Count returns how many documents are stored under ids starting with
+// prefix. It only lists keys, without reading the documents.
+func (d *DIDStore) Count(prefix string) (int, error) {
+	keys, err := d.store.List(prefix)
+	if err != nil {
+		return 0, fmt.Errorf("could not list store: %w", err)
+	}
+	count := 0
+	for _, key := range keys {
+		if !isMetadataKey(key) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Ping checks the underlying storage is usable, falling back to a read when
+// it cannot check itself.
+func (d *DIDStore) Ping() error {
+	if pinger, ok := d.store.(Pinger); ok {
+		return pinger.Ping()
+	}
+	_, err := get(d.store, "::ping")
+	return err
+}
+
+// healthProbePrefix is the prefix of the records Probe writes and removes
+// again.
+const healthProbePrefix = metadataPrefix + "health/"
+
+// ErrorProbeMismatch is returned by Probe when the storage reads back other
+// than what was written.
+var ErrorProbeMismatch = fmt.Errorf("probe read back a different value")
+
+// Probe checks the underlying storage with a write, read and delete of a
+// probe record, or with Ping when the storage is read-only. Each call uses a
+// record of its own, so concurrent probes do not read each other's writes.
+func (d *DIDStore) Probe() error {
+	if d.readOnly() {
+		return d.Ping()
+	}
+	value := make([]byte, 16)
+	if _, err := rand.Read(value); err != nil {
+		return fmt.Errorf("could not create probe: %w", err)
+	}
+	key := healthProbePrefix + hex.EncodeToString(value[:8])
+	if err := d.store.Set(key, value); err != nil {
+		return fmt.Errorf("could not write probe: %w", err)
+	}
+	got, err := d.store.Get(key)
+	if err != nil {
+		return fmt.Errorf("could not read probe: %w", err)
+	}
+	if !bytes.Equal(got, value) {
+		return ErrorProbeMismatch
+	}
+	if err := d.store.Delete(key); err != nil {
+		return fmt.Errorf("could not delete probe: %w", err)
+	}
+	return nil
+}
+
+// ErrorBackupUnsupported is returned by Backup when the underlying storage
+// cannot be backed up.
+var ErrorBackupUnsupported = storage.ErrBackupUnsupported
+
+// Backup writes a backup of the underlying storage to dst.
+func (d *DIDStore) Backup(dst io.Writer) error {
+	backuper, ok := d.store.(Backuper)
+	if !ok {
+		return ErrorBackupUnsupported
+	}
+	return backuper.Backup(dst)
+}
+
+// readOnly reports whether the underlying storage refuses writes.
+func (d *DIDStore) readOnly() bool {
+	ro, ok := d.store.(ReadOnlyStorage)
+	return ok && ro.ReadOnly()
+}
+
+// Delete purges id: its current document, every version of its history and
+// its tombstone, if it was deactivated.
 func (d *DIDStore) Delete(id string) error {
-	return d.store.Delete(id)
+	if d.readOnly() {
+		return storage.ErrReadOnly
+	}
+	keys, err := d.store.List(historyKeyPrefix(id))
+	if err != nil {
+		return fmt.Errorf("could not list history: %w", err)
+	}
+	keys = append(keys, deactivatedKey(id), id)
+	return d.batch(func(tx storage.Tx) error {
+		for _, key := range keys {
+			if err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const (
+	// DefaultAmount is the invoice amount in satoshis when WithAmount is not set.
+	DefaultAmount = 69
+	// DefaultMemoTemplate is the invoice memo when WithMemoTemplate is not set.
+	DefaultMemoTemplate = "Register {id}"
+	// DefaultExpiry is the invoice expiry in seconds when WithExpiry is not set.
+	DefaultExpiry = 3600
+	// DefaultCleanupInterval is how often expired pending registrations are
+	// removed when WithCleanupInterval is not set.
+	DefaultCleanupInterval = time.Hour
+	// DefaultAPIHost is the public LNBits instance.
+	DefaultAPIHost = "legend.lnbits.com"
+	// DefaultWebhookBaseURL is where payment webhooks are sent when
+	// WithWebhookBaseURL is not set.
+	DefaultWebhookBaseURL = "https://did-web.onrender.com"
+
+	pendingPrefix = "pending:"
+	secretPrefix  = "secret:"
+)
+
+var (
+	ErrorPendingNotFound  = fmt.Errorf("pending registration not found")
+	ErrorInvalidSignature = fmt.Errorf("invalid webhook signature")
+	ErrorInvalidToken     = fmt.Errorf("invalid webhook token")
+	ErrorNoPaymentHash    = fmt.Errorf("pending registration has no payment hash")
+)
+
+// WebhookTokenParam is the query parameter of the webhook URL given to the
+// payment provider that carries the invoice's webhook secret.
+const WebhookTokenParam = "token"
+
+type RegisterOption func(s *RegisterStore) error
+
+// WithAmount sets the invoice amount in satoshis.
+func WithAmount(sats int) RegisterOption {
+	return func(s *RegisterStore) error {
+		s.amount = sats
+		return nil
+	}
+}
+
+// WithMemoTemplate sets the invoice memo. {id} is replaced with the DID being
+// registered and {domain} with its host.
+func WithMemoTemplate(template string) RegisterOption {
+	return func(s *RegisterStore) error {
+		s.memoTemplate = template
+		return nil
+	}
+}
+
+// WithExpiry sets how many seconds an invoice stays payable.
+func WithExpiry(seconds int) RegisterOption {
+	return func(s *RegisterStore) error {
+		s.expiry = seconds
+		return nil
+	}
+}
+
+// WithHTTPClient sets the client used to talk to the payment provider.
+func WithHTTPClient(client *http.Client) RegisterOption {
+	return func(s *RegisterStore) error {
+		s.client = client
+		return nil
+	}
+}
+
+// WithWebhookSecret sets a secret shared with the payment provider, or a
+// proxy in front of the server, that webhooks are signed with. Webhooks are
+// then checked by their signature instead of the per-invoice token.
+func WithWebhookSecret(secret string) RegisterOption {
+	return func(s *RegisterStore) error {
+		s.webhookSecret = []byte(secret)
+		return nil
+	}
+}
+
+// WithWebhookBaseURL sets the URL of the server payment webhooks are sent
+// to, which must serve /paid/{id}.
+func WithWebhookBaseURL(baseURL string) RegisterOption {
+	return func(s *RegisterStore) error {
+		u, err := url.Parse(baseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("invalid webhook base url %q", baseURL)
+		}
+		s.webhookBaseURL = strings.TrimSuffix(baseURL, "/")
+		return nil
+	}
+}
+
+// parseAPIHost parses the LNBits host given to NewRegisterStore.
+func parseAPIHost(apiHost string) (*url.URL, error) {
+	rawURL := apiHost
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || len(u.Hostname()) == 0 || u.User != nil || len(u.RawQuery) > 0 || len(u.Fragment) > 0 {
+		return nil, fmt.Errorf("invalid api host %q: must be a host name or https url", apiHost)
+	}
+	return u, nil
+}
+
+// WithCleanupInterval sets how often Start removes expired pending
+// registrations.
+func WithCleanupInterval(d time.Duration) RegisterOption {
+	return func(s *RegisterStore) error {
+		s.cleanupInterval = d
+		return nil
+	}
 }
 
 type RegisterStore struct {
-	apiHost string
-	apiKey  string
-	store   Storage
+	apiHost         string
+	apiURL          string
+	apiKey          string
+	store           Storage
+	client          *http.Client
+	amount          int
+	memoTemplate    string
+	expiry          int
+	cleanupInterval time.Duration
+	webhookSecret   []byte
+	webhookBaseURL  string
+	now             func() time.Time
+
+	// idempotencyMu guards idempotencyLocks, which holds a lock for each
+	// idempotency key in use.
+	idempotencyMu    sync.Mutex
+	idempotencyLocks map[string]*keyLock
+}
+
+// NewRegisterStore creates invoices with the LNBits instance at apiHost,
+// either a bare host name, reached over HTTPS, or an https:// URL.
+func NewRegisterStore(apiHost, apiKey string, storage Storage, opts ...RegisterOption) (*RegisterStore, error) {
+	apiURL, err := parseAPIHost(apiHost)
+	if err != nil {
+		return nil, err
+	}
+	s := &RegisterStore{
+		apiHost:      apiURL.Host,
+		apiURL:       strings.TrimSuffix(apiURL.String(), "/"),
+		apiKey:       apiKey,
+		store:        storage,
+		client:       http.DefaultClient,
+		amount:       DefaultAmount,
+		memoTemplate: DefaultMemoTemplate,
+		expiry:       DefaultExpiry,
+
+		cleanupInterval: DefaultCleanupInterval,
+		webhookBaseURL:  DefaultWebhookBaseURL,
+		now:             time.Now,
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	if len(s.memoTemplate) == 0 {
+		return nil, fmt.Errorf("memo template required")
+	}
+	if s.expiry <= 0 {
+		return nil, fmt.Errorf("expiry must be positive")
+	}
+	if s.client == nil {
+		return nil, fmt.Errorf("http client required")
+	}
+	if s.cleanupInterval <= 0 {
+		return nil, fmt.Errorf("cleanup interval must be positive")
+	}
+
+	return s, nil
 }
 
-func NewRegisterStore(apiHost, apiKey string, storage Storage) *RegisterStore {
-	return &RegisterStore{
-		apiHost: apiHost,
-		apiKey:  apiKey,
-		store:   storage,
+func (s *RegisterStore) memo(doc *didweb.Document) string {
+	domain := ""
+	if didwebUrl, err := didweb.Parse(doc.ID); err == nil {
+		domain = didwebUrl.Host()
 	}
+	return strings.NewReplacer("{id}", doc.ID, "{domain}", domain).Replace(s.memoTemplate)
+}
+
+// PendingRegistration is the metadata kept for an invoice that has been
+// issued but not yet paid.
+type PendingRegistration struct {
+	Nonce          string    `json:"nonce"`
+	DID            string    `json:"did"`
+	PaymentHash    string    `json:"payment_hash,omitempty"`
+	PaymentRequest string    `json:"payment_request,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+func pendingKey(nonce string) string {
+	return pendingPrefix + nonce
+}
+
+func secretKey(nonce string) string {
+	return secretPrefix + nonce
 }
 
 type PaymentResponse struct {
@@ -135,30 +1107,38 @@ type PaymentResponse struct {
 	PaymentRequest string `json:"payment_request"`
 }
 
-func (s *RegisterStore) Get(doc *did.Document) (string, bool) {
-	payReq, err := s.store.Get(doc.ID)
-	if err != nil || len(payReq) == 0 {
-		return "", false
+// Get returns the pending registration of doc while its invoice can still be
+// paid. A registration whose invoice is no longer valid is deleted.
+func (s *RegisterStore) Get(doc *didweb.Document) (*PendingRegistration, bool) {
+	value, err := get(s.store, doc.ID)
+	if err != nil || len(value) == 0 {
+		return nil, false
+	}
+	var registration PendingRegistration
+	if err := json.Unmarshal(value, &registration); err != nil {
+		// Records written before registrations were stored as JSON hold
+		// only the payment request.
+		registration = PendingRegistration{DID: doc.ID, PaymentRequest: string(value)}
 	}
 
-	if s.validatePaymentRequest(string(payReq)) {
-		return string(payReq), true
+	if s.validatePaymentRequest(registration.PaymentRequest) {
+		return &registration, true
 	} else {
 		fmt.Printf("Invalid Pay Req... deleting record\n")
 		if err := s.store.Delete(doc.ID); err != nil {
-			return "", false
+			return nil, false
 		}
-		return "", false
+		return nil, false
 	}
 
 }
 
-func (s *RegisterStore) Paid(id string) (*did.Document, error) {
-	docBytes, err := s.store.Get(id)
+func (s *RegisterStore) Paid(id string) (*didweb.Document, error) {
+	docBytes, err := get(s.store, id)
 	if err != nil {
 		return nil, fmt.Errorf("invalid url: %w", err)
 	}
-	var doc did.Document
+	var doc didweb.Document
 	if err := json.Unmarshal(docBytes, &doc); err != nil {
 		return nil, fmt.Errorf("invalid document: %w", err)
 	}
@@ -166,13 +1146,42 @@ func (s *RegisterStore) Paid(id string) (*did.Document, error) {
 	if err := s.store.Delete(id); err != nil {
 		return nil, fmt.Errorf("could not delete secret: %w", err)
 	}
+	s.store.Delete(pendingKey(id))
+	s.store.Delete(secretKey(id))
 	s.store.Delete(doc.ID)
 
 	return &doc, nil
 }
 
-func (s *RegisterStore) Register(doc *did.Document) (*PaymentResponse, error) {
+func (s *RegisterStore) Register(doc *didweb.Document) (*PaymentResponse, error) {
+	return s.RegisterContext(context.Background(), doc)
+}
+
+// tracerName names the tracer registration spans are recorded with. Spans
+// are dropped unless a global tracer provider has been set.
+const tracerName = "github.com/13x-tech/go-did-web/pkg/storage/didstorage"
+
+// RegisterContext is like Register but carries ctx on the invoice request and
+// records a span with the global tracer provider.
+func (s *RegisterStore) RegisterContext(ctx context.Context, doc *didweb.Document) (*PaymentResponse, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "didstorage.Register",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("did.id", doc.ID),
+			attribute.String("server.address", s.apiHost),
+		),
+	)
+	defer span.End()
+
+	response, err := s.register(ctx, span, doc)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return response, err
+}
 
+func (s *RegisterStore) register(ctx context.Context, span trace.Span, doc *didweb.Document) (*PaymentResponse, error) {
 	if doc.ID == "" {
 		return nil, fmt.Errorf("invalid did doc")
 	}
@@ -186,6 +1195,10 @@ func (s *RegisterStore) Register(doc *did.Document) (*PaymentResponse, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not generate randomess: %w", err)
 	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("could not generate webhook secret: %w", err)
+	}
 
 	request := struct {
 		Out     bool   `json:"out"`
@@ -196,9 +1209,10 @@ func (s *RegisterStore) Register(doc *did.Document) (*PaymentResponse, error) {
 		WebHook string `json:"webhook,omitempty"`
 	}{
 		Out:     false,
-		Memo:    fmt.Sprintf("Register %s", doc.ID),
-		Amount:  69,
-		WebHook: fmt.Sprintf("https://did-web.onrender.com/paid/%x", nonce),
+		Memo:    s.memo(doc),
+		Amount:  s.amount,
+		Expiry:  s.expiry,
+		WebHook: fmt.Sprintf("%s/paid/%x?%s=%x", s.webhookBaseURL, nonce, WebhookTokenParam, secret),
 	}
 
 	jsonRequest, err := json.Marshal(request)
@@ -206,18 +1220,20 @@ func (s *RegisterStore) Register(doc *did.Document) (*PaymentResponse, error) {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/api/v1/payments", s.apiHost), strings.NewReader(string(jsonRequest)))
+	req, err := http.NewRequestWithContext(ctx, "POST", s.apiURL+"/api/v1/payments", strings.NewReader(string(jsonRequest)))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("X-Api-Key", s.apiKey)
 	req.Header.Add("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("could not do request: %w", err)
 	}
 
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
 	responseData, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("could not read body: %w", err)
@@ -232,29 +1248,269 @@ func (s *RegisterStore) Register(doc *did.Document) (*PaymentResponse, error) {
 		return nil, fmt.Errorf("could not parse: %w", err)
 	}
 
-	if err := s.store.Set(fmt.Sprintf("%x", nonce), docJSON); err != nil {
-		return nil, fmt.Errorf("could not store payment request: %w", err)
+	nonceHex := fmt.Sprintf("%x", nonce)
+	createdAt := s.now().UTC()
+	pendingJSON, err := json.Marshal(PendingRegistration{
+		Nonce:          nonceHex,
+		DID:            doc.ID,
+		PaymentHash:    response.PaymentHash,
+		PaymentRequest: response.PaymentRequest,
+		CreatedAt:      createdAt,
+		ExpiresAt:      createdAt.Add(time.Duration(s.expiry) * time.Second),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal pending registration: %w", err)
 	}
 
-	if err := s.store.Set(doc.ID, []byte(response.PaymentRequest)); err != nil {
-		return nil, fmt.Errorf("could not store payment request: %w", err)
+	// The records are written together where storage allows, so a failure
+	// part way does not leave some of them behind for Repair.
+	if err := s.batch(func(tx storage.Tx) error {
+		if err := s.setPending(tx, nonceHex, docJSON); err != nil {
+			return fmt.Errorf("could not store document: %w", err)
+		}
+		if err := tx.Set(doc.ID, pendingJSON); err != nil {
+			return fmt.Errorf("could not store payment request: %w", err)
+		}
+		if err := tx.Set(pendingKey(nonceHex), pendingJSON); err != nil {
+			return fmt.Errorf("could not store pending registration: %w", err)
+		}
+		if err := s.setPending(tx, secretKey(nonceHex), secret); err != nil {
+			return fmt.Errorf("could not store webhook secret: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
 	return &response, nil
 }
 
+// batch runs fn in a single transaction when the storage supports it, and
+// directly against the storage otherwise.
+func (s *RegisterStore) batch(fn func(tx storage.Tx) error) error {
+	if batcher, ok := s.store.(storage.Batcher); ok {
+		return batcher.Batch(fn)
+	}
+	return fn(s.store)
+}
+
+// ttlSetter is implemented by storage and transactions that can expire
+// records.
+type ttlSetter interface {
+	SetWithTTL(id string, value []byte, ttl time.Duration) error
+}
+
+// setPending stores a record in store that is only useful until the invoice
+// expires, letting storage expire it when supported.
+func (s *RegisterStore) setPending(store storage.Tx, id string, value []byte) error {
+	if expirable, ok := store.(ttlSetter); ok {
+		return expirable.SetWithTTL(id, value, time.Duration(s.expiry)*time.Second)
+	}
+	return store.Set(id, value)
+}
+
+// Pending returns every registration that has been issued an invoice but has
+// not been paid.
+func (s *RegisterStore) Pending() ([]PendingRegistration, error) {
+	pending := []PendingRegistration{}
+	var parseErr error
+	if err := s.store.ForEach(pendingPrefix, func(id string, value []byte) bool {
+		if !strings.HasPrefix(id, pendingPrefix) {
+			return false
+		}
+		var registration PendingRegistration
+		if err := json.Unmarshal(value, &registration); err != nil {
+			parseErr = fmt.Errorf("could not parse %s: %w", id, err)
+			return false
+		}
+		pending = append(pending, registration)
+		return true
+	}); err != nil {
+		return nil, fmt.Errorf("could not iterate store: %w", err)
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return pending, nil
+}
+
+// PendingFor returns the latest pending registration of the DID id.
+func (s *RegisterStore) PendingFor(id string) (PendingRegistration, error) {
+	pending, err := s.Pending()
+	if err != nil {
+		return PendingRegistration{}, err
+	}
+	var latest PendingRegistration
+	for _, registration := range pending {
+		if registration.DID == id && registration.ExpiresAt.After(latest.ExpiresAt) {
+			latest = registration
+		}
+	}
+	if len(latest.Nonce) == 0 {
+		return PendingRegistration{}, ErrorPendingNotFound
+	}
+	return latest, nil
+}
+
+// DeletePending removes a pending registration along with its stored
+// document, and its payment request unless the DID has been registered
+// again since.
+func (s *RegisterStore) DeletePending(nonce string) error {
+	pendingBytes, err := get(s.store, pendingKey(nonce))
+	if err != nil {
+		return fmt.Errorf("could not get from store: %w", err)
+	} else if len(pendingBytes) == 0 {
+		return ErrorPendingNotFound
+	}
+	var registration PendingRegistration
+	if err := json.Unmarshal(pendingBytes, &registration); err != nil {
+		return fmt.Errorf("invalid pending registration: %w", err)
+	}
+
+	if err := s.store.Delete(nonce); err != nil {
+		return fmt.Errorf("could not delete document: %w", err)
+	}
+	// A later registration of the DID replaces its payment request, which
+	// must then be left alone.
+	current, err := get(s.store, registration.DID)
+	if err != nil {
+		return fmt.Errorf("could not get payment request: %w", err)
+	}
+	var currentRegistration PendingRegistration
+	if json.Unmarshal(current, &currentRegistration) != nil {
+		currentRegistration = PendingRegistration{PaymentRequest: string(current)}
+	}
+	if currentRegistration.Nonce == nonce || (len(currentRegistration.Nonce) == 0 && currentRegistration.PaymentRequest == registration.PaymentRequest) {
+		if err := s.store.Delete(registration.DID); err != nil {
+			return fmt.Errorf("could not delete payment request: %w", err)
+		}
+	}
+	if err := s.store.Delete(secretKey(nonce)); err != nil {
+		return fmt.Errorf("could not delete webhook secret: %w", err)
+	}
+	if err := s.store.Delete(pendingKey(nonce)); err != nil {
+		return fmt.Errorf("could not delete pending registration: %w", err)
+	}
+	return nil
+}
+
+// WebhookSecret returns the secret generated for the invoice identified by
+// nonce, which the payment provider is given as the token of the webhook
+// URL.
+func (s *RegisterStore) WebhookSecret(nonce string) ([]byte, error) {
+	secret, err := get(s.store, secretKey(nonce))
+	if err != nil {
+		return nil, fmt.Errorf("could not get from store: %w", err)
+	} else if len(secret) == 0 {
+		return nil, ErrorPendingNotFound
+	}
+	return secret, nil
+}
+
+// VerifyWebhook authenticates the payment webhook of the invoice nonce. When
+// a shared webhook secret is set, signature must be the hex encoded
+// HMAC-SHA256 of body keyed with it. Otherwise token, taken from the webhook
+// URL, must be the invoice's webhook secret.
+func (s *RegisterStore) VerifyWebhook(nonce, token string, body []byte, signature string) error {
+	secret, err := s.WebhookSecret(nonce)
+	if err != nil {
+		return err
+	}
+	if len(s.webhookSecret) == 0 {
+		// LNBits cannot sign webhooks, so the secret it was given in the
+		// webhook URL is all it can prove itself with.
+		if got, err := hex.DecodeString(token); err != nil || !hmac.Equal(got, secret) {
+			return ErrorInvalidToken
+		}
+		return nil
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return ErrorInvalidSignature
+	}
+	mac := hmac.New(sha256.New, s.webhookSecret)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return ErrorInvalidSignature
+	}
+	return nil
+}
+
+// IsPaid asks the payment provider whether the invoice of the pending
+// registration nonce has been paid.
+func (s *RegisterStore) IsPaid(nonce string) (bool, error) {
+	pendingBytes, err := get(s.store, pendingKey(nonce))
+	if err != nil {
+		return false, fmt.Errorf("could not get from store: %w", err)
+	} else if len(pendingBytes) == 0 {
+		return false, ErrorPendingNotFound
+	}
+	var registration PendingRegistration
+	if err := json.Unmarshal(pendingBytes, &registration); err != nil {
+		return false, fmt.Errorf("could not parse pending registration: %w", err)
+	}
+	if len(registration.PaymentHash) == 0 {
+		return false, ErrorNoPaymentHash
+	}
+
+	req, err := http.NewRequest("GET", s.apiURL+"/api/v1/payments/"+url.PathEscape(registration.PaymentHash), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Add("X-Api-Key", s.apiKey)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("could not do request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("invalid status code: %d - %s", resp.StatusCode, resp.Status)
+	}
+	var status struct {
+		Paid bool `json:"paid"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&status); err != nil {
+		return false, fmt.Errorf("could not parse: %w", err)
+	}
+	return status.Paid, nil
+}
+
+// ErrorProviderStatus is returned by CheckProvider when the payment provider
+// answers, but not successfully.
+var ErrorProviderStatus = fmt.Errorf("unexpected payment provider status")
+
+// CheckProvider checks the payment provider is reachable and accepts the API
+// key by fetching the wallet details.
+func (s *RegisterStore) CheckProvider(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.apiURL+"/api/v1/wallet", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("X-Api-Key", s.apiKey)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not do request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %d", ErrorProviderStatus, resp.StatusCode)
+	}
+	return nil
+}
+
 func (s *RegisterStore) validatePaymentRequest(payReq string) bool {
 	jsonRequest, _ := json.Marshal(struct {
 		Data string `json:"data"`
 	}{Data: payReq})
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/api/v1/payments", s.apiHost), strings.NewReader(string(jsonRequest)))
+	req, err := http.NewRequest("POST", s.apiURL+"/api/v1/payments", strings.NewReader(string(jsonRequest)))
 	if err != nil {
 		return false
 	}
 	req.Header.Add("X-Api-Key", s.apiKey)
 	req.Header.Add("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.client.Do(req)
 	if err != nil {
 		return false
 	}
@@ -275,3 +1531,49 @@ func (s *RegisterStore) validatePaymentRequest(payReq string) bool {
 	}
 	return false
 }
+
+// Start removes expired pending registrations every cleanup interval until ctx
+// is cancelled.
+func (s *RegisterStore) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.cleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Cleanup(); err != nil {
+					log.Printf("could not clean up pending registrations: %s\n", err.Error())
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Cleanup removes every pending registration whose invoice has expired.
+func (s *RegisterStore) Cleanup() error {
+	keys, err := s.store.List(pendingPrefix)
+	if err != nil {
+		return fmt.Errorf("could not list pending registrations: %w", err)
+	}
+
+	now := s.now()
+	for _, key := range keys {
+		pendingBytes, err := get(s.store, key)
+		if err != nil || len(pendingBytes) == 0 {
+			continue
+		}
+		var registration PendingRegistration
+		if err := json.Unmarshal(pendingBytes, &registration); err != nil {
+			continue
+		}
+		if now.Before(registration.ExpiresAt) {
+			continue
+		}
+		if err := s.DeletePending(registration.Nonce); err != nil && !errors.Is(err, ErrorPendingNotFound) {
+			return fmt.Errorf("could not delete %s: %w", registration.Nonce, err)
+		}
+	}
+	return s.cleanupIdempotencyKeys()
+}
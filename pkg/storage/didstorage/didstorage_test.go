@@ -0,0 +1,646 @@
+package didstorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/storage"
+	"github.com/TBD54566975/ssi-sdk/cryptosuite"
+	"github.com/TBD54566975/ssi-sdk/did"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStore(t *testing.T) *DIDStore {
+	store, err := storage.New(t.TempDir(), "did")
+	assert.NoError(t, err)
+	return NewDIDStore(store)
+}
+
+func testKey(id string, purposes ...string) KeyInput {
+	return KeyInput{
+		Purposes: purposes,
+		VerificationMethod: did.VerificationMethod{
+			ID:                 id,
+			Type:               cryptosuite.Ed25519VerificationKey2018,
+			PublicKeyMultibase: "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK",
+		},
+	}
+}
+
+func testDocument(t *testing.T, id string, keys ...KeyInput) *didweb.Document {
+	if len(keys) == 0 {
+		keys = []KeyInput{testKey("key-1", "assertionMethod")}
+	}
+	doc, err := DIDFromProps(id, keys, nil)
+	assert.NoError(t, err)
+	return doc
+}
+
+func TestDIDStoreHistory(t *testing.T) {
+	store := newTestStore(t)
+
+	first := testDocument(t, "example.com:alice")
+	assert.NoError(t, store.Register(first))
+
+	second := testDocument(t, "example.com:alice",
+		testKey("key-1", "assertionMethod"),
+		testKey("key-2", "authentication"),
+	)
+	assert.NoError(t, store.Register(second))
+
+	current, err := store.Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Len(t, current.VerificationMethod, 2)
+
+	history, err := store.History("example.com:alice")
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, "1", history[0].VersionID)
+	assert.Equal(t, "2", history[1].VersionID)
+	assert.False(t, history[1].Created.Before(history[0].Created))
+	assert.Len(t, history[0].Document.VerificationMethod, 1)
+
+	old, err := store.ResolveVersion("example.com:alice", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "did:web:example.com:alice", old.ID)
+	assert.Len(t, old.VerificationMethod, 1)
+
+	_, err = store.ResolveVersion("example.com:alice", "3")
+	assert.Error(t, err)
+	_, err = store.ResolveVersion("example.com:alice", "latest")
+	assert.Error(t, err)
+}
+
+func TestDIDStoreHistoryVersionLikeID(t *testing.T) {
+	store := newTestStore(t)
+
+	// The second version of example.com:api must not be mistaken for the
+	// document of example.com:api:v2, or the other way round.
+	assert.NoError(t, store.Register(testDocument(t, "example.com:api")))
+	assert.NoError(t, store.Register(testDocument(t, "example.com:api",
+		testKey("key-1", "assertionMethod"),
+		testKey("key-2", "authentication"),
+	)))
+	assert.NoError(t, store.Register(testDocument(t, "example.com:api:v2")))
+	assert.NoError(t, store.Register(testDocument(t, "example.com:api:deactivated")))
+
+	ids, _, err := store.ListPage("", 10, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com:api", "example.com:api:deactivated", "example.com:api:v2"}, ids)
+
+	versioned, err := store.Resolve("example.com:api:v2")
+	assert.NoError(t, err)
+	assert.Equal(t, "did:web:example.com:api:v2", versioned.ID)
+	assert.Len(t, versioned.VerificationMethod, 1)
+
+	history, err := store.History("example.com:api")
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	history, err = store.History("example.com:api:v2")
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	result, err := store.ResolveWithMetadata("example.com:api")
+	assert.NoError(t, err)
+	assert.False(t, result.Deactivated)
+}
+
+func TestDIDStoreHistoryUnknown(t *testing.T) {
+	store := newTestStore(t)
+
+	history, err := store.History("example.com:nobody")
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+// brokenStorage is Storage whose reads fail.
+type brokenStorage struct {
+	Storage
+}
+
+func (brokenStorage) Get(id string) ([]byte, error) {
+	return nil, fmt.Errorf("disk error")
+}
+
+func TestDIDStoreResolveErrors(t *testing.T) {
+	store := newTestStore(t)
+	_, err := store.Resolve("example.com:nobody")
+	assert.ErrorIs(t, err, ErrorNotFound)
+
+	broken := NewDIDStore(brokenStorage{store.store})
+	_, err = broken.Resolve("example.com:nobody")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrorNotFound)
+}
+
+func TestDIDStoreDeactivate(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.Register(testDocument(t, "example.com:alice")))
+	assert.NoError(t, store.Register(testDocument(t, "example.com:bob")))
+
+	result, err := store.ResolveWithMetadata("example.com:alice")
+	assert.NoError(t, err)
+	assert.False(t, result.Deactivated)
+
+	assert.NoError(t, store.Deactivate("example.com:alice"))
+	assert.NoError(t, store.Deactivate("example.com:alice"))
+	assert.ErrorIs(t, store.Deactivate("example.com:nobody"), ErrorNotFound)
+
+	result, err = store.ResolveWithMetadata("example.com:alice")
+	assert.NoError(t, err)
+	assert.True(t, result.Deactivated)
+	assert.Equal(t, "did:web:example.com:alice", result.Document.ID)
+	doc, err := store.Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "did:web:example.com:alice", doc.ID)
+
+	// The tombstone is not listed as a document of its own.
+	ids, _, err := store.ListPage("", 10, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com:alice", "example.com:bob"}, ids)
+
+	// Purging removes the document, its history and its tombstone.
+	assert.NoError(t, store.Delete("example.com:alice"))
+	_, err = store.ResolveWithMetadata("example.com:alice")
+	assert.ErrorIs(t, err, ErrorNotFound)
+	history, err := store.History("example.com:alice")
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+	keys, err := store.store.List("")
+	assert.NoError(t, err)
+	for _, key := range keys {
+		assert.NotContains(t, key, "example.com:alice")
+	}
+	assert.NoError(t, store.Register(testDocument(t, "example.com:alice")))
+	result, err = store.ResolveWithMetadata("example.com:alice")
+	assert.NoError(t, err)
+	assert.False(t, result.Deactivated)
+	history, err = store.History("example.com:alice")
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestBuildDocumentAlsoKnownAs(t *testing.T) {
+	keys := []KeyInput{testKey("key-1", "assertionMethod")}
+
+	tt := []struct {
+		name        string
+		alsoKnownAs []string
+		expected    string
+		expectErr   bool
+	}{
+		{"none", nil, `{}`, false},
+		{"did key", []string{"did:key:z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"}, `{"alsoKnownAs":["did:key:z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"]}`, false},
+		{"https profile", []string{"https://mastodon.social/@alice"}, `{"alsoKnownAs":["https://mastodon.social/@alice"]}`, false},
+		{"multiple", []string{"mailto:alice@example.com", "https://mastodon.social/@alice"}, `{"alsoKnownAs":["mailto:alice@example.com","https://mastodon.social/@alice"]}`, false},
+		{"not a uri", []string{"alice"}, "", true},
+		{"one not a uri", []string{"mailto:alice@example.com", "alice"}, "", true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			doc, err := BuildDocument("example.com:alice", keys, nil, WithAlsoKnownAs(tc.alsoKnownAs))
+			if tc.expectErr {
+				assert.ErrorIs(t, err, ErrorInvalidAlsoKnownAs)
+				return
+			}
+			assert.NoError(t, err)
+
+			store := newTestStore(t)
+			assert.NoError(t, store.Register(doc))
+			stored, err := store.Resolve("example.com:alice")
+			assert.NoError(t, err)
+			assert.Equal(t, tc.alsoKnownAs, stored.AlsoKnownAs)
+
+			raw, err := json.Marshal(stored)
+			assert.NoError(t, err)
+			var serialized struct {
+				AlsoKnownAs json.RawMessage `json:"alsoKnownAs,omitempty"`
+			}
+			assert.NoError(t, json.Unmarshal(raw, &serialized))
+			reserialized, err := json.Marshal(serialized)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(reserialized))
+
+			history, err := store.History("example.com:alice")
+			assert.NoError(t, err)
+			if assert.Len(t, history, 1) {
+				assert.Equal(t, tc.alsoKnownAs, history[0].Document.AlsoKnownAs)
+			}
+		})
+	}
+}
+
+func TestDIDFromPropsVerificationMethodID(t *testing.T) {
+	tt := []struct {
+		input     string
+		expected  string
+		expectErr bool
+	}{
+		{"key-1", "#key-1", false},
+		{"#key-1", "#key-1", false},
+		{"did:web:example.com:alice#key-1", "#key-1", false},
+		{"did:web:example.com:bob#key-1", "", true},
+		{"did:key:z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK#key-1", "", true},
+		{"did:web:example.com:alice", "", true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.input, func(t *testing.T) {
+			doc, err := DIDFromProps("example.com:alice", []KeyInput{testKey(tc.input, "assertionMethod", "authentication")}, nil)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, doc.VerificationMethod[0].ID)
+			assert.Equal(t, []did.VerificationMethodSet{tc.expected}, doc.AssertionMethod)
+			assert.Equal(t, []did.VerificationMethodSet{tc.expected}, doc.Authentication)
+		})
+	}
+}
+
+func TestDIDFromPropsEmbed(t *testing.T) {
+	purposes := []string{"authentication", "assertionMethod", "keyAgreement", "capabilityInvocation", "capabilityDelegation"}
+	for _, purpose := range purposes {
+		for _, embed := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s embed=%t", purpose, embed), func(t *testing.T) {
+				key := testKey("key-2", purpose)
+				key.Embed = embed
+				doc, err := DIDFromProps("example.com:alice", []KeyInput{testKey("key-1", "assertionMethod"), key}, nil)
+				assert.NoError(t, err)
+
+				raw, err := json.Marshal(doc)
+				assert.NoError(t, err)
+				var shape map[string]any
+				assert.NoError(t, json.Unmarshal(raw, &shape))
+
+				relationship := shape[purpose].([]any)
+				last := relationship[len(relationship)-1]
+				methods := shape["verificationMethod"].([]any)
+				if !embed {
+					assert.Equal(t, "#key-2", last)
+					assert.Len(t, methods, 2)
+					return
+				}
+				assert.Len(t, methods, 1)
+				assert.Equal(t, map[string]any{
+					"id":                 "#key-2",
+					"type":               "Ed25519VerificationKey2018",
+					"controller":         "did:web:example.com:alice",
+					"publicKeyMultibase": "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK",
+				}, last)
+			})
+		}
+	}
+}
+
+func TestDIDFromPropsInvalidServices(t *testing.T) {
+	tt := []struct {
+		name    string
+		service did.Service
+		valid   bool
+	}{
+		{"uri", did.Service{ID: "#hub", Type: "LinkedDomains", ServiceEndpoint: "https://example.com"}, true},
+		{"object", did.Service{ID: "#hub", Type: "DIDCommMessaging", ServiceEndpoint: map[string]any{"uri": "https://example.com"}}, true},
+		{"set", did.Service{ID: "#hub", Type: "LinkedDomains", ServiceEndpoint: []any{"https://a.example", map[string]any{"uri": "https://b.example"}}}, true},
+		{"empty id", did.Service{Type: "LinkedDomains", ServiceEndpoint: "https://example.com"}, false},
+		{"blank id", did.Service{ID: "  ", Type: "LinkedDomains", ServiceEndpoint: "https://example.com"}, false},
+		{"missing type", did.Service{ID: "#hub", ServiceEndpoint: "https://example.com"}, false},
+		{"missing endpoint", did.Service{ID: "#hub", Type: "LinkedDomains"}, false},
+		{"relative endpoint", did.Service{ID: "#hub", Type: "LinkedDomains", ServiceEndpoint: "example.com/hub"}, false},
+		{"unparseable endpoint", did.Service{ID: "#hub", Type: "LinkedDomains", ServiceEndpoint: "https://exa mple.com/%zz"}, false},
+		{"number endpoint", did.Service{ID: "#hub", Type: "LinkedDomains", ServiceEndpoint: 42.0}, false},
+		{"empty object", did.Service{ID: "#hub", Type: "LinkedDomains", ServiceEndpoint: map[string]any{}}, false},
+		{"empty set", did.Service{ID: "#hub", Type: "LinkedDomains", ServiceEndpoint: []any{}}, false},
+		{"nested set", did.Service{ID: "#hub", Type: "LinkedDomains", ServiceEndpoint: []any{[]any{"https://example.com"}}}, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DIDFromProps("example.com:alice", []KeyInput{testKey("key-1", "assertionMethod")}, []did.Service{tc.service})
+			if tc.valid {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrorInvalidService)
+		})
+	}
+}
+
+func TestValidateService(t *testing.T) {
+	tt := []struct {
+		name     string
+		service  did.Service
+		expected string
+	}{
+		{"fragment id", did.Service{ID: "#svc-1", Type: "LinkedDomains", ServiceEndpoint: "https://example.com"}, ""},
+		{"absolute id", did.Service{ID: "did:web:example.com#svc-1", Type: "LinkedDomains", ServiceEndpoint: "https://example.com"}, ""},
+		{"string set", did.Service{ID: "#svc-1", Type: "LinkedDomains", ServiceEndpoint: []string{"https://a.example", "https://b.example"}}, ""},
+		{"relative id", did.Service{ID: "svc-1", Type: "LinkedDomains", ServiceEndpoint: "https://example.com"}, "id must be a fragment or an absolute URI"},
+		{"bad fragment", did.Service{ID: "#svc 1", Type: "LinkedDomains", ServiceEndpoint: "https://example.com"}, "id must be a fragment or an absolute URI"},
+		{"missing type", did.Service{ID: "#svc-1", ServiceEndpoint: "https://example.com"}, "service '#svc-1' is missing a type"},
+		{"empty endpoint", did.Service{ID: "did:web:example.com#svc-1", Type: "LinkedDomains", ServiceEndpoint: ""}, "service 'did:web:example.com#svc-1' has invalid endpoint URL"},
+		{"bad set element", did.Service{ID: "#svc-1", Type: "LinkedDomains", ServiceEndpoint: []any{"https://a.example", "not a url"}}, "service '#svc-1' has invalid endpoint URL"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateService(tc.service)
+			if len(tc.expected) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrorInvalidService)
+			assert.Contains(t, err.Error(), tc.expected)
+		})
+	}
+}
+
+func TestDIDFromPropsDuplicates(t *testing.T) {
+	service := func(id string) did.Service {
+		return did.Service{ID: id, Type: "LinkedDomains", ServiceEndpoint: "https://example.com"}
+	}
+
+	tt := []struct {
+		name     string
+		keys     []KeyInput
+		services []did.Service
+		err      error
+	}{
+		{"distinct", []KeyInput{testKey("key-1", "assertionMethod"), testKey("key-2")}, []did.Service{service("#a"), service("#b")}, nil},
+		{"same key", []KeyInput{testKey("key-1", "assertionMethod"), testKey("key-1")}, nil, ErrorDuplicateVerificationMethod},
+		{"same key different form", []KeyInput{testKey("key-1", "assertionMethod"), testKey("#key-1")}, nil, ErrorDuplicateVerificationMethod},
+		{"same key different case", []KeyInput{testKey("key-1", "assertionMethod"), testKey("KEY-1")}, nil, ErrorDuplicateVerificationMethod},
+		{"same service", []KeyInput{testKey("key-1", "assertionMethod")}, []did.Service{service("#a"), service("#a")}, ErrorDuplicateService},
+		{"same service different case", []KeyInput{testKey("key-1", "assertionMethod")}, []did.Service{service("#hub"), service("#Hub")}, ErrorDuplicateService},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DIDFromProps("example.com:alice", tc.keys, tc.services)
+			if tc.err == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+
+	_, err := DIDFromProps("example.com:alice", []KeyInput{testKey("key-1", "assertionMethod"), testKey("key-1")}, nil)
+	assert.EqualError(t, err, "duplicate verification method id: #key-1")
+}
+
+func TestDIDFromPropsInvalidVerificationMethodIDs(t *testing.T) {
+	tt := []struct {
+		name string
+		keys []KeyInput
+	}{
+		{"bare fragment", []KeyInput{testKey("#", "assertionMethod")}},
+		{"empty absolute fragment", []KeyInput{testKey("did:web:example.com:alice#", "assertionMethod")}},
+		{"space", []KeyInput{testKey("key 1", "assertionMethod")}},
+		{"second fragment", []KeyInput{testKey("key#1", "assertionMethod")}},
+		{"bad escape", []KeyInput{testKey("key%zz", "assertionMethod")}},
+		{"duplicate", []KeyInput{testKey("key-1", "assertionMethod"), testKey("did:web:example.com:alice#key-1")}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DIDFromProps("example.com:alice", tc.keys, nil)
+			assert.Error(t, err)
+		})
+	}
+
+	doc, err := DIDFromProps("example.com:alice", []KeyInput{testKey("key-1:a%20b", "assertionMethod")}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "#key-1:a%20b", doc.VerificationMethod[0].ID)
+}
+
+func TestDIDStoreResolveVersionTime(t *testing.T) {
+	store := newTestStore(t)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for version := 1; version <= 3; version++ {
+		store.now = func() time.Time { return start.Add(time.Duration(version-1) * 24 * time.Hour) }
+		keys := []KeyInput{}
+		for i := 1; i <= version; i++ {
+			keys = append(keys, testKey(fmt.Sprintf("key-%d", i), "assertionMethod"))
+		}
+		assert.NoError(t, store.Register(testDocument(t, "example.com:alice", keys...)))
+	}
+
+	tt := []struct {
+		versionTime string
+		numKeys     int
+	}{
+		{"2022-12-31T23:59:59Z", 0},
+		{"2023-01-01T00:00:00Z", 1},
+		{"2023-01-01T12:00:00Z", 1},
+		{"2023-01-02T00:00:00Z", 2},
+		{"2023-01-03T00:00:00Z", 3},
+		{"2030-01-01T00:00:00Z", 3},
+		{"2023-01-02T01:00:00+02:00", 1},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.versionTime, func(t *testing.T) {
+			versionTime, err := time.Parse(time.RFC3339, tc.versionTime)
+			assert.NoError(t, err)
+			doc, err := store.ResolveVersionTime("example.com:alice", versionTime)
+			if tc.numKeys == 0 {
+				assert.ErrorIs(t, err, ErrorVersionNotFound)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, doc.VerificationMethod, tc.numKeys)
+		})
+	}
+
+	_, err := store.ResolveVersionTime("example.com:nobody", start)
+	assert.ErrorIs(t, err, ErrorVersionNotFound)
+}
+
+func TestDIDStoreReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	writable, err := storage.New(dir, "did")
+	assert.NoError(t, err)
+	assert.NoError(t, NewDIDStore(writable).Register(testDocument(t, "example.com:alice")))
+	assert.NoError(t, writable.Close())
+
+	readOnly, err := storage.NewReadOnly(filepath.Join(dir, "did.db"), "did")
+	assert.NoError(t, err)
+	t.Cleanup(func() { readOnly.Close() })
+	store := NewDIDStore(readOnly)
+
+	doc, err := store.Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "did:web:example.com:alice", doc.ID)
+	assert.NoError(t, store.Ping())
+	assert.NoError(t, store.Probe())
+
+	assert.ErrorIs(t, store.Register(testDocument(t, "example.com:bob")), storage.ErrReadOnly)
+	_, err = store.UpdatePartial("example.com:alice", []JSONPatchOp{{Op: "remove", Path: "/service"}})
+	assert.ErrorIs(t, err, storage.ErrReadOnly)
+	assert.ErrorIs(t, store.Delete("example.com:alice"), storage.ErrReadOnly)
+}
+
+func TestDIDStoreProbe(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.Register(testDocument(t, "example.com:alice")))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, store.Probe())
+		}()
+	}
+	wg.Wait()
+
+	probes, err := store.store.List(healthProbePrefix)
+	assert.NoError(t, err)
+	assert.Empty(t, probes)
+	ids, _, err := store.ListPage("", 10, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com:alice"}, ids)
+}
+
+func TestDIDStoreListPage(t *testing.T) {
+	store := newTestStore(t)
+	for _, id := range []string{"example.com:alice", "example.com:users:bob", "example.com:users:carol", "example.com:users:dave"} {
+		assert.NoError(t, store.Register(testDocument(t, id)))
+	}
+	// A second version adds a history key that must not be listed.
+	assert.NoError(t, store.Register(testDocument(t, "example.com:users:bob")))
+
+	ids, next, err := store.ListPage("", 2, "example.com:users:")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com:users:bob", "example.com:users:carol"}, ids)
+	assert.Equal(t, "example.com:users:dave", next)
+
+	ids, next, err = store.ListPage(next, 2, "example.com:users:")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com:users:dave"}, ids)
+	assert.Empty(t, next)
+
+	ids, _, err = store.ListPage("", 10, "")
+	assert.NoError(t, err)
+	assert.Len(t, ids, 4)
+
+	count, err := store.Count("example.com:users:")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	count, err = store.Count("")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+}
+
+func TestBuildDocumentRequiredPurposes(t *testing.T) {
+	assertionOnly := []KeyInput{testKey("key-1", "assertionMethod")}
+	allPurposes := []KeyInput{
+		testKey("key-1", "assertionMethod", "authentication", "capabilityInvocation", "capabilityDelegation"),
+		testKey("key-2", "keyAgreement"),
+	}
+
+	tt := []struct {
+		name      string
+		keys      []KeyInput
+		opts      []DIDFromPropsOption
+		expectErr bool
+	}{
+		{"default", assertionOnly, nil, false},
+		{"default without assertion", []KeyInput{testKey("key-1", "authentication")}, nil, true},
+		{"authentication missing", assertionOnly, []DIDFromPropsOption{RequireAuthentication()}, true},
+		{"authentication only", []KeyInput{testKey("key-1", "authentication")}, []DIDFromPropsOption{RequireAuthentication()}, false},
+		{"key agreement missing", assertionOnly, []DIDFromPropsOption{RequireAssertionMethod(), RequireKeyAgreement()}, true},
+		{"all missing", assertionOnly, []DIDFromPropsOption{AllPurposesRequired()}, true},
+		{"all", allPurposes, []DIDFromPropsOption{AllPurposesRequired()}, false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := BuildDocument("example.com:alice", tc.keys, nil, tc.opts...)
+			if tc.expectErr {
+				assert.ErrorIs(t, err, ErrorMissingRelationship)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestBuildDocumentMultibaseShorthand(t *testing.T) {
+	doc, err := BuildDocument("example.com:alice", []KeyInput{
+		{Purposes: []string{"assertionMethod"}, PublicKeyMultibase: "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"},
+		{Purposes: []string{"keyAgreement"}, PublicKeyMultibase: "z6LSbysY2xFMRpGMhb7tFTLMpeuPRaqaWM1yECx2AtzE3KCc", KeyType: "X25519KeyAgreementKey2019"},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []did.VerificationMethod{
+		{
+			ID:                 "#z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK",
+			Type:               cryptosuite.Ed25519VerificationKey2020,
+			Controller:         "did:web:example.com:alice",
+			PublicKeyMultibase: "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK",
+		},
+		{
+			ID:                 "#z6LSbysY2xFMRpGMhb7tFTLMpeuPRaqaWM1yECx2AtzE3KCc",
+			Type:               cryptosuite.X25519KeyAgreementKey2019,
+			Controller:         "did:web:example.com:alice",
+			PublicKeyMultibase: "z6LSbysY2xFMRpGMhb7tFTLMpeuPRaqaWM1yECx2AtzE3KCc",
+		},
+	}, doc.VerificationMethod)
+	assert.Equal(t, []did.VerificationMethodSet{"#z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"}, doc.AssertionMethod)
+}
+
+func TestKeyInputValidate(t *testing.T) {
+	withKey := func(fn func(k *KeyInput)) KeyInput {
+		k := testKey("key-1", "assertionMethod")
+		fn(&k)
+		return k
+	}
+
+	tt := []struct {
+		name      string
+		key       KeyInput
+		expectErr bool
+	}{
+		{"valid", testKey("key-1", "assertionMethod"), false},
+		{"purpose case", testKey("key-1", "AssertionMethod", "keyagreement"), false},
+		{"no purposes", testKey("key-1"), false},
+		{"jwk only", withKey(func(k *KeyInput) {
+			k.VerificationMethod.PublicKeyMultibase = ""
+			key, err := jwk.ParseKey([]byte(`{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`))
+			assert.NoError(t, err)
+			k.PublicKeyJWK = key
+		}), false},
+		{"missing type", withKey(func(k *KeyInput) { k.VerificationMethod.Type = "" }), true},
+		{"missing key", withKey(func(k *KeyInput) { k.VerificationMethod.PublicKeyMultibase = "" }), true},
+		{"unknown purpose", testKey("key-1", "assertionMethod", "signing"), true},
+		{"empty purpose", testKey("key-1", ""), true},
+		{"multibase shorthand", KeyInput{Purposes: []string{"assertionMethod"}, PublicKeyMultibase: "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"}, false},
+		{"multibase shorthand with type", KeyInput{PublicKeyMultibase: "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK", KeyType: "Multikey"}, false},
+		{"invalid multibase", KeyInput{PublicKeyMultibase: "not multibase"}, true},
+		{"unknown multicodec", KeyInput{PublicKeyMultibase: "zQ3s"}, true},
+		{"multibase shorthand with another key", withKey(func(k *KeyInput) {
+			k.PublicKeyMultibase = "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK"
+		}), true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.key.Validate()
+			if tc.expectErr {
+				assert.ErrorIs(t, err, ErrorInvalidKey)
+				_, err = DIDFromProps("example.com:alice", []KeyInput{tc.key}, nil)
+				assert.ErrorIs(t, err, ErrorInvalidKey)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
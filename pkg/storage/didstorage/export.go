@@ -0,0 +1,87 @@
+package didstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/storage"
+)
+
+// ExportedDocument is one line of a DIDStore export.
+type ExportedDocument struct {
+	ID       string           `json:"id"`
+	Document *didweb.Document `json:"document"`
+}
+
+// Export writes every current document to w as JSON Lines, keyed by the id
+// it is stored under. Version history is not exported.
+func (d *DIDStore) Export(w io.Writer) error {
+	ids, err := d.store.List("")
+	if err != nil {
+		return fmt.Errorf("could not list store: %w", err)
+	}
+	encoder := json.NewEncoder(w)
+	for _, id := range ids {
+		if isMetadataKey(id) {
+			continue
+		}
+		doc, err := d.Resolve(id)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", id, err)
+		}
+		if err := encoder.Encode(ExportedDocument{ID: id, Document: doc}); err != nil {
+			return fmt.Errorf("could not write %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// Import registers each document of an export written by Export under its
+// exported id. Documents whose id is already taken are skipped with a
+// warning rather than overwritten.
+func (d *DIDStore) Import(r io.Reader) error {
+	if d.readOnly() {
+		return storage.ErrReadOnly
+	}
+	decoder := json.NewDecoder(r)
+	for {
+		var exported ExportedDocument
+		if err := decoder.Decode(&exported); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not read document: %w", err)
+		}
+		if len(exported.ID) == 0 || exported.Document == nil {
+			return fmt.Errorf("could not read document: missing id or document")
+		}
+
+		existing, err := get(d.store, exported.ID)
+		if err != nil {
+			return fmt.Errorf("could not check %s: %w", exported.ID, err)
+		}
+		if len(existing) > 0 {
+			log.Printf("skipping %s: already registered\n", exported.ID)
+			continue
+		}
+
+		bytes, err := json.Marshal(exported.Document)
+		if err != nil {
+			return fmt.Errorf("invalid doc %s: %w", exported.ID, err)
+		}
+		if err := d.batch(func(tx storage.Tx) error {
+			if err := d.appendVersion(tx, exported.ID, exported.Document); err != nil {
+				return err
+			}
+			if err := tx.Set(exported.ID, bytes); err != nil {
+				return fmt.Errorf("could not store %s: %w", exported.ID, err)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package didstorage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/storage/memstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDIDStoreExportImport(t *testing.T) {
+	bolt := newTestStore(t)
+	ids := []string{"example.com:alice", "example.com:users:bob", "example.com%3A8080:carol"}
+	for _, id := range ids {
+		assert.NoError(t, bolt.Register(testDocument(t, id)))
+	}
+	// A second version must not be exported as its own document.
+	assert.NoError(t, bolt.Register(testDocument(t, "example.com:alice", testKey("key-2", "assertionMethod"))))
+
+	var first bytes.Buffer
+	assert.NoError(t, bolt.Export(&first))
+
+	memory := NewDIDStore(memstorage.NewMemStorage())
+	assert.NoError(t, memory.Import(bytes.NewReader(first.Bytes())))
+	var second bytes.Buffer
+	assert.NoError(t, memory.Export(&second))
+	assert.Equal(t, first.String(), second.String())
+
+	restored := newTestStore(t)
+	assert.NoError(t, restored.Import(&second))
+	for _, id := range ids {
+		want, err := bolt.Resolve(id)
+		assert.NoError(t, err)
+		got, err := restored.Resolve(id)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	history, err := restored.History("example.com:alice")
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, "#key-2", history[0].Document.VerificationMethod[0].ID)
+}
+
+func TestDIDStoreImportConflicts(t *testing.T) {
+	src := newTestStore(t)
+	assert.NoError(t, src.Register(testDocument(t, "example.com:alice", testKey("key-2", "assertionMethod"))))
+	assert.NoError(t, src.Register(testDocument(t, "example.com:bob")))
+	var export bytes.Buffer
+	assert.NoError(t, src.Export(&export))
+
+	dst := newTestStore(t)
+	assert.NoError(t, dst.Register(testDocument(t, "example.com:alice")))
+	assert.NoError(t, dst.Import(&export))
+
+	alice, err := dst.Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "#key-1", alice.VerificationMethod[0].ID)
+	_, err = dst.Resolve("example.com:bob")
+	assert.NoError(t, err)
+
+	assert.Error(t, dst.Import(bytes.NewBufferString(`{"id":"example.com:carol"}`)))
+}
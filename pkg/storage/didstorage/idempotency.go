@@ -0,0 +1,158 @@
+package didstorage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+)
+
+const idempotencyPrefix = "idempotency:"
+
+var (
+	ErrorIdempotencyKeyReused = fmt.Errorf("idempotency key already used for another document")
+)
+
+// idempotentRegistration is the response returned for an idempotency key,
+// and the hash of the document it was returned for.
+type idempotentRegistration struct {
+	DID          string          `json:"did"`
+	DocumentHash string          `json:"document_hash"`
+	Response     PaymentResponse `json:"response"`
+	ExpiresAt    time.Time       `json:"expires_at"`
+}
+
+// idempotencyKey hashes the client supplied key so its length is bounded.
+func idempotencyKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return idempotencyPrefix + hex.EncodeToString(sum[:])
+}
+
+// documentHash hashes the JSON of doc, so a retry can be told apart from
+// another document sent with the same key.
+func documentHash(doc *didweb.Document) (string, error) {
+	docJSON, err := json.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal: %w", err)
+	}
+	sum := sha256.Sum256(docJSON)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// keyLock serializes the registrations using one idempotency key.
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockIdempotencyKey waits until no other registration is using key, and
+// returns the function releasing it. Registrations using other keys are
+// not held up.
+func (s *RegisterStore) lockIdempotencyKey(key string) func() {
+	s.idempotencyMu.Lock()
+	if s.idempotencyLocks == nil {
+		s.idempotencyLocks = map[string]*keyLock{}
+	}
+	lock, ok := s.idempotencyLocks[key]
+	if !ok {
+		lock = &keyLock{}
+		s.idempotencyLocks[key] = lock
+	}
+	lock.refs++
+	s.idempotencyMu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		s.idempotencyMu.Lock()
+		defer s.idempotencyMu.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(s.idempotencyLocks, key)
+		}
+	}
+}
+
+// RegisterIdempotent registers doc like Register, except that retries with
+// the same key before the invoice expires return the first response instead
+// of creating another invoice. Reusing the key for a different document
+// fails with ErrorIdempotencyKeyReused.
+func (s *RegisterStore) RegisterIdempotent(key string, doc *didweb.Document) (*PaymentResponse, error) {
+	return s.RegisterIdempotentContext(context.Background(), key, doc)
+}
+
+// RegisterIdempotentContext is like RegisterIdempotent but creates the
+// invoice with RegisterContext. A retry waits for the registration using
+// its key to finish.
+func (s *RegisterStore) RegisterIdempotentContext(ctx context.Context, key string, doc *didweb.Document) (*PaymentResponse, error) {
+	hash, err := documentHash(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	storeKey := idempotencyKey(key)
+	defer s.lockIdempotencyKey(storeKey)()
+
+	existing, err := get(s.store, storeKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not get idempotency key: %w", err)
+	}
+	if len(existing) > 0 {
+		var registration idempotentRegistration
+		if err := json.Unmarshal(existing, &registration); err != nil {
+			return nil, fmt.Errorf("could not parse idempotency key: %w", err)
+		}
+		if s.now().Before(registration.ExpiresAt) {
+			if registration.DID != doc.ID || registration.DocumentHash != hash {
+				return nil, ErrorIdempotencyKeyReused
+			}
+			return &registration.Response, nil
+		}
+	}
+
+	response, err := s.RegisterContext(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+	registrationJSON, err := json.Marshal(idempotentRegistration{
+		DID:          doc.ID,
+		DocumentHash: hash,
+		Response:     *response,
+		ExpiresAt:    s.now().UTC().Add(time.Duration(s.expiry) * time.Second),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal idempotency key: %w", err)
+	}
+	if err := s.setPending(s.store, storeKey, registrationJSON); err != nil {
+		return nil, fmt.Errorf("could not store idempotency key: %w", err)
+	}
+	return response, nil
+}
+
+// cleanupIdempotencyKeys removes idempotency keys whose window has passed.
+func (s *RegisterStore) cleanupIdempotencyKeys() error {
+	keys, err := s.store.List(idempotencyPrefix)
+	if err != nil {
+		return fmt.Errorf("could not list idempotency keys: %w", err)
+	}
+	now := s.now()
+	for _, key := range keys {
+		value, err := get(s.store, key)
+		if err != nil || len(value) == 0 {
+			continue
+		}
+		var registration idempotentRegistration
+		if err := json.Unmarshal(value, &registration); err == nil && now.Before(registration.ExpiresAt) {
+			continue
+		}
+		if err := s.store.Delete(key); err != nil {
+			return fmt.Errorf("could not delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
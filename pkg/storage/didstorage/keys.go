@@ -0,0 +1,192 @@
+package didstorage
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/TBD54566975/ssi-sdk/crypto/jwx"
+	"github.com/TBD54566975/ssi-sdk/cryptosuite"
+	"github.com/TBD54566975/ssi-sdk/did"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-varint"
+)
+
+// jwkKeyTypes lists the kty and crv a JWK must carry for each verification
+// method type. JsonWebKey2020 accepts any key.
+var jwkKeyTypes = map[cryptosuite.LDKeyType]struct{ kty, crv string }{
+	cryptosuite.Ed25519VerificationKey2018:        {"OKP", "Ed25519"},
+	cryptosuite.Ed25519VerificationKey2020:        {"OKP", "Ed25519"},
+	cryptosuite.X25519KeyAgreementKey2019:         {"OKP", "X25519"},
+	cryptosuite.X25519KeyAgreementKey2020:         {"OKP", "X25519"},
+	cryptosuite.ECDSASECP256k1VerificationKey2019: {"EC", "secp256k1"},
+}
+
+// multicodecKeyTypes maps the multicodec prefix of a multibase public key to
+// the verification method type it is published as.
+var multicodecKeyTypes = map[multicodec.Code]cryptosuite.LDKeyType{
+	did.Ed25519MultiCodec:   cryptosuite.Ed25519VerificationKey2020,
+	did.X25519MultiCodec:    cryptosuite.X25519KeyAgreementKey2020,
+	did.SECP256k1MultiCodec: cryptosuite.ECDSASECP256k1VerificationKey2019,
+}
+
+// MultibaseKeyType returns the verification method type of a multicodec
+// prefixed multibase public key.
+func MultibaseKeyType(publicKeyMultibase string) (cryptosuite.LDKeyType, error) {
+	_, decoded, err := multibase.Decode(publicKeyMultibase)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid publicKeyMultibase: %s", ErrorInvalidKey, err)
+	}
+	codec, _, err := varint.FromUvarint(decoded)
+	if err != nil {
+		return "", fmt.Errorf("%w: publicKeyMultibase has no multicodec prefix", ErrorInvalidKey)
+	}
+	keyType, ok := multicodecKeyTypes[multicodec.Code(codec)]
+	if !ok {
+		return "", fmt.Errorf("%w: unsupported multibase key type %s", ErrorInvalidKey, multicodec.Code(codec))
+	}
+	return keyType, nil
+}
+
+// parsePublicKeyJWK converts key to the JWK of a verification method,
+// discarding any private key material.
+func parsePublicKeyJWK(key jwk.Key) (*jwx.PublicKeyJWK, error) {
+	pubKey, err := jwk.PublicKeyOf(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid publicKeyJwk: %w", err)
+	}
+	pubBytes, err := json.Marshal(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid publicKeyJwk: %w", err)
+	}
+	var publicKeyJWK jwx.PublicKeyJWK
+	if err := json.Unmarshal(pubBytes, &publicKeyJWK); err != nil {
+		return nil, fmt.Errorf("invalid publicKeyJwk: %w", err)
+	}
+	return &publicKeyJWK, nil
+}
+
+// validateJWKType checks the key claimed by keyType matches the JWK.
+func validateJWKType(keyType cryptosuite.LDKeyType, key *jwx.PublicKeyJWK) error {
+	if keyType == cryptosuite.JSONWebKey2020Type {
+		return nil
+	}
+	expected, ok := jwkKeyTypes[keyType]
+	if !ok {
+		return fmt.Errorf("verification method type %s does not support publicKeyJwk", keyType)
+	}
+	if key.KTY != expected.kty || key.CRV != expected.crv {
+		return fmt.Errorf("verification method type %s requires a %s %s key, got %s %s", keyType, expected.kty, expected.crv, key.KTY, key.CRV)
+	}
+	return nil
+}
+
+// deriveVerificationMethodID returns a fragment for a verification method
+// submitted without an id, derived from its key so it is stable: the RFC 7638
+// thumbprint of a JWK, or the multibase key itself as did:key does.
+func deriveVerificationMethodID(vm did.VerificationMethod) (string, error) {
+	switch {
+	case vm.PublicKeyJWK != nil:
+		return jwkThumbprint(vm.PublicKeyJWK)
+	case len(vm.PublicKeyMultibase) > 0:
+		return "#" + vm.PublicKeyMultibase, nil
+	case len(vm.PublicKeyBase58) > 0:
+		return "#z" + vm.PublicKeyBase58, nil
+	}
+	return "", fmt.Errorf("verification method id required")
+}
+
+// jwkThumbprint computes the RFC 7638 SHA-256 thumbprint of key as a
+// fragment.
+func jwkThumbprint(key *jwx.PublicKeyJWK) (string, error) {
+	var members map[string]string
+	switch key.KTY {
+	case "EC":
+		members = map[string]string{"crv": key.CRV, "kty": key.KTY, "x": key.X, "y": key.Y}
+	case "OKP":
+		members = map[string]string{"crv": key.CRV, "kty": key.KTY, "x": key.X}
+	case "RSA":
+		members = map[string]string{"e": key.E, "kty": key.KTY, "n": key.N}
+	default:
+		return "", fmt.Errorf("cannot derive an id for %q keys", key.KTY)
+	}
+	// Maps marshal with sorted keys and no whitespace, as RFC 7638 requires.
+	canonical, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return "#" + base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// AuthenticationMethods returns the verification methods allowed to
+// authenticate as the controller of doc: its own authentication methods and,
+// when another DID controls it, that DID's, looked up with resolve.
+func AuthenticationMethods(doc *didweb.Document, resolve func(id string) (*didweb.Document, error)) ([]did.VerificationMethod, error) {
+	methods, err := authenticationMethods(doc)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc.Controller) == 0 || doc.Controller == doc.ID {
+		return methods, nil
+	}
+	controller, err := resolve(doc.Controller)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve controller %s: %w", doc.Controller, err)
+	}
+	controllerMethods, err := authenticationMethods(controller)
+	if err != nil {
+		return nil, err
+	}
+	return append(methods, controllerMethods...), nil
+}
+
+// authenticationMethods dereferences the authentication relationship of doc.
+// Method ids are made absolute so methods of different documents can be told
+// apart.
+func authenticationMethods(doc *didweb.Document) ([]did.VerificationMethod, error) {
+	methods := []did.VerificationMethod{}
+	for _, entry := range doc.Authentication {
+		var method did.VerificationMethod
+		switch entry := entry.(type) {
+		case string:
+			found := false
+			for _, vm := range doc.VerificationMethod {
+				if absoluteMethodID(doc.ID, vm.ID) == absoluteMethodID(doc.ID, entry) {
+					method, found = vm, true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("authentication method %s not found in %s", entry, doc.ID)
+			}
+		case did.VerificationMethod:
+			method = entry
+		default:
+			// Embedded methods decode from storage as generic objects.
+			raw, err := json.Marshal(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid authentication method: %w", err)
+			}
+			if err := json.Unmarshal(raw, &method); err != nil {
+				return nil, fmt.Errorf("invalid authentication method: %w", err)
+			}
+		}
+		method.ID = absoluteMethodID(doc.ID, method.ID)
+		methods = append(methods, method)
+	}
+	return methods, nil
+}
+
+// absoluteMethodID returns id, which may be relative to docID, as a DID URL.
+func absoluteMethodID(docID, id string) string {
+	if strings.HasPrefix(id, "#") {
+		return docID + id
+	}
+	return id
+}
@@ -0,0 +1,222 @@
+package didstorage
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/TBD54566975/ssi-sdk/cryptosuite"
+	"github.com/TBD54566975/ssi-sdk/did"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/stretchr/testify/assert"
+)
+
+func testJWK(t *testing.T, key any) jwk.Key {
+	parsed, err := jwk.FromRaw(key)
+	assert.NoError(t, err)
+	return parsed
+}
+
+func TestDIDFromPropsPublicKeyJWK(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tt := []struct {
+		name      string
+		keyType   cryptosuite.LDKeyType
+		jwk       jwk.Key
+		expectErr bool
+	}{
+		{"ed25519", cryptosuite.Ed25519VerificationKey2018, testJWK(t, edPub), false},
+		{"ed25519 private stripped", cryptosuite.Ed25519VerificationKey2020, testJWK(t, edPriv), false},
+		{"p-256 json web key", cryptosuite.JSONWebKey2020Type, testJWK(t, &ecPriv.PublicKey), false},
+		{"p-256 claimed ed25519", cryptosuite.Ed25519VerificationKey2018, testJWK(t, &ecPriv.PublicKey), true},
+		{"ed25519 claimed secp256k1", cryptosuite.ECDSASECP256k1VerificationKey2019, testJWK(t, edPub), true},
+		{"unsupported type", cryptosuite.BLS12381G2Key2020, testJWK(t, edPub), true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			doc, err := DIDFromProps("example.com:alice", []KeyInput{{
+				Purposes:           []string{"assertionMethod"},
+				VerificationMethod: did.VerificationMethod{ID: "key-1", Type: tc.keyType},
+				PublicKeyJWK:       tc.jwk,
+			}}, nil)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			vm := doc.VerificationMethod[0]
+			assert.Empty(t, vm.PublicKeyMultibase)
+			assert.NotNil(t, vm.PublicKeyJWK)
+			assert.NotEmpty(t, vm.PublicKeyJWK.X)
+			raw, err := json.Marshal(vm.PublicKeyJWK)
+			assert.NoError(t, err)
+			assert.NotContains(t, string(raw), `"d"`)
+		})
+	}
+}
+
+func TestKeyInputPublicKeyJWK(t *testing.T) {
+	var key KeyInput
+	assert.NoError(t, json.Unmarshal([]byte(`{"verificationMethod":{"type":"JsonWebKey2020"},"publicKeyJwk":{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}}`), &key))
+	if assert.NotNil(t, key.PublicKeyJWK) {
+		assert.Equal(t, "OKP", key.PublicKeyJWK.KeyType().String())
+	}
+	assert.Equal(t, cryptosuite.JSONWebKey2020Type, key.VerificationMethod.Type)
+
+	raw, err := json.Marshal(key)
+	assert.NoError(t, err)
+	assert.Contains(t, string(raw), `"publicKeyJwk":{"crv":"Ed25519","kty":"OKP","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`)
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"publicKeyJwk":null}`), &key))
+	assert.Nil(t, key.PublicKeyJWK)
+	assert.Error(t, json.Unmarshal([]byte(`{"publicKeyJwk":{"kty":"nope"}}`), &key))
+}
+
+func TestDIDFromPropsPrefersMultibase(t *testing.T) {
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	key := testKey("key-1", "assertionMethod")
+	key.PublicKeyJWK = testJWK(t, edPub)
+	doc, err := DIDFromProps("example.com:alice", []KeyInput{key}, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, doc.VerificationMethod[0].PublicKeyMultibase)
+	assert.Nil(t, doc.VerificationMethod[0].PublicKeyJWK)
+}
+
+func TestDIDFromPropsDerivedID(t *testing.T) {
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ecKey, err := jwk.FromRaw(&ecPriv.PublicKey)
+	assert.NoError(t, err)
+	thumbprint, err := ecKey.Thumbprint(crypto.SHA256)
+	assert.NoError(t, err)
+
+	tt := []struct {
+		name      string
+		key       KeyInput
+		expected  string
+		expectErr bool
+	}{
+		{
+			name: "jwk thumbprint",
+			key: KeyInput{
+				VerificationMethod: did.VerificationMethod{Type: cryptosuite.JSONWebKey2020Type},
+				PublicKeyJWK:       testJWK(t, &ecPriv.PublicKey),
+			},
+			expected: "#" + base64.RawURLEncoding.EncodeToString(thumbprint),
+		},
+		{
+			name:     "multibase",
+			key:      testKey(""),
+			expected: "#z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK",
+		},
+		{
+			name:      "no key material",
+			key:       KeyInput{VerificationMethod: did.VerificationMethod{Type: cryptosuite.JSONWebKey2020Type}},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.key.Purposes = []string{"assertionMethod", "authentication"}
+			ids := []string{}
+			for i := 0; i < 2; i++ {
+				doc, err := DIDFromProps("example.com:alice", []KeyInput{tc.key}, nil)
+				if tc.expectErr {
+					assert.Error(t, err)
+					return
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, []did.VerificationMethodSet{doc.VerificationMethod[0].ID}, doc.AssertionMethod)
+				assert.Equal(t, []did.VerificationMethodSet{doc.VerificationMethod[0].ID}, doc.Authentication)
+				ids = append(ids, doc.VerificationMethod[0].ID)
+			}
+			assert.Equal(t, []string{tc.expected, tc.expected}, ids)
+		})
+	}
+}
+
+func TestBuildDocumentController(t *testing.T) {
+	tt := []struct {
+		controller string
+		expectErr  bool
+	}{
+		{"", false},
+		{"did:web:example.com", false},
+		{"did:key:z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK", false},
+		{"did:web:example.com%3A8080:org", false},
+		{"https://example.com", true},
+		{"did:web:", true},
+		{"did:web:example.com#key-1", true},
+		{"example.com:org", true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.controller, func(t *testing.T) {
+			doc, err := BuildDocument("example.com:alice", []KeyInput{testKey("key-1", "assertionMethod")}, nil, WithController(tc.controller))
+			if tc.expectErr {
+				assert.ErrorIs(t, err, ErrorInvalidController)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.controller, doc.Controller)
+		})
+	}
+}
+
+func TestAuthenticationMethods(t *testing.T) {
+	org, err := BuildDocument("example.com:org", []KeyInput{testKey("org-key", "assertionMethod", "authentication")}, nil)
+	assert.NoError(t, err)
+	embedded := testKey("embedded", "authentication")
+	embedded.Embed = true
+	keys := []KeyInput{testKey("key-1", "assertionMethod", "authentication"), embedded}
+
+	self, err := BuildDocument("example.com:alice", keys, nil)
+	assert.NoError(t, err)
+	controlled, err := BuildDocument("example.com:bob", keys, nil, WithController(org.ID))
+	assert.NoError(t, err)
+
+	store := newTestStore(t)
+	for _, doc := range []*didweb.Document{org, self, controlled} {
+		assert.NoError(t, store.Register(doc))
+	}
+	resolve := func(id string) (*didweb.Document, error) {
+		u, err := didweb.Parse(id)
+		if err != nil {
+			return nil, err
+		}
+		return store.Resolve(u.ID())
+	}
+	ids := func(id string) []string {
+		doc, err := store.Resolve(id)
+		assert.NoError(t, err)
+		methods, err := AuthenticationMethods(doc, resolve)
+		assert.NoError(t, err)
+		result := []string{}
+		for _, method := range methods {
+			result = append(result, method.ID)
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"did:web:example.com:alice#key-1", "did:web:example.com:alice#embedded"}, ids("example.com:alice"))
+	assert.Equal(t, []string{"did:web:example.com:bob#key-1", "did:web:example.com:bob#embedded", "did:web:example.com:org#org-key"}, ids("example.com:bob"))
+
+	orphan, err := BuildDocument("example.com:carol", keys, nil, WithController("did:web:example.com:nobody"))
+	assert.NoError(t, err)
+	_, err = AuthenticationMethods(orphan, resolve)
+	assert.Error(t, err)
+}
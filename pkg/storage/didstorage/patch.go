@@ -0,0 +1,128 @@
+package didstorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/13x-tech/go-did-web/pkg/didweb"
+	"github.com/13x-tech/go-did-web/pkg/storage"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+)
+
+// JSONPatchOp is a single RFC 6902 JSON Patch operation.
+type JSONPatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+// patchableProperties are the top level document properties a partial update
+// may touch.
+var patchableProperties = map[string]struct{}{
+	"verificationMethod":   {},
+	"service":              {},
+	"authentication":       {},
+	"assertionMethod":      {},
+	"capabilityInvocation": {},
+	"capabilityDelegation": {},
+	"keyAgreement":         {},
+}
+
+func validatePatchPath(path string) error {
+	property := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	if _, ok := patchableProperties[property]; !ok || !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("patch path not allowed: %s", path)
+	}
+	return nil
+}
+
+// validateDocument checks a patched document is still usable as a did:web
+// document.
+func validateDocument(doc *didweb.Document) error {
+	if len(doc.AssertionMethod) == 0 {
+		return fmt.Errorf("did document must have at least one assertion verifiction method")
+	}
+	seen := map[string]struct{}{}
+	for _, vm := range doc.VerificationMethod {
+		if _, ok := seen[strings.ToLower(vm.ID)]; ok {
+			return fmt.Errorf("%w: %s", ErrorDuplicateVerificationMethod, vm.ID)
+		}
+		seen[strings.ToLower(vm.ID)] = struct{}{}
+	}
+	seen = map[string]struct{}{}
+	for _, service := range doc.Services {
+		if _, ok := seen[strings.ToLower(service.ID)]; ok {
+			return fmt.Errorf("%w: %s", ErrorDuplicateService, service.ID)
+		}
+		seen[strings.ToLower(service.ID)] = struct{}{}
+	}
+	return nil
+}
+
+// UpdatePartial applies ops to the stored document for id and returns the
+// result. Operations are limited to verification methods, services and
+// verification relationships.
+func (d *DIDStore) UpdatePartial(id string, ops []JSONPatchOp) (*didweb.Document, error) {
+	if d.readOnly() {
+		return nil, storage.ErrReadOnly
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("no patch operations")
+	}
+	for _, op := range ops {
+		if err := validatePatchPath(op.Path); err != nil {
+			return nil, err
+		}
+		if (op.Op == "move" || op.Op == "copy") && validatePatchPath(op.From) != nil {
+			return nil, fmt.Errorf("patch from not allowed: %s", op.From)
+		}
+	}
+	rawPatch, err := json.Marshal(ops)
+	if err != nil {
+		return nil, fmt.Errorf("invalid patch: %w", err)
+	}
+	patch, err := jsonpatch.DecodePatch(rawPatch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid patch: %w", err)
+	}
+
+	var updated didweb.Document
+	apply := func(current []byte) ([]byte, error) {
+		if len(current) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrorNotFound, id)
+		}
+		patched, err := patch.Apply(current)
+		if err != nil {
+			return nil, fmt.Errorf("could not apply patch: %w", err)
+		}
+		updated = didweb.Document{}
+		if err := json.Unmarshal(patched, &updated); err != nil {
+			return nil, fmt.Errorf("could not parse patched document: %w", err)
+		}
+		if err := validateDocument(&updated); err != nil {
+			return nil, err
+		}
+		return json.Marshal(&updated)
+	}
+
+	err = d.batch(func(tx storage.Tx) error {
+		current, err := get(tx, id)
+		if err != nil {
+			return fmt.Errorf("could not get from store: %w", err)
+		}
+		patched, err := apply(current)
+		if err != nil {
+			return err
+		}
+		if err := tx.Set(id, patched); err != nil {
+			return fmt.Errorf("could not store: %w", err)
+		}
+		return d.appendVersion(tx, id, &updated)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
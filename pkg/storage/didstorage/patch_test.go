@@ -0,0 +1,121 @@
+package didstorage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdatePartial(t *testing.T) {
+	store := newTestStore(t)
+	assert.NoError(t, store.Register(testDocument(t, "example.com:alice")))
+
+	doc, err := store.UpdatePartial("example.com:alice", []JSONPatchOp{
+		{Op: "add", Path: "/verificationMethod/-", Value: map[string]any{
+			"id":                 "#key-2",
+			"type":               "Ed25519VerificationKey2018",
+			"controller":         "did:web:example.com:alice",
+			"publicKeyMultibase": "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK",
+		}},
+		{Op: "add", Path: "/authentication", Value: []string{"#key-2"}},
+		{Op: "add", Path: "/service", Value: []map[string]any{{
+			"id":              "#hub",
+			"type":            "DecentralizedWebNode",
+			"serviceEndpoint": "https://dwn.example.com",
+		}}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, doc.VerificationMethod, 2)
+	assert.Len(t, doc.Authentication, 1)
+	assert.Len(t, doc.Services, 1)
+
+	stored, err := store.Resolve("example.com:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, doc, stored)
+
+	history, err := store.History("example.com:alice")
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+}
+
+// slowStorage is Bolt storage whose reads outside a transaction are slow,
+// widening any window between reading and writing a record.
+type slowStorage struct {
+	*storage.BoltStorage
+}
+
+func (s slowStorage) Get(id string) ([]byte, error) {
+	time.Sleep(10 * time.Millisecond)
+	return s.BoltStorage.Get(id)
+}
+
+func TestUpdatePartialConcurrent(t *testing.T) {
+	store := newTestStore(t)
+	store.store = slowStorage{store.store.(*storage.BoltStorage)}
+	assert.NoError(t, store.Register(testDocument(t, "example.com:alice")))
+
+	const patches = 10
+	var wg sync.WaitGroup
+	for i := 0; i < patches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := store.UpdatePartial("example.com:alice", []JSONPatchOp{
+				{Op: "add", Path: "/verificationMethod/-", Value: map[string]any{
+					"id":                 fmt.Sprintf("#key-%d", i+2),
+					"type":               "Ed25519VerificationKey2018",
+					"controller":         "did:web:example.com:alice",
+					"publicKeyMultibase": "z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK",
+				}},
+			})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	// Every patch is kept as its own version, the last one holding them all.
+	history, err := store.History("example.com:alice")
+	assert.NoError(t, err)
+	if assert.Len(t, history, patches+1) {
+		assert.Len(t, history[patches].Document.VerificationMethod, patches+1)
+	}
+}
+
+func TestUpdatePartialRejected(t *testing.T) {
+	tt := []struct {
+		name string
+		ops  []JSONPatchOp
+	}{
+		{"no ops", nil},
+		{"id", []JSONPatchOp{{Op: "replace", Path: "/id", Value: "did:web:evil.com"}}},
+		{"controller", []JSONPatchOp{{Op: "add", Path: "/controller", Value: "did:web:evil.com"}}},
+		{"relative path", []JSONPatchOp{{Op: "add", Path: "service", Value: []string{}}}},
+		{"move from id", []JSONPatchOp{{Op: "move", From: "/id", Path: "/service"}}},
+		{"remove assertion", []JSONPatchOp{{Op: "remove", Path: "/assertionMethod"}}},
+		{"duplicate key", []JSONPatchOp{{Op: "copy", From: "/verificationMethod/0", Path: "/verificationMethod/-"}}},
+		{"bad path", []JSONPatchOp{{Op: "remove", Path: "/service/4"}}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newTestStore(t)
+			original := testDocument(t, "example.com:alice")
+			assert.NoError(t, store.Register(original))
+
+			_, err := store.UpdatePartial("example.com:alice", tc.ops)
+			assert.Error(t, err)
+
+			stored, err := store.Resolve("example.com:alice")
+			assert.NoError(t, err)
+			assert.Equal(t, original.VerificationMethod, stored.VerificationMethod)
+			assert.Len(t, stored.AssertionMethod, 1)
+		})
+	}
+
+	_, err := newTestStore(t).UpdatePartial("example.com:nobody", []JSONPatchOp{{Op: "remove", Path: "/service"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,114 @@
+package didstorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// nonceKeyPattern matches the key a pending document is stored under, the
+// hex encoded 64 byte registration nonce.
+var nonceKeyPattern = regexp.MustCompile(`^[0-9a-f]{128}$`)
+
+// RepairReport lists the records Repair removed.
+type RepairReport struct {
+	// OrphanedDocuments are nonces whose pending document had no pending
+	// registration.
+	OrphanedDocuments []string `json:"orphaned_documents"`
+	// OrphanedPending are nonces of pending registrations missing their
+	// document or webhook secret, which can never be paid.
+	OrphanedPending []string `json:"orphaned_pending"`
+	// OrphanedSecrets are nonces whose webhook secret had no pending
+	// registration.
+	OrphanedSecrets []string `json:"orphaned_secrets"`
+	// DanglingPaymentRequests are DIDs with a stored payment request but no
+	// pending registration.
+	DanglingPaymentRequests []string `json:"dangling_payment_requests"`
+}
+
+// Repair removes the records a registration interrupted between its writes
+// leaves behind: documents, secrets and payment requests without a pending
+// registration, and pending registrations missing their document or secret.
+// It should not run while registrations are being made.
+func (s *RegisterStore) Repair() (*RepairReport, error) {
+	keys, err := s.store.List("")
+	if err != nil {
+		return nil, fmt.Errorf("could not list store: %w", err)
+	}
+	documents := map[string]struct{}{}
+	secrets := map[string]struct{}{}
+	pending := []string{}
+	paymentRequests := []string{}
+	for _, key := range keys {
+		switch {
+		case strings.HasPrefix(key, pendingPrefix):
+			pending = append(pending, strings.TrimPrefix(key, pendingPrefix))
+		case strings.HasPrefix(key, secretPrefix):
+			secrets[strings.TrimPrefix(key, secretPrefix)] = struct{}{}
+		case strings.HasPrefix(key, "did:"):
+			paymentRequests = append(paymentRequests, key)
+		case nonceKeyPattern.MatchString(key):
+			documents[key] = struct{}{}
+		}
+	}
+
+	report := &RepairReport{
+		OrphanedDocuments:       []string{},
+		OrphanedPending:         []string{},
+		OrphanedSecrets:         []string{},
+		DanglingPaymentRequests: []string{},
+	}
+	live := map[string]struct{}{}
+	liveDIDs := map[string]struct{}{}
+	for _, nonce := range pending {
+		_, hasDocument := documents[nonce]
+		_, hasSecret := secrets[nonce]
+		var registration PendingRegistration
+		value, err := get(s.store, pendingKey(nonce))
+		if err != nil {
+			return nil, fmt.Errorf("could not get pending registration %s: %w", nonce, err)
+		}
+		if hasDocument && hasSecret && json.Unmarshal(value, &registration) == nil {
+			live[nonce] = struct{}{}
+			liveDIDs[registration.DID] = struct{}{}
+			continue
+		}
+		if err := s.store.Delete(pendingKey(nonce)); err != nil {
+			return nil, fmt.Errorf("could not delete pending registration %s: %w", nonce, err)
+		}
+		report.OrphanedPending = append(report.OrphanedPending, nonce)
+	}
+
+	for nonce := range documents {
+		if _, ok := live[nonce]; ok {
+			continue
+		}
+		if err := s.store.Delete(nonce); err != nil {
+			return nil, fmt.Errorf("could not delete document %s: %w", nonce, err)
+		}
+		report.OrphanedDocuments = append(report.OrphanedDocuments, nonce)
+	}
+	for nonce := range secrets {
+		if _, ok := live[nonce]; ok {
+			continue
+		}
+		if err := s.store.Delete(secretKey(nonce)); err != nil {
+			return nil, fmt.Errorf("could not delete webhook secret %s: %w", nonce, err)
+		}
+		report.OrphanedSecrets = append(report.OrphanedSecrets, nonce)
+	}
+	for _, id := range paymentRequests {
+		if _, ok := liveDIDs[id]; ok {
+			continue
+		}
+		if err := s.store.Delete(id); err != nil {
+			return nil, fmt.Errorf("could not delete payment request %s: %w", id, err)
+		}
+		report.DanglingPaymentRequests = append(report.DanglingPaymentRequests, id)
+	}
+	sort.Strings(report.OrphanedDocuments)
+	sort.Strings(report.OrphanedSecrets)
+	return report, nil
+}
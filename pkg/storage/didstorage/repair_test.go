@@ -0,0 +1,67 @@
+package didstorage
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterStoreRepair(t *testing.T) {
+	regStore, _ := newTestRegisterStore(t)
+	for _, name := range []string{"alice", "erin"} {
+		_, err := regStore.Register(testDocument(t, "example.com:"+name))
+		assert.NoError(t, err)
+	}
+	pending, err := regStore.Pending()
+	assert.NoError(t, err)
+	var erin PendingRegistration
+	for _, registration := range pending {
+		if registration.DID == "did:web:example.com:erin" {
+			erin = registration
+		}
+	}
+
+	// carol crashed after storing her document, dave after storing his
+	// payment request and erin before storing her webhook secret.
+	carolNonce := strings.Repeat("c", 128)
+	daveNonce := strings.Repeat("d", 128)
+	carolJSON, err := json.Marshal(testDocument(t, "example.com:carol"))
+	assert.NoError(t, err)
+	assert.NoError(t, regStore.store.Set(carolNonce, carolJSON))
+	daveJSON, err := json.Marshal(testDocument(t, "example.com:dave"))
+	assert.NoError(t, err)
+	assert.NoError(t, regStore.store.Set(daveNonce, daveJSON))
+	assert.NoError(t, regStore.store.Set("did:web:example.com:dave", []byte("lnbc99")))
+	assert.NoError(t, regStore.store.Delete(secretKey(erin.Nonce)))
+	stray := strings.Repeat("f", 128)
+	assert.NoError(t, regStore.store.Set(secretKey(stray), []byte("secret")))
+
+	report, err := regStore.Repair()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{carolNonce, daveNonce, erin.Nonce}, report.OrphanedDocuments)
+	assert.Equal(t, []string{erin.Nonce}, report.OrphanedPending)
+	assert.Equal(t, []string{stray}, report.OrphanedSecrets)
+	assert.ElementsMatch(t, []string{"did:web:example.com:dave", "did:web:example.com:erin"}, report.DanglingPaymentRequests)
+
+	pending, err = regStore.Pending()
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "did:web:example.com:alice", pending[0].DID)
+		_, err = regStore.WebhookSecret(pending[0].Nonce)
+		assert.NoError(t, err)
+		payReq, err := regStore.store.Get("did:web:example.com:alice")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, payReq)
+	}
+
+	report, err = regStore.Repair()
+	assert.NoError(t, err)
+	assert.Equal(t, &RepairReport{
+		OrphanedDocuments:       []string{},
+		OrphanedPending:         []string{},
+		OrphanedSecrets:         []string{},
+		DanglingPaymentRequests: []string{},
+	}, report)
+}
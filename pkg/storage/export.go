@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Storage is a key/value backend Export and Import can move data between.
+type Storage interface {
+	Set(id string, value []byte) error
+	Get(id string) ([]byte, error)
+	Delete(id string) error
+	List(prefix string) ([]string, error)
+	ForEach(seek string, fn func(id string, value []byte) bool) error
+}
+
+// ExportVersion is the format version written in the export header.
+const ExportVersion = 1
+
+var (
+	ErrUnsupportedExport = fmt.Errorf("unsupported export version")
+)
+
+// exportHeader is the first line of an export.
+type exportHeader struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// exportRecord is one key/value pair of an export. Values are base64.
+type exportRecord struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Export writes every key/value pair of src to dst as JSON Lines, after a
+// header line carrying the format version. Expiry times are not exported.
+func Export(src Storage, dst io.Writer) error {
+	encoder := json.NewEncoder(dst)
+	if err := encoder.Encode(exportHeader{Version: ExportVersion, ExportedAt: time.Now().UTC()}); err != nil {
+		return fmt.Errorf("could not write header: %w", err)
+	}
+
+	var writeErr error
+	if err := src.ForEach("", func(id string, value []byte) bool {
+		if err := encoder.Encode(exportRecord{Key: id, Value: value}); err != nil {
+			writeErr = fmt.Errorf("could not write %s: %w", id, err)
+			return false
+		}
+		return true
+	}); err != nil {
+		return fmt.Errorf("could not iterate storage: %w", err)
+	}
+	return writeErr
+}
+
+// Import reads an export written by Export from src and sets each pair in
+// dst.
+func Import(dst Storage, src io.Reader) error {
+	decoder := json.NewDecoder(src)
+	var header exportHeader
+	if err := decoder.Decode(&header); err != nil {
+		return fmt.Errorf("could not read header: %w", err)
+	}
+	if header.Version != ExportVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedExport, header.Version)
+	}
+
+	for {
+		var record exportRecord
+		if err := decoder.Decode(&record); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not read record: %w", err)
+		}
+		if len(record.Key) == 0 {
+			return fmt.Errorf("could not read record: missing key")
+		}
+		if err := dst.Set(record.Key, record.Value); err != nil {
+			return fmt.Errorf("could not set %s: %w", record.Key, err)
+		}
+	}
+}
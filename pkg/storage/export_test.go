@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	src := newTestStorage(t)
+	values := map[string]string{
+		"example.com:alice":    `{"id":"did:web:example.com:alice"}`,
+		"example.com:alice:v1": `{"versionId":"1"}`,
+		"pending:abc":          "\x00binary\xff",
+	}
+	for key, value := range values {
+		assert.NoError(t, src.Set(key, []byte(value)))
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, Export(src, &buf))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 4)
+	var header map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &header))
+	assert.Equal(t, float64(1), header["version"])
+	assert.NotEmpty(t, header["exported_at"])
+	assert.JSONEq(t, `{"key":"pending:abc","value":"AGJpbmFyef8="}`, lines[3])
+
+	dst := newTestStorage(t)
+	assert.NoError(t, Import(dst, &buf))
+	for key, value := range values {
+		got, err := dst.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(value), got)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	tt := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"future version", `{"version":2,"exported_at":"2023-01-01T00:00:00Z"}`},
+		{"bad record", `{"version":1,"exported_at":"2023-01-01T00:00:00Z"}` + "\n" + `{"key":`},
+		{"missing key", `{"version":1,"exported_at":"2023-01-01T00:00:00Z"}` + "\n" + `{"value":"YQ=="}`},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Error(t, Import(newTestStorage(t), strings.NewReader(tc.input)))
+		})
+	}
+	err := Import(newTestStorage(t), strings.NewReader(tt[1].input))
+	assert.ErrorIs(t, err, ErrUnsupportedExport)
+}
@@ -0,0 +1,181 @@
+// Package filestorage keeps each value in its own JSON file, for small
+// deployments that want no database at all. Every List and ForEach reads the
+// whole directory, so it is not suited to high load.
+package filestorage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NewFileStorage returns storage keeping its files in dir, creating it when
+// missing.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create directory: %w", err)
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+type FileStorage struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+// record is the content of a file. The key is kept since file names only
+// carry its hash.
+type record struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// path returns the file of key, named by its SHA-256 so keys cannot escape
+// the directory.
+func (s *FileStorage) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Set writes value to a temporary file, syncs it and renames it into place,
+// so readers never see a partial write.
+func (s *FileStorage) Set(id string, value []byte) error {
+	data, err := json.Marshal(record{Key: id, Value: value})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("could not create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not sync file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(id)); err != nil {
+		return fmt.Errorf("could not rename file: %w", err)
+	}
+	return s.syncDir()
+}
+
+// syncDir persists renames and removals in the directory.
+func (s *FileStorage) syncDir() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (s *FileStorage) Get(id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, err := s.read(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return r.Value, nil
+}
+
+func (s *FileStorage) read(path string) (*record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", filepath.Base(path), err)
+	}
+	return &r, nil
+}
+
+func (s *FileStorage) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.path(id)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return s.syncDir()
+}
+
+// List returns every key starting with prefix in key order.
+func (s *FileStorage) List(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records, err := s.records(func(key string) bool { return strings.HasPrefix(key, prefix) })
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, r := range records {
+		keys = append(keys, r.Key)
+	}
+	return keys, nil
+}
+
+// ForEach calls fn for each key at or after seek in key order, stopping
+// early when fn returns false.
+func (s *FileStorage) ForEach(seek string, fn func(id string, value []byte) bool) error {
+	s.mu.RLock()
+	records, err := s.records(func(key string) bool { return key >= seek })
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if !fn(r.Key, r.Value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// records reads every file whose key matches, sorted by key.
+func (s *FileStorage) records(match func(key string) bool) ([]*record, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	records := []*record{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		r, err := s.read(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if match(r.Key) {
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records, nil
+}
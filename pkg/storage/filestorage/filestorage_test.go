@@ -0,0 +1,42 @@
+package filestorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		store, err := NewFileStorage(filepath.Join(t.TempDir(), "dids"))
+		assert.NoError(t, err)
+		return store
+	})
+}
+
+func TestFileStoragePaths(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "dids")
+	store, err := NewFileStorage(dir)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Set("../escape", []byte("a")))
+	assert.NoError(t, store.Set("example.com:alice", []byte("b")))
+
+	entries, err := os.ReadDir(root)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	entries, err = os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Regexp(t, `^[0-9a-f]{64}\.json$`, entry.Name())
+	}
+
+	keys, err := store.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"../escape", "example.com:alice"}, keys)
+}
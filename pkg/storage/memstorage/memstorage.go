@@ -0,0 +1,130 @@
+// Package memstorage keeps values in memory, for tests and for moving data
+// between backends. Nothing survives the process.
+package memstorage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/13x-tech/go-did-web/pkg/storage"
+)
+
+// NewMemStorage returns empty storage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{values: map[string][]byte{}}
+}
+
+type MemStorage struct {
+	mu     sync.RWMutex
+	values map[string][]byte
+}
+
+func (s *MemStorage) Set(id string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[id] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *MemStorage) Get(id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[id]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (s *MemStorage) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, id)
+	return nil
+}
+
+// Batch runs fn while holding the storage lock, applying its writes only
+// when it returns nil.
+func (s *MemStorage) Batch(fn func(tx storage.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := &memTx{s: s, writes: map[string][]byte{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for id, value := range tx.writes {
+		if value == nil {
+			delete(s.values, id)
+		} else {
+			s.values[id] = value
+		}
+	}
+	return nil
+}
+
+// memTx buffers the writes of a Batch. Deleted keys are buffered as nil.
+type memTx struct {
+	s      *MemStorage
+	writes map[string][]byte
+}
+
+func (tx *memTx) Set(id string, value []byte) error {
+	tx.writes[id] = append([]byte{}, value...)
+	return nil
+}
+
+func (tx *memTx) Get(id string) ([]byte, error) {
+	value, ok := tx.writes[id]
+	if !ok {
+		value = tx.s.values[id]
+	}
+	if value == nil {
+		return nil, nil
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (tx *memTx) Delete(id string) error {
+	tx.writes[id] = nil
+	return nil
+}
+
+// List returns every key starting with prefix in key order.
+func (s *MemStorage) List(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys(func(key string) bool { return strings.HasPrefix(key, prefix) }), nil
+}
+
+// ForEach calls fn for each key at or after seek in key order, stopping
+// early when fn returns false. fn sees the values as they were when
+// iteration started.
+func (s *MemStorage) ForEach(seek string, fn func(id string, value []byte) bool) error {
+	s.mu.RLock()
+	keys := s.keys(func(key string) bool { return key >= seek })
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = append([]byte{}, s.values[key]...)
+	}
+	s.mu.RUnlock()
+
+	for i, key := range keys {
+		if !fn(key, values[i]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// keys returns the matching keys, sorted. Callers must hold the lock.
+func (s *MemStorage) keys(match func(key string) bool) []string {
+	keys := []string{}
+	for key := range s.values {
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,13 @@
+package memstorage
+
+import (
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/storage/storagetest"
+)
+
+func TestMemStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		return NewMemStorage()
+	})
+}
@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// StorageObserver is told about the reads and writes of an
+// ObservableStorage, e.g. to count them or to write an audit log. Calls may
+// come from several goroutines at once.
+type StorageObserver interface {
+	BeforeSet(id string)
+	AfterSet(id string, err error, duration time.Duration)
+	BeforeGet(id string)
+	AfterGet(id string, err error, duration time.Duration)
+	BeforeDelete(id string)
+	AfterDelete(id string, err error, duration time.Duration)
+}
+
+// ObservableStorage reports the Set, Get and Delete calls on the storage it
+// wraps to a StorageObserver, including those made inside a Batch. Batches,
+// updates, expiring writes, paging, backups and Close use the wrapped storage
+// when it supports them and fall back to plain calls otherwise.
+type ObservableStorage struct {
+	inner    Storage
+	observer StorageObserver
+}
+
+// NewObservableStorage wraps inner so observer sees its operations.
+func NewObservableStorage(inner Storage, observer StorageObserver) *ObservableStorage {
+	return &ObservableStorage{inner: inner, observer: observer}
+}
+
+// observe runs op between the Before and After callbacks.
+func observe(id string, before func(id string), after func(id string, err error, duration time.Duration), op func() error) error {
+	before(id)
+	start := time.Now()
+	err := op()
+	after(id, err, time.Since(start))
+	return err
+}
+
+func (o *ObservableStorage) Set(id string, value []byte) error {
+	return observe(id, o.observer.BeforeSet, o.observer.AfterSet, func() error {
+		return o.inner.Set(id, value)
+	})
+}
+
+func (o *ObservableStorage) Get(id string) ([]byte, error) {
+	var value []byte
+	err := observe(id, o.observer.BeforeGet, o.observer.AfterGet, func() error {
+		var err error
+		value, err = o.inner.Get(id)
+		return err
+	})
+	return value, err
+}
+
+func (o *ObservableStorage) Delete(id string) error {
+	return observe(id, o.observer.BeforeDelete, o.observer.AfterDelete, func() error {
+		return o.inner.Delete(id)
+	})
+}
+
+func (o *ObservableStorage) List(prefix string) ([]string, error) {
+	return o.inner.List(prefix)
+}
+
+func (o *ObservableStorage) ForEach(seek string, fn func(id string, value []byte) bool) error {
+	return o.inner.ForEach(seek, fn)
+}
+
+// SetWithTTL is observed as a Set. The record does not expire when the
+// wrapped storage cannot expire records.
+func (o *ObservableStorage) SetWithTTL(id string, value []byte, ttl time.Duration) error {
+	return observe(id, o.observer.BeforeSet, o.observer.AfterSet, func() error {
+		if expirable, ok := o.inner.(ttlSetter); ok {
+			return expirable.SetWithTTL(id, value, ttl)
+		}
+		return o.inner.Set(id, value)
+	})
+}
+
+// Update is observed as a Set. It is only atomic when the wrapped storage
+// supports updates.
+func (o *ObservableStorage) Update(id string, fn func(value []byte) ([]byte, error)) error {
+	return observe(id, o.observer.BeforeSet, o.observer.AfterSet, func() error {
+		if updater, ok := o.inner.(updater); ok {
+			return updater.Update(id, fn)
+		}
+		current, err := o.inner.Get(id)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		updated, err := fn(current)
+		if err != nil {
+			return err
+		}
+		return o.inner.Set(id, updated)
+	})
+}
+
+// Batch runs fn in a transaction of the wrapped storage, observing its
+// operations. It is only atomic when the wrapped storage supports batches.
+func (o *ObservableStorage) Batch(fn func(tx Tx) error) error {
+	batcher, ok := o.inner.(Batcher)
+	if !ok {
+		return fn(o)
+	}
+	return batcher.Batch(func(tx Tx) error {
+		return fn(&observableTx{tx: tx, observer: o.observer})
+	})
+}
+
+// ReadOnly reports whether the wrapped storage refuses writes.
+func (o *ObservableStorage) ReadOnly() bool {
+	ro, ok := o.inner.(interface{ ReadOnly() bool })
+	return ok && ro.ReadOnly()
+}
+
+// Ping checks the wrapped storage, if it can check itself.
+func (o *ObservableStorage) Ping() error {
+	if pinger, ok := o.inner.(interface{ Ping() error }); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
+
+// TTL returns how long id has left before it expires, or ErrNoTTL when the
+// wrapped storage cannot expire records.
+func (o *ObservableStorage) TTL(id string) (time.Duration, error) {
+	if expirable, ok := o.inner.(ttlGetter); ok {
+		return expirable.TTL(id)
+	}
+	return 0, ErrNoTTL
+}
+
+// ListPage pages through the keys of the wrapped storage. When it cannot page
+// itself the keys are read with ForEach.
+func (o *ObservableStorage) ListPage(cursor string, limit int, opts ...ListOption) (keys []string, nextCursor string, err error) {
+	if pager, ok := o.inner.(pager); ok {
+		return pager.ListPage(cursor, limit, opts...)
+	}
+
+	lo := &listOptions{}
+	for _, opt := range opts {
+		if err := opt(lo); err != nil {
+			return nil, "", err
+		}
+	}
+	if limit < 1 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	seek := cursor
+	if seek < lo.prefix {
+		seek = lo.prefix
+	}
+
+	keys = []string{}
+	err = o.inner.ForEach(seek, func(id string, _ []byte) bool {
+		if !strings.HasPrefix(id, lo.prefix) {
+			return false
+		}
+		if lo.filter != nil && !lo.filter(id) {
+			return true
+		}
+		if len(keys) == limit {
+			nextCursor = id
+			return false
+		}
+		keys = append(keys, id)
+		return true
+	})
+	return keys, nextCursor, err
+}
+
+// Backup writes a backup of the wrapped storage to dst, or returns
+// ErrBackupUnsupported when it cannot be backed up.
+func (o *ObservableStorage) Backup(dst io.Writer) error {
+	if backuper, ok := o.inner.(backuper); ok {
+		return backuper.Backup(dst)
+	}
+	return ErrBackupUnsupported
+}
+
+// Close closes the wrapped storage, if it needs closing.
+func (o *ObservableStorage) Close() error {
+	if closer, ok := o.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type ttlSetter interface {
+	SetWithTTL(id string, value []byte, ttl time.Duration) error
+}
+
+type ttlGetter interface {
+	TTL(id string) (time.Duration, error)
+}
+
+type updater interface {
+	Update(id string, fn func(value []byte) ([]byte, error)) error
+}
+
+type pager interface {
+	ListPage(cursor string, limit int, opts ...ListOption) ([]string, string, error)
+}
+
+type backuper interface {
+	Backup(dst io.Writer) error
+}
+
+// observableTx reports the operations of a transaction.
+type observableTx struct {
+	tx       Tx
+	observer StorageObserver
+}
+
+func (t *observableTx) Set(id string, value []byte) error {
+	return observe(id, t.observer.BeforeSet, t.observer.AfterSet, func() error {
+		return t.tx.Set(id, value)
+	})
+}
+
+// SetWithTTL is observed as a Set, and expires the record when the
+// transaction supports it.
+func (t *observableTx) SetWithTTL(id string, value []byte, ttl time.Duration) error {
+	return observe(id, t.observer.BeforeSet, t.observer.AfterSet, func() error {
+		if expirable, ok := t.tx.(ttlSetter); ok {
+			return expirable.SetWithTTL(id, value, ttl)
+		}
+		return t.tx.Set(id, value)
+	})
+}
+
+func (t *observableTx) Get(id string) ([]byte, error) {
+	var value []byte
+	err := observe(id, t.observer.BeforeGet, t.observer.AfterGet, func() error {
+		var err error
+		value, err = t.tx.Get(id)
+		return err
+	})
+	return value, err
+}
+
+func (t *observableTx) Delete(id string) error {
+	return observe(id, t.observer.BeforeDelete, t.observer.AfterDelete, func() error {
+		return t.tx.Delete(id)
+	})
+}
+
+// LoggingObserver logs each completed operation with its duration, and
+// whether it failed.
+type LoggingObserver struct {
+	logger *slog.Logger
+}
+
+// NewLoggingObserver logs to logger, or the default logger when it is nil.
+// Completed operations are logged at info level and failed ones at error
+// level.
+func NewLoggingObserver(logger *slog.Logger) *LoggingObserver {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &LoggingObserver{logger: logger}
+}
+
+func (l *LoggingObserver) log(op, id string, err error, duration time.Duration) {
+	attrs := []slog.Attr{
+		slog.String("op", op),
+		slog.String("id", id),
+		slog.Duration("duration", duration),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+		l.logger.LogAttrs(context.Background(), slog.LevelError, "storage operation failed", attrs...)
+		return
+	}
+	l.logger.LogAttrs(context.Background(), slog.LevelInfo, "storage operation", attrs...)
+}
+
+func (l *LoggingObserver) BeforeSet(id string)    {}
+func (l *LoggingObserver) BeforeGet(id string)    {}
+func (l *LoggingObserver) BeforeDelete(id string) {}
+
+func (l *LoggingObserver) AfterSet(id string, err error, duration time.Duration) {
+	l.log("set", id, err, duration)
+}
+
+func (l *LoggingObserver) AfterGet(id string, err error, duration time.Duration) {
+	l.log("get", id, err, duration)
+}
+
+func (l *LoggingObserver) AfterDelete(id string, err error, duration time.Duration) {
+	l.log("delete", id, err, duration)
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+// recordingObserver records the operations it is told about.
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingObserver) record(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingObserver) after(op, id string, err error, duration time.Duration) {
+	if duration < 0 {
+		r.record("negative duration")
+	}
+	if err != nil {
+		r.record("after %s %s: %s", op, id, err)
+		return
+	}
+	r.record("after %s %s", op, id)
+}
+
+func (r *recordingObserver) BeforeSet(id string)    { r.record("before set %s", id) }
+func (r *recordingObserver) BeforeGet(id string)    { r.record("before get %s", id) }
+func (r *recordingObserver) BeforeDelete(id string) { r.record("before delete %s", id) }
+
+func (r *recordingObserver) AfterSet(id string, err error, duration time.Duration) {
+	r.after("set", id, err, duration)
+}
+
+func (r *recordingObserver) AfterGet(id string, err error, duration time.Duration) {
+	r.after("get", id, err, duration)
+}
+
+func (r *recordingObserver) AfterDelete(id string, err error, duration time.Duration) {
+	r.after("delete", id, err, duration)
+}
+
+func TestObservableStorage(t *testing.T) {
+	inner := newTestStorage(t)
+	observer := &recordingObserver{}
+	store := NewObservableStorage(inner, observer)
+
+	assert.NoError(t, store.Set("a", []byte("a")))
+	value, err := store.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(value))
+	assert.NoError(t, store.Delete("a"))
+	assert.NoError(t, store.SetWithTTL("b", []byte("b"), time.Hour))
+	_, err = inner.TTL("b")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Batch(func(tx Tx) error {
+		return tx.Set("c", []byte("c"))
+	}))
+	keys, err := store.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, keys)
+
+	assert.NoError(t, inner.Close())
+	assert.Error(t, store.Set("d", []byte("d")))
+
+	assert.Equal(t, []string{
+		"before set a", "after set a",
+		"before get a", "after get a",
+		"before delete a", "after delete a",
+		"before set b", "after set b",
+		"before set c", "after set c",
+		"before set d", "after set d: database not open",
+	}, observer.events)
+}
+
+// plainStorage hides the optional methods of the storage it embeds.
+type plainStorage struct {
+	Storage
+}
+
+func TestObservableStorageForwards(t *testing.T) {
+	inner := newTestStorage(t)
+	store := NewObservableStorage(inner, &recordingObserver{})
+
+	assert.NoError(t, store.SetWithTTL("a", []byte("a"), time.Hour))
+	ttl, err := store.TTL("a")
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Hour, ttl)
+
+	assert.NoError(t, store.Set("b", []byte("b")))
+	keys, next, err := store.ListPage("", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, keys)
+	assert.Equal(t, "b", next)
+
+	var buf bytes.Buffer
+	assert.NoError(t, store.Backup(&buf))
+	assert.NotZero(t, buf.Len())
+
+	assert.NoError(t, store.Close())
+	_, err = inner.Get("a")
+	assert.Error(t, err)
+}
+
+func TestObservableStorageFallbacks(t *testing.T) {
+	store := NewObservableStorage(plainStorage{newTestStorage(t)}, &recordingObserver{})
+
+	assert.NoError(t, store.SetWithTTL("a", []byte("a"), time.Hour))
+	_, err := store.TTL("a")
+	assert.ErrorIs(t, err, ErrNoTTL)
+
+	for _, id := range []string{"b:1", "b:2", "b:3", "c"} {
+		assert.NoError(t, store.Set(id, []byte(id)))
+	}
+	keys, next, err := store.ListPage("", 2, WithPrefix("b:"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b:1", "b:2"}, keys)
+	assert.Equal(t, "b:3", next)
+	keys, next, err = store.ListPage(next, 2, WithPrefix("b:"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b:3"}, keys)
+	assert.Empty(t, next)
+	keys, _, err = store.ListPage("", 10, WithKeyFilter(func(key string) bool { return key != "a" }))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b:1", "b:2", "b:3", "c"}, keys)
+	_, _, err = store.ListPage("", 0)
+	assert.Error(t, err)
+
+	assert.ErrorIs(t, store.Backup(io.Discard), ErrBackupUnsupported)
+	assert.NoError(t, store.Close())
+}
+
+func TestLoggingObserver(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf))
+	store := NewObservableStorage(newTestStorage(t), NewLoggingObserver(logger))
+
+	assert.NoError(t, store.Set("a", []byte("a")))
+	_, err := store.Get("a")
+	assert.NoError(t, err)
+	assert.Error(t, store.Update("b", func([]byte) ([]byte, error) { return nil, fmt.Errorf("boom") }))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Contains(t, lines[0], `level=INFO msg="storage operation" op=set id=a duration=`)
+		assert.Contains(t, lines[1], `level=INFO msg="storage operation" op=get id=a duration=`)
+		assert.Contains(t, lines[2], `level=ERROR msg="storage operation failed" op=set id=b duration=`)
+		assert.Contains(t, lines[2], `error=boom`)
+	}
+}
@@ -0,0 +1,170 @@
+// Package s3storage stores values as objects in an S3 compatible bucket such
+// as AWS S3, Cloudflare R2 or MinIO.
+package s3storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/13x-tech/go-did-web/pkg/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// New returns storage keeping each value in bucket under "{prefix}/{id}".
+func New(bucket, prefix string, client *s3.Client) *S3Storage {
+	return &S3Storage{
+		bucket: bucket,
+		prefix: strings.Trim(prefix, "/"),
+		client: client,
+	}
+}
+
+type S3Storage struct {
+	bucket string
+	prefix string
+	client *s3.Client
+}
+
+// key returns the object key of id.
+func (s *S3Storage) key(id string) string {
+	if len(s.prefix) == 0 {
+		return id
+	}
+	return s.prefix + "/" + id
+}
+
+// id returns the id stored under the object key.
+func (s *S3Storage) id(key string) string {
+	if len(s.prefix) == 0 {
+		return key
+	}
+	return strings.TrimPrefix(key, s.prefix+"/")
+}
+
+func (s *S3Storage) Set(id string, value []byte) error {
+	_, err := s.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+		Body:   bytes.NewReader(value),
+	})
+	if err != nil {
+		return fmt.Errorf("could not put %s: %w", id, err)
+	}
+	return nil
+}
+
+// Get returns the value of id, or an error wrapping storage.ErrNotFound when
+// there is no such object.
+func (s *S3Storage) Get(id string) ([]byte, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if isNotFound(err) {
+		return nil, fmt.Errorf("%w: %s", storage.ErrNotFound, id)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not get %s: %w", id, err)
+	}
+	defer out.Body.Close()
+	value, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", id, err)
+	}
+	return value, nil
+}
+
+func isNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return true
+	}
+	var responseErr *awshttp.ResponseError
+	return errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusNotFound
+}
+
+func (s *S3Storage) Delete(id string) error {
+	_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if err != nil {
+		return fmt.Errorf("could not delete %s: %w", id, err)
+	}
+	return nil
+}
+
+// List returns every id starting with prefix in key order.
+func (s *S3Storage) List(prefix string) ([]string, error) {
+	ids := []string{}
+	err := s.list(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key(prefix)),
+	}, func(id string) bool {
+		ids = append(ids, id)
+		return true
+	})
+	return ids, err
+}
+
+// ForEach calls fn for each id at or after seek in key order, stopping early
+// when fn returns false. Each value is fetched with its own request.
+func (s *S3Storage) ForEach(seek string, fn func(id string, value []byte) bool) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key("")),
+	}
+	if len(seek) > 0 {
+		// StartAfter is exclusive, so seek itself is checked first.
+		value, err := s.Get(seek)
+		if err == nil {
+			if !fn(seek, value) {
+				return nil
+			}
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		input.StartAfter = aws.String(s.key(seek))
+	}
+
+	var getErr error
+	err := s.list(input, func(id string) bool {
+		value, err := s.Get(id)
+		if errors.Is(err, storage.ErrNotFound) {
+			return true
+		} else if err != nil {
+			getErr = err
+			return false
+		}
+		return fn(id, value)
+	})
+	if err != nil {
+		return err
+	}
+	return getErr
+}
+
+// list pages through the objects matched by input, stopping early when fn
+// returns false.
+func (s *S3Storage) list(input *s3.ListObjectsV2Input, fn func(id string) bool) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return fmt.Errorf("could not list objects: %w", err)
+		}
+		for _, object := range page.Contents {
+			if !fn(s.id(aws.ToString(object.Key))) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
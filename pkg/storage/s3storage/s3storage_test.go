@@ -0,0 +1,209 @@
+package s3storage
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/13x-tech/go-did-web/pkg/storage"
+	"github.com/13x-tech/go-did-web/pkg/storage/storagetest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeS3 serves the handful of path style S3 calls S3Storage makes.
+func newFakeS3(t *testing.T, bucket string) *httptest.Server {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/"+bucket)
+		key = strings.TrimPrefix(key, "/")
+		switch {
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			objects[key] = body
+		case r.Method == http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+			type contents struct {
+				Key string
+			}
+			result := struct {
+				XMLName     xml.Name `xml:"ListBucketResult"`
+				Name        string
+				IsTruncated bool
+				Contents    []contents
+			}{Name: bucket}
+			keys := []string{}
+			for k := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) && k > r.URL.Query().Get("start-after") {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				result.Contents = append(result.Contents, contents{Key: k})
+			}
+			xml.NewEncoder(w).Encode(result)
+		case r.Method == http.MethodGet:
+			value, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+				return
+			}
+			w.Write(value)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestStorage uses the S3 compatible endpoint in S3STORAGE_TEST_ENDPOINT,
+// e.g. a local MinIO, with S3STORAGE_TEST_BUCKET and the usual AWS access key
+// variables, and falls back to an in process fake.
+func newTestStorage(t *testing.T, prefix string) *S3Storage {
+	endpoint := os.Getenv("S3STORAGE_TEST_ENDPOINT")
+	bucket := os.Getenv("S3STORAGE_TEST_BUCKET")
+	if len(endpoint) == 0 {
+		bucket = "dids"
+		endpoint = newFakeS3(t, bucket).URL
+	}
+	client := newClient(endpoint, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	return New(bucket, prefix, client)
+}
+
+// newClient returns a path style S3 client for endpoint.
+func newClient(endpoint, accessKeyID, secretAccessKey string) *s3.Client {
+	return s3.New(s3.Options{
+		Region:           "us-east-1",
+		EndpointResolver: s3.EndpointResolverFromURL(endpoint),
+		UsePathStyle:     true,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{
+				AccessKeyID:     accessKeyID,
+				SecretAccessKey: secretAccessKey,
+			}, nil
+		}),
+	})
+}
+
+const (
+	minioUser     = "minioadmin"
+	minioPassword = "minioadmin"
+)
+
+// startMinIO runs a MinIO container for the test and returns its endpoint.
+// The test is skipped when Docker is not available.
+func startMinIO(t *testing.T) string {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker not found")
+	}
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skip("docker daemon not available")
+	}
+	out, err := exec.Command("docker", "run", "--detach", "--rm",
+		"--publish", "127.0.0.1::9000",
+		"--env", "MINIO_ROOT_USER="+minioUser,
+		"--env", "MINIO_ROOT_PASSWORD="+minioPassword,
+		"minio/minio", "server", "/data",
+	).Output()
+	if err != nil {
+		t.Fatalf("could not start minio: %s", err)
+	}
+	container := strings.TrimSpace(string(out))
+	t.Cleanup(func() { exec.Command("docker", "rm", "--force", container).Run() })
+
+	out, err = exec.Command("docker", "port", container, "9000/tcp").Output()
+	if err != nil {
+		t.Fatalf("could not get minio port: %s", err)
+	}
+	address, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	endpoint := "http://" + address
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		resp, err := http.Get(endpoint + "/minio/health/live")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return endpoint
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("minio did not become ready at %s", endpoint)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	store := newTestStorage(t, "test/"+t.Name())
+
+	assert.NoError(t, store.Set("example.com:alice", []byte("a")))
+	assert.NoError(t, store.Set("example.com:bob", []byte("b")))
+	assert.NoError(t, store.Set("pending:1", []byte("p")))
+
+	value, err := store.Get("example.com:alice")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), value)
+
+	_, err = store.Get("example.com:carol")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	keys, err := store.List("example.com:")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com:alice", "example.com:bob"}, keys)
+
+	seen := map[string]string{}
+	assert.NoError(t, store.ForEach("example.com:bob", func(id string, value []byte) bool {
+		seen[id] = string(value)
+		return true
+	}))
+	assert.Equal(t, map[string]string{"example.com:bob": "b", "pending:1": "p"}, seen)
+
+	assert.NoError(t, store.Delete("example.com:alice"))
+	_, err = store.Get("example.com:alice")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	keys, err = store.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com:bob", "pending:1"}, keys)
+}
+
+func TestKey(t *testing.T) {
+	assert.Equal(t, "dids/example.com:alice", New("b", "/dids/", nil).key("example.com:alice"))
+	assert.Equal(t, "example.com:alice", New("b", "", nil).key("example.com:alice"))
+	assert.Equal(t, "example.com:alice", New("b", "dids", nil).id("dids/example.com:alice"))
+}
+
+func TestS3StorageBehavior(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		return newTestStorage(t, "test/"+t.Name())
+	})
+}
+
+func TestS3StorageMinIO(t *testing.T) {
+	endpoint := startMinIO(t)
+	client := newClient(endpoint, minioUser, minioPassword)
+	_, err := client.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String("dids")})
+	assert.NoError(t, err)
+
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		return New("dids", "test/"+t.Name(), client)
+	})
+}
@@ -0,0 +1,118 @@
+// Package sqlitestorage stores values in a SQLite key/value table, for
+// deployments where BoltDB struggles with write load or the filesystem.
+package sqlitestorage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	// The driver registers itself as "sqlite3".
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// New opens the SQLite database at dsn, e.g. "/var/lib/didsrv/dids.sqlite",
+// switches it to WAL mode and creates the kv table when missing.
+func New(dsn string) (*SQLiteStorage, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open database: %w", err)
+	}
+	for _, stmt := range []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA foreign_keys=ON",
+		"CREATE TABLE IF NOT EXISTS kv (id TEXT PRIMARY KEY, value BLOB NOT NULL)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("could not prepare database: %w", err)
+		}
+	}
+	return &SQLiteStorage{db: db}, nil
+}
+
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// Close releases the database.
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStorage) Set(id string, value []byte) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO kv (id, value) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET value = excluded.value", id, value)
+		return err
+	})
+}
+
+func (s *SQLiteStorage) Get(id string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRow("SELECT value FROM kv WHERE id = ?", id).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (s *SQLiteStorage) Delete(id string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM kv WHERE id = ?", id)
+		return err
+	})
+}
+
+// List returns every key starting with prefix in key order.
+func (s *SQLiteStorage) List(prefix string) ([]string, error) {
+	rows, err := s.db.Query("SELECT id FROM kv WHERE substr(id, 1, length(?1)) = ?1 ORDER BY id", prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		keys = append(keys, id)
+	}
+	return keys, rows.Err()
+}
+
+// ForEach calls fn for each key at or after seek in key order, stopping
+// early when fn returns false.
+func (s *SQLiteStorage) ForEach(seek string, fn func(id string, value []byte) bool) error {
+	rows, err := s.db.Query("SELECT id, value FROM kv WHERE id >= ? ORDER BY id", seek)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var value []byte
+		if err := rows.Scan(&id, &value); err != nil {
+			return err
+		}
+		if !fn(id, value) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+// inTx runs fn in a transaction, committing when it succeeds.
+func (s *SQLiteStorage) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,29 @@
+package sqlitestorage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStorage(t *testing.T) *SQLiteStorage {
+	store, err := New(filepath.Join(t.TempDir(), "test.sqlite"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		return newTestStorage(t)
+	})
+}
+
+func TestWALMode(t *testing.T) {
+	store := newTestStorage(t)
+	var mode string
+	assert.NoError(t, store.db.QueryRow("PRAGMA journal_mode").Scan(&mode))
+	assert.Equal(t, "wal", mode)
+}
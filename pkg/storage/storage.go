@@ -1,16 +1,27 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"go.etcd.io/bbolt"
 )
 
-func initStorageDir(dir string) error {
+// DefaultDirMode and DefaultFileMode are the permissions the storage
+// directory and database files are created with, before the umask.
+const (
+	DefaultDirMode  os.FileMode = 0755
+	DefaultFileMode os.FileMode = 0600
+)
+
+func initStorageDir(dir string, mode os.FileMode) error {
 	if stat, err := os.Stat(dir); os.IsNotExist(err) {
-		err := os.MkdirAll(dir, 0755)
+		err := os.MkdirAll(dir, mode)
 		if err != nil {
 			return fmt.Errorf("could not create directory: %w", err)
 		}
@@ -19,12 +30,71 @@ func initStorageDir(dir string) error {
 	}
 	return nil
 }
-func New(storageDir, bucket string) (*BoltStorage, error) {
-	if err := initStorageDir(storageDir); err != nil {
+
+// Option configures how New opens the database.
+type Option func(o *options) error
+
+type options struct {
+	fileName string
+	dirMode  os.FileMode
+	fileMode os.FileMode
+}
+
+// WithFileName sets the database file name within the storage directory. By
+// default each bucket lives in its own "<bucket>.db" file.
+func WithFileName(name string) Option {
+	return func(o *options) error {
+		if len(name) == 0 || name != filepath.Base(name) {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+		o.fileName = name
+		return nil
+	}
+}
+
+// WithDirMode sets the permissions of the storage directory and any missing
+// parents when New creates them, DefaultDirMode by default. The owner needs
+// full access, and the process umask still applies. Existing directories
+// are left as they are.
+func WithDirMode(mode os.FileMode) Option {
+	return func(o *options) error {
+		if mode&^os.ModePerm != 0 || mode&0700 != 0700 {
+			return fmt.Errorf("invalid directory mode %#o: must be permission bits including 0700", mode)
+		}
+		o.dirMode = mode
+		return nil
+	}
+}
+
+// WithFileMode sets the permissions of a database file New creates,
+// DefaultFileMode by default. The owner needs read and write access, and
+// the process umask still applies.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) error {
+		if mode&^os.ModePerm != 0 || mode&0600 != 0600 {
+			return fmt.Errorf("invalid file mode %#o: must be permission bits including 0600", mode)
+		}
+		o.fileMode = mode
+		return nil
+	}
+}
+
+func New(storageDir, bucket string, opts ...Option) (*BoltStorage, error) {
+	o := &options{
+		fileName: fmt.Sprintf("%s.db", bucket),
+		dirMode:  DefaultDirMode,
+		fileMode: DefaultFileMode,
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	if err := initStorageDir(storageDir, o.dirMode); err != nil {
 		return nil, err
 	}
-	dbPath := filepath.Join(storageDir, fmt.Sprintf("%s.db", bucket))
-	db, err := bbolt.Open(dbPath, 0600, bbolt.DefaultOptions)
+	dbPath := filepath.Join(storageDir, o.fileName)
+	db, err := bbolt.Open(dbPath, o.fileMode, bbolt.DefaultOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -42,28 +112,387 @@ func New(storageDir, bucket string) (*BoltStorage, error) {
 	}, nil
 }
 
+// NewReadOnly opens the database file at path without write access, e.g. a
+// replica restored from a backup. Bolt takes a shared lock for read-only
+// handles, so it fails with bbolt.ErrTimeout while a writer holds the file.
+func NewReadOnly(path, bucket string) (*BoltStorage, error) {
+	db, err := bbolt.Open(path, 0400, &bbolt.Options{ReadOnly: true, Timeout: readOnlyTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(bucket)) == nil {
+			return fmt.Errorf("bucket %s not found", bucket)
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStorage{
+		db:       db,
+		bucket:   []byte(bucket),
+		readOnly: true,
+	}, nil
+}
+
+// readOnlyTimeout is how long NewReadOnly waits for a writer to release the
+// file.
+const readOnlyTimeout = time.Second
+
 type BoltStorage struct {
-	bucket []byte
-	db     *bbolt.DB
+	bucket   []byte
+	db       *bbolt.DB
+	readOnly bool
+}
+
+// Close releases the database file.
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+// ReadOnly reports whether the storage was opened with NewReadOnly.
+func (s *BoltStorage) ReadOnly() bool {
+	return s.readOnly
+}
+
+const ttlSuffix = "::ttl"
+
+// pingKey is written and removed again by Ping.
+const pingKey = "::ping"
+
+var (
+	ErrNoTTL    = fmt.Errorf("no ttl set")
+	ErrReadOnly = fmt.Errorf("storage is read-only")
+	// ErrNotFound is returned by storage that reports missing keys as an
+	// error rather than an empty value.
+	ErrNotFound = fmt.Errorf("not found")
+	// ErrBackupUnsupported is returned when the storage cannot be backed up.
+	ErrBackupUnsupported = fmt.Errorf("storage does not support backups")
+)
+
+func ttlKey(id []byte) []byte {
+	return append(append([]byte{}, id...), ttlSuffix...)
+}
+
+func isTTLKey(id []byte) bool {
+	return bytes.HasSuffix(id, []byte(ttlSuffix))
+}
+
+// expiresAt returns when id expires, or the zero time if it has no ttl.
+func expiresAt(b *bbolt.Bucket, id []byte) time.Time {
+	raw := b.Get(ttlKey(id))
+	if len(raw) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(raw)))
+}
+
+func expired(b *bbolt.Bucket, id []byte) bool {
+	expiry := expiresAt(b, id)
+	return !expiry.IsZero() && !time.Now().Before(expiry)
 }
 
 func (s *BoltStorage) Set(id string, value []byte) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
 	return s.db.Update(func(tx *bbolt.Tx) error {
-		return tx.Bucket(s.bucket).Put([]byte(id), value)
+		b := tx.Bucket(s.bucket)
+		if err := b.Delete(ttlKey([]byte(id))); err != nil {
+			return err
+		}
+		return b.Put([]byte(id), value)
 	})
 }
 
+// SetWithTTL stores value under id until ttl has elapsed, after which Get
+// treats it as absent.
+func (s *BoltStorage) SetWithTTL(id string, value []byte, ttl time.Duration) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	expiry := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiry, uint64(time.Now().Add(ttl).UnixNano()))
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if err := b.Put(ttlKey([]byte(id)), expiry); err != nil {
+			return err
+		}
+		return b.Put([]byte(id), value)
+	})
+}
+
+// TTL returns how long id has left before it expires, or ErrNoTTL when it was
+// not stored with one.
+func (s *BoltStorage) TTL(id string) (time.Duration, error) {
+	var expiry time.Time
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		expiry = expiresAt(tx.Bucket(s.bucket), []byte(id))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if expiry.IsZero() {
+		return 0, ErrNoTTL
+	}
+	if remaining := time.Until(expiry); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
+
 func (s *BoltStorage) Get(id string) ([]byte, error) {
 	var data []byte
 	err := s.db.View(func(tx *bbolt.Tx) error {
-		data = tx.Bucket(s.bucket).Get([]byte(id))
+		b := tx.Bucket(s.bucket)
+		if expired(b, []byte(id)) {
+			return nil
+		}
+		if value := b.Get([]byte(id)); value != nil {
+			data = append([]byte{}, value...)
+		}
 		return nil
 	})
 	return data, err
 }
 
+// Update replaces the value of id with the result of fn in a single write
+// transaction. fn receives nil when id is absent or expired.
+func (s *BoltStorage) Update(id string, fn func(value []byte) ([]byte, error)) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		var current []byte
+		if expired(b, []byte(id)) {
+			// The expired record is replaced by one without a ttl.
+			if err := b.Delete(ttlKey([]byte(id))); err != nil {
+				return err
+			}
+		} else if value := b.Get([]byte(id)); value != nil {
+			current = append([]byte{}, value...)
+		}
+		updated, err := fn(current)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), updated)
+	})
+}
+
+// Tx reads and writes storage inside a Batch.
+type Tx interface {
+	Set(id string, value []byte) error
+	Get(id string) ([]byte, error)
+	Delete(id string) error
+}
+
+// Batcher is implemented by storage that can write several keys
+// atomically.
+type Batcher interface {
+	// Batch runs fn in a single transaction, applying its writes only when
+	// it returns nil.
+	Batch(fn func(tx Tx) error) error
+}
+
+// Batch runs fn in a single write transaction. Nothing fn wrote is stored
+// when it returns an error.
+func (s *BoltStorage) Batch(fn func(tx Tx) error) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return fn(&boltTx{b: tx.Bucket(s.bucket)})
+	})
+}
+
+// boltTx is the Tx of a Bolt write transaction. It also supports
+// SetWithTTL.
+type boltTx struct {
+	b *bbolt.Bucket
+}
+
+func (tx *boltTx) Set(id string, value []byte) error {
+	if err := tx.b.Delete(ttlKey([]byte(id))); err != nil {
+		return err
+	}
+	return tx.b.Put([]byte(id), value)
+}
+
+func (tx *boltTx) SetWithTTL(id string, value []byte, ttl time.Duration) error {
+	expiry := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiry, uint64(time.Now().Add(ttl).UnixNano()))
+	if err := tx.b.Put(ttlKey([]byte(id)), expiry); err != nil {
+		return err
+	}
+	return tx.b.Put([]byte(id), value)
+}
+
+func (tx *boltTx) Get(id string) ([]byte, error) {
+	if expired(tx.b, []byte(id)) {
+		return nil, nil
+	}
+	if value := tx.b.Get([]byte(id)); value != nil {
+		return append([]byte{}, value...), nil
+	}
+	return nil, nil
+}
+
+func (tx *boltTx) Delete(id string) error {
+	if err := tx.b.Delete(ttlKey([]byte(id))); err != nil {
+		return err
+	}
+	return tx.b.Delete([]byte(id))
+}
+
 func (s *BoltStorage) Delete(id string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		if err := b.Delete(ttlKey([]byte(id))); err != nil {
+			return err
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// List returns every unexpired key starting with prefix in key order.
+func (s *BoltStorage) List(prefix string) ([]string, error) {
+	keys := []string{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			if isTTLKey(k) || expired(b, k) {
+				continue
+			}
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// ListOption narrows the keys returned by ListPage.
+type ListOption func(o *listOptions) error
+
+type listOptions struct {
+	prefix string
+	filter func(key string) bool
+}
+
+// WithPrefix only lists keys starting with prefix.
+func WithPrefix(prefix string) ListOption {
+	return func(o *listOptions) error {
+		o.prefix = prefix
+		return nil
+	}
+}
+
+// WithKeyFilter skips keys for which keep returns false. Skipped keys do not
+// count towards the page limit.
+func WithKeyFilter(keep func(key string) bool) ListOption {
+	return func(o *listOptions) error {
+		o.filter = keep
+		return nil
+	}
+}
+
+// ListPage returns up to limit unexpired keys in key order, starting at
+// cursor, which is empty for the first page. nextCursor is the first key of
+// the following page, or empty after the last one.
+func (s *BoltStorage) ListPage(cursor string, limit int, opts ...ListOption) (keys []string, nextCursor string, err error) {
+	o := &listOptions{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, "", err
+		}
+	}
+	if limit < 1 {
+		return nil, "", fmt.Errorf("invalid limit %d", limit)
+	}
+	seek := cursor
+	if seek < o.prefix {
+		seek = o.prefix
+	}
+
+	keys = []string{}
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(seek)); k != nil && bytes.HasPrefix(k, []byte(o.prefix)); k, _ = c.Next() {
+			if isTTLKey(k) || expired(b, k) || (o.filter != nil && !o.filter(string(k))) {
+				continue
+			}
+			if len(keys) == limit {
+				nextCursor = string(k)
+				return nil
+			}
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, nextCursor, err
+}
+
+// ForEach calls fn for each unexpired key at or after seek in key order,
+// stopping early when fn returns false. value is only valid for the duration
+// of the call.
+func (s *BoltStorage) ForEach(seek string, fn func(id string, value []byte) bool) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(seek)); k != nil; k, v = c.Next() {
+			if isTTLKey(k) || expired(b, k) {
+				continue
+			}
+			if !fn(string(k), v) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Ping checks the database is writable by storing and removing a key in a
+// single transaction, so the key is never visible to readers. Read-only
+// storage only checks its bucket can be read.
+func (s *BoltStorage) Ping() error {
+	if s.readOnly {
+		return s.db.View(func(tx *bbolt.Tx) error {
+			if tx.Bucket(s.bucket) == nil {
+				return fmt.Errorf("bucket %s not found", s.bucket)
+			}
+			return nil
+		})
+	}
 	return s.db.Update(func(tx *bbolt.Tx) error {
-		return tx.Bucket(s.bucket).Delete([]byte(id))
+		b := tx.Bucket(s.bucket)
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", s.bucket)
+		}
+		if err := b.Put([]byte(pingKey), []byte{1}); err != nil {
+			return err
+		}
+		if b.Get([]byte(pingKey)) == nil {
+			return fmt.Errorf("could not read back ping key")
+		}
+		return b.Delete([]byte(pingKey))
+	})
+}
+
+// Backup writes a consistent copy of the database to dst while it stays
+// available to readers and writers.
+func (s *BoltStorage) Backup(dst io.Writer) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		_, err := tx.WriteTo(dst)
+		return err
 	})
 }
@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func newTestStorage(t *testing.T) *BoltStorage {
+	store, err := New(t.TempDir(), "test")
+	assert.NoError(t, err)
+	return store
+}
+
+func TestSetWithTTL(t *testing.T) {
+	store := newTestStorage(t)
+
+	assert.NoError(t, store.Set("forever", []byte("a")))
+	assert.NoError(t, store.SetWithTTL("brief", []byte("b"), 50*time.Millisecond))
+	assert.NoError(t, store.SetWithTTL("long", []byte("c"), time.Hour))
+
+	_, err := store.TTL("forever")
+	assert.ErrorIs(t, err, ErrNoTTL)
+	ttl, err := store.TTL("long")
+	assert.NoError(t, err)
+	assert.True(t, ttl > 59*time.Minute && ttl <= time.Hour)
+
+	value, err := store.Get("brief")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), value)
+
+	keys, err := store.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"brief", "forever", "long"}, keys)
+
+	time.Sleep(60 * time.Millisecond)
+
+	value, err = store.Get("brief")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+	ttl, err = store.TTL("brief")
+	assert.NoError(t, err)
+	assert.Zero(t, ttl)
+
+	keys, err = store.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"forever", "long"}, keys)
+
+	// A plain Set clears any previous ttl.
+	assert.NoError(t, store.Set("brief", []byte("d")))
+	_, err = store.TTL("brief")
+	assert.ErrorIs(t, err, ErrNoTTL)
+	value, err = store.Get("brief")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("d"), value)
+
+	assert.NoError(t, store.Delete("long"))
+	_, err = store.TTL("long")
+	assert.ErrorIs(t, err, ErrNoTTL)
+}
+
+func TestUpdateWithTTL(t *testing.T) {
+	store := newTestStorage(t)
+	assert.NoError(t, store.SetWithTTL("live", []byte("a"), time.Hour))
+	assert.NoError(t, store.SetWithTTL("expired", []byte("b"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+
+	var seen []byte
+	assert.NoError(t, store.Update("expired", func(value []byte) ([]byte, error) {
+		seen = value
+		return []byte("c"), nil
+	}))
+	assert.Nil(t, seen)
+	value, err := store.Get("expired")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("c"), value)
+	_, err = store.TTL("expired")
+	assert.ErrorIs(t, err, ErrNoTTL)
+
+	// A record that has not expired keeps its ttl.
+	assert.NoError(t, store.Update("live", func(value []byte) ([]byte, error) {
+		return append(value, 'd'), nil
+	}))
+	value, err = store.Get("live")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("ad"), value)
+	ttl, err := store.TTL("live")
+	assert.NoError(t, err)
+	assert.True(t, ttl > 59*time.Minute)
+}
+
+func TestPing(t *testing.T) {
+	store := newTestStorage(t)
+	assert.NoError(t, store.Ping())
+
+	keys, err := store.List("")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	assert.NoError(t, store.db.Close())
+	assert.Error(t, store.Ping())
+}
+
+func TestBackup(t *testing.T) {
+	store := newTestStorage(t)
+	assert.NoError(t, store.Set("alice", []byte("a")))
+	assert.NoError(t, store.Set("bob", []byte("b")))
+	assert.NoError(t, store.SetWithTTL("carol", []byte("c"), time.Hour))
+
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "test.db"))
+	assert.NoError(t, err)
+	assert.NoError(t, store.Backup(f))
+	assert.NoError(t, f.Close())
+
+	restored, err := New(dir, "test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { restored.db.Close() })
+
+	keys, err := restored.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob", "carol"}, keys)
+	for key, want := range map[string]string{"alice": "a", "bob": "b", "carol": "c"} {
+		value, err := restored.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(want), value)
+	}
+	ttl, err := restored.TTL("carol")
+	assert.NoError(t, err)
+	assert.True(t, ttl > 59*time.Minute)
+}
+
+func TestNewReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	writer, err := New(dir, "test")
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Set("alice", []byte("a")))
+
+	// The writer holds an exclusive lock, so readers wait and time out.
+	_, err = NewReadOnly(path, "test")
+	assert.ErrorIs(t, err, bbolt.ErrTimeout)
+	assert.NoError(t, writer.Close())
+
+	// Readers share the lock with each other.
+	first, err := NewReadOnly(path, "test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { first.Close() })
+	second, err := NewReadOnly(path, "test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { second.Close() })
+
+	for _, store := range []*BoltStorage{first, second} {
+		assert.True(t, store.ReadOnly())
+		value, err := store.Get("alice")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("a"), value)
+		assert.NoError(t, store.Ping())
+		assert.ErrorIs(t, store.Set("bob", []byte("b")), ErrReadOnly)
+		assert.ErrorIs(t, store.SetWithTTL("bob", []byte("b"), time.Hour), ErrReadOnly)
+		assert.ErrorIs(t, store.Delete("alice"), ErrReadOnly)
+	}
+
+	_, err = NewReadOnly(path, "missing")
+	assert.Error(t, err)
+}
+
+func TestWithFileName(t *testing.T) {
+	dir := t.TempDir()
+	first, err := New(dir, "did", WithFileName("first.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { first.Close() })
+	second, err := New(dir, "did", WithFileName("second.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { second.Close() })
+
+	assert.NoError(t, first.Set("alice", []byte("a")))
+	assert.NoError(t, second.Set("bob", []byte("b")))
+
+	keys, err := first.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice"}, keys)
+	keys, err = second.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bob"}, keys)
+
+	for _, name := range []string{"first.db", "second.db"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.NoError(t, err)
+	}
+
+	_, err = New(dir, "did", WithFileName("../escape.db"))
+	assert.Error(t, err)
+}
+
+func TestModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not unix modes on windows")
+	}
+	// Find the umask from a directory created with every permission.
+	probe := filepath.Join(t.TempDir(), "probe")
+	assert.NoError(t, os.Mkdir(probe, 0777))
+	stat, err := os.Stat(probe)
+	assert.NoError(t, err)
+	umask := 0777 &^ stat.Mode().Perm()
+
+	tt := []struct {
+		name     string
+		opts     []Option
+		dirMode  os.FileMode
+		fileMode os.FileMode
+	}{
+		{"defaults", nil, DefaultDirMode, DefaultFileMode},
+		{"private", []Option{WithDirMode(0700), WithFileMode(0600)}, 0700, 0600},
+		{"group", []Option{WithDirMode(0750), WithFileMode(0640)}, 0750, 0640},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "parent", "storage")
+			store, err := New(dir, "did", tc.opts...)
+			assert.NoError(t, err)
+			t.Cleanup(func() { store.Close() })
+
+			for _, d := range []string{dir, filepath.Dir(dir)} {
+				stat, err := os.Stat(d)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.dirMode&^umask, stat.Mode().Perm())
+			}
+			stat, err := os.Stat(filepath.Join(dir, "did.db"))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.fileMode&^umask, stat.Mode().Perm())
+		})
+	}
+
+	for _, opt := range []Option{WithDirMode(0600), WithDirMode(os.ModeDir | 0700), WithFileMode(0400), WithFileMode(os.ModeSetuid | 0600)} {
+		_, err := New(t.TempDir(), "did", opt)
+		assert.Error(t, err)
+	}
+}
+
+func TestListPage(t *testing.T) {
+	store := newTestStorage(t)
+	for _, key := range []string{"a:1", "a:2", "a:3", "a:4", "b:1"} {
+		assert.NoError(t, store.Set(key, []byte(key)))
+	}
+	assert.NoError(t, store.SetWithTTL("a:0", []byte("a:0"), time.Hour))
+
+	tt := []struct {
+		name   string
+		cursor string
+		limit  int
+		opts   []ListOption
+		keys   []string
+		next   string
+	}{
+		{"first page", "", 2, nil, []string{"a:0", "a:1"}, "a:2"},
+		{"middle page", "a:2", 2, nil, []string{"a:2", "a:3"}, "a:4"},
+		{"last page", "a:4", 2, nil, []string{"a:4", "b:1"}, ""},
+		{"exact fit", "", 6, nil, []string{"a:0", "a:1", "a:2", "a:3", "a:4", "b:1"}, ""},
+		{"past the end", "c", 2, nil, []string{}, ""},
+		{"prefix", "", 3, []ListOption{WithPrefix("a:")}, []string{"a:0", "a:1", "a:2"}, "a:3"},
+		{"prefix last page", "a:3", 3, []ListOption{WithPrefix("a:")}, []string{"a:3", "a:4"}, ""},
+		{"cursor before prefix", "0", 1, []ListOption{WithPrefix("b:")}, []string{"b:1"}, ""},
+		{"filter", "", 2, []ListOption{WithKeyFilter(func(key string) bool { return key != "a:1" })}, []string{"a:0", "a:2"}, "a:3"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, next, err := store.ListPage(tc.cursor, tc.limit, tc.opts...)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.keys, keys)
+			assert.Equal(t, tc.next, next)
+		})
+	}
+
+	_, _, err := store.ListPage("", 0)
+	assert.Error(t, err)
+}
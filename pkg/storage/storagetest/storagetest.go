@@ -0,0 +1,133 @@
+// Package storagetest is a behavioral test suite shared by the storage
+// backends.
+package storagetest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/13x-tech/go-did-web/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// Storage is the behavior every backend is checked for.
+type Storage interface {
+	Set(id string, value []byte) error
+	Get(id string) ([]byte, error)
+	Delete(id string) error
+	List(prefix string) ([]string, error)
+	ForEach(seek string, fn func(id string, value []byte) bool) error
+}
+
+// Run checks a backend returned empty by newStorage. Missing keys may be
+// reported either as an empty value or as storage.ErrNotFound.
+func Run(t *testing.T, newStorage func(t *testing.T) Storage) {
+	t.Run("SetGet", func(t *testing.T) {
+		s := newStorage(t)
+		assert.NoError(t, s.Set("example.com:alice", []byte("a")))
+		assertValue(t, s, "example.com:alice", "a")
+
+		assert.NoError(t, s.Set("example.com:alice", []byte("b")))
+		assertValue(t, s, "example.com:alice", "b")
+		assertMissing(t, s, "example.com:bob")
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := newStorage(t)
+		assert.NoError(t, s.Set("example.com:alice", []byte("a")))
+		assert.NoError(t, s.Delete("example.com:alice"))
+		assertMissing(t, s, "example.com:alice")
+		assert.NoError(t, s.Delete("example.com:alice"))
+	})
+
+	t.Run("List", func(t *testing.T) {
+		s := newStorage(t)
+		for _, id := range []string{"pending:2", "example.com:bob", "pending:1", "example.com:alice"} {
+			assert.NoError(t, s.Set(id, []byte(id)))
+		}
+
+		keys, err := s.List("pending:")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"pending:1", "pending:2"}, keys)
+
+		keys, err = s.List("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"example.com:alice", "example.com:bob", "pending:1", "pending:2"}, keys)
+
+		keys, err = s.List("missing:")
+		assert.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+
+	t.Run("ForEach", func(t *testing.T) {
+		s := newStorage(t)
+		for _, id := range []string{"c", "a", "b", "d"} {
+			assert.NoError(t, s.Set(id, []byte("value-"+id)))
+		}
+
+		seen := []string{}
+		assert.NoError(t, s.ForEach("b", func(id string, value []byte) bool {
+			assert.Equal(t, "value-"+id, string(value))
+			seen = append(seen, id)
+			return id != "c"
+		}))
+		assert.Equal(t, []string{"b", "c"}, seen)
+
+		seen = []string{}
+		assert.NoError(t, s.ForEach("", func(id string, value []byte) bool {
+			seen = append(seen, id)
+			return true
+		}))
+		assert.Equal(t, []string{"a", "b", "c", "d"}, seen)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		s := newStorage(t)
+		batcher, ok := s.(storage.Batcher)
+		if !ok {
+			t.Skip("storage does not support batches")
+		}
+		assert.NoError(t, s.Set("c", []byte("c")))
+
+		failed := fmt.Errorf("failed")
+		err := batcher.Batch(func(tx storage.Tx) error {
+			assert.NoError(t, tx.Set("a", []byte("a")))
+			assert.NoError(t, tx.Set("b", []byte("b")))
+			assert.NoError(t, tx.Delete("c"))
+			return failed
+		})
+		assert.ErrorIs(t, err, failed)
+		assertMissing(t, s, "a")
+		assertMissing(t, s, "b")
+		assertValue(t, s, "c", "c")
+
+		assert.NoError(t, batcher.Batch(func(tx storage.Tx) error {
+			assert.NoError(t, tx.Set("a", []byte("a")))
+			value, err := tx.Get("a")
+			assert.NoError(t, err)
+			assert.Equal(t, "a", string(value))
+			assert.NoError(t, tx.Set("b", []byte("b")))
+			return tx.Delete("c")
+		}))
+		assertValue(t, s, "a", "a")
+		assertValue(t, s, "b", "b")
+		assertMissing(t, s, "c")
+	})
+}
+
+func assertValue(t *testing.T, s Storage, id, want string) {
+	t.Helper()
+	value, err := s.Get(id)
+	assert.NoError(t, err)
+	assert.Equal(t, want, string(value))
+}
+
+func assertMissing(t *testing.T, s Storage, id string) {
+	t.Helper()
+	value, err := s.Get(id)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("get %s: %s", id, err)
+	}
+	assert.Empty(t, value)
+}